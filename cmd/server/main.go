@@ -2,7 +2,9 @@ package main
 
 import (
 	"log"
+	"os"
 	"qiservice/internal/api"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -10,6 +12,18 @@ import (
 func main() {
 	r := gin.Default()
 
+	// Client addresses (API key CIDR restrictions) only come from X-Forwarded-For
+	// when the request passed through one of these proxies
+	var trustedProxies []string
+	if v := os.Getenv("QISERVICE_TRUSTED_PROXIES"); v != "" {
+		for _, p := range strings.Split(v, ",") {
+			trustedProxies = append(trustedProxies, strings.TrimSpace(p))
+		}
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid QISERVICE_TRUSTED_PROXIES: %v", err)
+	}
+
 	// CORS middleware
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
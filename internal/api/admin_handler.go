@@ -1,28 +1,25 @@
 package api
 
 import (
+	"log"
+	"qiservice/internal/auth"
 	"qiservice/internal/db"
-	"strings"
+	"qiservice/internal/quota"
+	"qiservice/internal/rbac"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 // ListUsersHandler - GET /api/users
 func ListUsersHandler(c *gin.Context) {
-	requestorRole := c.GetString("role")
-
 	var users []db.User
-	query := db.DB.Preload("APIKeys").Order("id desc")
-
-	// Filter: Admin can only see Users (or themselves, maybe? Let's just say Users)
-	// SuperAdmin sees all.
-	if requestorRole == db.RoleAdmin {
-		query = query.Where("role = ?", db.RoleUser)
-	} else if requestorRole != db.RoleSuperAdmin {
-		// Regular user should not be here (Middleware protected), but safety check
-		c.JSON(403, gin.H{"error": "Forbidden"})
-		return
+	query := db.DB.Preload("APIKeys").Preload("Groups").Order("id desc")
+
+	// Without users.manage_staff only ordinary users (roles without permissions) are listed
+	if !can(c, rbac.UsersManageStaff) {
+		query = query.Where("role IN ?", rbac.Unprivileged())
 	}
 
 	if err := query.Find(&users).Error; err != nil {
@@ -34,10 +31,12 @@ func ListUsersHandler(c *gin.Context) {
 
 // CreateUserRequest
 type CreateUserRequest struct {
-	Username string  `json:"username" binding:"required"`
-	Password string  `json:"password" binding:"required"`
-	Role     string  `json:"role"`
-	Quota    float64 `json:"quota"`
+	Username    string  `json:"username" binding:"required"`
+	Password    string  `json:"password" binding:"required"`
+	Role        string  `json:"role"`
+	Quota       float64 `json:"quota"`
+	BillingMode string  `json:"billing_mode"` // Default 'quota'
+	PlanID      *uint   `json:"plan_id"`      // Optional quota plan
 }
 
 // CreateUserHandler - POST /api/users
@@ -48,42 +47,50 @@ func CreateUserHandler(c *gin.Context) {
 		return
 	}
 
-	// Simple hash logic (Production usage should use bcrypt)
-	// We reuse hashPassword from somewhere?
-	// Or just do it here for now as placeholder.
-	pwdHash := req.Password // TODO: Real Hash
-
-	// Check Requestor Permissions (Assumes Middleware injects "role")
-	requestorRole := c.GetString("role")
+	pwdHash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to hash password"})
+		return
+	}
 
 	targetRole := db.RoleUser
-	if req.Role == db.RoleAdmin {
-		if requestorRole != db.RoleSuperAdmin {
-			c.JSON(403, gin.H{"error": "Only Super Admin can create Admins"})
+	if req.Role != "" {
+		if !checkRoleAssignment(c, req.Role) {
 			return
 		}
-		targetRole = db.RoleAdmin
-	} else if req.Role == db.RoleSuperAdmin {
-		c.JSON(403, gin.H{"error": "Cannot create Super Admin via API"})
+		targetRole = req.Role
+	}
+
+	billingMode, ok := parseBillingMode(req.BillingMode)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid billing mode"})
 		return
 	}
 
+	// Balance starts empty: it only moves through the wallet ledger (top-ups)
 	user := db.User{
 		Username:     req.Username,
 		PasswordHash: pwdHash,
 		Role:         targetRole,
 		Quota:        req.Quota,
-		Balance:      req.Quota, // Initial balance = Quota? Or Balance is remaining?
-		// Let's say Quota is Monthly limit, Balance is Credit?
-		// For simplicity: UsedAmount vs Quota.
-		// Balance concept might be "Prepaid".
-		// Let's stick to Quota model: UsedAmount vs Quota.
+		BillingMode:  billingMode,
+	}
+
+	if req.PlanID != nil {
+		plan, ok := quota.Get(*req.PlanID)
+		if !ok {
+			c.JSON(400, gin.H{"error": "Quota plan not found"})
+			return
+		}
+		user.PlanID = &plan.ID
+		user.PeriodStart = quota.PeriodStart(plan.Period, time.Now())
 	}
 
 	if err := db.DB.Create(&user).Error; err != nil {
 		c.JSON(500, gin.H{"error": "Failed to create user (username might exist)"})
 		return
 	}
+	recordAudit(c, auditUserCreate, "user", user.ID, user.Username, nil, userSnapshot(&user))
 
 	c.JSON(200, user)
 }
@@ -108,19 +115,17 @@ func GenerateAPIKeyHandler(c *gin.Context) {
 		c.JSON(404, gin.H{"error": "User not found"})
 		return
 	}
-
-	newKey := "sk-" + strings.ReplaceAll(uuid.New().String(), "-", "")
-	apiKey := db.APIKey{
-		Key:      newKey,
-		Name:     req.Name,
-		UserID:   user.ID,
-		IsActive: true,
+	if !canManageUser(c, &user) {
+		c.JSON(403, gin.H{"error": "Forbidden: cannot manage this user"})
+		return
 	}
 
-	if err := db.DB.Create(&apiKey).Error; err != nil {
+	apiKey, err := issueAPIKey(user.ID, nil, req.Name)
+	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to generate key"})
 		return
 	}
+	recordAudit(c, auditKeyCreate, "api_key", apiKey.ID, apiKey.KeyPrefix, nil, keySnapshot(apiKey))
 
 	c.JSON(200, apiKey)
 }
@@ -137,17 +142,16 @@ func UpdateUserRoleHandler(c *gin.Context) {
 		return
 	}
 
-	// Only SuperAdmin can modify roles? Or Admin can promote User to Admin?
-	// Let's stick to strict: SuperAdmin can do anything.
-	// Admin can NOT change roles for now.
-	requestorRole := c.GetString("role")
-	if requestorRole != db.RoleSuperAdmin {
-		c.JSON(403, gin.H{"error": "Only Super Admin can update roles"})
+	var target db.User
+	if err := db.DB.First(&target, req.UserID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
 		return
 	}
-
-	if req.Role != db.RoleAdmin && req.Role != db.RoleUser {
-		c.JSON(400, gin.H{"error": "Invalid role"})
+	if !canManageUser(c, &target) {
+		c.JSON(403, gin.H{"error": "Forbidden: cannot manage this user"})
+		return
+	}
+	if !checkRoleAssignment(c, req.Role) {
 		return
 	}
 
@@ -155,15 +159,26 @@ func UpdateUserRoleHandler(c *gin.Context) {
 		c.JSON(500, gin.H{"error": "Failed to update user role"})
 		return
 	}
+	recordAudit(c, auditUserRole, "user", target.ID, target.Username, gin.H{"role": target.Role}, gin.H{"role": req.Role})
+	// Tokens carry the role, make the user log in again to pick up the new one
+	if err := revokeUserTokens(req.UserID); err != nil {
+		log.Printf("[Auth] Failed to revoke tokens of user %d: %v", req.UserID, err)
+	}
 
 	c.JSON(200, gin.H{"status": "updated"})
 }
 
 type UpdateUserRequest struct {
-	UserID   uint     `json:"user_id" binding:"required"`
-	Password string   `json:"password"`
-	Quota    *float64 `json:"quota"` // Use pointer to distinguish 0 vs nil, and allow negative
-	Role     string   `json:"role"`  // Optional
+	UserID      uint      `json:"user_id" binding:"required"`
+	Password    string    `json:"password"`
+	Quota       *float64  `json:"quota"` // Use pointer to distinguish 0 vs nil, and allow negative
+	Role        string    `json:"role"`  // Optional
+	BillingMode *string   `json:"billing_mode"`
+	PlanID      *uint     `json:"plan_id"` // 0 removes the plan
+	GroupIDs    *[]uint   `json:"group_ids"`
+	Services    *[]string `json:"services"` // Granted directly, on top of the groups
+	LogPayloads *bool     `json:"log_payloads"`
+	RateLimitFields
 }
 
 // UpdateUserHandler - POST /api/user_update
@@ -174,52 +189,113 @@ func UpdateUserHandler(c *gin.Context) {
 		return
 	}
 
-	requestorRole := c.GetString("role")
 	var targetUser db.User
-	if err := db.DB.First(&targetUser, req.UserID).Error; err != nil {
+	if err := db.DB.Preload("Groups").First(&targetUser, req.UserID).Error; err != nil {
 		c.JSON(404, gin.H{"error": "User not found"})
 		return
 	}
 
-	// Permission Check
-	// 1. SuperAdmin can update anyone (Role, Quota, Pwd).
-	// 2. Admin can ONLY update User (Quota, Pwd). NO Role change.
-	if requestorRole == db.RoleAdmin {
-		if targetUser.Role != db.RoleUser {
-			c.JSON(403, gin.H{"error": "Admin can only manage ordinary Users"})
-			return
-		}
-		if req.Role != "" && req.Role != targetUser.Role {
-			c.JSON(403, gin.H{"error": "Admin cannot change roles"})
-			return
-		}
-	} else if requestorRole != db.RoleSuperAdmin {
-		c.JSON(403, gin.H{"error": "Forbidden"})
+	// Permission Check: the target must be manageable, a role change needs roles.assign
+	if !canManageUser(c, &targetUser) {
+		c.JSON(403, gin.H{"error": "Forbidden: cannot manage this user"})
 		return
 	}
+	roleChanged := req.Role != "" && req.Role != targetUser.Role
+	if roleChanged && !checkRoleAssignment(c, req.Role) {
+		return
+	}
+	before := userSnapshot(&targetUser)
 
-	updates := make(map[string]interface{})
+	updates, err := req.RateLimitFields.updates()
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
 	if req.Quota != nil {
 		updates["quota"] = *req.Quota
+		updates["quota_review"] = false
 	}
-	if req.Password != "" {
-		updates["password_hash"] = req.Password // TODO: Hash
+	if req.Services != nil {
+		updates["services"] = jsonColumn(*req.Services)
 	}
-	if req.Role != "" {
-		if requestorRole == db.RoleSuperAdmin {
-			if req.Role == db.RoleAdmin || req.Role == db.RoleUser {
-				updates["role"] = req.Role
-			}
+	if req.LogPayloads != nil {
+		updates["log_payloads"] = *req.LogPayloads
+	}
+	if req.BillingMode != nil {
+		mode, ok := parseBillingMode(*req.BillingMode)
+		if !ok {
+			c.JSON(400, gin.H{"error": "Invalid billing mode"})
+			return
+		}
+		updates["billing_mode"] = mode
+	}
+	if req.Password != "" {
+		pwdHash, err := auth.HashPassword(req.Password)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to hash password"})
+			return
 		}
+		updates["password_hash"] = pwdHash
+	}
+	if roleChanged {
+		updates["role"] = req.Role
 	}
 
-	if len(updates) > 0 {
-		if err := db.DB.Model(&targetUser).Updates(updates).Error; err != nil {
-			c.JSON(500, gin.H{"error": "Failed to update user"})
+	// Everything the update refers to is checked before the first write, which then
+	// happen in one transaction
+	var groups []db.UserGroup
+	if req.GroupIDs != nil {
+		if groups, err = findGroups(*req.GroupIDs); err != nil {
+			c.JSON(400, gin.H{"error": "User group not found"})
+			return
+		}
+	}
+	changePlan := req.PlanID != nil && !samePlan(targetUser.PlanID, *req.PlanID)
+	var planID *uint
+	if changePlan && *req.PlanID != 0 {
+		if _, ok := quota.Get(*req.PlanID); !ok {
+			c.JSON(400, gin.H{"error": "Quota plan not found"})
 			return
 		}
+		planID = req.PlanID
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(&targetUser).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if req.GroupIDs != nil {
+			if err := setUserGroups(tx, &targetUser, groups); err != nil {
+				return err
+			}
+		}
+		if changePlan {
+			return quota.Assign(tx, targetUser.ID, planID)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to update user"})
+		return
+	}
+	// Tokens carry the role, make the user log in again to pick up the new one.
+	// A password reset logs out every session of the old password.
+	if roleChanged || req.Password != "" {
+		if err := revokeUserTokens(targetUser.ID); err != nil {
+			log.Printf("[Auth] Failed to revoke tokens of user %d: %v", targetUser.ID, err)
+		}
 	}
 
+	var updated db.User
+	db.DB.Preload("Groups").First(&updated, targetUser.ID)
+	after := userSnapshot(&updated)
+	if req.Password != "" {
+		after["password"] = "reset" // Only that it changed
+	}
+	recordAudit(c, auditUserUpdate, "user", targetUser.ID, targetUser.Username, before, after)
+
 	c.JSON(200, gin.H{"status": "updated"})
 }
 
@@ -227,7 +303,7 @@ func UpdateUserHandler(c *gin.Context) {
 func ListMyKeysHandler(c *gin.Context) {
 	userID := c.GetUint("userID")
 	var keys []db.APIKey
-	if err := db.DB.Where("user_id = ?", userID).Find(&keys).Error; err != nil {
+	if err := db.DB.Where("user_id = ? AND org_id IS NULL", userID).Find(&keys).Error; err != nil {
 		c.JSON(500, gin.H{"error": "Failed to fetch keys"})
 		return
 	}
@@ -237,31 +313,46 @@ func ListMyKeysHandler(c *gin.Context) {
 // DeleteUserHandler - DELETE /api/users/:id
 func DeleteUserHandler(c *gin.Context) {
 	id := c.Param("id")
-	requestorRole := c.GetString("role")
 
 	var user db.User
-	if err := db.DB.First(&user, id).Error; err != nil {
+	if err := db.DB.Preload("Groups").First(&user, id).Error; err != nil {
 		c.JSON(404, gin.H{"error": "User not found"})
 		return
 	}
 
-	// Permission: SuperAdmin deletes anyone (except self?), Admin deletes User.
-	if requestorRole == db.RoleAdmin {
-		if user.Role != db.RoleUser {
-			c.JSON(403, gin.H{"error": "Admin can only delete Users"})
+	// Permission: staff need users.manage_staff, and never a role above the caller's
+	if !canManageUser(c, &user) {
+		c.JSON(403, gin.H{"error": "Forbidden: cannot manage this user"})
+		return
+	}
+	// Organizations keep at least one owner: ownership has to be handed over first
+	var owned []db.OrgMember
+	db.DB.Where("user_id = ? AND role = ?", user.ID, db.OrgRoleOwner).Find(&owned)
+	for _, m := range owned {
+		if lastOwner(m.OrgID) {
+			c.JSON(400, gin.H{"error": "User is the last owner of an organization, transfer it first", "org_id": m.OrgID})
 			return
 		}
-	} else if requestorRole != db.RoleSuperAdmin {
-		c.JSON(403, gin.H{"error": "Forbidden"})
-		return
 	}
 
+	if err := db.DB.Model(&user).Association("Groups").Clear(); err != nil {
+		log.Printf("Failed to remove user %d from groups: %v", user.ID, err)
+	}
+	// Keys the user created for organizations stay with them
+	if err := db.DB.Where("user_id = ?", user.ID).Delete(&db.OrgMember{}).Error; err != nil {
+		log.Printf("Failed to remove user %d from organizations: %v", user.ID, err)
+	}
 	// Use Unscoped to verify hard delete (or handle soft delete properly)
 	// For this user management, we prefer Hard Delete to allow re-creating same username.
 	if err := db.DB.Unscoped().Delete(&user).Error; err != nil {
 		c.JSON(500, gin.H{"error": "Failed to delete user"})
 		return
 	}
+	// Outstanding tokens of the deleted user must stop working now, not when they expire
+	if err := revokeUserTokens(user.ID); err != nil {
+		log.Printf("[Auth] Failed to revoke tokens of deleted user %d: %v", user.ID, err)
+	}
+	recordAudit(c, auditUserDelete, "user", user.ID, user.Username, userSnapshot(&user), nil)
 	c.JSON(200, gin.H{"status": "deleted"})
 }
 
@@ -271,7 +362,7 @@ func DeleteMyKeyHandler(c *gin.Context) {
 	userID := c.GetUint("userID")
 
 	var key db.APIKey
-	if err := db.DB.Where("id = ? AND user_id = ?", keyID, userID).First(&key).Error; err != nil {
+	if err := db.DB.Where("id = ? AND user_id = ? AND org_id IS NULL", keyID, userID).First(&key).Error; err != nil {
 		c.JSON(404, gin.H{"error": "Key not found"})
 		return
 	}
@@ -280,6 +371,7 @@ func DeleteMyKeyHandler(c *gin.Context) {
 		c.JSON(500, gin.H{"error": "Failed to delete key"})
 		return
 	}
+	recordAudit(c, auditKeyDelete, "api_key", key.ID, key.KeyPrefix, keySnapshot(&key), nil)
 	c.JSON(200, gin.H{"status": "deleted"})
 }
 
@@ -291,5 +383,12 @@ func GetMyProfileHandler(c *gin.Context) {
 		c.JSON(404, gin.H{"error": "User not found"})
 		return
 	}
-	c.JSON(200, user)
+	c.JSON(200, profileResponse{User: user, Period: quota.Current(&user), Permissions: rbac.Permissions(user.Role)})
+}
+
+// profileResponse is the user with the state of their quota plan window and their permissions
+type profileResponse struct {
+	db.User
+	Period      *quota.Usage `json:"period,omitempty"`
+	Permissions []string     `json:"permissions"` // Granted by the user's role
 }
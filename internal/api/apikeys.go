@@ -0,0 +1,203 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"qiservice/internal/auth"
+	"qiservice/internal/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// apiKeyPepperSetting names the generated salt in the settings table
+const apiKeyPepperSetting = "api_key_pepper"
+
+// InitAPIKeyHashing loads the salt for client key hashes from QISERVICE_KEY_PEPPER,
+// or from the settings table where it is generated on first boot.
+// Changing it invalidates every client key.
+func InitAPIKeyHashing() {
+	if v := os.Getenv("QISERVICE_KEY_PEPPER"); v != "" {
+		auth.SetAPIKeyPepper([]byte(v))
+		return
+	}
+
+	var setting db.Setting
+	err := db.DB.First(&setting, "key = ?", apiKeyPepperSetting).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			log.Fatalf("❌ Failed to generate API key pepper: %v", err)
+		}
+		setting = db.Setting{Key: apiKeyPepperSetting, Value: hex.EncodeToString(buf)}
+		err = db.DB.Create(&setting).Error
+		log.Println("🔑 Generated API key pepper")
+	}
+	if err != nil {
+		log.Fatalf("❌ Failed to load API key pepper: %v", err)
+	}
+	auth.SetAPIKeyPepper([]byte(setting.Value))
+}
+
+// issueAPIKey creates a client key for a user, or an organization key created by the user
+// when orgID is set. The returned row carries the plaintext in Key; it is not stored and
+// cannot be shown again.
+func issueAPIKey(userID uint, orgID *uint, name string) (*db.APIKey, error) {
+	plain := auth.GenerateAPIKey()
+	apiKey := db.APIKey{
+		KeyHash:   auth.HashAPIKey(plain),
+		KeyPrefix: auth.APIKeyPrefix(plain),
+		Name:      name,
+		UserID:    userID,
+		OrgID:     orgID,
+		IsActive:  true,
+	}
+	if err := db.DB.Create(&apiKey).Error; err != nil {
+		return nil, err
+	}
+	apiKey.Key = plain
+	return &apiKey, nil
+}
+
+// KeyScopeFields are the optional restrictions of a client key, shared by creation and update
+type KeyScopeFields struct {
+	ExpiresAt     *string   `json:"expires_at"`     // RFC 3339, "" removes the expiry
+	SpendLimit    *float64  `json:"spend_limit"`    // 0 removes the cap
+	AllowedModels *[]string `json:"allowed_models"` // Service names, empty allows all
+	AllowedCIDRs  *[]string `json:"allowed_cidrs"`  // CIDRs or single addresses, empty allows any
+}
+
+// updates validates the fields that were sent and returns their column updates
+func (f KeyScopeFields) updates() (map[string]interface{}, error) {
+	updates := make(map[string]interface{})
+	if f.ExpiresAt != nil {
+		if *f.ExpiresAt == "" {
+			updates["expires_at"] = nil
+		} else {
+			t, err := time.Parse(time.RFC3339, *f.ExpiresAt)
+			if err != nil {
+				return nil, fmt.Errorf("expires_at must be an RFC 3339 time")
+			}
+			updates["expires_at"] = t
+		}
+	}
+	if f.SpendLimit != nil {
+		if *f.SpendLimit < 0 {
+			return nil, fmt.Errorf("spend_limit must be 0 (no cap) or positive")
+		}
+		updates["spend_limit"] = *f.SpendLimit
+	}
+	if f.AllowedModels != nil {
+		models := make([]string, 0, len(*f.AllowedModels))
+		for _, m := range *f.AllowedModels {
+			if m = strings.TrimSpace(m); m != "" {
+				models = append(models, m)
+			}
+		}
+		updates["allowed_models"] = jsonColumn(models)
+	}
+	if f.AllowedCIDRs != nil {
+		cidrs := make([]string, 0, len(*f.AllowedCIDRs))
+		for _, c := range *f.AllowedCIDRs {
+			if c = strings.TrimSpace(c); c == "" {
+				continue
+			}
+			n, err := parseCIDR(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", c)
+			}
+			cidrs = append(cidrs, n.String())
+		}
+		updates["allowed_cidrs"] = jsonColumn(cidrs)
+	}
+	return updates, nil
+}
+
+// jsonColumn encodes a value for a serializer:json column in a map update,
+// which gorm would otherwise neither serialize nor copy back into the model
+func jsonColumn(v interface{}) clause.Expr {
+	b, _ := json.Marshal(v)
+	return gorm.Expr("?", string(b))
+}
+
+// parseCIDR accepts a network or a single address
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address")
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// keyAllowsIP reports whether the key may be used from the client address
+func keyAllowsIP(k *db.APIKey, clientIP string) bool {
+	if len(k.AllowedCIDRs) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, c := range k.AllowedCIDRs {
+		if n, err := parseCIDR(c); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyAllowsModel reports whether the calling key (if any) may use the model
+func keyAllowsModel(c *gin.Context, model string) bool {
+	v, ok := c.Get("apiKey")
+	if !ok {
+		return true
+	}
+	k := v.(*db.APIKey)
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	for _, m := range k.AllowedModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// abortModelNotAllowed answers 403 in the error format of the protocol being called
+func abortModelNotAllowed(c *gin.Context, model string) {
+	msg := "This API key is not allowed to use the model '" + model + "'"
+	if strings.HasPrefix(c.Request.URL.Path, "/v1/messages") {
+		c.JSON(403, gin.H{
+			"type":  "error",
+			"error": gin.H{"type": "permission_error", "message": msg},
+		})
+		return
+	}
+	c.JSON(403, gin.H{
+		"error": gin.H{
+			"message": msg,
+			"type":    "invalid_request_error",
+			"param":   "model",
+			"code":    "model_not_allowed",
+		},
+	})
+}
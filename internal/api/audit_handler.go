@@ -0,0 +1,179 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"qiservice/internal/audit"
+	"qiservice/internal/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audited actions
+const (
+	auditServiceUpdate = "service.update"
+	auditUserCreate    = "user.create"
+	auditUserUpdate    = "user.update"
+	auditUserRole      = "user.role"
+	auditUserDelete    = "user.delete"
+	auditKeyCreate     = "key.create"
+	auditKeyUpdate     = "key.update"
+	auditKeyDelete     = "key.delete"
+	auditRoleSave      = "role.save"
+	auditRoleDelete    = "role.delete"
+
+	auditRedactionSave   = "redaction.save"
+	auditRedactionDelete = "redaction.delete"
+
+	auditWalletTopUp     = "wallet.topup"
+	auditGroupSave       = "group.save"
+	auditGroupDelete     = "group.delete"
+	auditPlanSave        = "plan.save"
+	auditPlanDelete      = "plan.delete"
+	auditOrgSave         = "org.save"
+	auditOrgDelete       = "org.delete"
+	auditOrgMemberSave   = "org.member.save"
+	auditOrgMemberRemove = "org.member.remove"
+	auditJWTRotate       = "jwt.rotate"
+	auditKeyHealthReset  = "upstream_key.reset"
+)
+
+// recordAudit logs an action of the caller on a target with the snapshots before and after it
+// (nil for none). The action already happened, so a failure to record is only logged.
+func recordAudit(c *gin.Context, action, targetType string, targetID interface{}, target string, before, after interface{}) {
+	e := db.AuditLog{
+		ActorID:    c.GetUint("userID"),
+		Actor:      c.GetString("username"),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   fmt.Sprint(targetID),
+		Target:     target,
+		IP:         c.ClientIP(),
+	}
+	if err := audit.Record(&e, before, after); err != nil {
+		log.Printf("[Audit] Failed to record %s on %s %v: %v", action, targetType, targetID, err)
+	}
+}
+
+// userSnapshot is what the audit log compares of a user: bookkeeping fields that change on
+// every request (usage, timestamps) are left out, groups are reduced to their names
+func userSnapshot(u *db.User) map[string]interface{} {
+	groups := make([]string, 0, len(u.Groups))
+	for _, g := range u.Groups {
+		groups = append(groups, g.Name)
+	}
+	return map[string]interface{}{
+		"username":       u.Username,
+		"role":           u.Role,
+		"quota":          u.Quota,
+		"billing_mode":   u.BillingMode,
+		"plan_id":        u.PlanID,
+		"services":       u.Services,
+		"groups":         groups,
+		"rpm_limit":      u.RPMLimit,
+		"tpm_limit":      u.TPMLimit,
+		"max_concurrent": u.MaxConcurrent,
+		"log_payloads":   u.LogPayloads,
+	}
+}
+
+// keySnapshot is what the audit log keeps of an API key, never the secret
+func keySnapshot(k *db.APIKey) map[string]interface{} {
+	return map[string]interface{}{
+		"name":           k.Name,
+		"key_prefix":     k.KeyPrefix,
+		"user_id":        k.UserID,
+		"org_id":         k.OrgID,
+		"rpm_limit":      k.RPMLimit,
+		"tpm_limit":      k.TPMLimit,
+		"max_concurrent": k.MaxConcurrent,
+		"expires_at":     k.ExpiresAt,
+		"spend_limit":    k.SpendLimit,
+		"allowed_models": k.AllowedModels,
+		"allowed_cidrs":  k.AllowedCIDRs,
+	}
+}
+
+// orgSnapshot is what the audit log compares of an organization, without the usage and
+// balance that change on every request (balance changes are audited as top-ups)
+func orgSnapshot(o *db.Organization) map[string]interface{} {
+	return map[string]interface{}{
+		"name":         o.Name,
+		"description":  o.Description,
+		"billing_mode": o.BillingMode,
+		"quota":        o.Quota,
+		"services":     o.Services,
+	}
+}
+
+// servicesSnapshot keys the services by ID, upstream keys masked
+func servicesSnapshot(services []ServiceConfig) map[string]ServiceConfig {
+	out := make(map[string]ServiceConfig, len(services))
+	for _, s := range redactedServices(services, true) {
+		out[s.ID] = s
+	}
+	return out
+}
+
+// ListAuditHandler - GET /api/audit?actor=&action=&target_type=&target_id=&from=&to=&before_id=&limit=
+// Newest first; from/to are dates (YYYY-MM-DD), before_id pages back from an entry.
+func ListAuditHandler(c *gin.Context) {
+	query := db.DB.Order("id desc").Limit(ledgerLimit(c))
+	if actor := c.Query("actor"); actor != "" {
+		query = query.Where("actor = ?", actor)
+	}
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action LIKE ?", action+"%")
+	}
+	if typ := c.Query("target_type"); typ != "" {
+		query = query.Where("target_type = ?", typ)
+	}
+	if id := c.Query("target_id"); id != "" {
+		query = query.Where("target_id = ?", id)
+	}
+	if v := c.Query("from"); v != "" {
+		from, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid from date"})
+			return
+		}
+		query = query.Where("created_at >= ?", from.UTC())
+	}
+	if v := c.Query("to"); v != "" {
+		to, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid to date"})
+			return
+		}
+		query = query.Where("created_at < ?", to.AddDate(0, 0, 1).UTC())
+	}
+	if v := c.Query("before_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid before_id"})
+			return
+		}
+		query = query.Where("id < ?", id)
+	}
+
+	var entries []db.AuditLog
+	if err := query.Find(&entries).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch audit log"})
+		return
+	}
+	c.JSON(200, entries)
+}
+
+// VerifyAuditHandler - GET /api/audit/verify
+// Recomputes the hash chain and reports the first entry that was tampered with.
+func VerifyAuditHandler(c *gin.Context) {
+	res, err := audit.Verify()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to verify audit log"})
+		return
+	}
+	c.JSON(200, res)
+}
@@ -1,14 +1,21 @@
 package api
 
 import (
+	"fmt"
+	"log"
+	"os"
 	"qiservice/internal/auth"
 	"qiservice/internal/db"
-	"strings"
+	"qiservice/internal/rbac"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
+// defaultGroup is the user group self-registered users join, set by QISERVICE_DEFAULT_GROUP.
+// Without it new users are granted no services until an admin assigns some.
+var defaultGroup = os.Getenv("QISERVICE_DEFAULT_GROUP")
+
 type RegisterRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required,min=6"`
@@ -35,16 +42,36 @@ func RegisterHandler(c *gin.Context) {
 		return
 	}
 
+	pwdHash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create user"})
+		return
+	}
+
 	// Create User (Default Role: User)
 	newUser := db.User{
 		Username:     req.Username,
-		PasswordHash: req.Password, // TODO: Use BCrypt in production
+		PasswordHash: pwdHash,
 		Role:         db.RoleUser,
-		Quota:        100000, // Default Quota
+		Quota:        db.DefaultUserQuota,
 		Balance:      0,
 	}
 
-	if err := db.DB.Create(&newUser).Error; err != nil {
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newUser).Error; err != nil {
+			return err
+		}
+		if defaultGroup == "" {
+			return nil
+		}
+		var group db.UserGroup
+		if err := tx.Where("name = ?", defaultGroup).First(&group).Error; err != nil {
+			log.Printf("⚠️ Default group %q not found, %s registered without services", defaultGroup, newUser.Username)
+			return nil
+		}
+		return tx.Model(&newUser).Association("Groups").Append(&group)
+	})
+	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to create user"})
 		return
 	}
@@ -61,13 +88,42 @@ func UserLoginHandler(c *gin.Context) {
 	}
 
 	var user db.User
-	if err := db.DB.Where("username = ? AND password_hash = ?", req.Username, req.Password).First(&user).Error; err != nil {
+	if err := db.DB.Where("username = ?", req.Username).First(&user).Error; err != nil {
+		// Burn the same time as a real check so usernames cannot be probed
+		auth.CheckPassword(dummyPasswordHash, req.Password)
+		c.JSON(401, gin.H{"error": "Invalid username or password"})
+		return
+	}
+	ok, legacy := auth.CheckPassword(user.PasswordHash, req.Password)
+	if !ok {
 		c.JSON(401, gin.H{"error": "Invalid username or password"})
 		return
 	}
 
-	// Generate JWT
-	token, err := auth.GenerateToken(user.ID, user.Username, user.Role)
+	updates := make(map[string]interface{})
+	if legacy {
+		// Plaintext row from before hashing: upgrade it now that we know the password
+		if pwdHash, err := auth.HashPassword(req.Password); err == nil {
+			updates["password_hash"] = pwdHash
+		}
+	}
+	if user.Username == db.DefaultAdminUsername && req.Password == db.DefaultAdminPassword && !user.MustChangePassword {
+		// Deployments seeded before forced change still run with the well-known password
+		user.MustChangePassword = true
+		updates["must_change_password"] = true
+	}
+	if len(updates) > 0 {
+		if err := db.DB.Model(&user).Updates(updates).Error; err != nil {
+			log.Printf("[Auth] Failed to upgrade password of %s: %v", user.Username, err)
+		}
+	}
+
+	respondWithToken(c, &user)
+}
+
+// respondWithToken issues a JWT for the user and writes the login response
+func respondWithToken(c *gin.Context, user *db.User) {
+	token, err := auth.GenerateToken(user.ID, user.Username, user.Role, user.MustChangePassword)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to generate token"})
 		return
@@ -76,36 +132,191 @@ func UserLoginHandler(c *gin.Context) {
 	c.JSON(200, gin.H{
 		"token": token,
 		"user": gin.H{
-			"id":       user.ID,
-			"username": user.Username,
-			"role":     user.Role,
+			"id":                   user.ID,
+			"username":             user.Username,
+			"role":                 user.Role,
+			"must_change_password": user.MustChangePassword,
+			"permissions":          rbac.Permissions(user.Role),
 		},
 	})
 }
 
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+// ChangePasswordHandler - POST /api/user/password
+// Changes the caller's own password and returns a fresh token.
+func ChangePasswordHandler(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user db.User
+	if err := db.DB.First(&user, c.GetUint("userID")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if ok, _ := auth.CheckPassword(user.PasswordHash, req.OldPassword); !ok {
+		c.JSON(401, gin.H{"error": "Old password is incorrect"})
+		return
+	}
+	if req.NewPassword == req.OldPassword || (user.Username == db.DefaultAdminUsername && req.NewPassword == db.DefaultAdminPassword) {
+		c.JSON(400, gin.H{"error": "Please choose a different password"})
+		return
+	}
+
+	pwdHash, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to hash password"})
+		return
+	}
+	user.PasswordHash = pwdHash
+	user.MustChangePassword = false
+	if err := db.DB.Model(&user).Updates(map[string]interface{}{
+		"password_hash":        pwdHash,
+		"must_change_password": false,
+	}).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to update password"})
+		return
+	}
+	// Log out every session, the token used here is replaced by the one returned below
+	if err := revokeUserTokens(user.ID); err != nil {
+		log.Printf("[Auth] Failed to revoke tokens of %s: %v", user.Username, err)
+	}
+
+	respondWithToken(c, &user)
+}
+
+// dummyPasswordHash is compared against when the username does not exist
+var dummyPasswordHash, _ = auth.HashPassword("qiservice-dummy-password")
+
 // GenerateMyKeyHandler - POST /api/my_keys
 func GenerateMyKeyHandler(c *gin.Context) {
-	userID := c.GetUint("userID")
+	createKey(c, c.GetUint("userID"), nil)
+}
+
+// createKey issues a key with the name, limits and scope of the request body
+// and answers with it, plaintext included
+func createKey(c *gin.Context, userID uint, orgID *uint) {
 	var req struct {
 		Name string `json:"name"`
+		RateLimitFields
+		KeyScopeFields
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-
-	newKey := "sk-" + strings.ReplaceAll(uuid.New().String(), "-", "")
-	apiKey := db.APIKey{
-		Key:      newKey,
-		Name:     req.Name,
-		UserID:   userID,
-		IsActive: true,
+	limits, err := req.RateLimitFields.updates()
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	scope, err := req.KeyScopeFields.updates()
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	for column, v := range scope {
+		limits[column] = v
 	}
 
-	if err := db.DB.Create(&apiKey).Error; err != nil {
+	apiKey, err := issueAPIKey(userID, orgID, req.Name)
+	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to generate key"})
 		return
 	}
+	if len(limits) > 0 {
+		if err := db.DB.Model(apiKey).Updates(limits).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to set key limits"})
+			return
+		}
+		plain := apiKey.Key
+		db.DB.First(apiKey, apiKey.ID)
+		apiKey.Key = plain
+	}
+	recordAudit(c, auditKeyCreate, "api_key", apiKey.ID, apiKey.KeyPrefix, nil, keySnapshot(apiKey))
 
 	c.JSON(200, apiKey)
 }
+
+// UpdateMyKeyHandler - PUT /api/my_keys/:id
+// Changes the name, limits or scope of one of the caller's keys.
+func UpdateMyKeyHandler(c *gin.Context) {
+	var key db.APIKey
+	if err := db.DB.Where("id = ? AND user_id = ? AND org_id IS NULL", c.Param("id"), c.GetUint("userID")).First(&key).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Key not found"})
+		return
+	}
+	updateKey(c, &key)
+}
+
+// updateKey applies the name, limits and scope sent in the request body to key
+func updateKey(c *gin.Context, key *db.APIKey) {
+	var req struct {
+		Name *string `json:"name"`
+		RateLimitFields
+		KeyScopeFields
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	updates, err := req.RateLimitFields.updates()
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	scope, err := req.KeyScopeFields.updates()
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	for column, v := range scope {
+		updates[column] = v
+	}
+	if req.Name != nil {
+		updates["name"] = *req.Name
+	}
+
+	if len(updates) > 0 {
+		before := keySnapshot(key)
+		if err := db.DB.Model(key).Updates(updates).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to update key"})
+			return
+		}
+		db.DB.First(key, key.ID)
+		recordAudit(c, auditKeyUpdate, "api_key", key.ID, key.KeyPrefix, before, keySnapshot(key))
+	}
+	c.JSON(200, key)
+}
+
+// RateLimitFields are the optional limit settings shared by user and key updates
+type RateLimitFields struct {
+	RPMLimit      *int `json:"rpm_limit"`
+	TPMLimit      *int `json:"tpm_limit"`
+	MaxConcurrent *int `json:"max_concurrent"`
+}
+
+// updates returns the column updates for the fields that were sent
+func (f RateLimitFields) updates() (map[string]interface{}, error) {
+	updates := make(map[string]interface{})
+	for column, v := range map[string]*int{
+		"rpm_limit":      f.RPMLimit,
+		"tpm_limit":      f.TPMLimit,
+		"max_concurrent": f.MaxConcurrent,
+	} {
+		if v == nil {
+			continue
+		}
+		if *v < 0 {
+			return nil, fmt.Errorf("%s must be 0 (unlimited) or positive", column)
+		}
+		updates[column] = *v
+	}
+	return updates, nil
+}
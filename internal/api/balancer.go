@@ -0,0 +1,111 @@
+package api
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Selection strategies among services sharing a public model name
+const (
+	StrategyWeighted      = "weighted"
+	StrategyLeastInFlight = "least_inflight"
+	StrategyLatency       = "latency"
+)
+
+// latencyAlpha is the weight of the newest sample in the latency moving average
+const latencyAlpha = 0.3
+
+func (s *ServiceConfig) weight() int {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+// acquire marks a request as in flight on this service
+func (s *ServiceConfig) acquire() {
+	atomic.AddInt64(&s.inFlight, 1)
+}
+
+// release is the counterpart of acquire
+func (s *ServiceConfig) release() {
+	atomic.AddInt64(&s.inFlight, -1)
+}
+
+// observeLatency folds the time until the upstream answered into the moving average
+func (s *ServiceConfig) observeLatency(d time.Duration) {
+	sample := d.Milliseconds()
+	if sample <= 0 {
+		sample = 1
+	}
+	for {
+		old := atomic.LoadInt64(&s.latencyMs)
+		next := sample
+		if old > 0 {
+			next = int64(latencyAlpha*float64(sample) + (1-latencyAlpha)*float64(old))
+		}
+		if atomic.CompareAndSwapInt64(&s.latencyMs, old, next) {
+			return
+		}
+	}
+}
+
+// orderByStrategy returns the services of one public model name in the order they should be tried.
+// The strategy is taken from the first service that sets one.
+func orderByStrategy(group []*ServiceConfig) []*ServiceConfig {
+	ordered := make([]*ServiceConfig, len(group))
+	copy(ordered, group)
+	if len(ordered) < 2 {
+		return ordered
+	}
+
+	strategy := StrategyWeighted
+	for _, s := range group {
+		if s.Strategy != "" {
+			strategy = s.Strategy
+			break
+		}
+	}
+
+	// Shuffle first so that ties below are broken randomly
+	rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+
+	switch strategy {
+	case StrategyLeastInFlight:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return atomic.LoadInt64(&ordered[i].inFlight) < atomic.LoadInt64(&ordered[j].inFlight)
+		})
+	case StrategyLatency:
+		// Services without samples yet go first so they get measured
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return atomic.LoadInt64(&ordered[i].latencyMs) < atomic.LoadInt64(&ordered[j].latencyMs)
+		})
+	default:
+		ordered = weightedOrder(ordered)
+	}
+	return ordered
+}
+
+// weightedOrder draws services one by one with probability proportional to their weight
+func weightedOrder(services []*ServiceConfig) []*ServiceConfig {
+	remaining := services
+	result := make([]*ServiceConfig, 0, len(services))
+	for len(remaining) > 0 {
+		total := 0
+		for _, s := range remaining {
+			total += s.weight()
+		}
+		pick := rand.Intn(total)
+		for i, s := range remaining {
+			pick -= s.weight()
+			if pick < 0 {
+				result = append(result, s)
+				remaining = append(remaining[:i:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return result
+}
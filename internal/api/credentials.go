@@ -0,0 +1,213 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"qiservice/internal/db"
+	"qiservice/internal/health"
+	"qiservice/internal/secret"
+)
+
+// Upstream keys are kept sealed in the database, in config.json and in memory.
+// Only GetAPIKey opens them, right before a request goes upstream.
+
+// sealKey encrypts an upstream key, keeping its health fingerprint and mask readable
+func sealKey(plain string) (string, error) {
+	return secret.Seal(plain, health.Fingerprint(plain), maskKey(plain))
+}
+
+// openKey decrypts a stored upstream key (legacy plaintext passes through)
+func openKey(stored string) (string, error) {
+	if !secret.IsSealed(stored) {
+		return stored, nil
+	}
+	return secret.Open(stored)
+}
+
+// keyFingerprint identifies a stored key for the health tracker without decrypting it
+func keyFingerprint(stored string) string {
+	if fp, _, ok := secret.Meta(stored); ok {
+		return fp
+	}
+	return health.Fingerprint(stored)
+}
+
+// keyMask is what API responses show instead of a stored key
+func keyMask(stored string) string {
+	if _, hint, ok := secret.Meta(stored); ok {
+		return hint
+	}
+	return maskKey(stored)
+}
+
+// maskedKeys masks a key list for API responses
+func maskedKeys(stored []string) []string {
+	if stored == nil {
+		return nil
+	}
+	out := make([]string, len(stored))
+	for i, k := range stored {
+		out[i] = keyMask(k)
+	}
+	return out
+}
+
+// resolveSubmittedKey turns a key sent by the admin UI into its stored form. The UI only
+// ever sees masks, so a mask stands for a key the service already has: the one at the same
+// position, else the first unclaimed one with that mask (keys removed before it shift the
+// positions). Masks are not unique, short keys all mask to asterisks, so they are never
+// matched across services. Anything else is a new key and gets sealed.
+func resolveSubmittedKey(submitted string, pos int, previous []string, claimed []bool) (string, error) {
+	if pos < len(previous) && !claimed[pos] && keyMask(previous[pos]) == submitted {
+		claimed[pos] = true
+		return previous[pos], nil
+	}
+	for i, stored := range previous {
+		if !claimed[i] && keyMask(stored) == submitted {
+			claimed[i] = true
+			return stored, nil
+		}
+	}
+	if secret.IsSealed(submitted) || strings.Contains(submitted, "...") || strings.Trim(submitted, "*") == "" {
+		return "", fmt.Errorf("unknown masked key %q, enter the full key again", submitted)
+	}
+	return sealKey(submitted)
+}
+
+// sealSubmittedKeys rewrites the keys of services posted by the admin UI into sealed form,
+// matching masks against the keys the same service ID currently has
+func sealSubmittedKeys(services []ServiceConfig, current []ServiceConfig) error {
+	byID := make(map[string]*ServiceConfig, len(current))
+	for i := range current {
+		byID[current[i].ID] = &current[i]
+	}
+
+	for i := range services {
+		s := &services[i]
+		// The UI moves a legacy single key into the pool and sends the first pool key as api_key
+		var pool, single []string
+		if prev := byID[s.ID]; prev != nil {
+			pool = prev.keyPool()
+			if prev.APIKey != "" {
+				single = []string{prev.APIKey}
+			}
+			single = append(single, prev.APIKeys...)
+		}
+		claimed := make([]bool, len(pool))
+		for j, k := range s.APIKeys {
+			sealed, err := resolveSubmittedKey(k, j, pool, claimed)
+			if err != nil {
+				return fmt.Errorf("service %s: %w", s.Name, err)
+			}
+			s.APIKeys[j] = sealed
+		}
+		if s.APIKey != "" {
+			sealed, err := resolveSubmittedKey(s.APIKey, 0, single, make([]bool, len(single)))
+			if err != nil {
+				return fmt.Errorf("service %s: %w", s.Name, err)
+			}
+			s.APIKey = sealed
+		}
+	}
+	return nil
+}
+
+// redactedServices is the service list as API responses show it: keys masked for admins,
+// upstream details left out entirely for everyone else
+func redactedServices(services []ServiceConfig, isAdmin bool) []ServiceConfig {
+	out := make([]ServiceConfig, len(services))
+	for i, s := range services {
+		if isAdmin {
+			out[i] = ServiceConfig{
+				ID:        s.ID,
+				Name:      s.Name,
+				Type:      s.Type,
+				BaseURL:   s.BaseURL,
+				APIKey:    keyMask(s.APIKey),
+				APIKeys:   maskedKeys(s.APIKeys),
+				ModelName: s.ModelName,
+				Fallbacks: s.Fallbacks,
+				Weight:    s.Weight,
+				Strategy:  s.Strategy,
+
+				InputPrice:       s.InputPrice,
+				OutputPrice:      s.OutputPrice,
+				CachedInputPrice: s.CachedInputPrice,
+
+				LogPayloads: s.LogPayloads,
+				ParamPolicy: s.ParamPolicy,
+			}
+			if s.APIKey == "" {
+				out[i].APIKey = ""
+			}
+		} else {
+			out[i] = ServiceConfig{ID: s.ID, Name: s.Name, Type: s.Type,
+				InputPrice: s.InputPrice, OutputPrice: s.OutputPrice, CachedInputPrice: s.CachedInputPrice}
+		}
+	}
+	return out
+}
+
+// SealServiceKeys encrypts upstream keys that earlier versions stored in plaintext.
+// Returns true when rows were rewritten.
+func SealServiceKeys() bool {
+	var rows []db.Service
+	if err := db.DB.Find(&rows).Error; err != nil {
+		log.Printf("❌ Failed to load services for key encryption: %v", err)
+		return false
+	}
+
+	sealed := 0
+	for _, row := range rows {
+		changed := false
+		if row.APIKey != "" && !secret.IsSealed(row.APIKey) {
+			v, err := sealKey(row.APIKey)
+			if err != nil {
+				log.Printf("❌ Failed to encrypt key of service %s: %v", row.Name, err)
+				continue
+			}
+			row.APIKey = v
+			changed = true
+		}
+
+		var keys []string
+		if row.APIKeys != "" && json.Unmarshal([]byte(row.APIKeys), &keys) == nil {
+			keysChanged := false
+			for i, k := range keys {
+				if k == "" || secret.IsSealed(k) {
+					continue
+				}
+				v, err := sealKey(k)
+				if err != nil {
+					log.Printf("❌ Failed to encrypt key of service %s: %v", row.Name, err)
+					continue
+				}
+				keys[i] = v
+				keysChanged = true
+			}
+			if keysChanged {
+				b, _ := json.Marshal(keys)
+				row.APIKeys = string(b)
+				changed = true
+			}
+		}
+
+		if changed {
+			if err := db.DB.Model(&db.Service{}).Where("id = ?", row.ID).Updates(map[string]interface{}{
+				"api_key":  row.APIKey,
+				"api_keys": row.APIKeys,
+			}).Error; err != nil {
+				log.Printf("❌ Failed to save encrypted keys of service %s: %v", row.Name, err)
+				continue
+			}
+			sealed++
+		}
+	}
+	if sealed > 0 {
+		log.Printf("✅ Encrypted upstream keys of %d services", sealed)
+	}
+	return sealed > 0
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"qiservice/internal/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// groupResponse is a group with the IDs of its members
+type groupResponse struct {
+	db.UserGroup
+	Members []uint `json:"members"`
+}
+
+// ListGroupsHandler - GET /api/groups
+func ListGroupsHandler(c *gin.Context) {
+	var groups []db.UserGroup
+	if err := db.DB.Preload("Users", func(tx *gorm.DB) *gorm.DB { return tx.Select("id") }).Order("id").Find(&groups).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch groups"})
+		return
+	}
+	out := make([]groupResponse, len(groups))
+	for i, g := range groups {
+		out[i] = groupResponse{UserGroup: g, Members: make([]uint, 0, len(g.Users))}
+		for _, u := range g.Users {
+			out[i].Members = append(out[i].Members, u.ID)
+		}
+	}
+	c.JSON(200, out)
+}
+
+// SaveGroupHandler - POST /api/groups (creates, or updates when id is set)
+func SaveGroupHandler(c *gin.Context) {
+	var req db.UserGroup
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" {
+		c.JSON(400, gin.H{"error": "Name is required"})
+		return
+	}
+	if req.Services == nil {
+		req.Services = []string{}
+	}
+
+	var before interface{}
+	if req.ID == 0 {
+		if err := db.DB.Omit("Users").Create(&req).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create group (name might exist)"})
+			return
+		}
+	} else {
+		var existing db.UserGroup
+		if err := db.DB.First(&existing, req.ID).Error; err != nil {
+			c.JSON(404, gin.H{"error": "Group not found"})
+			return
+		}
+		before = existing
+		if err := db.DB.Model(&existing).Select("name", "description", "services").Updates(&req).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to update group"})
+			return
+		}
+		db.DB.First(&req, req.ID)
+	}
+	recordAudit(c, auditGroupSave, "group", req.ID, req.Name, before, req)
+	c.JSON(200, req)
+}
+
+// DeleteGroupHandler - DELETE /api/groups/:id
+func DeleteGroupHandler(c *gin.Context) {
+	var group db.UserGroup
+	if err := db.DB.First(&group, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Group not found"})
+		return
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&group).Association("Users").Clear(); err != nil {
+			return err
+		}
+		return tx.Delete(&group).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete group"})
+		return
+	}
+	recordAudit(c, auditGroupDelete, "group", group.ID, group.Name, group, nil)
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+// findGroups loads the groups with the given IDs, gorm.ErrRecordNotFound when one is missing
+func findGroups(groupIDs []uint) ([]db.UserGroup, error) {
+	var groups []db.UserGroup
+	if len(groupIDs) == 0 {
+		return groups, nil
+	}
+	if err := db.DB.Find(&groups, groupIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(groups) != len(groupIDs) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return groups, nil
+}
+
+// setUserGroups replaces the groups of a user
+func setUserGroups(tx *gorm.DB, user *db.User, groups []db.UserGroup) error {
+	if len(groups) == 0 {
+		return tx.Model(user).Association("Groups").Clear()
+	}
+	return tx.Model(user).Association("Groups").Replace(groups)
+}
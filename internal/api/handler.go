@@ -2,8 +2,10 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -18,11 +20,17 @@ import (
 	"time"
 
 	"qiservice/internal/db"
+	"qiservice/internal/health"
+	"qiservice/internal/metrics"
+	"qiservice/internal/payload"
 	"qiservice/internal/provider"
 	"qiservice/internal/provider/anthropic"
-	"qiservice/internal/provider/gemini"
-	"qiservice/internal/provider/openai"
+	"qiservice/internal/quota"
+	"qiservice/internal/rbac"
+	"qiservice/internal/secret"
 	"qiservice/internal/stats"
+	"qiservice/internal/tracing"
+	"qiservice/internal/wallet"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -45,24 +53,93 @@ type ServiceConfig struct {
 	APIKey    string      `json:"api_key"`
 	APIKeys   []string    `json:"api_keys"`   // New Pool
 	ModelName string      `json:"model_name"` // Optional Override
+	Fallbacks []string    `json:"fallbacks"`  // Service names tried in order when this one fails
+	Weight    int         `json:"weight"`     // Share among services with the same Name
+	Strategy  string      `json:"strategy"`   // Selection among services with the same Name
 
-	keyCounter uint64 // Round-Robin Counter (Internal)
+	// Prices per 1M tokens (currency of user quotas); CachedInputPrice 0 = InputPrice
+	InputPrice       float64 `json:"input_price"`
+	OutputPrice      float64 `json:"output_price"`
+	CachedInputPrice float64 `json:"cached_input_price"`
+
+	LogPayloads bool `json:"log_payloads"` // Capture request/response bodies of requests served here
+
+	// What adapters do with sampling parameters the upstream protocol lacks: ParamPolicyDrop
+	// (default) or ParamPolicyReject
+	ParamPolicy string `json:"param_policy"`
+
+	*serviceCounters // Internal, see withCounters
+}
+
+// serviceCounters is the runtime state of a service. The entries of the same service ID share it
+// across config saves, so requests still in flight release the counter of the current entry.
+type serviceCounters struct {
+	keyCounter uint64 // Round-Robin Counter
+	inFlight   int64  // Requests currently routed here
+	latencyMs  int64  // Moving average of upstream latency, 0 = unknown
+}
+
+// withCounters gives each service the counters of the current entry with the same ID,
+// fresh ones for new services. Callers hold configMutex.
+func withCounters(services []ServiceConfig, current []ServiceConfig) {
+	byID := make(map[string]*serviceCounters, len(current))
+	for _, s := range current {
+		byID[s.ID] = s.serviceCounters
+	}
+	for i := range services {
+		if services[i].serviceCounters = byID[services[i].ID]; services[i].serviceCounters == nil {
+			services[i].serviceCounters = &serviceCounters{}
+		}
+	}
 }
 
-func (s *ServiceConfig) GetAPIKey() string {
+// upstreamModel is the model name sent to the upstream
+func (s *ServiceConfig) upstreamModel() string {
+	if s.ModelName != "" {
+		return s.ModelName
+	}
+	return s.Name
+}
+
+// keyPool returns the upstream keys of the service (the pool, or the legacy single key)
+func (s *ServiceConfig) keyPool() []string {
 	if len(s.APIKeys) > 0 {
-		// Round Robin
-		idx := atomic.AddUint64(&s.keyCounter, 1) - 1
-		return s.APIKeys[idx%uint64(len(s.APIKeys))]
+		return s.APIKeys
+	}
+	if s.APIKey != "" {
+		return []string{s.APIKey}
 	}
-	return s.APIKey
+	return nil
+}
+
+// GetAPIKey round-robins over the key pool, skipping keys that are disabled, cooling down
+// or have an open circuit, and returns the decrypted key.
+// ok is false when the service has keys but none is usable.
+func (s *ServiceConfig) GetAPIKey() (key string, ok bool) {
+	pool := s.keyPool()
+	if len(pool) == 0 {
+		return "", true // Keyless upstream (e.g. local model server)
+	}
+	// Round Robin
+	start := atomic.AddUint64(&s.keyCounter, 1) - 1
+	for i := uint64(0); i < uint64(len(pool)); i++ {
+		k := pool[(start+i)%uint64(len(pool))]
+		if !health.Keys.Available(keyFingerprint(k)) {
+			continue
+		}
+		plain, err := openKey(k)
+		if err != nil {
+			log.Printf("[Routing] Cannot decrypt key %s of %s: %v", keyMask(k), s.Name, err)
+			continue
+		}
+		return plain, true
+	}
+	return "", false
 }
 
 type Config struct {
 	Services        []ServiceConfig `json:"services"`
 	ActiveServiceId string          `json:"active_service_id"`
-	ClientKeys      []string        `json:"client_keys"`
-	AdminPassword   string          `json:"admin_password"`
 }
 
 var (
@@ -79,6 +156,7 @@ func LoadConfig() {
 	// 1. Load Services
 	var dbServices []db.Service
 	if err := db.DB.Find(&dbServices).Error; err == nil {
+		current := config.Services
 		config.Services = make([]ServiceConfig, 0, len(dbServices))
 		for _, s := range dbServices {
 			targetModel := ""
@@ -100,6 +178,11 @@ func LoadConfig() {
 			// Fallback: If pool matches single key, or empty, ensure primary key is in pool?
 			// Logic: If pool is empty, use APIKey. If pool exists, use pool.
 
+			var fallbacks []string
+			if s.Fallbacks != "" {
+				json.Unmarshal([]byte(s.Fallbacks), &fallbacks)
+			}
+
 			config.Services = append(config.Services, ServiceConfig{
 				ID:        strconv.Itoa(int(s.ID)),
 				Name:      s.Name,
@@ -108,29 +191,23 @@ func LoadConfig() {
 				APIKey:    s.APIKey,
 				APIKeys:   keys,
 				ModelName: targetModel,
-			})
-		}
-	}
+				Fallbacks: fallbacks,
+				Weight:    s.Weight,
+				Strategy:  s.Strategy,
 
-	// 2. Load Client Keys (load all active keys for allow-list)
-	var dbKeys []db.APIKey
-	if err := db.DB.Where("is_active = ?", true).Find(&dbKeys).Error; err == nil {
-		config.ClientKeys = make([]string, 0, len(dbKeys))
-		for _, k := range dbKeys {
-			config.ClientKeys = append(config.ClientKeys, k.Key)
-		}
-	}
+				InputPrice:       s.InputPrice,
+				OutputPrice:      s.OutputPrice,
+				CachedInputPrice: s.CachedInputPrice,
 
-	// 3. Load Admin Password
-	var adminUser db.User
-	if err := db.DB.Where("role = ?", "admin").First(&adminUser).Error; err == nil {
-		// Populate config with the Hash from DB
-		config.AdminPassword = adminUser.PasswordHash
-	} else {
-		config.AdminPassword = "admin"
+				LogPayloads: s.LogPayloads,
+				ParamPolicy: s.ParamPolicy,
+			})
+		}
+		withCounters(config.Services, current)
+		warnUnpriced(config.Services)
 	}
 
-	log.Printf("✅ Config loaded from DB: %d Services, %d Keys.", len(config.Services), len(config.ClientKeys))
+	log.Printf("✅ Config loaded from DB: %d Services.", len(config.Services))
 }
 
 func SaveConfig() {
@@ -156,12 +233,30 @@ func ModelsHandler(c *gin.Context) {
 		OwnedBy string `json:"owned_by"`
 	}
 	var models []gin.H
+	index := make(map[string]int)
 	for _, s := range config.Services {
+		if !serviceVisible(c, s.Name) {
+			continue
+		}
+		// Load-balanced services share one public name; the model is degraded if any of them is down
+		degraded := health.Services.Degraded(s.ID)
+		if i, ok := index[s.Name]; ok {
+			if degraded {
+				models[i]["status"] = "degraded"
+			}
+			continue
+		}
+		status := "available"
+		if degraded {
+			status = "degraded"
+		}
+		index[s.Name] = len(models)
 		models = append(models, gin.H{
 			"id":       s.Name,
 			"object":   "model",
 			"created":  1677610602,
 			"owned_by": "openai",
+			"status":   status,
 		})
 	}
 
@@ -187,46 +282,104 @@ func getServiceProtocol(serviceType ServiceType) string {
 }
 
 // --- Usage Snooper ---
+
+// UsageSnooper reads the token usage out of a relayed response body, line by line (one SSE
+// event per line, or a whole JSON body). Counters hold the last value seen: OpenAI sends usage
+// once, Anthropic repeats the running totals (input and cache counts in message_start and again
+// in message_delta, output in both), so adding them up would bill a stream twice.
 type UsageSnooper struct {
 	io.ReadCloser
-	tokensIn  *int
-	tokensOut *int
+	protocol     string
+	tokensIn     *int
+	tokensOut    *int
+	tokensCached *int
+
+	pending                              []byte // Start of a line split across reads
+	input, output, cacheRead, cacheWrite int
 }
 
 var (
 	reInput  = regexp.MustCompile(`"(?:prompt_tokens|input_tokens)"\s*:\s*(\d+)`)
 	reOutput = regexp.MustCompile(`"(?:completion_tokens|output_tokens)"\s*:\s*(\d+)`)
+	// OpenAI reports cache hits inside prompt_tokens; Anthropic reports them (and cache writes) next to input_tokens
+	reCached     = regexp.MustCompile(`"(?:cached_tokens|cache_read_input_tokens)"\s*:\s*(\d+)`)
+	reCacheWrite = regexp.MustCompile(`"cache_creation_input_tokens"\s*:\s*(\d+)`)
 )
 
+// maxSnoopLine bounds the buffered partial line, longer lines are scanned in pieces
+const maxSnoopLine = 1 << 20
+
 func (s *UsageSnooper) Read(p []byte) (n int, err error) {
 	n, err = s.ReadCloser.Read(p)
-	if n > 0 {
-		chunk := p[:n]
-		// Optimization: Only scan if we see "tokens" keyword
-		if bytes.Contains(chunk, []byte("tokens")) {
-			// Find Input (accumulative logic if multiple chunks contain part? No, regex is simple)
-			// Note: This naive regex might match multiple times or miss split JSON.
-			// Ideally we accumulate stats. But most APIs send Usage block once at end.
-			// We trust the LAST match or use logic to detect if we already found it?
-			// Some APIs like Anthropic send usage in delta updates.
-			if matches := reInput.FindSubmatch(chunk); len(matches) > 1 {
-				val, _ := strconv.Atoi(string(matches[1]))
-				// For streaming, we might see it multiple times?
-				// Anthropic delta: input_tokens in message_start, output_tokens in message_delta/stop.
-				// They are distinct. So += is correct.
-				// OpenAI usage at end: just one block. += is correct (0+val).
-				*s.tokensIn += val
-			}
-			if matches := reOutput.FindSubmatch(chunk); len(matches) > 1 {
-				val, _ := strconv.Atoi(string(matches[1]))
-				*s.tokensOut += val
+	data := p[:n]
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			s.pending = append(s.pending, data...)
+			if len(s.pending) > maxSnoopLine {
+				s.scan(s.pending)
+				s.pending = s.pending[:0]
 			}
+			break
+		}
+		if len(s.pending) > 0 {
+			s.scan(append(s.pending, data[:i]...))
+			s.pending = s.pending[:0]
+		} else {
+			s.scan(data[:i])
 		}
+		data = data[i+1:]
+	}
+	if err != nil && len(s.pending) > 0 {
+		s.scan(s.pending) // Last line, or a JSON body without newline
+		s.pending = nil
 	}
 	return
 }
 
-func handleReverseProxy(c *gin.Context, targetBaseURL, targetPath, apiKey, protocol string, tokensIn, tokensOut *int) {
+// scan takes the usage counters of one line
+func (s *UsageSnooper) scan(line []byte) {
+	if !bytes.Contains(line, []byte("tokens")) {
+		return
+	}
+	value := func(re *regexp.Regexp) (int, bool) {
+		m := re.FindSubmatch(line)
+		if len(m) < 2 {
+			return 0, false
+		}
+		v, _ := strconv.Atoi(string(m[1]))
+		return v, true
+	}
+	// Anthropic input and cache counts only ever grow: a 0 (older message_delta) keeps the earlier value
+	keep := func(re *regexp.Regexp, counter *int) {
+		if v, ok := value(re); ok && (s.protocol != "anthropic" || v > 0) {
+			*counter = v
+		}
+	}
+	keep(reInput, &s.input)
+	keep(reCached, &s.cacheRead)
+	if s.protocol == "anthropic" {
+		keep(reCacheWrite, &s.cacheWrite)
+	}
+	if v, ok := value(reOutput); ok {
+		s.output = v
+	}
+
+	*s.tokensOut = s.output
+	*s.tokensCached = s.cacheRead
+	if s.protocol == "anthropic" {
+		*s.tokensIn = s.input + s.cacheRead + s.cacheWrite // input_tokens excludes the cache
+	} else {
+		*s.tokensIn = s.input
+	}
+}
+
+// handleReverseProxy relays the request to the upstream and returns the status sent to the client.
+// When canRetry is set, connection errors and retryable statuses (5xx/429) are not relayed:
+// a non-nil error is returned instead and nothing has been written, so the caller can fail over.
+// onResponse (optional) is called as soon as the upstream response headers arrive.
+// ctx carries the trace of the attempt.
+func handleReverseProxy(ctx context.Context, c *gin.Context, targetBaseURL, targetPath, apiKey, protocol string, tokensIn, tokensOut, tokensCached *int, canRetry bool, onResponse func(*http.Response)) (int, error) {
 	// Parse Target URL
 	// Ensure targetBaseURL doesn't have trailing slash
 	targetBaseURL = strings.TrimRight(targetBaseURL, "/")
@@ -236,24 +389,39 @@ func handleReverseProxy(c *gin.Context, targetBaseURL, targetPath, apiKey, proto
 	remote, err := url.Parse(fullURLStr)
 	if err != nil {
 		log.Printf("[Proxy Error] Invalid Target URL: %v", err)
+		if canRetry {
+			return 0, err
+		}
 		c.JSON(500, gin.H{"error": "Invalid Upstream Configuration"})
-		return
+		return 500, nil
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(remote)
 
 	// Custom Transport to improve stability (Fix 520 errors)
-	proxy.Transport = &http.Transport{
+	proxy.Transport = tracing.Transport(&http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: true, // Allow self-signed certs just in case
 		},
 		DisableKeepAlives: true, // Force fresh connection to avoid 520/Connection Reset
-	}
+	})
+
+	status := 0
+	var retryErr error
 
 	// Snoop Body
 	proxy.ModifyResponse = func(resp *http.Response) error {
-		resp.Body = &UsageSnooper{ReadCloser: resp.Body, tokensIn: tokensIn, tokensOut: tokensOut}
+		if onResponse != nil {
+			onResponse(resp)
+		}
+		if canRetry && provider.IsRetryableStatus(resp.StatusCode) {
+			bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			return &provider.APIError{Provider: protocol, StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+		}
+		status = resp.StatusCode
+		resp.Body = &UsageSnooper{ReadCloser: resp.Body, protocol: protocol, tokensIn: tokensIn, tokensOut: tokensOut, tokensCached: tokensCached}
 		return nil
 	}
 
@@ -294,32 +462,31 @@ func handleReverseProxy(c *gin.Context, targetBaseURL, targetPath, apiKey, proto
 	// Error Handler
 	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
 		log.Printf("[Proxy Error] %v", err)
+		if canRetry && provider.IsRetryable(err) {
+			// Leave the client untouched, the caller tries the next service
+			retryErr = err
+			return
+		}
 		// gin's ResponseWriter might have issues if we write multiple times, but standard http.Error is okay here
+		status = 502
 		http.Error(w, "Bad Gateway: "+err.Error(), 502)
 	}
 
 	// Serve
-	proxy.ServeHTTP(c.Writer, c.Request)
+	proxy.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+	return status, retryErr
 }
 
-// Client Keys Handlers
-func UpdateKeysHandler(c *gin.Context) {
-	var newKeys []string
-	if err := c.ShouldBindJSON(&newKeys); err != nil {
-		c.JSON(400, gin.H{"error": err.Error()})
-		return
-	}
-
-	configMutex.Lock()
-	config.ClientKeys = newKeys
-	configMutex.Unlock()
-	SaveConfig()
-	c.JSON(200, gin.H{"status": "updated", "keys": newKeys})
-}
+// GetConfigHandler - GET /api/config
+// Callers with services.write get upstream keys masked; others only see service names and types.
 func GetConfigHandler(c *gin.Context) {
 	configMutex.RLock()
 	defer configMutex.RUnlock()
-	c.JSON(200, config)
+
+	c.JSON(200, gin.H{
+		"services":          redactedServices(visibleServices(c, config.Services), can(c, rbac.ServicesWrite)),
+		"active_service_id": config.ActiveServiceId,
+	})
 }
 
 func GetStatsHandler(c *gin.Context) {
@@ -329,23 +496,28 @@ func GetStatsHandler(c *gin.Context) {
 	}
 
 	// Determine Scope
-	role := c.GetString("role")
 	userID := c.GetUint("userID")
 
-	// If Admin/SuperAdmin, they *can* see global stats.
-	// But if they want to see "My Stats", how do we distinguish?
-	// For now, let's say Admin Dashboard shows GLOBAL.
-	// If we want "My Stats" for Admin, we'd need a query param or separate endpoint.
-	// Given user request "Users see their own", let's imply:
-	// - Non-Admin -> Enforced UserID scope
-	// - Admin -> Global (userID=0)
+	// - Without stats.global -> Enforced UserID scope
+	// - With stats.global -> Global (userID=0)
 
 	targetUserID := uint(0)
-	if role != db.RoleSuperAdmin && role != db.RoleAdmin {
+	if !can(c, rbac.StatsGlobal) {
 		targetUserID = userID
 	}
 
-	data := stats.GlobalManager.GetDaily(date, targetUserID)
+	// ?org_id= scopes to the requests made with an organization's keys, for its members
+	var orgID uint
+	if v := c.Query("org_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || orgRole(c, uint(id)) == "" {
+			c.JSON(403, gin.H{"error": "Not a member of this organization"})
+			return
+		}
+		orgID, targetUserID = uint(id), 0
+	}
+
+	data := stats.GlobalManager.GetDaily(date, targetUserID, orgID)
 	c.JSON(200, data)
 }
 
@@ -355,77 +527,167 @@ func TelemetrySinkHandler(c *gin.Context) {
 	c.Status(200)
 }
 
+// UpdateServicesHandler - POST /api/services
+// Replaces the service list. Services are matched to their rows by ID and updated in place;
+// new services get a row (and its ID), rows missing from the list are deleted.
 func UpdateServicesHandler(c *gin.Context) {
 	var newServices []ServiceConfig
 	if err := c.ShouldBindJSON(&newServices); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-
-	// Ensure IDs
-	for i := range newServices {
-		if newServices[i].ID == "" {
-			newServices[i].ID = uuid.New().String()
+	for _, s := range newServices {
+		if p := s.ParamPolicy; p != "" && p != ParamPolicyDrop && p != ParamPolicyReject {
+			c.JSON(400, gin.H{"error": "param_policy must be \"drop\" or \"reject\""})
+			return
 		}
 	}
 
 	configMutex.Lock()
+	// The UI only has masked keys: map them back to the stored ones, seal new ones
+	if err := sealSubmittedKeys(newServices, config.Services); err != nil {
+		configMutex.Unlock()
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.DB.Transaction(func(tx *gorm.DB) error { return saveServices(tx, newServices) }); err != nil {
+		configMutex.Unlock()
+		log.Printf("Failed to save services: %v", err)
+		c.JSON(500, gin.H{"error": "Failed to save services"})
+		return
+	}
+	before := servicesSnapshot(config.Services)
+	withCounters(newServices, config.Services)
+	warnUnpriced(newServices)
 	config.Services = newServices
 	configMutex.Unlock()
 	SaveConfig() // Save to JSON file as backup
+	recordAudit(c, auditServiceUpdate, "services", "", "", before, servicesSnapshot(newServices))
 
-	// Save to DB (Sync)
-	// Strategy: Delete all and re-create? Or Upsert?
-	// Delete all is safest for simple config sync.
-	// But ID might be needed for stats? RequestLog refers to ServiceModel (string name), not ID.
-	// So deleting is fine.
-	go func() {
-		// Use transaction
-		db.DB.Transaction(func(tx *gorm.DB) error {
-			// 1. Delete all existing services (Soft Delete or Hard?)
-			// Hard delete to clean up or just update?
-			// Let's use Hard Delete for now to avoid duplicates logic complexity
-			// Warning: If we have FKs, might be issue. RequestLog doesn't have FK to Service ID.
-			tx.Exec("DELETE FROM services")
-
-			for _, s := range newServices {
-				// Prepare JSONs
-				keysBytes, _ := json.Marshal(s.APIKeys)
-
-				// Model Mapping?
-				// Frontend assumes ModelName. DB uses ModelMapping.
-				// We store simple target for now.
-				mapping := s.ModelName
-				// Or use JSON format if needed?
-				// The loader supports simple string or JSON.
-				// Let's store simple string to be compatible with frontend input.
-
-				svc := db.Service{
-					// ID: Parse uint? Config uses string UUID.
-					// DB uses uint. We can't easily sync UUID to uint ID.
-					// We will let DB auto-generating IDs.
-					// config.Services IDs are UUIDs.
-					// This is a mismatch.
-					// However, frontend uses UUIDs.
-					// DB ID is internal.
-					Name:         s.Name,
-					Type:         string(s.Type),
-					BaseURL:      s.BaseURL,
-					APIKey:       s.APIKey,
-					APIKeys:      string(keysBytes),
-					ModelMapping: mapping,
-					IsActive:     true,
-				}
-				if err := tx.Create(&svc).Error; err != nil {
-					log.Printf("Failed to save service %s: %v", s.Name, err)
-					return err
-				}
+	c.JSON(200, gin.H{"status": "updated", "services": redactedServices(newServices, true)})
+}
+
+// saveServices writes the service list to its rows: services whose ID names a row update it,
+// the others (no ID, or one already used in the list) are created and take the ID of their
+// new row. Rows not in the list are deleted.
+func saveServices(tx *gorm.DB, services []ServiceConfig) error {
+	var existing []uint
+	if err := tx.Model(&db.Service{}).Pluck("id", &existing).Error; err != nil {
+		return err
+	}
+	stale := make(map[uint]bool, len(existing))
+	for _, id := range existing {
+		stale[id] = true
+	}
+
+	for i := range services {
+		s := &services[i]
+		keysBytes, _ := json.Marshal(s.APIKeys)
+		fallbacksBytes, _ := json.Marshal(s.Fallbacks)
+		row := db.Service{
+			Name:         s.Name,
+			Type:         string(s.Type),
+			BaseURL:      s.BaseURL,
+			APIKey:       s.APIKey,
+			APIKeys:      string(keysBytes),
+			ModelMapping: s.ModelName, // Plain target model, the loader also reads the JSON form
+			Fallbacks:    string(fallbacksBytes),
+			Weight:       s.Weight,
+			Strategy:     s.Strategy,
+			IsActive:     true,
+
+			InputPrice:       s.InputPrice,
+			OutputPrice:      s.OutputPrice,
+			CachedInputPrice: s.CachedInputPrice,
+
+			LogPayloads: s.LogPayloads,
+			ParamPolicy: s.ParamPolicy,
+		}
+		if id, err := strconv.ParseUint(s.ID, 10, 64); err == nil && stale[uint(id)] {
+			row.ID = uint(id)
+			delete(stale, row.ID)
+			if err := tx.Select("*").Updates(&row).Error; err != nil {
+				return fmt.Errorf("service %s: %w", s.Name, err)
 			}
-			return nil
-		})
-	}()
+			continue
+		}
+		if err := tx.Create(&row).Error; err != nil {
+			return fmt.Errorf("service %s: %w", s.Name, err)
+		}
+		s.ID = strconv.Itoa(int(row.ID))
+	}
+
+	for id := range stale {
+		if err := tx.Delete(&db.Service{}, id).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maskKey shows only the ends of a secret, e.g. "sk-a...wxyz"
+func maskKey(k string) string {
+	if len(k) <= 8 {
+		return strings.Repeat("*", len(k))
+	}
+	return k[:4] + "..." + k[len(k)-4:]
+}
+
+// ListKeyHealthHandler - GET /api/services/key_health
+// Per-service list of upstream keys with their health state (keys are masked).
+func ListKeyHealthHandler(c *gin.Context) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	type keyHealth struct {
+		db.UpstreamKeyState
+		Masked string `json:"masked"`
+	}
+	result := make([]gin.H, 0, len(config.Services))
+	for i := range config.Services {
+		s := &config.Services[i]
+		keys := []keyHealth{}
+		for _, k := range s.keyPool() {
+			st := health.Keys.State(keyFingerprint(k))
+			st.ServiceName = s.Name
+			keys = append(keys, keyHealth{UpstreamKeyState: st, Masked: keyMask(k)})
+		}
+		result = append(result, gin.H{"service_id": s.ID, "service_name": s.Name, "keys": keys})
+	}
+	c.JSON(200, result)
+}
+
+// ServiceHealthHandler - GET /api/services/health
+// Probe results of every service. Upstream error details need services.write.
+func ServiceHealthHandler(c *gin.Context) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
 
-	c.JSON(200, gin.H{"status": "updated", "services": newServices})
+	isAdmin := can(c, rbac.ServicesWrite)
+	result := make([]gin.H, 0, len(config.Services))
+	for _, s := range visibleServices(c, config.Services) {
+		st := health.Services.State(s.ID)
+		if !isAdmin {
+			st.LastError = ""
+		}
+		result = append(result, gin.H{"service_id": s.ID, "service_name": s.Name, "health": st})
+	}
+	c.JSON(200, result)
+}
+
+// ResetKeyHealthHandler - POST /api/services/key_health/reset
+// Puts a disabled or resting key back into rotation.
+func ResetKeyHealthHandler(c *gin.Context) {
+	var req struct {
+		Fingerprint string `json:"fingerprint" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	health.Keys.Reset(req.Fingerprint)
+	recordAudit(c, auditKeyHealthReset, "upstream_key", req.Fingerprint, req.Fingerprint, nil, nil)
+	c.JSON(200, gin.H{"status": "reset"})
 }
 
 func ChatCompletionsHandler(c *gin.Context) {
@@ -434,6 +696,12 @@ func ChatCompletionsHandler(c *gin.Context) {
 	success := false
 	tokensIn := 0
 	tokensOut := 0
+	tokensCached := 0
+	var served *ServiceConfig // Service that handled the request, its prices apply
+	var route string          // metrics.RouteProxy or metrics.RouteAdapter, for served
+	var hold *wallet.Hold     // Wallet reservation, settled to the actual cost
+	var capture *payloadCapture
+	var requestBody []byte // Priced when the upstream reports no usage
 	// 4. Record Stats (Async)
 	// We need success/failure from the inner logic?
 	// The inner logic returns here.
@@ -466,12 +734,19 @@ func ChatCompletionsHandler(c *gin.Context) {
 			userID = uID.(uint)
 		}
 
+		c.Set("tokensUsed", tokensIn+tokensOut) // Charged to TPM limits by RateLimitMiddleware
+		if served != nil {
+			obs := observe(c)
+			obs.Model, obs.Service, obs.UpstreamModel, obs.Route = finalModel, served.Name, served.upstreamModel(), route
+			obs.TokensIn, obs.TokensOut, obs.TokensCached = tokensIn, tokensOut, tokensCached
+		}
 		if finalModel != "" {
-			stats.GlobalManager.Record(finalModel, time.Since(startTime), success, tokensIn, tokensOut, userID)
-			// Update User Quota
-			if userID > 0 && success {
-				db.DB.Model(&db.User{}).Where("id = ?", userID).UpdateColumn("used_amount", gorm.Expr("used_amount + ?", float64(tokensIn+tokensOut)))
+			cost := requestCost(served, success, tokensIn, tokensCached, tokensOut, requestBody)
+			stats.GlobalManager.Record(finalModel, time.Since(startTime), success, tokensIn, tokensOut, tokensCached, cost, userID, c.GetUint("orgID"), capture.finish(served))
+			if err := hold.Settle(cost); err != nil {
+				log.Printf("[Wallet] Failed to settle %.6f for user %d: %v", cost, userID, err)
 			}
+			chargeUsage(c, userID, cost)
 		}
 	}()
 
@@ -481,6 +756,7 @@ func ChatCompletionsHandler(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Failed to read request body"})
 		return
 	}
+	requestBody = bodyBytes
 	// Restore body for subsequent reads (Binding or Proxying)
 	c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
@@ -493,19 +769,15 @@ func ChatCompletionsHandler(c *gin.Context) {
 		return
 	}
 
-	// 2. Find Service
-	configMutex.RLock()
-	var matchedService *ServiceConfig
-	for i := range config.Services {
-		if config.Services[i].Name == baseReq.Model {
-			matchedService = &config.Services[i]
-			finalModel = matchedService.Name
-			break
-		}
+	// Scoped keys may only call their allowed models
+	if !keyAllowsModel(c, baseReq.Model) {
+		abortModelNotAllowed(c, baseReq.Model)
+		return
 	}
-	configMutex.RUnlock()
 
-	if matchedService == nil {
+	// 2. Resolve Service Chain (primary + fallbacks); models outside the caller's groups do not exist for them
+	chain := routeRequest(c, baseReq.Model)
+	if len(chain) == 0 {
 		c.JSON(404, gin.H{
 			"error": gin.H{
 				"message": "The model '" + baseReq.Model + "' does not exist. Please check your service configuration.",
@@ -515,118 +787,239 @@ func ChatCompletionsHandler(c *gin.Context) {
 		})
 		return
 	}
+	finalModel = chain[0].Name
 
-	// 3. Smart Proxy Decision
-	upstreamProtocol := getServiceProtocol(matchedService.Type)
-	selectedAPIKey := matchedService.GetAPIKey()
-
-	if upstreamProtocol == "openai" {
-		// [FAST PATH] Direct Proxy
-		log.Printf("[Proxy] Fast Path: OpenAI -> OpenAI (%s)", matchedService.Name)
-
-		// Rewrite Body if Model Name Override exists
-		if matchedService.ModelName != "" && matchedService.ModelName != matchedService.Name {
-			var bodyMap map[string]interface{}
-			if err := json.Unmarshal(bodyBytes, &bodyMap); err == nil {
-				bodyMap["model"] = matchedService.ModelName
-				if newBytes, err := json.Marshal(bodyMap); err == nil {
-					c.Request.Body = io.NopCloser(bytes.NewBuffer(newBytes))
-					c.Request.ContentLength = int64(len(newBytes))
-					c.Request.Header.Set("Content-Length", strconv.Itoa(len(newBytes)))
-					c.Request.Header.Del("Content-Encoding")
-					c.Request.Header.Del("Transfer-Encoding")
-				}
-			}
-		}
-
-		handleReverseProxy(c, matchedService.BaseURL, "/chat/completions", selectedAPIKey, "openai", &tokensIn, &tokensOut)
-		success = true // Assume proxy success if no panic, or track status code?
-		// handleReverseProxy writes directly. We can't easily intercept status unless we wrap writer.
-		// For simplicity, assume success if we reached here.
+	// Wallet users pay in advance: hold the worst case before forwarding
+	h, ok := reserveWallet(c, chain, bodyBytes)
+	if !ok {
 		return
 	}
+	hold = h
+	capture = startPayloadCapture(c, chain, bodyBytes)
 
-	// [SLOW PATH] Logic
-	var req provider.ChatCompletionRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(400, gin.H{"error": err.Error()})
-		return
-	}
+	// Parsed lazily, only needed when a service goes through the adapter
+	var parsedReq *provider.ChatCompletionRequest
 
-	// Override Model if configured
-	if matchedService.ModelName != "" {
-		req.Model = matchedService.ModelName
-	}
+	// 3. Try each service until one answers (failover happens before anything is flushed)
+	var lastErr error
+	var active *ServiceConfig
+	defer func() {
+		if active != nil {
+			active.release()
+		}
+	}()
+	var attempt attemptSpan
+	defer attempt.end(nil)
+	for i, matchedService := range chain {
+		ctx := attempt.next(c, matchedService, lastErr)
+		canRetry := i < len(chain)-1
+		if i > 0 {
+			log.Printf("[Failover] %s -> %s (%v)", chain[i-1].Name, matchedService.Name, lastErr)
+		}
+		if !health.Services.Available(matchedService.ID) {
+			lastErr = errCircuitOpen
+			log.Printf("[Routing] %s: %v", matchedService.Name, lastErr)
+			continue
+		}
+		if active != nil {
+			active.release()
+		}
+		active = matchedService
+		served = matchedService
+		matchedService.acquire()
+		attemptStart := time.Now()
+		observeLatency := func(resp *http.Response) {
+			if resp == nil || resp.StatusCode < 400 {
+				matchedService.observeLatency(time.Since(attemptStart))
+			}
+		}
 
-	log.Printf("[Debug] Routing (Adapter) to Service: %s, Type: %s", matchedService.Name, matchedService.Type)
+		// Smart Proxy Decision
+		upstreamProtocol := getServiceProtocol(matchedService.Type)
+		selectedAPIKey, ok := matchedService.GetAPIKey()
+		if !ok {
+			lastErr = errNoHealthyKey
+			log.Printf("[Routing] %s: %v", matchedService.Name, lastErr)
+			continue
+		}
+		gotResponse := false
+		onProxyResponse := func(resp *http.Response) {
+			gotResponse = true
+			observeLatency(resp)
+			reportUpstreamStatus(matchedService, selectedAPIKey, resp.StatusCode, provider.ParseRetryAfter(resp.Header.Get("Retry-After")), "")
+		}
 
-	var p provider.Provider
-	switch matchedService.Type {
-	case ServiceTypeGemini:
-		p = gemini.NewGeminiProvider(matchedService.BaseURL)
-	case ServiceTypeAnthropic:
-		p = anthropic.NewAnthropicProvider(matchedService.BaseURL)
-	default:
-		p = openai.NewOpenAIProvider(matchedService.BaseURL)
-	}
+		if upstreamProtocol == "openai" {
+			// [FAST PATH] Direct Proxy
+			log.Printf("[Proxy] Fast Path: OpenAI -> OpenAI (%s)", matchedService.Name)
+			route = metrics.RouteProxy
+			attempt.route(route)
 
-	// Check for Streaming
-	if req.Stream {
-		c.Header("Content-Type", "text/event-stream")
-		c.Header("Cache-Control", "no-cache")
-		c.Header("Connection", "keep-alive")
-		c.Header("Transfer-Encoding", "chunked")
+			setRequestBody(c, proxyRequestBody(matchedService, bodyBytes))
 
-		outputChan := make(chan provider.StreamResponse)
-		errChan := make(chan error)
+			status, err := handleReverseProxy(ctx, c, matchedService.BaseURL, "/chat/completions", selectedAPIKey, "openai", &tokensIn, &tokensOut, &tokensCached, canRetry, onProxyResponse)
+			if !gotResponse {
+				// Connection error (retryable or relayed as 502)
+				reportUpstreamError(matchedService, selectedAPIKey, err)
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			success = status < 400
+			return
+		}
 
-		go func() {
-			defer close(outputChan)
-			defer close(errChan)
-			if err := p.StreamChatCompletion(c.Request.Context(), req, selectedAPIKey, outputChan); err != nil {
-				errChan <- err
+		// [SLOW PATH] Logic
+		route = metrics.RouteAdapter
+		attempt.route(route)
+		if parsedReq == nil {
+			parsedReq = &provider.ChatCompletionRequest{}
+			if err := json.Unmarshal(bodyBytes, parsedReq); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
 			}
-		}()
+		}
+		req := *parsedReq
 
-		c.Stream(func(w io.Writer) bool {
-			select {
-			case chunk, ok := <-outputChan:
-				if !ok {
-					c.SSEvent("", "[DONE]")
-					return false
+		// Override Model if configured
+		if matchedService.ModelName != "" {
+			req.Model = matchedService.ModelName
+		}
+		if err := applyParamPolicy(matchedService, &req); err != nil {
+			attempt.end(err)
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		log.Printf("[Debug] Routing (Adapter) to Service: %s, Type: %s", matchedService.Name, matchedService.Type)
+
+		p := newProvider(matchedService)
+
+		// Check for Streaming
+		if req.Stream {
+			stream, err := openStream(ctx, p, req, selectedAPIKey)
+			reportUpstreamError(matchedService, selectedAPIKey, err)
+			if err != nil {
+				if canRetry && provider.IsRetryable(err) {
+					lastErr = err
+					continue
 				}
+				log.Printf("Stream error: %v", err)
+				attempt.end(err)
+				c.JSON(upstreamErrorStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			observeLatency(nil)
+
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("Connection", "keep-alive")
+			c.Header("Transfer-Encoding", "chunked")
+
+			sendChunk := func(chunk provider.StreamResponse) {
 				c.SSEvent("", chunk)
 				if chunk.Usage != nil {
 					tokensIn += chunk.Usage.PromptTokens
 					tokensOut += chunk.Usage.CompletionTokens
+					tokensCached += chunk.Usage.CachedTokens()
 				}
 				success = true
-				return true
-			case err, ok := <-errChan:
-				if !ok {
-					errChan = nil
+			}
+			if stream.first != nil {
+				sendChunk(*stream.first)
+			}
+
+			outputChan, errChan := stream.chunks, stream.errs
+			_, relay := tracing.Start(ctx, "stream_relay")
+			defer relay.End()
+			c.Stream(func(w io.Writer) bool {
+				select {
+				case chunk, ok := <-outputChan:
+					if !ok {
+						c.SSEvent("", "[DONE]")
+						return false
+					}
+					sendChunk(chunk)
 					return true
+				case err, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						return true
+					}
+					log.Printf("Stream error: %v", err)
+					return false
+				case <-c.Request.Context().Done():
+					return false
 				}
-				log.Printf("Stream error: %v", err)
-				return false
-			case <-c.Request.Context().Done():
-				return false
+			})
+			return
+		}
+
+		resp, err := p.ChatCompletion(ctx, req, selectedAPIKey)
+		reportUpstreamError(matchedService, selectedAPIKey, err)
+		if err != nil {
+			if canRetry && provider.IsRetryable(err) {
+				lastErr = err
+				continue
 			}
-		})
-		return
-	}
+			log.Printf("Error processing chat completion: %v", err)
+			attempt.end(err)
+			c.JSON(upstreamErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		observeLatency(nil)
 
-	resp, err := p.ChatCompletion(c.Request.Context(), req, selectedAPIKey)
-	if err != nil {
-		log.Printf("Error processing chat completion: %v", err)
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(200, resp)
+		success = true
+		tokensIn = resp.Usage.PromptTokens
+		tokensOut = resp.Usage.CompletionTokens
+		tokensCached = resp.Usage.CachedTokens()
 		return
 	}
 
-	c.JSON(200, resp)
-	success = true
-	tokensIn = resp.Usage.PromptTokens
-	tokensOut = resp.Usage.CompletionTokens
+	// Every candidate was skipped
+	attempt.end(lastErr)
+	c.JSON(503, gin.H{
+		"error": gin.H{
+			"message": "No available upstream for model '" + baseReq.Model + "': " + lastErr.Error(),
+			"type":    "server_error",
+			"code":    "upstream_unavailable",
+		},
+	})
+}
+
+// proxyRequestBody rewrites the body of a fast-path request: the model name override, and
+// stream_options.include_usage on streams, as usage is only reported when asked for and billing
+// needs it. The body is forwarded as is when neither applies.
+func proxyRequestBody(s *ServiceConfig, body []byte) []byte {
+	var bodyMap map[string]interface{}
+	if err := json.Unmarshal(body, &bodyMap); err != nil {
+		return body
+	}
+	changed := false
+	if s.ModelName != "" && s.ModelName != s.Name {
+		bodyMap["model"] = s.ModelName
+		changed = true
+	}
+	if stream, _ := bodyMap["stream"].(bool); stream {
+		options, _ := bodyMap["stream_options"].(map[string]interface{})
+		if options == nil {
+			options = map[string]interface{}{}
+		}
+		if include, _ := options["include_usage"].(bool); !include {
+			options["include_usage"] = true
+			bodyMap["stream_options"] = options
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+	if newBytes, err := json.Marshal(bodyMap); err == nil {
+		return newBytes
+	}
+	return body
 }
 
 // Anthropic Handler
@@ -636,18 +1029,31 @@ func AnthropicMessagesHandler(c *gin.Context) {
 	success := false
 	tokensIn := 0
 	tokensOut := 0
+	tokensCached := 0
+	var served *ServiceConfig // Service that handled the request, its prices apply
+	var route string          // metrics.RouteProxy or metrics.RouteAdapter, for served
+	var hold *wallet.Hold     // Wallet reservation, settled to the actual cost
+	var capture *payloadCapture
+	var requestBody []byte // Priced when the upstream reports no usage
 	defer func() {
 		var userID uint
 		if uID, exists := c.Get("userID"); exists {
 			userID = uID.(uint)
 		}
 
+		c.Set("tokensUsed", tokensIn+tokensOut) // Charged to TPM limits by RateLimitMiddleware
+		if served != nil {
+			obs := observe(c)
+			obs.Model, obs.Service, obs.UpstreamModel, obs.Route = finalModel, served.Name, served.upstreamModel(), route
+			obs.TokensIn, obs.TokensOut, obs.TokensCached = tokensIn, tokensOut, tokensCached
+		}
 		if finalModel != "" {
-			stats.GlobalManager.Record(finalModel, time.Since(startTime), success, tokensIn, tokensOut, userID)
-			// Update User Quota
-			if userID > 0 && success {
-				db.DB.Model(&db.User{}).Where("id = ?", userID).UpdateColumn("used_amount", gorm.Expr("used_amount + ?", float64(tokensIn+tokensOut)))
+			cost := requestCost(served, success, tokensIn, tokensCached, tokensOut, requestBody)
+			stats.GlobalManager.Record(finalModel, time.Since(startTime), success, tokensIn, tokensOut, tokensCached, cost, userID, c.GetUint("orgID"), capture.finish(served))
+			if err := hold.Settle(cost); err != nil {
+				log.Printf("[Wallet] Failed to settle %.6f for user %d: %v", cost, userID, err)
 			}
+			chargeUsage(c, userID, cost)
 		}
 	}()
 
@@ -657,6 +1063,7 @@ func AnthropicMessagesHandler(c *gin.Context) {
 		c.JSON(400, gin.H{"error": "Failed to read request body"})
 		return
 	}
+	requestBody = bodyBytes
 	c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
 	var baseReq struct {
@@ -668,94 +1075,364 @@ func AnthropicMessagesHandler(c *gin.Context) {
 		return
 	}
 
-	// 2. Find Service
-	configMutex.RLock()
-	var matchedService *ServiceConfig
-	for i := range config.Services {
-		if config.Services[i].Name == baseReq.Model {
-			matchedService = &config.Services[i]
-			finalModel = matchedService.Name
-			break
-		}
+	// Scoped keys may only call their allowed models
+	if !keyAllowsModel(c, baseReq.Model) {
+		abortModelNotAllowed(c, baseReq.Model)
+		return
 	}
-	configMutex.RUnlock()
 
-	if matchedService == nil {
+	// 2. Resolve Service Chain (primary + fallbacks); models outside the caller's groups do not exist for them
+	chain := routeRequest(c, baseReq.Model)
+	if len(chain) == 0 {
 		c.JSON(404, gin.H{"error": "Model not found: " + baseReq.Model})
 		return
 	}
+	finalModel = chain[0].Name
 
-	// 3. Smart Proxy Decision
-	// Ingress is Anthropic Protocol
-	upstreamProtocol := getServiceProtocol(matchedService.Type)
-	selectedAPIKey := matchedService.GetAPIKey()
-
-	if upstreamProtocol == "anthropic" {
-		// [FAST PATH] Direct Proxy
-		log.Printf("[Proxy] Fast Path: Anthropic -> Anthropic (%s)", matchedService.Name)
-
-		// Rewrite Body if Model Name Override exists
-		if matchedService.ModelName != "" && matchedService.ModelName != matchedService.Name {
-			var bodyMap map[string]interface{}
-			if err := json.Unmarshal(bodyBytes, &bodyMap); err == nil {
-				bodyMap["model"] = matchedService.ModelName
-
-				// [FIX] Sanitize "system" prompt for upstream compatibility
-				if sysVal, ok := bodyMap["system"]; ok {
-					var flatSystem string
-					if sysList, isList := sysVal.([]interface{}); isList {
-						for _, item := range sysList {
-							if itemMap, ok := item.(map[string]interface{}); ok {
-								if t, ok := itemMap["text"].(string); ok {
-									flatSystem += t + "\n"
+	// Wallet users pay in advance: hold the worst case before forwarding
+	h, ok := reserveWallet(c, chain, bodyBytes)
+	if !ok {
+		return
+	}
+	hold = h
+	capture = startPayloadCapture(c, chain, bodyBytes)
+
+	// Parsed lazily, only needed when a service goes through the adapter
+	var anthroReq *anthropic.AnthropicRequest
+	var convertedReq provider.ChatCompletionRequest
+
+	// 3. Try each service until one answers (failover happens before anything is flushed)
+	var lastErr error
+	var active *ServiceConfig
+	defer func() {
+		if active != nil {
+			active.release()
+		}
+	}()
+	var attempt attemptSpan
+	defer attempt.end(nil)
+	for i, matchedService := range chain {
+		ctx := attempt.next(c, matchedService, lastErr)
+		canRetry := i < len(chain)-1
+		if i > 0 {
+			log.Printf("[Failover] %s -> %s (%v)", chain[i-1].Name, matchedService.Name, lastErr)
+		}
+		if !health.Services.Available(matchedService.ID) {
+			lastErr = errCircuitOpen
+			log.Printf("[Routing] %s: %v", matchedService.Name, lastErr)
+			continue
+		}
+		if active != nil {
+			active.release()
+		}
+		active = matchedService
+		served = matchedService
+		matchedService.acquire()
+		attemptStart := time.Now()
+		observeLatency := func(resp *http.Response) {
+			if resp == nil || resp.StatusCode < 400 {
+				matchedService.observeLatency(time.Since(attemptStart))
+			}
+		}
+
+		// Smart Proxy Decision
+		// Ingress is Anthropic Protocol
+		upstreamProtocol := getServiceProtocol(matchedService.Type)
+		selectedAPIKey, ok := matchedService.GetAPIKey()
+		if !ok {
+			lastErr = errNoHealthyKey
+			log.Printf("[Routing] %s: %v", matchedService.Name, lastErr)
+			continue
+		}
+		gotResponse := false
+		onProxyResponse := func(resp *http.Response) {
+			gotResponse = true
+			observeLatency(resp)
+			reportUpstreamStatus(matchedService, selectedAPIKey, resp.StatusCode, provider.ParseRetryAfter(resp.Header.Get("Retry-After")), "")
+		}
+
+		if upstreamProtocol == "anthropic" {
+			// [FAST PATH] Direct Proxy
+			log.Printf("[Proxy] Fast Path: Anthropic -> Anthropic (%s)", matchedService.Name)
+			route = metrics.RouteProxy
+			attempt.route(route)
+
+			// Rewrite Body if Model Name Override exists
+			attemptBody := bodyBytes
+			if matchedService.ModelName != "" && matchedService.ModelName != matchedService.Name {
+				var bodyMap map[string]interface{}
+				if err := json.Unmarshal(bodyBytes, &bodyMap); err == nil {
+					bodyMap["model"] = matchedService.ModelName
+
+					// [FIX] Sanitize "system" prompt for upstream compatibility
+					if sysVal, ok := bodyMap["system"]; ok {
+						var flatSystem string
+						if sysList, isList := sysVal.([]interface{}); isList {
+							for _, item := range sysList {
+								if itemMap, ok := item.(map[string]interface{}); ok {
+									if t, ok := itemMap["text"].(string); ok {
+										flatSystem += t + "\n"
+									}
 								}
 							}
+							// Replace list with simple string if flattened
+							if flatSystem != "" {
+								bodyMap["system"] = strings.TrimSpace(flatSystem)
+							}
+						}
+					}
+
+					if newBytes, err := json.Marshal(bodyMap); err == nil {
+						attemptBody = newBytes
+					}
+				}
+			}
+			setRequestBody(c, attemptBody)
+
+			// BaseURL convention: it already includes the version prefix, e.g.
+			// "https://open.bigmodel.cn/api/anthropic/v1" + "/messages".
+			status, err := handleReverseProxy(ctx, c, matchedService.BaseURL, "/messages", selectedAPIKey, "anthropic", &tokensIn, &tokensOut, &tokensCached, canRetry, onProxyResponse)
+			if !gotResponse {
+				// Connection error (retryable or relayed as 502)
+				reportUpstreamError(matchedService, selectedAPIKey, err)
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			success = status < 400
+			return
+		}
+
+		// [SLOW PATH] Adapter
+		route = metrics.RouteAdapter
+		attempt.route(route)
+		if anthroReq == nil {
+			anthroReq = &anthropic.AnthropicRequest{}
+			if err := json.Unmarshal(bodyBytes, anthroReq); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			_, span := tracing.Start(ctx, "translate_request")
+			var err error
+			convertedReq, err = convertAnthropicRequest(*anthroReq)
+			tracing.Fail(span, err)
+			span.End()
+			if err != nil {
+				attempt.end(err)
+				c.JSON(400, gin.H{"type": "error", "error": gin.H{"type": "invalid_request_error", "message": err.Error()}})
+				return
+			}
+		}
+		internalReq := convertedReq
+
+		log.Printf("[Debug] Routing to Service: %s, Type: %s, URL: %s", matchedService.Name, matchedService.Type, matchedService.BaseURL)
+
+		if matchedService.ModelName != "" {
+			internalReq.Model = matchedService.ModelName
+		}
+		if err := applyParamPolicy(matchedService, &internalReq); err != nil {
+			attempt.end(err)
+			c.JSON(400, gin.H{"type": "error", "error": gin.H{"type": "invalid_request_error", "message": err.Error()}})
+			return
+		}
+
+		p := newProvider(matchedService)
+
+		// Handle Streaming
+		if internalReq.Stream {
+			stream, err := openStream(ctx, p, internalReq, selectedAPIKey)
+			reportUpstreamError(matchedService, selectedAPIKey, err)
+			if err != nil {
+				if canRetry && provider.IsRetryable(err) {
+					lastErr = err
+					continue
+				}
+				log.Printf("[ERROR] Stream Error: %v", err)
+				attempt.end(err)
+				c.JSON(upstreamErrorStatus(err), gin.H{"error": gin.H{"type": "api_error", "message": err.Error()}})
+				return
+			}
+			observeLatency(nil)
+
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("Connection", "keep-alive")
+			c.Header("Transfer-Encoding", "chunked")
+
+			// Send 'message_start' event
+			msgID := "msg_" + uuid.New().String()
+			// We format data manually for Anthropic SSE to ensure exact compliance if gin.SSEvent behaves weirdly with event names
+
+			c.Writer.WriteString("event: message_start\n")
+			c.Writer.WriteString("data: " + toJSON(gin.H{
+				"type": "message_start",
+				"message": gin.H{
+					"id": msgID, "type": "message", "role": "assistant", "model": anthroReq.Model,
+					"usage":   gin.H{"input_tokens": 0, "output_tokens": 0},
+					"content": []interface{}{},
+				},
+			}) + "\n\n")
+			c.Writer.Flush()
+
+			// Content blocks (thinking, text, tool_use) are opened as their deltas arrive, one at a time
+			blockIndex := -1
+			blockType := ""
+			toolIndex := -1 // Index of the tool call in the open tool_use block
+			stopReason := "end_turn"
+
+			writeEvent := func(data gin.H) {
+				c.Writer.WriteString("event: " + data["type"].(string) + "\n")
+				c.Writer.WriteString("data: " + toJSON(data) + "\n\n")
+			}
+			closeBlock := func() {
+				if blockType != "" {
+					writeEvent(gin.H{"type": "content_block_stop", "index": blockIndex})
+					blockType = ""
+				}
+			}
+			openBlock := func(block gin.H) {
+				closeBlock()
+				blockIndex++
+				blockType = block["type"].(string)
+				writeEvent(gin.H{"type": "content_block_start", "index": blockIndex, "content_block": block})
+			}
+			writeDelta := func(delta gin.H) {
+				writeEvent(gin.H{"type": "content_block_delta", "index": blockIndex, "delta": delta})
+			}
+
+			sendChunk := func(chunk provider.StreamResponse) {
+				success = true
+				if chunk.Usage != nil {
+					tokensIn += chunk.Usage.PromptTokens
+					tokensOut += chunk.Usage.CompletionTokens
+					tokensCached += chunk.Usage.CachedTokens()
+				}
+				if len(chunk.Choices) > 0 {
+					delta := chunk.Choices[0].Delta
+					if reason := chunk.Choices[0].FinishReason; reason != nil {
+						stopReason = anthropicStopReason(*reason)
+					}
+
+					// Case A: Reasoning. A signature ends the thinking block, redacted blocks come whole.
+					if delta.ReasoningContent != "" {
+						if blockType != "thinking" {
+							openBlock(gin.H{"type": "thinking", "thinking": ""})
+						}
+						writeDelta(gin.H{"type": "thinking_delta", "thinking": delta.ReasoningContent})
+					}
+					for _, tb := range delta.ThinkingBlocks {
+						if tb.Type == provider.ThinkingTypeRedacted {
+							openBlock(gin.H{"type": "redacted_thinking", "data": tb.Data})
+						} else {
+							if blockType != "thinking" {
+								openBlock(gin.H{"type": "thinking", "thinking": tb.Thinking})
+							}
+							writeDelta(gin.H{"type": "signature_delta", "signature": tb.Signature})
 						}
-						// Replace list with simple string if flattened
-						if flatSystem != "" {
-							bodyMap["system"] = strings.TrimSpace(flatSystem)
+						closeBlock()
+					}
+
+					// Case B: Text Content
+					if delta.Content != "" {
+						if blockType != "text" {
+							openBlock(gin.H{"type": "text", "text": ""})
+						}
+						writeDelta(gin.H{"type": "text_delta", "text": delta.Content})
+					}
+
+					// Case C: Tool Calls, several per chunk when parallel. Each call gets its own block;
+					// argument deltas without an ID continue the call with the same index.
+					for i, toolCall := range delta.ToolCalls {
+						index := i
+						if toolCall.Index != nil {
+							index = *toolCall.Index
+						}
+						if blockType != "tool_use" || toolCall.ID != "" || index != toolIndex {
+							openBlock(gin.H{
+								"type":  "tool_use",
+								"id":    toolCall.ID,
+								"name":  toolCall.Function.Name,
+								"input": gin.H{}, // Start empty, fill via delta
+							})
+							toolIndex = index
+						}
+						if toolCall.Function.Arguments != "" {
+							writeDelta(gin.H{"type": "input_json_delta", "partial_json": toolCall.Function.Arguments})
 						}
 					}
+					c.Writer.Flush()
 				}
+			}
+			if stream.first != nil {
+				sendChunk(*stream.first)
+			}
+
+			outputChan, errChan := stream.chunks, stream.errs
+			_, relay := tracing.Start(ctx, "stream_relay")
+			defer relay.End()
+			c.Stream(func(w io.Writer) bool {
+				select {
+				case chunk, ok := <-outputChan:
+					if !ok {
+						if blockIndex < 0 {
+							// Some clients expect at least one content block
+							openBlock(gin.H{"type": "text", "text": ""})
+						}
+						closeBlock()
 
-				if newBytes, err := json.Marshal(bodyMap); err == nil {
-					c.Request.Body = io.NopCloser(bytes.NewBuffer(newBytes))
-					c.Request.ContentLength = int64(len(newBytes))
-					c.Request.Header.Set("Content-Length", strconv.Itoa(len(newBytes)))
-					c.Request.Header.Del("Content-Encoding")
-					c.Request.Header.Del("Transfer-Encoding")
+						c.Writer.WriteString("event: message_delta\n")
+						c.Writer.WriteString("data: " + toJSON(gin.H{"type": "message_delta", "delta": gin.H{"stop_reason": stopReason, "stop_sequence": nil}, "usage": gin.H{"input_tokens": tokensIn - tokensCached, "output_tokens": tokensOut, "cache_read_input_tokens": tokensCached}}) + "\n\n")
+
+						c.Writer.WriteString("event: message_stop\n")
+						c.Writer.WriteString("data: " + toJSON(gin.H{"type": "message_stop"}) + "\n\n")
+						return false
+					}
+					sendChunk(chunk)
+					return true
+				case err, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						return true // Continue stream
+					}
+					log.Printf("[ERROR] Stream Error: %v", err)
+					return false
+				case <-c.Request.Context().Done():
+					return false
 				}
+			})
+			return
+		}
+
+		// 4. Handle Non-Streaming
+		resp, err := p.ChatCompletion(ctx, internalReq, selectedAPIKey)
+		reportUpstreamError(matchedService, selectedAPIKey, err)
+		if err != nil {
+			if canRetry && provider.IsRetryable(err) {
+				lastErr = err
+				continue
 			}
+			attempt.end(err)
+			c.JSON(upstreamErrorStatus(err), gin.H{"error": gin.H{"type": "api_error", "message": err.Error()}})
+			return
 		}
+		observeLatency(nil)
 
-		// We presume target path is /v1/messages usually, or append what the client sent?
-		// Usually internal config BaseURL is "https://api.anthropic.com". Client requests "/v1/messages".
-		// ReverseProxy will join them. But handleReverseProxy overrides path.
-		// Let's rely on standard endpoint "/v1/messages" for now.
-		handleReverseProxy(c, matchedService.BaseURL, "/messages", selectedAPIKey, "anthropic", &tokensIn, &tokensOut)
-		// Note: Anthropic API is /v1/messages. If BaseURL includes /v1, then /messages.
+		c.JSON(200, anthropicResponse(resp, anthroReq.Model))
 		success = true
-		// If BaseURL is just https://api.anthropic.com, then /v1/messages.
-		// Users usually put full base url.
-		// If user put "https://open.bigmodel.cn/api/anthropic/v1", then we append "/messages"?
-		// Let's assume user config follows strict BaseURL convention.
-		// My handleReverseProxy uses fullURLStr := targetBaseURL + targetPath.
-
-		// Wait, Anthropic SDK usually assumes BaseURL doesn't have /messages.
-		// If user config is "https://open.bigmodel.cn/api/anthropic/v1", and we add "/messages".
-		// That matches https://open.bigmodel.cn/api/anthropic/v1/messages. Correct.
+		tokensIn = resp.Usage.PromptTokens
+		tokensOut = resp.Usage.CompletionTokens
+		tokensCached = resp.Usage.CachedTokens()
 		return
 	}
 
-	// [SLOW PATH] Adapter
-	var anthroReq anthropic.AnthropicRequest
-	if err := c.ShouldBindJSON(&anthroReq); err != nil {
-		c.JSON(400, gin.H{"error": err.Error()})
-		return
-	}
-
-	// log.Printf("[Debug] Anthropic Request Model: %s", anthroReq.Model)
+	// Every candidate was skipped
+	attempt.end(lastErr)
+	c.JSON(503, gin.H{"error": gin.H{"type": "overloaded_error", "message": "No available upstream for model " + baseReq.Model + ": " + lastErr.Error()}})
+}
 
+// convertAnthropicRequest maps an inbound Anthropic Messages request to the internal (OpenAI) format
+func convertAnthropicRequest(anthroReq anthropic.AnthropicRequest) (provider.ChatCompletionRequest, error) {
 	// 1. Convert Anthropic Request -> Internal Request
 	messages := []provider.Message{}
 
@@ -785,9 +1462,11 @@ func AnthropicMessagesHandler(c *gin.Context) {
 			continue
 		}
 
-		// Process blocks
-		var textParts []string
+		// Process blocks (text, image and document blocks are kept in order as content parts)
+		var parts []provider.ContentPart
 		var toolCalls []provider.ToolCall
+		var thinking []provider.ThinkingBlock
+		var reasoning []string
 
 		// Pre-scan to group text or gather tool calls
 		for _, block := range contentList {
@@ -795,7 +1474,23 @@ func AnthropicMessagesHandler(c *gin.Context) {
 
 			if bType == "text" {
 				if t, ok := block["text"].(string); ok {
-					textParts = append(textParts, t)
+					parts = append(parts, provider.ContentPart{Type: provider.PartText, Text: t})
+				}
+			} else if bType == "image" || bType == "document" {
+				part, err := anthropicMediaPart(block)
+				if err != nil {
+					return provider.ChatCompletionRequest{}, err
+				}
+				parts = append(parts, part)
+			} else if bType == "thinking" || bType == "redacted_thinking" {
+				// Reasoning of a previous assistant turn, sent back with its signature
+				tb := provider.ThinkingBlock{Type: bType}
+				tb.Thinking, _ = block["thinking"].(string)
+				tb.Signature, _ = block["signature"].(string)
+				tb.Data, _ = block["data"].(string)
+				thinking = append(thinking, tb)
+				if tb.Thinking != "" {
+					reasoning = append(reasoning, tb.Thinking)
 				}
 			} else if bType == "tool_use" {
 				// Parse Tool Call (Assistant Side)
@@ -815,13 +1510,10 @@ func AnthropicMessagesHandler(c *gin.Context) {
 				})
 			} else if bType == "tool_result" {
 				// Parse Tool Result (User Side -> Convert to Tool Role Message)
-				// Flush any accumulated text as a User message first
-				if len(textParts) > 0 {
-					messages = append(messages, provider.Message{
-						Role:    "user",
-						Content: strings.Join(textParts, "\n"),
-					})
-					textParts = []string{} // Clear
+				// Flush any accumulated content as a User message first
+				if len(parts) > 0 {
+					messages = append(messages, provider.NewMessage("user", parts))
+					parts = nil // Clear
 				}
 
 				toolUseID, _ := block["tool_use_id"].(string)
@@ -853,27 +1545,15 @@ func AnthropicMessagesHandler(c *gin.Context) {
 
 		// Final Flush for this message
 		// If it's assistant with tool calls
-		if m.Role == "assistant" && len(toolCalls) > 0 {
-			msg := provider.Message{
-				Role:      "assistant",
-				ToolCalls: toolCalls,
-			}
-			if len(textParts) > 0 {
-				msg.Content = strings.Join(textParts, "\n")
-			}
+		if m.Role == "assistant" && (len(toolCalls) > 0 || len(parts) > 0 || len(thinking) > 0) {
+			msg := provider.NewMessage("assistant", parts)
+			msg.ToolCalls = toolCalls
+			msg.ThinkingBlocks = thinking
+			msg.ReasoningContent = strings.Join(reasoning, "\n")
 			messages = append(messages, msg)
-		} else if m.Role == "user" && len(textParts) > 0 {
-			// Remaining extracted text
-			messages = append(messages, provider.Message{
-				Role:    "user",
-				Content: strings.Join(textParts, "\n"),
-			})
-		} else if m.Role == "assistant" && len(textParts) > 0 && len(toolCalls) == 0 {
-			// Assistant text only
-			messages = append(messages, provider.Message{
-				Role:    "assistant",
-				Content: strings.Join(textParts, "\n"),
-			})
+		} else if m.Role == "user" && len(parts) > 0 {
+			// Remaining extracted content
+			messages = append(messages, provider.NewMessage("user", parts))
 		}
 	}
 
@@ -881,6 +1561,18 @@ func AnthropicMessagesHandler(c *gin.Context) {
 		Model:    anthroReq.Model,
 		Messages: messages,
 		Stream:   anthroReq.Stream,
+
+		Temperature: anthroReq.Temperature,
+		TopP:        anthroReq.TopP,
+		TopK:        anthroReq.TopK,
+		Stop:        anthroReq.StopSequences,
+		Thinking:    anthroReq.Thinking,
+	}
+	if anthroReq.MaxTokens > 0 {
+		internalReq.MaxTokens = &anthroReq.MaxTokens
+	}
+	if anthroReq.Metadata != nil {
+		internalReq.User = anthroReq.Metadata.UserID
 	}
 
 	// 1.5 Map Tools
@@ -898,205 +1590,98 @@ func AnthropicMessagesHandler(c *gin.Context) {
 				},
 			})
 		}
+		internalReq.ToolChoice = anthroReq.ToolChoice.ToOpenAI()
 	}
 
-	// 2. Find Service (Already done above)
-	// matchedService is available from the Fast Path check
-
-	log.Printf("[Debug] Routing to Service: %s, Type: %s, URL: %s", matchedService.Name, matchedService.Type, matchedService.BaseURL)
+	return internalReq, nil
+}
 
-	if matchedService.ModelName != "" {
-		internalReq.Model = matchedService.ModelName
+// anthropicStopReason maps an OpenAI finish_reason to the Anthropic stop_reason
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "length":
+		return "max_tokens"
+	case "content_filter":
+		return "refusal"
 	}
+	return "end_turn"
+}
 
-	var p provider.Provider
-	switch matchedService.Type {
-	case ServiceTypeGemini:
-		p = gemini.NewGeminiProvider(matchedService.BaseURL)
-	case ServiceTypeAnthropic:
-		log.Printf("[Debug] Using Anthropic Provider")
-		p = anthropic.NewAnthropicProvider(matchedService.BaseURL)
-	default:
-		log.Printf("[Debug] Using OpenAI Provider (Default)")
-		p = openai.NewOpenAIProvider(matchedService.BaseURL)
+// anthropicResponse converts a chat completion to an Anthropic message: thinking blocks first,
+// then the text and the tool calls, as Anthropic returns them
+func anthropicResponse(resp *provider.ChatCompletionResponse, model string) anthropic.AnthropicResponse {
+	var blocks []anthropic.AnthropicContent
+	stopReason := anthropicStopReason("")
+	if len(resp.Choices) > 0 {
+		choice := resp.Choices[0]
+		blocks = anthropicThinkingContent(choice.Message)
+		if choice.Message.Content != "" {
+			blocks = append(blocks, anthropic.AnthropicContent{Type: "text", Text: choice.Message.Content})
+		}
+		for _, tc := range choice.Message.ToolCalls {
+			blocks = append(blocks, anthropic.AnthropicContent{Type: "tool_use", ID: tc.ID, Name: tc.Function.Name, Input: json.RawMessage(tc.Function.Arguments)})
+		}
+		stopReason = anthropicStopReason(choice.FinishReason)
 	}
-
-	// 3. Handle Streaming
-	if internalReq.Stream {
-		c.Header("Content-Type", "text/event-stream")
-		c.Header("Cache-Control", "no-cache")
-		c.Header("Connection", "keep-alive")
-		c.Header("Transfer-Encoding", "chunked")
-
-		outputChan := make(chan provider.StreamResponse)
-		errChan := make(chan error)
-
-		go func() {
-			defer close(outputChan)
-			defer close(errChan)
-			if err := p.StreamChatCompletion(c.Request.Context(), internalReq, selectedAPIKey, outputChan); err != nil {
-				errChan <- err
-			}
-		}()
-
-		// Send 'message_start' event
-		msgID := "msg_" + uuid.New().String()
-		// We format data manually for Anthropic SSE to ensure exact compliance if gin.SSEvent behaves weirdly with event names
-		// But here we use standard gin SSEvent (Event, Data)
-
-		c.Writer.WriteString("event: message_start\n")
-		c.Writer.WriteString("data: " + toJSON(gin.H{
-			"type": "message_start",
-			"message": gin.H{
-				"id": msgID, "type": "message", "role": "assistant", "model": anthroReq.Model,
-				"usage":   gin.H{"input_tokens": 0, "output_tokens": 0},
-				"content": []interface{}{},
-			},
-		}) + "\n\n")
-		c.Writer.Flush()
-
-		// Keep track of current block index
-		blockIndex := 0
-		inToolUse := false
-
-		// Initial text block
-		c.Writer.WriteString("event: content_block_start\n")
-		c.Writer.WriteString("data: " + toJSON(gin.H{"type": "content_block_start", "index": blockIndex, "content_block": gin.H{"type": "text", "text": ""}}) + "\n\n")
-		c.Writer.Flush()
-
-		c.Stream(func(w io.Writer) bool {
-			select {
-			case chunk, ok := <-outputChan:
-				if !ok {
-					c.Writer.WriteString("event: content_block_stop\n")
-					c.Writer.WriteString("data: " + toJSON(gin.H{"type": "content_block_stop", "index": blockIndex}) + "\n\n")
-
-					c.Writer.WriteString("event: message_delta\n")
-					c.Writer.WriteString("data: " + toJSON(gin.H{"type": "message_delta", "delta": gin.H{"stop_reason": "end_turn", "stop_sequence": nil}, "usage": gin.H{"output_tokens": 0}}) + "\n\n")
-
-					c.Writer.WriteString("event: message_stop\n")
-					c.Writer.WriteString("data: " + toJSON(gin.H{"type": "message_stop"}) + "\n\n")
-					return false
-				}
-
-				if len(chunk.Choices) > 0 {
-					delta := chunk.Choices[0].Delta
-
-					// Case A: Text Content
-					if delta.Content != "" {
-						if inToolUse {
-							// Close previous tool block if we switch back to text (rare in streaming but possible)
-							c.Writer.WriteString("event: content_block_stop\n")
-							c.Writer.WriteString("data: " + toJSON(gin.H{"type": "content_block_stop", "index": blockIndex}) + "\n\n")
-							blockIndex++
-							inToolUse = false
-
-							// Start new text block
-							c.Writer.WriteString("event: content_block_start\n")
-							c.Writer.WriteString("data: " + toJSON(gin.H{"type": "content_block_start", "index": blockIndex, "content_block": gin.H{"type": "text", "text": ""}}) + "\n\n")
-							c.Writer.Flush()
-						}
-
-						c.Writer.WriteString("event: content_block_delta\n")
-						c.Writer.WriteString("data: " + toJSON(gin.H{
-							"type":  "content_block_delta",
-							"index": blockIndex,
-							"delta": gin.H{"type": "text_delta", "text": delta.Content},
-						}) + "\n\n")
-						c.Writer.Flush()
-					}
-
-					// Case B: Tool Calls
-					if len(delta.ToolCalls) > 0 {
-						log.Printf("[DEBUG] Rx ToolCall: %+v", delta.ToolCalls[0])
-						if !inToolUse || delta.ToolCalls[0].ID != "" {
-							if !inToolUse && blockIndex == 0 {
-								// Close the initial empty text block if we go straight to tools
-								// (Optional optimization: some clients might expect at least one text block)
-								c.Writer.WriteString("event: content_block_stop\n")
-								c.Writer.WriteString("data: " + toJSON(gin.H{"type": "content_block_stop", "index": blockIndex}) + "\n\n")
-								blockIndex++
-							} else if inToolUse && delta.ToolCalls[0].ID != "" {
-								// Close previous tool block
-								c.Writer.WriteString("event: content_block_stop\n")
-								c.Writer.WriteString("data: " + toJSON(gin.H{"type": "content_block_stop", "index": blockIndex}) + "\n\n")
-								blockIndex++
-							}
-
-							inToolUse = true
-							// Start Tool Block
-							toolCall := delta.ToolCalls[0]
-							c.Writer.WriteString("event: content_block_start\n")
-							c.Writer.WriteString("data: " + toJSON(gin.H{
-								"type":  "content_block_start",
-								"index": blockIndex,
-								"content_block": gin.H{
-									"type":  "tool_use",
-									"id":    toolCall.ID,
-									"name":  toolCall.Function.Name,
-									"input": gin.H{}, // Start empty, fill via delta
-								},
-							}) + "\n\n")
-							c.Writer.Flush()
-						}
-
-						if delta.ToolCalls[0].Function.Arguments != "" {
-							c.Writer.WriteString("event: content_block_delta\n")
-							c.Writer.WriteString("data: " + toJSON(gin.H{
-								"type":  "content_block_delta",
-								"index": blockIndex,
-								"delta": gin.H{"type": "input_json_delta", "partial_json": delta.ToolCalls[0].Function.Arguments},
-							}) + "\n\n")
-							c.Writer.Flush()
-						}
-					}
-				}
-				return true
-			case err, ok := <-errChan:
-				if !ok {
-					errChan = nil
-					return true // Continue stream
-				}
-				log.Printf("[ERROR] Stream Error: %v", err)
-				return false
-			case <-c.Request.Context().Done():
-				return false
-			}
-		})
-		return
+	if len(blocks) == 0 {
+		// Some clients expect at least one content block
+		blocks = append(blocks, anthropic.AnthropicContent{Type: "text"})
+	}
+	return anthropic.AnthropicResponse{
+		ID:         resp.ID,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      model,
+		Content:    blocks,
+		StopReason: &stopReason,
+		Usage:      anthropic.NewUsage(resp.Usage),
 	}
+}
 
-	// 4. Handle Non-Streaming
-	resp, err := p.ChatCompletion(c.Request.Context(), internalReq, selectedAPIKey)
-	if err != nil {
-		c.JSON(500, gin.H{"error": gin.H{"type": "api_error", "message": err.Error()}})
-		return
+// anthropicThinkingContent returns the thinking blocks of a response message. Reasoning the blocks
+// do not hold (OpenAI-compatible upstreams, Gemini thoughts) becomes an unsigned thinking block.
+func anthropicThinkingContent(msg provider.Message) []anthropic.AnthropicContent {
+	var blocks []anthropic.AnthropicContent
+	withText := false
+	for _, tb := range msg.ThinkingBlocks {
+		blocks = append(blocks, anthropic.AnthropicContent{Type: tb.Type, Thinking: tb.Thinking, Signature: tb.Signature, Data: tb.Data})
+		withText = withText || tb.Thinking != ""
 	}
+	if !withText && msg.ReasoningContent != "" {
+		blocks = append([]anthropic.AnthropicContent{{Type: provider.ThinkingTypeThinking, Thinking: msg.ReasoningContent}}, blocks...)
+	}
+	return blocks
+}
 
-	// Convert Response -> Anthropic
-	content := ""
-	if len(resp.Choices) > 0 {
-		content = resp.Choices[0].Message.Content
-	}
-	anthroResp := anthropic.AnthropicResponse{
-		ID:      resp.ID,
-		Type:    "message",
-		Role:    "assistant",
-		Content: []anthropic.AnthropicContent{{Type: "text", Text: content}},
-	}
-
-	c.JSON(200, anthroResp)
-	success = true
-	// Anthropic non-stream response usually has usage
-	// But `ChatCompletionsHandler` calls `p.ChatCompletion` which returns `ChatCompletionResponse`.
-	// For `AnthropicMessagesHandler`, we logic is slightly different (Wait, existing code calls internal helper? No, it proxies or adapts).
-	// ...
-	// Wait, the slow path for Anthropic calls `p.StreamChatCompletion` or what?
-	// It calls `handleReverseProxy` mostly.
-	// But for "Slow Path"? `AnthropicMessagesHandler` doesn't implement Slow Path adapter yet?
-	// Step 1119 lines 572+ show `[SLOW PATH] Adapter`.
-	// But I don't see `p.ChatCompletion` call there?
-	// Ah, I need to check how slow path is implemented.
+// anthropicMediaPart converts an image or document block. Sources may be base64, url or,
+// for documents, plain text; uploaded files (Files API) cannot be forwarded.
+func anthropicMediaPart(block map[string]interface{}) (provider.ContentPart, error) {
+	bType, _ := block["type"].(string)
+	part := provider.ContentPart{Type: provider.PartImage}
+	if bType == "document" {
+		part.Type = provider.PartDocument
+		part.Filename, _ = block["title"].(string)
+	}
+	source, _ := block["source"].(map[string]interface{})
+	sType, _ := source["type"].(string)
+	switch sType {
+	case "base64":
+		part.MIMEType, _ = source["media_type"].(string)
+		part.Data, _ = source["data"].(string)
+	case "url":
+		part.URL, _ = source["url"].(string)
+	case "text":
+		if bType == "document" {
+			text, _ := source["data"].(string)
+			return provider.ContentPart{Type: provider.PartText, Text: text}, nil
+		}
+	}
+	if part.Data == "" && part.URL == "" {
+		return part, fmt.Errorf("unsupported %s source %q", bType, sType)
+	}
+	return part, nil
 }
 
 func toJSON(v interface{}) string {
@@ -1106,19 +1691,46 @@ func toJSON(v interface{}) string {
 func RegisterRoutes(r *gin.Engine) {
 	// Initialize Database and Migrate Config
 	db.Init("qiservice.db")
+	InitAPIKeyHashing()
 	db.MigrateConfig()
-
+	db.MigrateAPIKeys()
+	db.MigrateBillingCurrency()
+	db.MigrateServiceGrants()
+
+	InitTokenKeys()
+	InitRevocations()
+	if err := secret.Init(); err != nil {
+		log.Fatalf("❌ Failed to load master key: %v", err)
+	}
+	sealed := SealServiceKeys()
+	health.Init()
+	wallet.Init()
+	rbac.Load()
+	quota.Start()
 	LoadConfig()
+	if _, err := os.Stat(configFile); sealed && err == nil {
+		SaveConfig() // The JSON backup still holds the plaintext keys
+	}
 	stats.Init("stats")
+	payload.Start()
+	tracing.Init()
+	StartHealthProber()
 
-	// Protected API routes
+	// Protected API routes. Listing models is not a model call: it does not use up RPM limits.
 	v1 := r.Group("/v1")
 	v1.Use(AuthMiddleware())
 	{
-		v1.POST("/chat/completions", ChatCompletionsHandler)
 		v1.GET("/models", ModelsHandler)
-		v1.POST("/messages", AnthropicMessagesHandler)
 	}
+	// Model calls, traced and counted in /metrics even when auth or rate limits reject them
+	calls := r.Group("/v1")
+	calls.Use(TracingMiddleware(), MetricsMiddleware(), AuthMiddleware(), RateLimitMiddleware())
+	{
+		calls.POST("/chat/completions", ChatCompletionsHandler)
+		calls.POST("/messages", AnthropicMessagesHandler)
+	}
+	metrics.Registry.MustRegister(upstreamCollector{})
+	r.GET("/metrics", MetricsHandler)
 
 	// Public / specific API routes that bypass Admin Auth
 	r.POST("/api/event_logging/batch", TelemetrySinkHandler)
@@ -1133,31 +1745,65 @@ func RegisterRoutes(r *gin.Engine) {
 	apiGroup.Use(AuthMiddleware()) // require JWT (or valid Key for some paths)
 	{
 		// Common (User/Admin)
-		apiGroup.GET("/config", GetConfigHandler)           // Filter sensitive data? TODO
-		apiGroup.GET("/my_keys", ListMyKeysHandler)         // [NEW] User gets their own keys
-		apiGroup.POST("/my_keys", GenerateMyKeyHandler)     // [NEW] User generates key
-		apiGroup.DELETE("/my_keys/:id", DeleteMyKeyHandler) // [NEW] Delete key
-		apiGroup.GET("/user/me", GetMyProfileHandler)       // [NEW] Get profile (quota)
-		apiGroup.GET("/stats", GetStatsHandler)             // [MOVED] Authenticated Users (Scoped)
-
-		// Admin Only
-		admin := apiGroup.Group("/")
-		admin.Use(RoleMiddleware(db.RoleAdmin, db.RoleSuperAdmin))
-		{
-			admin.GET("/users", ListUsersHandler)
-			admin.POST("/users", CreateUserHandler) // Admin Create User
-			admin.DELETE("/users/:id", DeleteUserHandler)
-			admin.POST("/user_update", UpdateUserHandler) // Update Quota/Pwd
-			admin.POST("/user_keys", GenerateAPIKeyHandler)
-			admin.POST("/services", UpdateServicesHandler)
-			admin.POST("/keys", UpdateKeysHandler)
-		}
-
-		// Super Admin Only
-		super := apiGroup.Group("/")
-		super.Use(RoleMiddleware(db.RoleSuperAdmin))
+		apiGroup.GET("/config", GetConfigHandler)              // Filter sensitive data? TODO
+		apiGroup.GET("/my_keys", ListMyKeysHandler)            // [NEW] User gets their own keys
+		apiGroup.POST("/my_keys", GenerateMyKeyHandler)        // [NEW] User generates key
+		apiGroup.DELETE("/my_keys/:id", DeleteMyKeyHandler)    // [NEW] Delete key
+		apiGroup.PUT("/my_keys/:id", UpdateMyKeyHandler)       // Rename / set limits
+		apiGroup.GET("/user/me", GetMyProfileHandler)          // [NEW] Get profile (quota, plan period)
+		apiGroup.POST("/user/password", ChangePasswordHandler) // Change own password
+		apiGroup.POST("/logout", LogoutHandler)                // Revoke the current token
+		apiGroup.GET("/user/ledger", MyLedgerHandler)          // Own wallet transactions
+
+		// Login sessions only: API keys just call models and manage their own account
+		session := apiGroup.Group("/")
+		session.Use(SessionOnly())
 		{
-			super.POST("/user_role", UpdateUserRoleHandler)
+			session.GET("/stats", GetStatsHandler)                // Scoped by stats.global and ?org_id=
+			session.GET("/services/health", ServiceHealthHandler) // Probe results (dashboard)
+
+			// Organizations: access is checked against the caller's role in the organization
+			session.GET("/orgs", ListOrgsHandler)
+			session.GET("/orgs/:id/members", ListOrgMembersHandler)
+			session.POST("/orgs/:id/members", SaveOrgMemberHandler)
+			session.DELETE("/orgs/:id/members/:user_id", RemoveOrgMemberHandler)
+			session.GET("/orgs/:id/keys", ListOrgKeysHandler)
+			session.POST("/orgs/:id/keys", CreateOrgKeyHandler)
+			session.PUT("/orgs/:id/keys/:key_id", UpdateOrgKeyHandler)
+			session.DELETE("/orgs/:id/keys/:key_id", DeleteOrgKeyHandler)
+			session.GET("/orgs/:id/ledger", OrgLedgerHandler)
+
+			// Management: every route names the permissions that unlock it
+			session.GET("/users", RequirePermission(rbac.UsersRead), ListUsersHandler)
+			session.POST("/users", RequirePermission(rbac.UsersWrite), CreateUserHandler)
+			session.DELETE("/users/:id", RequirePermission(rbac.UsersWrite), DeleteUserHandler)
+			session.POST("/user_update", RequirePermission(rbac.UsersWrite), UpdateUserHandler)
+			session.POST("/user_role", RequirePermission(rbac.RolesAssign), UpdateUserRoleHandler)
+			session.POST("/user_keys", RequirePermission(rbac.KeysManageOthers), GenerateAPIKeyHandler)
+			session.GET("/roles", RequirePermission(rbac.UsersRead, rbac.RolesManage), ListRolesHandler)
+			session.POST("/roles", RequirePermission(rbac.RolesManage), SaveRoleHandler)
+			session.DELETE("/roles/:name", RequirePermission(rbac.RolesManage), DeleteRoleHandler)
+			session.POST("/services", RequirePermission(rbac.ServicesWrite), UpdateServicesHandler)
+			session.GET("/services/key_health", RequirePermission(rbac.ServicesWrite), ListKeyHealthHandler)
+			session.POST("/services/key_health/reset", RequirePermission(rbac.ServicesWrite), ResetKeyHealthHandler)
+			session.POST("/wallet/topup", RequirePermission(rbac.UsersWrite, rbac.OrgsManage), TopUpHandler)
+			session.GET("/wallet/ledger", RequirePermission(rbac.WalletRead), ListLedgerHandler)
+			session.GET("/plans", RequirePermission(rbac.PlansWrite, rbac.UsersRead), ListPlansHandler)
+			session.POST("/plans", RequirePermission(rbac.PlansWrite), SavePlanHandler)
+			session.DELETE("/plans/:id", RequirePermission(rbac.PlansWrite), DeletePlanHandler)
+			session.GET("/groups", RequirePermission(rbac.GroupsWrite, rbac.UsersRead), ListGroupsHandler)
+			session.POST("/groups", RequirePermission(rbac.GroupsWrite), SaveGroupHandler)
+			session.DELETE("/groups/:id", RequirePermission(rbac.GroupsWrite), DeleteGroupHandler)
+			session.POST("/orgs", RequirePermission(rbac.OrgsManage), SaveOrgHandler)
+			session.DELETE("/orgs/:id", RequirePermission(rbac.OrgsManage), DeleteOrgHandler)
+			session.POST("/auth/rotate_key", RequirePermission(rbac.AuthRotateKey), RotateJWTKeyHandler)
+			session.GET("/audit", RequirePermission(rbac.AuditRead), ListAuditHandler)
+			session.GET("/audit/verify", RequirePermission(rbac.AuditRead), VerifyAuditHandler)
+			session.GET("/payloads", RequirePermission(rbac.PayloadsRead), ListPayloadsHandler)
+			session.GET("/payloads/:id", RequirePermission(rbac.PayloadsRead), GetPayloadHandler)
+			session.GET("/redaction_rules", RequirePermission(rbac.ServicesWrite, rbac.PayloadsRead), ListRedactionRulesHandler)
+			session.POST("/redaction_rules", RequirePermission(rbac.ServicesWrite), SaveRedactionRuleHandler)
+			session.DELETE("/redaction_rules/:id", RequirePermission(rbac.ServicesWrite), DeleteRedactionRuleHandler)
 		}
 	}
 
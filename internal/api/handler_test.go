@@ -0,0 +1,104 @@
+package api
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+const anthropicStream = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"usage":{"input_tokens":100,"cache_creation_input_tokens":10,"cache_read_input_tokens":50,"output_tokens":1}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"output_tokens are counted"}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":100,"cache_creation_input_tokens":10,"cache_read_input_tokens":50,"output_tokens":30}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+// Older API versions only report the output in message_delta
+const anthropicStreamLegacy = `event: message_start
+data: {"type":"message_start","message":{"usage":{"input_tokens":100,"cache_read_input_tokens":50,"output_tokens":1}}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":30}}
+
+`
+
+const openAIStream = `data: {"id":"x","choices":[{"index":0,"delta":{"content":"Hi"}}]}
+
+data: {"id":"x","choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}
+
+data: {"id":"x","choices":[],"usage":{"prompt_tokens":120,"completion_tokens":30,"total_tokens":150,"prompt_tokens_details":{"cached_tokens":64},"completion_tokens_details":{"reasoning_tokens":10}}}
+
+data: [DONE]
+
+`
+
+const openAIBody = `{"id":"x","choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`
+
+const anthropicBody = `{"id":"msg_1","type":"message","content":[{"type":"text","text":"Hi"}],"usage":{"input_tokens":20,"cache_read_input_tokens":5,"output_tokens":7}}`
+
+// chunkReader returns at most n bytes per Read, splitting lines across reads
+type chunkReader struct {
+	s string
+	n int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.s == "" {
+		return 0, io.EOF
+	}
+	k := min(r.n, len(p), len(r.s))
+	copy(p, r.s[:k])
+	r.s = r.s[k:]
+	return k, nil
+}
+
+func TestUsageSnooper(t *testing.T) {
+	tests := []struct {
+		name               string
+		protocol, body     string
+		in, cached, output int
+	}{
+		{"anthropic stream", "anthropic", anthropicStream, 160, 50, 30},
+		{"anthropic stream, output only in message_delta", "anthropic", anthropicStreamLegacy, 150, 50, 30},
+		{"anthropic body", "anthropic", anthropicBody, 25, 5, 7},
+		{"openai stream", "openai", openAIStream, 120, 64, 30},
+		{"openai body", "openai", openAIBody, 12, 0, 3},
+	}
+	for _, tt := range tests {
+		for _, size := range []int{1, 7, 64, 1 << 16} {
+			var in, out, cached int
+			s := &UsageSnooper{
+				ReadCloser: io.NopCloser(&chunkReader{s: tt.body, n: size}),
+				protocol:   tt.protocol,
+				tokensIn:   &in, tokensOut: &out, tokensCached: &cached,
+			}
+			relayed, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(relayed) != tt.body {
+				t.Errorf("%s/%d: body changed", tt.name, size)
+			}
+			if in != tt.in || cached != tt.cached || out != tt.output {
+				t.Errorf("%s/%d: in=%d cached=%d out=%d, want %d/%d/%d", tt.name, size, in, cached, out, tt.in, tt.cached, tt.output)
+			}
+		}
+	}
+}
+
+func TestUsageSnooperIgnoresText(t *testing.T) {
+	var in, out, cached int
+	body := strings.Repeat(`data: {"choices":[{"delta":{"content":"no usage here, only tokens"}}]}`+"\n\n", 3)
+	s := &UsageSnooper{ReadCloser: io.NopCloser(strings.NewReader(body)), protocol: "openai", tokensIn: &in, tokensOut: &out, tokensCached: &cached}
+	io.ReadAll(s)
+	if in != 0 || out != 0 || cached != 0 {
+		t.Errorf("in=%d out=%d cached=%d, want zeros", in, out, cached)
+	}
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"crypto/subtle"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"qiservice/internal/health"
+	"qiservice/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsToken guards /metrics, set by QISERVICE_METRICS_TOKEN; empty disables the endpoint
+var metricsToken = os.Getenv("QISERVICE_METRICS_TOKEN")
+
+// MetricsHandler - GET /metrics
+// Prometheus scrape endpoint, authenticated with the scrape token (Authorization: Bearer <token>).
+func MetricsHandler(c *gin.Context) {
+	if metricsToken == "" {
+		c.JSON(404, gin.H{"error": "Metrics are disabled, set QISERVICE_METRICS_TOKEN to enable them"})
+		return
+	}
+	given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(metricsToken)) != 1 {
+		c.JSON(401, gin.H{"error": "Invalid scrape token"})
+		return
+	}
+	metrics.Handler().ServeHTTP(c.Writer, c.Request)
+}
+
+// firstWriteRecorder notes when the first byte of the body went out
+type firstWriteRecorder struct {
+	gin.ResponseWriter
+	first time.Time
+}
+
+func (r *firstWriteRecorder) Write(b []byte) (int, error) {
+	r.mark()
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *firstWriteRecorder) WriteString(s string) (int, error) {
+	r.mark()
+	return r.ResponseWriter.WriteString(s)
+}
+
+func (r *firstWriteRecorder) mark() {
+	if r.first.IsZero() {
+		r.first = time.Now()
+	}
+}
+
+// MetricsMiddleware counts model requests, including those rejected by the auth and rate
+// limit middlewares that follow it. Handlers fill in the observation (see observe).
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		metrics.InFlight.Inc()
+		defer metrics.InFlight.Dec()
+
+		obs := &metrics.Observation{}
+		c.Set("metrics", obs)
+		rec := &firstWriteRecorder{ResponseWriter: c.Writer}
+		c.Writer = rec
+
+		c.Next()
+
+		route := obs.Route
+		if obs.Service == "" {
+			route = metrics.RouteNone
+		}
+		user := c.GetString("username")
+		metrics.Requests.WithLabelValues(obs.Service, route, strconv.Itoa(rec.Status()), user).Inc()
+		if obs.Service == "" {
+			return
+		}
+		metrics.Duration.WithLabelValues(obs.Service, route).Observe(time.Since(start).Seconds())
+		if !rec.first.IsZero() && strings.HasPrefix(rec.Header().Get("Content-Type"), "text/event-stream") {
+			metrics.TimeToFirstToken.WithLabelValues(obs.Service, route).Observe(rec.first.Sub(start).Seconds())
+		}
+		for typ, n := range map[string]int{"input": obs.TokensIn, "output": obs.TokensOut, "cached": obs.TokensCached} {
+			if n > 0 {
+				metrics.Tokens.WithLabelValues(obs.Service, user, typ).Add(float64(n))
+			}
+		}
+	}
+}
+
+// observe returns the observation of the request, a throwaway one outside MetricsMiddleware
+func observe(c *gin.Context) *metrics.Observation {
+	if v, ok := c.Get("metrics"); ok {
+		return v.(*metrics.Observation)
+	}
+	return &metrics.Observation{}
+}
+
+// upstreamCollector reports the live state of the configured services at scrape time
+type upstreamCollector struct{}
+
+var (
+	descServiceInFlight = prometheus.NewDesc("qiservice_upstream_in_flight",
+		"Requests currently routed to a service.", []string{"service", "service_id"}, nil)
+	descServiceUp = prometheus.NewDesc("qiservice_upstream_available",
+		"1 when the circuit of a service is closed (it receives traffic).", []string{"service", "service_id"}, nil)
+	descKeyUp = prometheus.NewDesc("qiservice_upstream_key_available",
+		"1 when a pooled upstream key may receive traffic.", []string{"service", "service_id", "key"}, nil)
+	descKeyState = prometheus.NewDesc("qiservice_upstream_key_state",
+		"Health state of a pooled upstream key, 1 for the current state.", []string{"service", "service_id", "key", "state"}, nil)
+)
+
+var keyStates = []string{health.KeyActive, health.KeyCooldown, health.KeyCircuitOpen, health.KeyDisabled}
+
+func (upstreamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descServiceInFlight
+	ch <- descServiceUp
+	ch <- descKeyUp
+	ch <- descKeyState
+}
+
+func (upstreamCollector) Collect(ch chan<- prometheus.Metric) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	bool01 := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	for i := range config.Services {
+		s := &config.Services[i]
+		ch <- prometheus.MustNewConstMetric(descServiceInFlight, prometheus.GaugeValue, float64(atomic.LoadInt64(&s.inFlight)), s.Name, s.ID)
+		ch <- prometheus.MustNewConstMetric(descServiceUp, prometheus.GaugeValue, bool01(!health.Services.Degraded(s.ID)), s.Name, s.ID)
+
+		seen := make(map[string]bool)
+		for _, k := range s.keyPool() {
+			fp := keyFingerprint(k)
+			if seen[fp] {
+				continue
+			}
+			seen[fp] = true
+			ch <- prometheus.MustNewConstMetric(descKeyUp, prometheus.GaugeValue, bool01(health.Keys.Available(fp)), s.Name, s.ID, fp)
+			status := health.Keys.State(fp).Status
+			for _, st := range keyStates {
+				ch <- prometheus.MustNewConstMetric(descKeyState, prometheus.GaugeValue, bool01(st == status), s.Name, s.ID, fp, st)
+			}
+		}
+	}
+}
@@ -1,82 +1,187 @@
 package api
 
 import (
+	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 
 	"qiservice/internal/auth"
 	"qiservice/internal/db"
+	"qiservice/internal/quota"
+	"qiservice/internal/ratelimit"
+	"qiservice/internal/rbac"
 
 	"github.com/gin-gonic/gin"
 )
 
+// passwordChangeAllowedPaths are reachable with a token that still has to change its password
+var passwordChangeAllowedPaths = map[string]bool{
+	"/api/user/password": true,
+	"/api/user/me":       true,
+}
+
 // AuthMiddleware - Parses JWT Token or API Key
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 1. Try JWT (Authorization: Bearer <token>)
-		authHeader := c.GetHeader("Authorization")
-		if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
-			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-			claims, err := auth.ParseToken(tokenString)
-			if err == nil {
-				// Valid JWT
-				c.Set("userID", claims.UserID)
-				c.Set("username", claims.Username)
-				c.Set("role", claims.Role)
-				c.Next()
+		traceStep(c, "auth", func() { authenticate(c) })
+		if !c.IsAborted() {
+			c.Next()
+		}
+	}
+}
+
+// authenticate identifies the caller by JWT or API key, checking the quota of key callers
+// and of sessions calling models, and aborts the request when neither is valid
+func authenticate(c *gin.Context) {
+	// 1. Try JWT (Authorization: Bearer <token>)
+	authHeader := c.GetHeader("Authorization")
+	if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		claims, err := auth.ParseToken(tokenString)
+		if err == nil {
+			if isTokenRevoked(claims) {
+				c.AbortWithStatusJSON(401, gin.H{"error": "Token has been revoked"})
+				return
+			}
+			// Until the default password is changed, the token only unlocks the change itself
+			if claims.MustChangePassword && !passwordChangeAllowedPaths[c.Request.URL.Path] {
+				c.AbortWithStatusJSON(403, gin.H{"error": "Password change required", "code": "password_change_required"})
 				return
 			}
+			// Valid JWT
+			c.Set("userID", claims.UserID)
+			c.Set("username", claims.Username)
+			c.Set("role", claims.Role)
+			c.Set("claims", claims)
+			// Model calls from a session (the playground) spend the same budget as key calls
+			if strings.HasPrefix(c.Request.URL.Path, "/v1/") {
+				var u db.User
+				if err := db.DB.First(&u, claims.UserID).Error; err != nil {
+					c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+					return
+				}
+				if !checkUserQuota(c, &u) {
+					return
+				}
+				c.Set("user", &u)
+			}
+			return
 		}
+	}
 
-		// 2. Try API Key (x-api-key or Bearer sk-...)
-		// Only for Service invocations, not for Admin API.
-		// If accessing /api/chat/completions, allow API Key.
-		// If accessing /api/users, STRICTLY require JWT.
+	// 2. Try API Key (x-api-key or Bearer sk-...)
+	// Routes that need a login session are guarded by SessionOnly.
 
-		if strings.HasPrefix(c.Request.URL.Path, "/api/users") ||
-			strings.HasPrefix(c.Request.URL.Path, "/api/services") ||
-			strings.HasPrefix(c.Request.URL.Path, "/api/stats") {
-			c.AbortWithStatusJSON(401, gin.H{"error": "Authentication required (JWT)"})
-			return
+	// Legacy API Key Logic for Chat/Completions
+	apiKey := c.GetHeader("x-api-key")
+	if apiKey == "" {
+		if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
+			apiKey = strings.TrimPrefix(authHeader, "Bearer ")
 		}
+	}
 
-		// Legacy API Key Logic for Chat/Completions
-		apiKey := c.GetHeader("x-api-key")
-		if apiKey == "" {
-			if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
-				apiKey = strings.TrimPrefix(authHeader, "Bearer ")
+	if apiKey != "" {
+		var keyRecord db.APIKey
+		if err := db.DB.Preload("User").Where("key_hash = ? AND is_active = ?", auth.HashAPIKey(apiKey), true).First(&keyRecord).Error; err == nil {
+			if keyRecord.OrgID != nil {
+				if !checkKeyScope(c, &keyRecord) {
+					return
+				}
+				// Organization keys act for the organization, whoever created them
+				var org db.Organization
+				if err := db.DB.First(&org, *keyRecord.OrgID).Error; err != nil {
+					c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+					return
+				}
+				if org.BillingMode != db.BillingWallet && org.Quota >= 0 && org.UsedAmount >= org.Quota {
+					c.AbortWithStatusJSON(403, gin.H{"error": "Organization quota exceeded"})
+					return
+				}
+				c.Set("userID", uint(0))
+				c.Set("username", "org:"+org.Name)
+				c.Set("role", db.RoleUser)
+				c.Set("orgID", org.ID)
+				c.Set("apiKey", &keyRecord)
+				return
 			}
-		}
-
-		if apiKey != "" {
-			var keyRecord db.APIKey
-			if err := db.DB.Preload("User").Where("key = ? AND is_active = ?", apiKey, true).First(&keyRecord).Error; err == nil {
-				if keyRecord.User.ID != 0 {
-					// Check Quota
-					u := keyRecord.User
-					// Quota < 0 means Unlimited. Quota >= 0 means Limited.
-					if u.Role != db.RoleSuperAdmin && u.Role != db.RoleAdmin && u.Quota >= 0 && u.UsedAmount >= u.Quota {
-						c.AbortWithStatusJSON(403, gin.H{"error": "Quota exceeded"})
-						return
-					}
-					c.Set("userID", u.ID)
-					c.Set("username", u.Username)
-					c.Set("role", u.Role) // API Key inherits User Role
-					c.Next()
+			if keyRecord.User.ID != 0 {
+				if !checkKeyScope(c, &keyRecord) {
 					return
 				}
+				u := keyRecord.User
+				if !checkUserQuota(c, &u) {
+					return
+				}
+				c.Set("userID", u.ID)
+				c.Set("username", u.Username)
+				c.Set("role", u.Role) // API Key inherits User Role
+				c.Set("user", &u)
+				c.Set("apiKey", &keyRecord)
+				return
 			}
 		}
+	}
+
+	c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+}
 
-		c.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+// checkUserQuota enforces the plan period or lifetime quota of a user.
+// It aborts the request and returns false when it is used up.
+func checkUserQuota(c *gin.Context, u *db.User) bool {
+	// Quota < 0 means Unlimited. Quota >= 0 means Limited.
+	// Wallet users are checked against their balance when the request is priced
+	if rbac.Has(u.Role, rbac.QuotaExempt) || u.BillingMode == db.BillingWallet {
+		return true
+	}
+	// A plan's period window replaces the lifetime quota
+	if period := quota.Current(u); period != nil {
+		if period.Exceeded() {
+			c.AbortWithStatusJSON(403, gin.H{"error": "Quota exceeded for this period", "next_reset": period.NextReset})
+			return false
+		}
+	} else if u.Quota >= 0 && u.UsedAmount >= u.Quota {
+		c.AbortWithStatusJSON(403, gin.H{"error": "Quota exceeded"})
+		return false
 	}
+	return true
 }
 
-// RoleMiddleware - Enforces Role Access
-func RoleMiddleware(allowedRoles ...string) gin.HandlerFunc {
+// checkKeyScope enforces the expiry, source networks and spend limit of a key.
+// It aborts the request and returns false when one of them rejects it.
+func checkKeyScope(c *gin.Context, key *db.APIKey) bool {
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		c.AbortWithStatusJSON(401, gin.H{"error": "API key expired"})
+		return false
+	}
+	if !keyAllowsIP(key, c.ClientIP()) {
+		c.AbortWithStatusJSON(403, gin.H{"error": "API key not allowed from this address"})
+		return false
+	}
+	if key.SpendLimit > 0 && key.UsedAmount >= key.SpendLimit {
+		c.AbortWithStatusJSON(403, gin.H{"error": "API key spend limit reached"})
+		return false
+	}
+	return true
+}
+
+// SessionOnly rejects API key callers: management and organization routes need a login (JWT)
+func SessionOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("apiKey"); ok {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Authentication required (JWT)"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequirePermission lets the request through when the caller's role grants any of the permissions
+func RequirePermission(permissions ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userRole := c.GetString("role")
-		for _, role := range allowedRoles {
-			if userRole == role {
+		for _, p := range permissions {
+			if can(c, p) {
 				c.Next()
 				return
 			}
@@ -84,3 +189,95 @@ func RoleMiddleware(allowedRoles ...string) gin.HandlerFunc {
 		c.AbortWithStatusJSON(403, gin.H{"error": "Forbidden: Insufficient Permissions"})
 	}
 }
+
+// can reports whether the caller's role grants the permission
+func can(c *gin.Context, permission string) bool {
+	return rbac.Has(c.GetString("role"), permission)
+}
+
+// RateLimitMiddleware enforces the RPM/TPM/concurrency limits of the calling user and,
+// for API key calls, of the key. Must run after AuthMiddleware; handlers report the
+// tokens they used through the "tokensUsed" context value.
+func RateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var subjects map[string]ratelimit.Limits
+		traceStep(c, "rate_limit", func() {
+			subjects = rateLimitSubjects(c)
+			if len(subjects) == 0 {
+				return
+			}
+			if rej := ratelimit.Global.Acquire(subjects); rej != nil {
+				abortRateLimited(c, rej)
+			}
+		})
+		if c.IsAborted() {
+			return
+		}
+		if len(subjects) == 0 {
+			c.Next()
+			return
+		}
+		defer ratelimit.Global.Release(subjects)
+
+		c.Next()
+		ratelimit.Global.ChargeTokens(subjects, c.GetInt("tokensUsed"))
+	}
+}
+
+// rateLimitSubjects collects the limits that apply to this request
+func rateLimitSubjects(c *gin.Context) map[string]ratelimit.Limits {
+	subjects := make(map[string]ratelimit.Limits)
+
+	var user *db.User
+	if v, ok := c.Get("user"); ok {
+		user = v.(*db.User)
+	} else if userID := c.GetUint("userID"); userID != 0 {
+		// JWT callers: limits are not in the token
+		var u db.User
+		if err := db.DB.Select("id", "rpm_limit", "tpm_limit", "max_concurrent").First(&u, userID).Error; err == nil {
+			user = &u
+		}
+	}
+	if user != nil {
+		if lim := (ratelimit.Limits{RPM: user.RPMLimit, TPM: user.TPMLimit, MaxConcurrent: user.MaxConcurrent}); lim != (ratelimit.Limits{}) {
+			subjects["user:"+strconv.Itoa(int(user.ID))] = lim
+		}
+	}
+
+	if v, ok := c.Get("apiKey"); ok {
+		k := v.(*db.APIKey)
+		if lim := (ratelimit.Limits{RPM: k.RPMLimit, TPM: k.TPMLimit, MaxConcurrent: k.MaxConcurrent}); lim != (ratelimit.Limits{}) {
+			subjects["key:"+strconv.Itoa(int(k.ID))] = lim
+		}
+	}
+	return subjects
+}
+
+// abortRateLimited answers 429 in the error format of the protocol being called
+func abortRateLimited(c *gin.Context, rej *ratelimit.Rejection) {
+	secs := int(math.Ceil(rej.RetryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(secs))
+	msg := fmt.Sprintf("Rate limit exceeded (%s), retry after %d seconds", rej.Limit, secs)
+
+	if strings.HasPrefix(c.Request.URL.Path, "/v1/messages") {
+		c.AbortWithStatusJSON(429, gin.H{
+			"type": "error",
+			"error": gin.H{
+				"type":    "rate_limit_error",
+				"message": msg,
+			},
+		})
+		return
+	}
+	c.AbortWithStatusJSON(429, gin.H{
+		"error": gin.H{
+			"message": msg,
+			"type":    "rate_limit_error",
+			"param":   nil,
+			"code":    "rate_limit_exceeded",
+		},
+	})
+}
@@ -0,0 +1,405 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+
+	"qiservice/internal/db"
+	"qiservice/internal/rbac"
+	"qiservice/internal/wallet"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// orgRoleRank orders organization roles, higher manages lower
+var orgRoleRank = map[string]int{db.OrgRoleMember: 1, db.OrgRoleAdmin: 2, db.OrgRoleOwner: 3}
+
+// orgRole returns the caller's role in an organization, "" when not a member.
+// Callers with orgs.manage act as owners of every organization.
+func orgRole(c *gin.Context, orgID uint) string {
+	if can(c, rbac.OrgsManage) {
+		return db.OrgRoleOwner
+	}
+	var m db.OrgMember
+	if err := db.DB.Where("org_id = ? AND user_id = ?", orgID, c.GetUint("userID")).First(&m).Error; err != nil {
+		return ""
+	}
+	return m.Role
+}
+
+// lastOwner reports whether the organization has a single owner left
+func lastOwner(orgID uint) bool {
+	var owners int64
+	db.DB.Model(&db.OrgMember{}).Where("org_id = ? AND role = ?", orgID, db.OrgRoleOwner).Count(&owners)
+	return owners <= 1
+}
+
+// orgFromParam loads the organization in :id and checks that the caller holds at least
+// the role need in it. It answers the error and returns false otherwise.
+func orgFromParam(c *gin.Context, need string) (*db.Organization, string, bool) {
+	var org db.Organization
+	if err := db.DB.First(&org, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Organization not found"})
+		return nil, "", false
+	}
+	role := orgRole(c, org.ID)
+	if orgRoleRank[role] < orgRoleRank[need] {
+		c.JSON(403, gin.H{"error": "Forbidden: Insufficient organization role"})
+		return nil, "", false
+	}
+	return &org, role, true
+}
+
+// orgResponse is an organization with the caller's role and its member count
+type orgResponse struct {
+	db.Organization
+	MyRole      string `json:"my_role"`
+	MemberCount int64  `json:"member_count"`
+}
+
+// ListOrgsHandler - GET /api/orgs
+// Callers with orgs.manage see every organization, other users the ones they belong to.
+func ListOrgsHandler(c *gin.Context) {
+	query := db.DB.Order("id")
+	if !can(c, rbac.OrgsManage) {
+		query = query.Where("id IN (?)", db.DB.Model(&db.OrgMember{}).Select("org_id").Where("user_id = ?", c.GetUint("userID")))
+	}
+	var orgs []db.Organization
+	if err := query.Find(&orgs).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch organizations"})
+		return
+	}
+	out := make([]orgResponse, len(orgs))
+	for i, o := range orgs {
+		out[i] = orgResponse{Organization: o, MyRole: orgRole(c, o.ID)}
+		db.DB.Model(&db.OrgMember{}).Where("org_id = ?", o.ID).Count(&out[i].MemberCount)
+	}
+	c.JSON(200, out)
+}
+
+type SaveOrgRequest struct {
+	ID          uint      `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	BillingMode string    `json:"billing_mode"`
+	Quota       *float64  `json:"quota"`    // < 0 = unlimited (default)
+	Services    *[]string `json:"services"` // Services its keys may call, none by default
+	OwnerID     uint      `json:"owner_id"` // First owner, on creation only
+}
+
+// SaveOrgHandler - POST /api/orgs (creates, or updates when id is set)
+// The budget is set by callers with orgs.manage; top-ups go through POST /api/wallet/topup.
+func SaveOrgHandler(c *gin.Context) {
+	var req SaveOrgRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" {
+		c.JSON(400, gin.H{"error": "Name is required"})
+		return
+	}
+	mode, ok := parseBillingMode(req.BillingMode)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Invalid billing_mode"})
+		return
+	}
+	org := db.Organization{ID: req.ID, Name: req.Name, Description: req.Description, BillingMode: mode, Quota: -1, Services: []string{}}
+	if req.Quota != nil {
+		org.Quota = *req.Quota
+	}
+	if req.Services != nil {
+		org.Services = *req.Services
+	}
+
+	var before interface{}
+	if req.ID == 0 {
+		err := db.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&org).Error; err != nil {
+				return err
+			}
+			if req.OwnerID == 0 {
+				return nil
+			}
+			if err := tx.First(&db.User{}, req.OwnerID).Error; err != nil {
+				return err
+			}
+			return tx.Create(&db.OrgMember{OrgID: org.ID, UserID: req.OwnerID, Role: db.OrgRoleOwner}).Error
+		})
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"error": "Owner not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create organization (name might exist)"})
+			return
+		}
+	} else {
+		var existing db.Organization
+		if err := db.DB.First(&existing, req.ID).Error; err != nil {
+			c.JSON(404, gin.H{"error": "Organization not found"})
+			return
+		}
+		before = orgSnapshot(&existing)
+		columns := []string{"name", "description"}
+		if req.BillingMode != "" {
+			columns = append(columns, "billing_mode")
+		}
+		if req.Quota != nil {
+			columns = append(columns, "quota")
+		}
+		if req.Services != nil {
+			columns = append(columns, "services")
+		}
+		if err := db.DB.Model(&existing).Select(columns).Updates(&org).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to update organization"})
+			return
+		}
+		db.DB.First(&org, org.ID)
+	}
+	recordAudit(c, auditOrgSave, "org", org.ID, org.Name, before, orgSnapshot(&org))
+	c.JSON(200, org)
+}
+
+// DeleteOrgHandler - DELETE /api/orgs/:id
+// Removes the members and deletes the organization's keys; its ledger is kept.
+func DeleteOrgHandler(c *gin.Context) {
+	var org db.Organization
+	if err := db.DB.First(&org, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Organization not found"})
+		return
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("org_id = ?", org.ID).Delete(&db.OrgMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("org_id = ?", org.ID).Delete(&db.APIKey{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&org).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete organization"})
+		return
+	}
+	recordAudit(c, auditOrgDelete, "org", org.ID, org.Name, orgSnapshot(&org), nil)
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+// orgMemberResponse is a member with their username
+type orgMemberResponse struct {
+	db.OrgMember
+	Username string `json:"username"`
+}
+
+// ListOrgMembersHandler - GET /api/orgs/:id/members
+func ListOrgMembersHandler(c *gin.Context) {
+	org, _, ok := orgFromParam(c, db.OrgRoleMember)
+	if !ok {
+		return
+	}
+	var members []db.OrgMember
+	if err := db.DB.Preload("User").Where("org_id = ?", org.ID).Order("created_at").Find(&members).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+	out := make([]orgMemberResponse, len(members))
+	for i, m := range members {
+		out[i] = orgMemberResponse{OrgMember: m, Username: m.User.Username}
+	}
+	c.JSON(200, out)
+}
+
+type SaveOrgMemberRequest struct {
+	Username string `json:"username" binding:"required"`
+	Role     string `json:"role"` // Default 'member'
+}
+
+// SaveOrgMemberHandler - POST /api/orgs/:id/members
+// Adds a member or changes their role. Org admins manage members and admins,
+// owners also manage owners.
+func SaveOrgMemberHandler(c *gin.Context) {
+	org, myRole, ok := orgFromParam(c, db.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+	var req SaveOrgMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Role == "" {
+		req.Role = db.OrgRoleMember
+	}
+	if orgRoleRank[req.Role] == 0 {
+		c.JSON(400, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	var user db.User
+	if err := db.DB.Where("username = ?", req.Username).First(&user).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	member := db.OrgMember{OrgID: org.ID, UserID: user.ID}
+	exists := db.DB.Where(&member).First(&member).Error == nil
+	if req.Role == db.OrgRoleOwner || (exists && member.Role == db.OrgRoleOwner) {
+		if myRole != db.OrgRoleOwner {
+			c.JSON(403, gin.H{"error": "Only owners can manage owners"})
+			return
+		}
+	}
+
+	if exists && member.Role == db.OrgRoleOwner && req.Role != db.OrgRoleOwner && lastOwner(org.ID) {
+		c.JSON(400, gin.H{"error": "An organization needs at least one owner"})
+		return
+	}
+
+	var before interface{}
+	if exists {
+		before = gin.H{"role": member.Role}
+	}
+	member.Role = req.Role
+	var err error
+	if exists {
+		err = db.DB.Model(&member).Update("role", req.Role).Error
+	} else {
+		err = db.DB.Create(&member).Error
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save member"})
+		return
+	}
+	recordAudit(c, auditOrgMemberSave, "org", org.ID, org.Name, before, gin.H{"user_id": user.ID, "role": member.Role})
+	c.JSON(200, orgMemberResponse{OrgMember: member, Username: user.Username})
+}
+
+// RemoveOrgMemberHandler - DELETE /api/orgs/:id/members/:user_id
+// Org admins remove members; every member may leave. Keys created by the member stay with the organization.
+func RemoveOrgMemberHandler(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid user_id"})
+		return
+	}
+	need := db.OrgRoleAdmin
+	if uint(userID) == c.GetUint("userID") {
+		need = db.OrgRoleMember
+	}
+	org, myRole, ok := orgFromParam(c, need)
+	if !ok {
+		return
+	}
+
+	var member db.OrgMember
+	if err := db.DB.Where("org_id = ? AND user_id = ?", org.ID, userID).First(&member).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Member not found"})
+		return
+	}
+	if member.Role == db.OrgRoleOwner && myRole != db.OrgRoleOwner {
+		c.JSON(403, gin.H{"error": "Only owners can manage owners"})
+		return
+	}
+	if member.Role == db.OrgRoleOwner && lastOwner(org.ID) {
+		c.JSON(400, gin.H{"error": "An organization needs at least one owner"})
+		return
+	}
+	if err := db.DB.Where("org_id = ? AND user_id = ?", org.ID, userID).Delete(&db.OrgMember{}).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to remove member"})
+		return
+	}
+	recordAudit(c, auditOrgMemberRemove, "org", org.ID, org.Name, gin.H{"user_id": member.UserID, "role": member.Role}, nil)
+	c.JSON(200, gin.H{"status": "removed"})
+}
+
+// ListOrgKeysHandler - GET /api/orgs/:id/keys
+func ListOrgKeysHandler(c *gin.Context) {
+	org, _, ok := orgFromParam(c, db.OrgRoleMember)
+	if !ok {
+		return
+	}
+	var keys []db.APIKey
+	if err := db.DB.Where("org_id = ?", org.ID).Find(&keys).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch keys"})
+		return
+	}
+	c.JSON(200, keys)
+}
+
+// CreateOrgKeyHandler - POST /api/orgs/:id/keys
+// Takes the same body as POST /api/my_keys; the key is billed to the organization.
+func CreateOrgKeyHandler(c *gin.Context) {
+	org, _, ok := orgFromParam(c, db.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+	createKey(c, c.GetUint("userID"), &org.ID)
+}
+
+// UpdateOrgKeyHandler - PUT /api/orgs/:id/keys/:key_id
+func UpdateOrgKeyHandler(c *gin.Context) {
+	org, _, ok := orgFromParam(c, db.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+	var key db.APIKey
+	if err := db.DB.Where("id = ? AND org_id = ?", c.Param("key_id"), org.ID).First(&key).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Key not found"})
+		return
+	}
+	updateKey(c, &key)
+}
+
+// DeleteOrgKeyHandler - DELETE /api/orgs/:id/keys/:key_id
+func DeleteOrgKeyHandler(c *gin.Context) {
+	org, _, ok := orgFromParam(c, db.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+	var key db.APIKey
+	if err := db.DB.Where("id = ? AND org_id = ?", c.Param("key_id"), org.ID).First(&key).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Key not found"})
+		return
+	}
+	if err := db.DB.Delete(&key).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete key"})
+		return
+	}
+	recordAudit(c, auditKeyDelete, "api_key", key.ID, key.KeyPrefix, keySnapshot(&key), nil)
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+// OrgLedgerHandler - GET /api/orgs/:id/ledger
+func OrgLedgerHandler(c *gin.Context) {
+	org, _, ok := orgFromParam(c, db.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+	var entries []db.WalletTransaction
+	if err := db.DB.Where("org_id = ?", org.ID).Order("id desc").Limit(ledgerLimit(c)).Find(&entries).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch ledger"})
+		return
+	}
+	c.JSON(200, entries)
+}
+
+// creditOrg tops up an organization wallet, see TopUpHandler
+func creditOrg(c *gin.Context, req *TopUpRequest) {
+	var org db.Organization
+	if err := db.DB.First(&org, req.OrgID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Organization not found"})
+		return
+	}
+	entry, err := wallet.CreditOrg(org.ID, req.Amount, c.GetUint("userID"), req.Note)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"error": "Organization not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to top up"})
+		return
+	}
+	recordAudit(c, auditWalletTopUp, "org", org.ID, org.Name, nil, entry)
+	c.JSON(200, entry)
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"qiservice/internal/db"
+	"qiservice/internal/payload"
+
+	"github.com/gin-gonic/gin"
+)
+
+// payloadRecorder keeps a copy of the response body, dropped once it outgrows
+// payload.MaxCaptureBytes: only a full body can be redacted
+type payloadRecorder struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *payloadRecorder) Write(b []byte) (int, error) {
+	r.keep(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *payloadRecorder) WriteString(s string) (int, error) {
+	r.keep([]byte(s))
+	return r.ResponseWriter.WriteString(s)
+}
+
+func (r *payloadRecorder) keep(b []byte) {
+	if r.overflow {
+		return
+	}
+	if r.body.Len()+len(b) > payload.MaxCaptureBytes {
+		r.overflow = true
+		r.body = bytes.Buffer{}
+		return
+	}
+	r.body.Write(b)
+}
+
+// payloadCapture is the payload of a request being recorded
+type payloadCapture struct {
+	rec     *payloadRecorder
+	request []byte
+	user    bool // The caller has payload logging on, whatever the service
+}
+
+// startPayloadCapture records the response when the caller or a service of the chain has
+// payload logging on. Returns nil when nothing needs to be captured.
+func startPayloadCapture(c *gin.Context, chain []*ServiceConfig, body []byte) *payloadCapture {
+	user := userLogsPayloads(c)
+	wanted := user
+	for _, s := range chain {
+		wanted = wanted || s.LogPayloads
+	}
+	if !wanted {
+		return nil
+	}
+	rec := &payloadRecorder{ResponseWriter: c.Writer}
+	c.Writer = rec
+	return &payloadCapture{rec: rec, request: body, user: user}
+}
+
+func userLogsPayloads(c *gin.Context) bool {
+	if v, ok := c.Get("user"); ok {
+		return v.(*db.User).LogPayloads
+	}
+	userID := c.GetUint("userID")
+	if userID == 0 {
+		return false // Organization keys: only the services decide
+	}
+	var u db.User
+	return db.DB.Select("log_payloads").First(&u, userID).Error == nil && u.LogPayloads
+}
+
+// finish returns what to store once the request is over, nil when neither the caller nor
+// the service that answered logs payloads
+func (pc *payloadCapture) finish(served *ServiceConfig) *db.RequestPayload {
+	if pc == nil || !(pc.user || (served != nil && served.LogPayloads)) {
+		return nil
+	}
+	request, response := string(pc.request), pc.rec.body.String()
+	if len(request) > payload.MaxCaptureBytes {
+		request = payload.NotStored
+	}
+	if pc.rec.overflow {
+		response = payload.NotStored
+	}
+	return &db.RequestPayload{
+		Request:  request,
+		Response: response,
+		Streamed: strings.HasPrefix(pc.rec.Header().Get("Content-Type"), "text/event-stream"),
+	}
+}
+
+// payloadEntry is a stored payload with the request log row it belongs to
+type payloadEntry struct {
+	db.RequestPayload
+	Log *db.RequestLog `json:"log"`
+}
+
+// ListPayloadsHandler - GET /api/payloads?user_id=&model=&request_log_id=&before_id=&limit=
+// Newest first, without the bodies.
+func ListPayloadsHandler(c *gin.Context) {
+	query := db.DB.Omit("request", "response", "output").Order("id desc").Limit(ledgerLimit(c))
+	if v := c.Query("user_id"); v != "" {
+		query = query.Where("user_id = ?", v)
+	}
+	if v := c.Query("model"); v != "" {
+		query = query.Where("service_model = ?", v)
+	}
+	if v := c.Query("request_log_id"); v != "" {
+		query = query.Where("request_log_id = ?", v)
+	}
+	if v := c.Query("before_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid before_id"})
+			return
+		}
+		query = query.Where("id < ?", id)
+	}
+
+	var payloads []db.RequestPayload
+	if err := query.Find(&payloads).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch payloads"})
+		return
+	}
+	logIDs := make([]uint, len(payloads))
+	for i, p := range payloads {
+		logIDs[i] = p.RequestLogID
+	}
+	var logs []db.RequestLog
+	db.DB.Where("id IN ?", logIDs).Find(&logs)
+	byID := make(map[uint]*db.RequestLog, len(logs))
+	for i := range logs {
+		byID[logs[i].ID] = &logs[i]
+	}
+
+	out := make([]payloadEntry, len(payloads))
+	for i, p := range payloads {
+		out[i] = payloadEntry{RequestPayload: p, Log: byID[p.RequestLogID]}
+	}
+	c.JSON(200, out)
+}
+
+// GetPayloadHandler - GET /api/payloads/:id
+func GetPayloadHandler(c *gin.Context) {
+	var p db.RequestPayload
+	if err := db.DB.First(&p, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Payload not found"})
+		return
+	}
+	entry := payloadEntry{RequestPayload: p}
+	var l db.RequestLog
+	if db.DB.First(&l, p.RequestLogID).Error == nil {
+		entry.Log = &l
+	}
+	c.JSON(200, entry)
+}
+
+// ListRedactionRulesHandler - GET /api/redaction_rules
+func ListRedactionRulesHandler(c *gin.Context) {
+	var rules []db.RedactionRule
+	if err := db.DB.Order("id").Find(&rules).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch redaction rules"})
+		return
+	}
+	c.JSON(200, rules)
+}
+
+// SaveRedactionRuleHandler - POST /api/redaction_rules (creates, or updates when id is set)
+func SaveRedactionRuleHandler(c *gin.Context) {
+	var req db.RedactionRule
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := payload.Validate(req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var before interface{}
+	if req.ID == 0 {
+		if err := db.DB.Create(&req).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create redaction rule"})
+			return
+		}
+	} else {
+		var existing db.RedactionRule
+		if err := db.DB.First(&existing, req.ID).Error; err != nil {
+			c.JSON(404, gin.H{"error": "Redaction rule not found"})
+			return
+		}
+		before = existing
+		if err := db.DB.Model(&existing).Select("kind", "pattern", "replacement", "description").Updates(&req).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to update redaction rule"})
+			return
+		}
+		db.DB.First(&req, req.ID)
+	}
+	payload.LoadRules()
+	recordAudit(c, auditRedactionSave, "redaction_rule", req.ID, req.Pattern, before, req)
+	c.JSON(200, req)
+}
+
+// DeleteRedactionRuleHandler - DELETE /api/redaction_rules/:id
+func DeleteRedactionRuleHandler(c *gin.Context) {
+	var rule db.RedactionRule
+	if err := db.DB.First(&rule, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Redaction rule not found"})
+		return
+	}
+	if err := db.DB.Delete(&rule).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete redaction rule"})
+		return
+	}
+	payload.LoadRules()
+	recordAudit(c, auditRedactionDelete, "redaction_rule", rule.ID, rule.Pattern, rule, nil)
+	c.JSON(200, gin.H{"status": "deleted"})
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"qiservice/internal/db"
+	"qiservice/internal/quota"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ListPlansHandler - GET /api/plans
+func ListPlansHandler(c *gin.Context) {
+	var plans []db.QuotaPlan
+	if err := db.DB.Order("id").Find(&plans).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch plans"})
+		return
+	}
+	c.JSON(200, plans)
+}
+
+// SavePlanHandler - POST /api/plans (creates, or updates when id is set)
+func SavePlanHandler(c *gin.Context) {
+	var req db.QuotaPlan
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" || !quota.ValidPeriod(req.Period) {
+		c.JSON(400, gin.H{"error": "Name and a period of daily, weekly or monthly are required"})
+		return
+	}
+
+	var before interface{}
+	if req.ID == 0 {
+		if err := db.DB.Create(&req).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create plan (name might exist)"})
+			return
+		}
+	} else {
+		var existing db.QuotaPlan
+		if err := db.DB.First(&existing, req.ID).Error; err != nil {
+			c.JSON(404, gin.H{"error": "Plan not found"})
+			return
+		}
+		before = existing
+		if err := db.DB.Model(&existing).Select("name", "period", "period_limit", "rollover").Updates(&req).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to update plan"})
+			return
+		}
+		db.DB.First(&req, req.ID)
+	}
+	quota.LoadPlans()
+	recordAudit(c, auditPlanSave, "plan", req.ID, req.Name, before, req)
+	c.JSON(200, req)
+}
+
+// DeletePlanHandler - DELETE /api/plans/:id (its users fall back to their lifetime quota)
+func DeletePlanHandler(c *gin.Context) {
+	var plan db.QuotaPlan
+	if err := db.DB.First(&plan, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Plan not found"})
+		return
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&db.User{}).Where("plan_id = ?", plan.ID).Update("plan_id", nil).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&plan).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete plan"})
+		return
+	}
+	quota.LoadPlans()
+	recordAudit(c, auditPlanDelete, "plan", plan.ID, plan.Name, plan, nil)
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+// samePlan reports whether the user is already on planID (0 = no plan)
+func samePlan(current *uint, planID uint) bool {
+	if current == nil {
+		return planID == 0
+	}
+	return *current == planID
+}
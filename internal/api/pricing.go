@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"qiservice/internal/db"
+	"qiservice/internal/tracing"
+	"qiservice/internal/wallet"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+// cost prices a request with the service's per-1M-token prices.
+// tokensIn includes the cached tokens, which are billed at CachedInputPrice when set.
+func (s *ServiceConfig) cost(tokensIn, tokensCached, tokensOut int) float64 {
+	if s == nil {
+		return 0
+	}
+	if tokensCached > tokensIn {
+		tokensCached = tokensIn
+	}
+	cachedPrice := s.CachedInputPrice
+	if cachedPrice == 0 {
+		cachedPrice = s.InputPrice
+	}
+	return (float64(tokensIn-tokensCached)*s.InputPrice +
+		float64(tokensCached)*cachedPrice +
+		float64(tokensOut)*s.OutputPrice) / 1e6
+}
+
+// warnUnpriced logs the services without any price: their requests are billed nothing
+// and skip the wallet hold
+func warnUnpriced(services []ServiceConfig) {
+	for _, s := range services {
+		if s.InputPrice == 0 && s.OutputPrice == 0 && s.CachedInputPrice == 0 {
+			log.Printf("⚠️ Service %s has no price set, its requests are not billed", s.Name)
+		}
+	}
+}
+
+// requestCost is what a finished request is billed. When the upstream reported no input
+// usage (provider without usage data, stream dropped or cancelled before the final chunk) the
+// prompt is billed at its estimate, with the output reported so far: never the output budget
+// of a response that may not have been relayed.
+func requestCost(served *ServiceConfig, success bool, tokensIn, tokensCached, tokensOut int, body []byte) float64 {
+	if !success {
+		return 0
+	}
+	if tokensIn == 0 {
+		tokensIn, tokensCached = estimateInputTokens(body), 0
+		if cost := served.cost(tokensIn, 0, tokensOut); cost > 0 {
+			log.Printf("[Billing] %s reported no input usage, billing %d estimated prompt tokens", served.Name, tokensIn)
+		}
+	}
+	return served.cost(tokensIn, tokensCached, tokensOut)
+}
+
+// defaultHoldOutputTokens is assumed for wallet holds when the request sets no max_tokens
+const defaultHoldOutputTokens = 4096
+
+// estimateInputTokens estimates the prompt tokens of a request body: roughly 4 bytes per token
+// for ASCII text, one token per character otherwise (a CJK character is 3 bytes but usually
+// one token or more)
+func estimateInputTokens(body []byte) int {
+	ascii, other := 0, 0
+	for _, r := range string(body) {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return ascii/4 + other + 1
+}
+
+// estimateCost is the most the request may cost on any service of its chain:
+// the estimated prompt plus the full output budget.
+func estimateCost(chain []*ServiceConfig, body []byte) float64 {
+	var req struct {
+		MaxTokens           int `json:"max_tokens"`
+		MaxCompletionTokens int `json:"max_completion_tokens"`
+	}
+	json.Unmarshal(body, &req)
+	tokensOut := req.MaxCompletionTokens
+	if tokensOut <= 0 {
+		tokensOut = req.MaxTokens
+	}
+	if tokensOut <= 0 {
+		tokensOut = defaultHoldOutputTokens
+	}
+	tokensIn := estimateInputTokens(body)
+
+	estimate := 0.0
+	for _, s := range chain {
+		estimate = math.Max(estimate, s.cost(tokensIn, 0, tokensOut))
+	}
+	return estimate
+}
+
+// reserveWallet holds the estimated cost for wallet users, or on the organization wallet
+// for organization keys. It answers 402 and returns false when the balance does not cover it.
+func reserveWallet(c *gin.Context, chain []*ServiceConfig, body []byte) (*wallet.Hold, bool) {
+	userID, orgID := c.GetUint("userID"), c.GetUint("orgID")
+	estimate := estimateCost(chain, body)
+	if (userID == 0 && orgID == 0) || estimate == 0 {
+		return nil, true
+	}
+	_, span := tracing.Start(c.Request.Context(), "wallet.reserve", attribute.Float64("qiservice.estimate", estimate))
+	defer span.End()
+	var hold *wallet.Hold
+	var err error
+	if orgID != 0 {
+		hold, err = wallet.ReserveOrg(orgID, estimate, chain[0].Name)
+	} else {
+		hold, err = wallet.Reserve(userID, estimate, chain[0].Name)
+	}
+	if err == nil {
+		return hold, true
+	}
+	tracing.Fail(span, err)
+
+	msg := "Failed to reserve balance"
+	if errors.Is(err, wallet.ErrInsufficientBalance) {
+		msg = fmt.Sprintf("Insufficient balance: this request needs up to %.6f", estimate)
+	} else {
+		log.Printf("[Wallet] Failed to hold %.6f for user %d / org %d: %v", estimate, userID, orgID, err)
+	}
+	if strings.HasPrefix(c.Request.URL.Path, "/v1/messages") {
+		c.JSON(402, gin.H{
+			"type":  "error",
+			"error": gin.H{"type": "billing_error", "message": msg},
+		})
+	} else {
+		c.JSON(402, gin.H{
+			"error": gin.H{
+				"message": msg,
+				"type":    "insufficient_quota",
+				"param":   nil,
+				"code":    "insufficient_balance",
+			},
+		})
+	}
+	return nil, false
+}
+
+// chargeUsage adds the cost of a request to the user's totals, or the organization's for
+// organization keys, and to the calling key
+func chargeUsage(c *gin.Context, userID uint, cost float64) {
+	if cost <= 0 {
+		return
+	}
+	if orgID := c.GetUint("orgID"); orgID != 0 {
+		db.DB.Model(&db.Organization{}).Where("id = ?", orgID).UpdateColumn("used_amount", gorm.Expr("used_amount + ?", cost))
+	} else if userID != 0 {
+		db.DB.Model(&db.User{}).Where("id = ?", userID).UpdateColumns(map[string]interface{}{
+			"used_amount": gorm.Expr("used_amount + ?", cost),
+			"period_used": gorm.Expr("period_used + ?", cost),
+		})
+	}
+	if v, ok := c.Get("apiKey"); ok {
+		db.DB.Model(&db.APIKey{}).Where("id = ?", v.(*db.APIKey).ID).UpdateColumn("used_amount", gorm.Expr("used_amount + ?", cost))
+	}
+}
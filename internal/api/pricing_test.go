@@ -0,0 +1,49 @@
+package api
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRequestCost(t *testing.T) {
+	// $1 per million input tokens, $2 per million output tokens, $0.5 cached
+	svc := &ServiceConfig{Name: "m", InputPrice: 1, OutputPrice: 2, CachedInputPrice: 0.5}
+	body := []byte(`{"max_tokens":100000,"messages":[{"role":"user","content":"0123456789012345678901234567890123456"}]}`)
+	prompt := float64(estimateInputTokens(body))
+
+	tests := []struct {
+		name                              string
+		success                           bool
+		tokensIn, tokensCached, tokensOut int
+		want                              float64
+	}{
+		{"failed request", false, 100, 0, 50, 0},
+		{"reported usage", true, 1000, 400, 500, (600*1 + 400*0.5 + 500*2) / 1e6},
+		{"no usage bills the prompt estimate, not max_tokens", true, 0, 0, 0, prompt / 1e6},
+		{"output only keeps the reported output", true, 0, 0, 20, (prompt + 20*2) / 1e6},
+	}
+	for _, tt := range tests {
+		got := requestCost(svc, tt.success, tt.tokensIn, tt.tokensCached, tt.tokensOut, body)
+		if math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%s: cost %.9f, want %.9f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEstimateInputTokens(t *testing.T) {
+	tests := []struct {
+		body string
+		want int
+	}{
+		{"", 1},
+		{"abcdefgh", 3},
+		{"你好世界", 5},     // 12 bytes, one token per character
+		{"ab你好cd", 4},   // 4 ASCII bytes, 2 characters
+		{"\xff\xfe", 3}, // Invalid UTF-8 counts like other characters
+	}
+	for _, tt := range tests {
+		if got := estimateInputTokens([]byte(tt.body)); got != tt.want {
+			t.Errorf("estimateInputTokens(%q) = %d, want %d", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"qiservice/internal/health"
+	"qiservice/internal/provider"
+)
+
+const (
+	defaultProbeInterval = 60 * time.Second
+	probeTimeout         = 10 * time.Second
+)
+
+// StartHealthProber probes every configured service in the background.
+// QISERVICE_HEALTH_INTERVAL (e.g. "30s") overrides the interval, "0" disables probing.
+func StartHealthProber() {
+	interval := defaultProbeInterval
+	if v := os.Getenv("QISERVICE_HEALTH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("[Health] Invalid QISERVICE_HEALTH_INTERVAL %q, using %s", v, interval)
+		} else {
+			interval = d
+		}
+	}
+	if interval <= 0 {
+		log.Println("[Health] Active health checks disabled")
+		return
+	}
+
+	go func() {
+		for {
+			probeServices()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// probeServices checks all services concurrently and waits for the results
+func probeServices() {
+	configMutex.RLock()
+	services := make([]*ServiceConfig, len(config.Services))
+	keep := make(map[string]bool, len(config.Services))
+	for i := range config.Services {
+		services[i] = &config.Services[i]
+		keep[config.Services[i].ID] = true
+	}
+	configMutex.RUnlock()
+
+	health.Services.Forget(keep)
+
+	var wg sync.WaitGroup
+	for _, s := range services {
+		wg.Add(1)
+		go func(s *ServiceConfig) {
+			defer wg.Done()
+			probeService(s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func probeService(s *ServiceConfig) {
+	apiKey, ok := s.GetAPIKey()
+	if !ok {
+		return // Every key is resting or disabled, key health already says so
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := newProvider(s).HealthCheck(ctx, apiKey)
+	latency := time.Since(start)
+
+	// Any answer below 500 (even a 401 or a missing /models route) means the upstream is reachable.
+	// Probes only feed service health: some upstreams' keys cannot list models, live traffic
+	// alone judges the keys.
+	var apiErr *provider.APIError
+	if err == nil || (errors.As(err, &apiErr) && apiErr.StatusCode < 500) {
+		health.Services.ReportSuccess(s.ID, latency)
+		return
+	}
+	health.Services.ReportFailure(s.ID, s.Name, err.Error())
+	log.Printf("[Health] Probe of %s failed: %v", s.Name, err)
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"strings"
+
+	"qiservice/internal/db"
+	"qiservice/internal/rbac"
+
+	"github.com/gin-gonic/gin"
+)
+
+// roleResponse is a built-in or custom role with what it grants
+type roleResponse struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+	Builtin     bool     `json:"builtin"`
+}
+
+// ListRolesHandler - GET /api/roles
+// Returns the roles and the permission catalogue.
+func ListRolesHandler(c *gin.Context) {
+	out := []roleResponse{
+		{Name: db.RoleSuperAdmin, Description: "超级管理员", Permissions: rbac.Permissions(db.RoleSuperAdmin), Builtin: true},
+		{Name: db.RoleAdmin, Description: "管理员", Permissions: rbac.Permissions(db.RoleAdmin), Builtin: true},
+		{Name: db.RoleUser, Description: "普通用户", Permissions: rbac.Permissions(db.RoleUser), Builtin: true},
+	}
+	var custom []db.Role
+	if err := db.DB.Order("name").Find(&custom).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch roles"})
+		return
+	}
+	for _, r := range custom {
+		out = append(out, roleResponse{Name: r.Name, Description: r.Description, Permissions: rbac.Permissions(r.Name)})
+	}
+	c.JSON(200, gin.H{"roles": out, "permissions": rbac.Catalogue})
+}
+
+// SaveRoleHandler - POST /api/roles (creates or replaces a custom role)
+func SaveRoleHandler(c *gin.Context) {
+	var req db.Role
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(400, gin.H{"error": "Name is required"})
+		return
+	}
+	if rbac.IsBuiltin(req.Name) {
+		c.JSON(400, gin.H{"error": "Built-in roles cannot be changed"})
+		return
+	}
+	// Like role assignment: nobody edits their own role or one granting more than theirs,
+	// and a role grants at most what the caller has
+	myRole := c.GetString("role")
+	if req.Name == myRole {
+		c.JSON(403, gin.H{"error": "Cannot change your own role"})
+		return
+	}
+	if rbac.Exists(req.Name) && !rbac.Covers(myRole, req.Name) {
+		c.JSON(403, gin.H{"error": "Cannot change a role with more permissions than your own"})
+		return
+	}
+	perms := make([]string, 0, len(req.Permissions))
+	for _, p := range req.Permissions {
+		if !rbac.Valid(p) {
+			c.JSON(400, gin.H{"error": "Unknown permission: " + p})
+			return
+		}
+		if !rbac.Has(myRole, p) {
+			c.JSON(403, gin.H{"error": "Cannot grant a permission you do not have: " + p})
+			return
+		}
+		perms = append(perms, p)
+	}
+	req.Permissions = perms
+
+	var before interface{}
+	var existing db.Role
+	if db.DB.First(&existing, "name = ?", req.Name).Error == nil {
+		before = roleSnapshot(&existing)
+	}
+	if err := db.DB.Save(&req).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save role"})
+		return
+	}
+	rbac.Load()
+	recordAudit(c, auditRoleSave, "role", req.Name, req.Name, before, roleSnapshot(&req))
+	c.JSON(200, req)
+}
+
+// DeleteRoleHandler - DELETE /api/roles/:name
+func DeleteRoleHandler(c *gin.Context) {
+	name := c.Param("name")
+	if rbac.IsBuiltin(name) {
+		c.JSON(400, gin.H{"error": "Built-in roles cannot be deleted"})
+		return
+	}
+	var users int64
+	db.DB.Model(&db.User{}).Where("role = ?", name).Count(&users)
+	if users > 0 {
+		c.JSON(400, gin.H{"error": "Role is still assigned to users"})
+		return
+	}
+	var role db.Role
+	if err := db.DB.First(&role, "name = ?", name).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Role not found"})
+		return
+	}
+	if err := db.DB.Delete(&role).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete role"})
+		return
+	}
+	rbac.Load()
+	recordAudit(c, auditRoleDelete, "role", role.Name, role.Name, roleSnapshot(&role), nil)
+	c.JSON(200, gin.H{"status": "deleted"})
+}
+
+// roleSnapshot is what the audit log compares of a custom role
+func roleSnapshot(r *db.Role) gin.H {
+	return gin.H{"description": r.Description, "permissions": r.Permissions}
+}
+
+// canManageUser reports whether the caller may act on target: staff (users whose role grants
+// permissions) need users.manage_staff, and nobody acts on a role granting more than their own.
+func canManageUser(c *gin.Context, target *db.User) bool {
+	role := c.GetString("role")
+	if rbac.Privileged(target.Role) && !rbac.Has(role, rbac.UsersManageStaff) {
+		return false
+	}
+	return rbac.Covers(role, target.Role)
+}
+
+// checkRoleAssignment validates giving role to a user. It answers the error and returns false
+// when the caller may not: the role must exist, must not be super_admin, and must not grant
+// more than the caller's own role.
+func checkRoleAssignment(c *gin.Context, role string) bool {
+	if role == db.RoleSuperAdmin {
+		c.JSON(403, gin.H{"error": "Cannot assign Super Admin via API"})
+		return false
+	}
+	if !rbac.Exists(role) {
+		c.JSON(400, gin.H{"error": "Invalid role"})
+		return false
+	}
+	if role != db.RoleUser && !can(c, rbac.RolesAssign) {
+		c.JSON(403, gin.H{"error": "Forbidden: roles.assign required"})
+		return false
+	}
+	if !rbac.Covers(c.GetString("role"), role) || (rbac.Privileged(role) && !can(c, rbac.UsersManageStaff)) {
+		c.JSON(403, gin.H{"error": "Cannot assign a role with more permissions than your own"})
+		return false
+	}
+	return true
+}
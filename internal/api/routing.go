@@ -0,0 +1,232 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"qiservice/internal/health"
+	"qiservice/internal/provider"
+	"qiservice/internal/provider/anthropic"
+	"qiservice/internal/provider/gemini"
+	"qiservice/internal/provider/openai"
+	"qiservice/internal/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// routeRequest resolves the service chain of a model for the caller, empty when the model
+// does not exist or is hidden from them
+func routeRequest(c *gin.Context, model string) []*ServiceConfig {
+	_, span := tracing.Start(c.Request.Context(), "route", attribute.String("gen_ai.request.model", model))
+	defer span.End()
+	if !serviceVisible(c, model) {
+		return nil
+	}
+	// Fallbacks are only tried when the caller may call them directly as well
+	var chain []*ServiceConfig
+	for _, s := range resolveServiceChain(model) {
+		if serviceVisible(c, s.Name) {
+			chain = append(chain, s)
+		}
+	}
+	names := make([]string, len(chain))
+	for i, s := range chain {
+		names[i] = s.Name + "#" + s.ID
+	}
+	span.SetAttributes(attribute.StringSlice("qiservice.candidates", names))
+	return chain
+}
+
+// resolveServiceChain returns the ordered list of services to try for a public model name:
+// the services answering that name (ordered by their balancing strategy), then the
+// services of each configured fallback name.
+func resolveServiceChain(model string) []*ServiceConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	groups := make(map[string][]*ServiceConfig)
+	for i := range config.Services {
+		name := config.Services[i].Name
+		groups[name] = append(groups[name], &config.Services[i])
+	}
+
+	primary, ok := groups[model]
+	if !ok {
+		return nil
+	}
+
+	chain := orderByStrategy(primary)
+	seen := map[string]bool{model: true}
+	for _, svc := range primary {
+		for _, name := range svc.Fallbacks {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if group, ok := groups[name]; ok {
+				chain = append(chain, orderByStrategy(group)...)
+			}
+		}
+	}
+	return chain
+}
+
+// errNoHealthyKey is used when every key of a service is disabled or resting
+var errNoHealthyKey = errors.New("no healthy upstream key")
+
+// errCircuitOpen is used when a service is skipped because its circuit is open
+var errCircuitOpen = errors.New("service circuit open")
+
+// reportUpstreamStatus feeds an upstream HTTP status into the service and key health trackers
+func reportUpstreamStatus(s *ServiceConfig, apiKey string, status int, retryAfter time.Duration, errMsg string) {
+	// Any answer below 500 means the service is reachable, the key may still be at fault
+	if status == 0 || status >= 500 {
+		health.Services.ReportFailure(s.ID, s.Name, errMsg)
+	} else {
+		health.Services.ReportSuccess(s.ID, 0)
+	}
+
+	if apiKey == "" {
+		return
+	}
+	fp := health.Fingerprint(apiKey)
+	if status >= 200 && status < 400 {
+		health.Keys.ReportSuccess(fp)
+		return
+	}
+	health.Keys.ReportFailure(fp, s.Name, status, retryAfter, errMsg)
+}
+
+// reportUpstreamError feeds the result of an adapter call (nil = success) into the health trackers
+func reportUpstreamError(s *ServiceConfig, apiKey string, err error) {
+	if err == nil {
+		reportUpstreamStatus(s, apiKey, 200, 0, "")
+		return
+	}
+	var contentErr *provider.UnsupportedContentError
+	if errors.Is(err, context.Canceled) || errors.As(err, &contentErr) {
+		return // Client went away or sent content the protocol lacks, says nothing about the key
+	}
+	var apiErr *provider.APIError
+	if errors.As(err, &apiErr) {
+		reportUpstreamStatus(s, apiKey, apiErr.StatusCode, apiErr.RetryAfter, apiErr.Body)
+		return
+	}
+	reportUpstreamStatus(s, apiKey, 0, 0, err.Error())
+}
+
+// newProvider builds the protocol adapter for a service
+func newProvider(s *ServiceConfig) provider.Provider {
+	switch providerName(s) {
+	case provider.ProviderGemini:
+		return gemini.NewGeminiProvider(s.BaseURL)
+	case provider.ProviderAnthropic:
+		return anthropic.NewAnthropicProvider(s.BaseURL)
+	default:
+		return openai.NewOpenAIProvider(s.BaseURL)
+	}
+}
+
+// Service param policies: what to do with sampling parameters the upstream protocol lacks
+const (
+	ParamPolicyDrop   = "drop"   // Leave them out (default)
+	ParamPolicyReject = "reject" // Fail the request with 400
+)
+
+// providerName is the protocol newProvider uses for a service
+func providerName(s *ServiceConfig) string {
+	switch s.Type {
+	case ServiceTypeGemini:
+		return provider.ProviderGemini
+	case ServiceTypeAnthropic:
+		return provider.ProviderAnthropic
+	default:
+		return provider.ProviderOpenAI
+	}
+}
+
+// applyParamPolicy handles the parameters of an adapter request that the service cannot honour:
+// they are dropped, or the request is rejected when the service's policy says so
+func applyParamPolicy(s *ServiceConfig, req *provider.ChatCompletionRequest) error {
+	unsupported := req.UnsupportedParams(providerName(s))
+	if len(unsupported) == 0 {
+		return nil
+	}
+	if s.ParamPolicy == ParamPolicyReject {
+		return fmt.Errorf("%s does not support %s", s.Name, strings.Join(unsupported, ", "))
+	}
+	log.Printf("[Params] Dropping %s for service %s", strings.Join(unsupported, ", "), s.Name)
+	req.DropParams(unsupported)
+	return nil
+}
+
+// setRequestBody replaces the inbound body so it can be proxied again on the next attempt
+func setRequestBody(c *gin.Context, body []byte) {
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+	c.Request.ContentLength = int64(len(body))
+	c.Request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	c.Request.Header.Del("Content-Encoding")
+	c.Request.Header.Del("Transfer-Encoding")
+}
+
+// upstreamErrorStatus maps an adapter error to the status returned to the client
+func upstreamErrorStatus(err error) int {
+	var apiErr *provider.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 {
+		return apiErr.StatusCode
+	}
+	var contentErr *provider.UnsupportedContentError
+	if errors.As(err, &contentErr) {
+		return 400
+	}
+	return 502
+}
+
+// upstreamStream is an adapter stream whose first event has already been received
+type upstreamStream struct {
+	first  *provider.StreamResponse // nil if the upstream closed without output
+	chunks <-chan provider.StreamResponse
+	errs   <-chan error
+}
+
+// openStream starts the adapter stream and waits for its first chunk. Nothing has been
+// written to the client yet when it returns an error, so the caller can still fail over.
+func openStream(ctx context.Context, p provider.Provider, req provider.ChatCompletionRequest, apiKey string) (*upstreamStream, error) {
+	outputChan := make(chan provider.StreamResponse)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(outputChan)
+		if err := p.StreamChatCompletion(ctx, req, apiKey, outputChan); err != nil {
+			errChan <- err
+		}
+		close(errChan)
+	}()
+
+	select {
+	case chunk, ok := <-outputChan:
+		if !ok {
+			// errChan is closed before outputChan, so a pending error is already there
+			if err := <-errChan; err != nil {
+				return nil, err
+			}
+			return &upstreamStream{chunks: outputChan, errs: errChan}, nil
+		}
+		return &upstreamStream{first: &chunk, chunks: outputChan, errs: errChan}, nil
+	case <-ctx.Done():
+		// Drain so the provider goroutine is not left blocked on send
+		go func() {
+			for range outputChan {
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
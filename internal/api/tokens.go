@@ -0,0 +1,257 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"qiservice/internal/auth"
+	"qiservice/internal/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jwtKeysFromEnv is set when the signing secrets come from the environment;
+// they are then rotated by the operator rather than through the API.
+var jwtKeysFromEnv bool
+
+// InitTokenKeys loads the JWT signing secrets. Sources, in order:
+//   - QISERVICE_JWT_SECRET: one secret, or several separated by commas
+//   - QISERVICE_JWT_SECRET_FILE: one secret per line ('#' starts a comment)
+//   - the jwt_keys table, generated on first boot
+//
+// With several secrets the first one signs new tokens and the others still verify.
+func InitTokenKeys() {
+	var secrets []string
+	if v := os.Getenv("QISERVICE_JWT_SECRET"); v != "" {
+		secrets = strings.Split(v, ",")
+	} else if path := os.Getenv("QISERVICE_JWT_SECRET_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("❌ Failed to read QISERVICE_JWT_SECRET_FILE: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				secrets = append(secrets, line)
+			}
+		}
+	}
+
+	if len(secrets) > 0 {
+		keys := make(map[string][]byte)
+		current := ""
+		for _, s := range secrets {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if len(s) < 32 {
+				log.Printf("⚠️ JWT secret shorter than 32 characters, consider a longer one")
+			}
+			kid := auth.KeyID([]byte(s))
+			keys[kid] = []byte(s)
+			if current == "" {
+				current = kid
+			}
+		}
+		if err := auth.SetSigningKeys(keys, current); err != nil {
+			log.Fatalf("❌ Invalid JWT secret configuration: %v", err)
+		}
+		jwtKeysFromEnv = true
+		log.Printf("✅ Loaded %d JWT signing key(s) from environment (current kid %s)", len(keys), current)
+		return
+	}
+
+	if err := loadDBSigningKeys(); err != nil {
+		log.Fatalf("❌ Failed to load JWT signing keys: %v", err)
+	}
+}
+
+// loadDBSigningKeys installs the stored keys, generating the first one if needed.
+// Retired keys are dropped once every token they signed has expired.
+func loadDBSigningKeys() error {
+	db.DB.Where("retired_at IS NOT NULL AND retired_at < ?", time.Now().Add(-auth.TokenLifetime)).Delete(&db.JWTKey{})
+
+	var rows []db.JWTKey
+	if err := db.DB.Find(&rows).Error; err != nil {
+		return err
+	}
+	hasCurrent := false
+	for _, r := range rows {
+		hasCurrent = hasCurrent || r.IsCurrent
+	}
+	if !hasCurrent {
+		row, err := newDBSigningKey()
+		if err != nil {
+			return err
+		}
+		rows = append(rows, *row)
+		log.Printf("🔑 Generated JWT signing key %s", row.KID)
+	}
+
+	keys := make(map[string][]byte)
+	current := ""
+	for _, r := range rows {
+		secret, err := base64.StdEncoding.DecodeString(r.Secret)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", r.KID, err)
+		}
+		keys[r.KID] = secret
+		if r.IsCurrent {
+			current = r.KID
+		}
+	}
+	return auth.SetSigningKeys(keys, current)
+}
+
+// newDBSigningKey stores a fresh random secret as the current key
+func newDBSigningKey() (*db.JWTKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	row := &db.JWTKey{
+		KID:       auth.KeyID(secret),
+		Secret:    base64.StdEncoding.EncodeToString(secret),
+		IsCurrent: true,
+	}
+	if err := db.DB.Create(row).Error; err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// RotateJWTKeyHandler - POST /api/auth/rotate_key
+// Generates a new signing key. Tokens signed with the previous key stay valid until they expire.
+func RotateJWTKeyHandler(c *gin.Context) {
+	if jwtKeysFromEnv {
+		c.JSON(409, gin.H{"error": "JWT secrets are configured through the environment, rotate them there"})
+		return
+	}
+
+	now := time.Now()
+	if err := db.DB.Model(&db.JWTKey{}).Where("is_current = ?", true).Updates(map[string]interface{}{
+		"is_current": false,
+		"retired_at": now,
+	}).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to retire current key"})
+		return
+	}
+	row, err := newDBSigningKey()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate key"})
+		return
+	}
+	if err := loadDBSigningKeys(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("🔑 JWT signing key rotated to %s by %s", row.KID, c.GetString("username"))
+	recordAudit(c, auditJWTRotate, "jwt_key", row.KID, row.KID, nil, gin.H{"kid": row.KID})
+	c.JSON(200, gin.H{"status": "rotated", "kid": row.KID})
+}
+
+// revocations mirrors the revoked_tokens table so every request can be checked without a query
+var revocations = struct {
+	sync.RWMutex
+	tokens map[string]time.Time // jti -> token expiry
+	users  map[uint]time.Time   // userID -> tokens issued before this are revoked
+}{
+	tokens: make(map[string]time.Time),
+	users:  make(map[uint]time.Time),
+}
+
+// InitRevocations loads unexpired revocations and prunes old ones periodically
+func InitRevocations() {
+	loadRevocations()
+	go func() {
+		for range time.Tick(time.Hour) {
+			loadRevocations()
+		}
+	}()
+}
+
+func loadRevocations() {
+	db.DB.Where("expires_at < ?", time.Now()).Delete(&db.RevokedToken{})
+
+	var rows []db.RevokedToken
+	if err := db.DB.Find(&rows).Error; err != nil {
+		log.Printf("[Auth] Failed to load revoked tokens: %v", err)
+		return
+	}
+	tokens := make(map[string]time.Time)
+	users := make(map[uint]time.Time)
+	for _, r := range rows {
+		if r.JTI != "" {
+			tokens[r.JTI] = r.ExpiresAt
+		} else if r.RevokedAt.After(users[r.UserID]) {
+			users[r.UserID] = r.RevokedAt
+		}
+	}
+	revocations.Lock()
+	revocations.tokens = tokens
+	revocations.users = users
+	revocations.Unlock()
+}
+
+// isTokenRevoked reports whether a parsed token was logged out or belongs to a revoked user
+func isTokenRevoked(claims *auth.Claims) bool {
+	revocations.RLock()
+	defer revocations.RUnlock()
+
+	if _, ok := revocations.tokens[claims.ID]; ok {
+		return true
+	}
+	if before, ok := revocations.users[claims.UserID]; ok {
+		return claims.IssuedAt == nil || claims.IssuedAt.Time.Before(before)
+	}
+	return false
+}
+
+// revokeToken invalidates a single token
+func revokeToken(claims *auth.Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return fmt.Errorf("token cannot be revoked individually")
+	}
+	row := db.RevokedToken{JTI: claims.ID, UserID: claims.UserID, RevokedAt: time.Now(), ExpiresAt: claims.ExpiresAt.Time}
+	if err := db.DB.Create(&row).Error; err != nil {
+		return err
+	}
+	revocations.Lock()
+	revocations.tokens[row.JTI] = row.ExpiresAt
+	revocations.Unlock()
+	return nil
+}
+
+// revokeUserTokens invalidates every token issued to a user so far
+func revokeUserTokens(userID uint) error {
+	now := time.Now()
+	row := db.RevokedToken{UserID: userID, RevokedAt: now, ExpiresAt: now.Add(auth.TokenLifetime)}
+	if err := db.DB.Create(&row).Error; err != nil {
+		return err
+	}
+	revocations.Lock()
+	revocations.users[userID] = now
+	revocations.Unlock()
+	return nil
+}
+
+// LogoutHandler - POST /api/logout
+// Revokes the token used for this request.
+func LogoutHandler(c *gin.Context) {
+	claims, ok := c.Get("claims")
+	if !ok {
+		c.JSON(400, gin.H{"error": "Logout requires a JWT"})
+		return
+	}
+	if err := revokeToken(claims.(*auth.Claims)); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+	c.JSON(200, gin.H{"status": "logged_out"})
+}
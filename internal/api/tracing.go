@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"qiservice/internal/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingMiddleware starts the trace of a model request and echoes its ID in X-Trace-Id.
+// Once the handler is done, the root span gets the served service and the token usage.
+func TracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, span := tracing.StartRequest(c.Request.Context(), c.Request.Method+" "+c.FullPath(), c.Request.Header)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		if id := tracing.TraceID(ctx); id != "" {
+			c.Header(tracing.HeaderTraceID, id)
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(
+			attribute.String("http.route", c.FullPath()),
+			attribute.Int("http.response.status_code", status),
+			attribute.String("user.name", c.GetString("username")),
+		)
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		if obs := observe(c); obs.Service != "" {
+			span.SetAttributes(
+				attribute.String("gen_ai.request.model", obs.Model),
+				attribute.String("qiservice.service", obs.Service),
+				attribute.String("qiservice.route", obs.Route),
+				attribute.String("gen_ai.response.model", obs.UpstreamModel),
+				attribute.Int("gen_ai.usage.input_tokens", obs.TokensIn),
+				attribute.Int("gen_ai.usage.output_tokens", obs.TokensOut),
+				attribute.Int("gen_ai.usage.cached_tokens", obs.TokensCached),
+			)
+		}
+	}
+}
+
+// traceStep runs a middleware step in its own span; the step ends before the rest of the chain runs
+func traceStep(c *gin.Context, name string, step func()) {
+	_, span := tracing.Start(c.Request.Context(), name)
+	step()
+	if c.IsAborted() {
+		span.SetAttributes(attribute.Int("http.response.status_code", c.Writer.Status()))
+		span.SetStatus(codes.Error, http.StatusText(c.Writer.Status()))
+	}
+	span.End()
+}
+
+// attemptSpan traces the upstream attempts of a request, one span per candidate service
+type attemptSpan struct {
+	span trace.Span
+}
+
+// next ends the previous attempt (failed with err, if not nil) and starts the attempt on s
+func (a *attemptSpan) next(c *gin.Context, s *ServiceConfig, err error) context.Context {
+	a.end(err)
+	ctx, span := tracing.Start(c.Request.Context(), "upstream "+s.Name,
+		attribute.String("qiservice.service", s.Name),
+		attribute.String("qiservice.service_id", s.ID),
+		attribute.String("qiservice.service_type", string(s.Type)),
+		attribute.String("gen_ai.request.model", s.upstreamModel()),
+	)
+	a.span = span
+	return ctx
+}
+
+// route records how the attempt reaches the upstream (metrics.RouteProxy or RouteAdapter)
+func (a *attemptSpan) route(route string) {
+	if a.span != nil {
+		a.span.SetAttributes(attribute.String("qiservice.route", route))
+	}
+}
+
+// end ends the attempt in progress, failed with err if not nil
+func (a *attemptSpan) end(err error) {
+	if a.span == nil {
+		return
+	}
+	tracing.Fail(a.span, err)
+	a.span.End()
+	a.span = nil
+}
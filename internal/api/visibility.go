@@ -0,0 +1,71 @@
+package api
+
+import (
+	"qiservice/internal/db"
+	"qiservice/internal/rbac"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serviceGrants returns the service names the caller may see and call. all is true for
+// roles with services.all and for users granted AllServices; users without any grant see
+// nothing. Organization keys get the grants of their organization. The result is cached
+// on the request.
+func serviceGrants(c *gin.Context) (names map[string]bool, all bool) {
+	if v, ok := c.Get("serviceGrants"); ok {
+		names = v.(map[string]bool)
+		return names, names == nil
+	}
+
+	if orgID, ok := c.Get("orgID"); ok {
+		names = make(map[string]bool)
+		var org db.Organization
+		if err := db.DB.Select("id", "services").First(&org, orgID).Error; err == nil {
+			for _, s := range org.Services {
+				names[s] = true
+			}
+		}
+		if names[db.AllServices] {
+			names = nil
+		}
+	} else if !can(c, rbac.ServicesAll) {
+		names = make(map[string]bool)
+		var user db.User
+		if err := db.DB.Preload("Groups").Select("id", "services").First(&user, c.GetUint("userID")).Error; err == nil {
+			for _, s := range user.Services {
+				names[s] = true
+			}
+			for _, g := range user.Groups {
+				for _, s := range g.Services {
+					names[s] = true
+				}
+			}
+		}
+		if names[db.AllServices] {
+			names = nil
+		}
+	}
+	c.Set("serviceGrants", names)
+	return names, names == nil
+}
+
+// serviceVisible reports whether the caller may see and call the service name,
+// combining group grants with the restrictions of the calling key
+func serviceVisible(c *gin.Context, name string) bool {
+	if !keyAllowsModel(c, name) {
+		return false
+	}
+	names, all := serviceGrants(c)
+	return all || names[name]
+}
+
+// visibleServices filters a service list down to what the caller may see
+func visibleServices(c *gin.Context, services []ServiceConfig) []ServiceConfig {
+	out := make([]ServiceConfig, 0, len(services))
+	for _, s := range services {
+		if serviceVisible(c, s.Name) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+
+	"qiservice/internal/db"
+	"qiservice/internal/rbac"
+	"qiservice/internal/wallet"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// parseBillingMode validates a billing mode, "" meaning the default quota mode
+func parseBillingMode(mode string) (string, bool) {
+	switch mode {
+	case "", db.BillingQuota:
+		return db.BillingQuota, true
+	case db.BillingWallet:
+		return db.BillingWallet, true
+	}
+	return "", false
+}
+
+type TopUpRequest struct {
+	UserID uint    `json:"user_id"`
+	OrgID  uint    `json:"org_id"`                    // Tops up an organization wallet instead
+	Amount float64 `json:"amount" binding:"required"` // Negative corrects the balance
+	Note   string  `json:"note"`
+}
+
+// TopUpHandler - POST /api/wallet/topup
+func TopUpHandler(c *gin.Context) {
+	var req TopUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.OrgID != 0 {
+		if !can(c, rbac.OrgsManage) {
+			c.JSON(403, gin.H{"error": "Forbidden: orgs.manage required"})
+			return
+		}
+		creditOrg(c, &req)
+		return
+	}
+	if !can(c, rbac.UsersWrite) {
+		c.JSON(403, gin.H{"error": "Forbidden: users.write required"})
+		return
+	}
+
+	var target db.User
+	if err := db.DB.First(&target, req.UserID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if !canManageUser(c, &target) {
+		c.JSON(403, gin.H{"error": "Forbidden: cannot manage this user"})
+		return
+	}
+
+	entry, err := wallet.Credit(target.ID, req.Amount, c.GetUint("userID"), req.Note)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to top up"})
+		return
+	}
+	recordAudit(c, auditWalletTopUp, "user", target.ID, target.Username, nil, entry)
+	c.JSON(200, entry)
+}
+
+// ListLedgerHandler - GET /api/wallet/ledger?user_id=&org_id=&type=&limit=
+func ListLedgerHandler(c *gin.Context) {
+	query := db.DB.Order("id desc").Limit(ledgerLimit(c))
+	if !can(c, rbac.UsersManageStaff) {
+		// Same visibility as the user list: only ordinary users (and organizations)
+		query = query.Where("user_id IN (?) OR org_id <> 0", db.DB.Model(&db.User{}).Select("id").Where("role IN ?", rbac.Unprivileged()))
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if orgID := c.Query("org_id"); orgID != "" {
+		query = query.Where("org_id = ?", orgID)
+	}
+	if typ := c.Query("type"); typ != "" {
+		query = query.Where("type = ?", typ)
+	}
+
+	var entries []db.WalletTransaction
+	if err := query.Find(&entries).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch ledger"})
+		return
+	}
+	c.JSON(200, entries)
+}
+
+// MyLedgerHandler - GET /api/user/ledger
+func MyLedgerHandler(c *gin.Context) {
+	var entries []db.WalletTransaction
+	if err := db.DB.Where("user_id = ?", c.GetUint("userID")).Order("id desc").Limit(ledgerLimit(c)).Find(&entries).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch ledger"})
+		return
+	}
+	c.JSON(200, entries)
+}
+
+// ledgerLimit reads ?limit=, default 100, at most 1000
+func ledgerLimit(c *gin.Context) int {
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		return 100
+	}
+	if limit > 1000 {
+		return 1000
+	}
+	return limit
+}
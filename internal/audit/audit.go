@@ -0,0 +1,144 @@
+// Package audit keeps the log of administrative actions. Every entry is chained to the one
+// before it by a SHA-256 hash, so a row edited or deleted in the database is detected by Verify.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"qiservice/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// mu serializes appends: each entry needs the hash of the previous one
+var mu sync.Mutex
+
+// Change is the value of a field before and after an action, nil when absent
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Diff compares two snapshots (structs or maps, nil for none) field by field on their JSON form.
+// Objects present on both sides are compared per field, as "parent.field".
+func Diff(before, after interface{}) map[string]Change {
+	out := make(map[string]Change)
+	diff(out, "", fields(before), fields(after))
+	return out
+}
+
+func diff(out map[string]Change, prefix string, b, a map[string]interface{}) {
+	for k, v := range b {
+		bm, bok := v.(map[string]interface{})
+		am, aok := a[k].(map[string]interface{})
+		switch {
+		case bok && aok:
+			diff(out, prefix+k+".", bm, am)
+		case !reflect.DeepEqual(v, a[k]):
+			out[prefix+k] = Change{Before: v, After: a[k]}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok && v != nil {
+			out[prefix+k] = Change{After: v}
+		}
+	}
+}
+
+func fields(v interface{}) map[string]interface{} {
+	out := make(map[string]interface{})
+	if v == nil {
+		return out
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return out
+	}
+	json.Unmarshal(raw, &out)
+	return out
+}
+
+// Record appends e with the diff between before and after. ID, CreatedAt and the hashes are set here.
+func Record(e *db.AuditLog, before, after interface{}) error {
+	diff, err := json.Marshal(Diff(before, after))
+	if err != nil {
+		return err
+	}
+	e.Diff = string(diff)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		var last db.AuditLog
+		err := tx.Select("hash").Order("id desc").First(&last).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		e.ID = 0
+		e.PrevHash = last.Hash
+		// Stored times come back in UTC; keep the hashed form stable across the round trip
+		e.CreatedAt = time.Now().UTC()
+		e.Hash = Hash(e)
+		return tx.Create(e).Error
+	})
+}
+
+// Hash is the chain hash of an entry: SHA-256 over the previous hash and every recorded field
+func Hash(e *db.AuditLog) string {
+	payload, _ := json.Marshal([]interface{}{
+		e.PrevHash,
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		e.ActorID, e.Actor, e.Action,
+		e.TargetType, e.TargetID, e.Target,
+		e.Diff, e.IP,
+	})
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// Result is the outcome of a chain verification
+type Result struct {
+	Valid    bool   `json:"valid"`
+	Checked  int    `json:"checked"`             // Entries verified
+	BrokenID uint   `json:"broken_id,omitempty"` // First entry that does not match the chain
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Verify walks the whole chain in order and reports the first entry whose hash or link is wrong.
+// Removing the newest entries leaves a valid chain; everything before them stays verifiable.
+func Verify() (Result, error) {
+	res := Result{Valid: true}
+	prev := ""
+	var batch []db.AuditLog
+	err := db.DB.FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			e := &batch[i]
+			switch {
+			case e.PrevHash != prev:
+				res.Reason = "previous hash mismatch (entry before it edited or deleted)"
+			case Hash(e) != e.Hash:
+				res.Reason = "hash mismatch (entry edited)"
+			default:
+				prev = e.Hash
+				res.Checked++
+				continue
+			}
+			res.Valid = false
+			res.BrokenID = e.ID
+			return errStop
+		}
+		return nil
+	}).Error
+	if err != nil && !errors.Is(err, errStop) {
+		return res, err
+	}
+	return res, nil
+}
+
+var errStop = errors.New("stop")
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// apiKeyPrefixLen is how much of a client key stays visible ("sk-" + 8 characters)
+const apiKeyPrefixLen = 11
+
+// apiKeyPepper salts the stored client key hashes. It is server-wide rather than per key
+// so a presented key can be looked up by its hash.
+var apiKeyPepper struct {
+	sync.RWMutex
+	value []byte
+}
+
+// SetAPIKeyPepper installs the salt used by HashAPIKey
+func SetAPIKeyPepper(p []byte) {
+	apiKeyPepper.Lock()
+	defer apiKeyPepper.Unlock()
+	apiKeyPepper.value = p
+}
+
+// GenerateAPIKey returns a new random client key ("sk-...")
+func GenerateAPIKey() string {
+	return "sk-" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// HashAPIKey returns the salted hash under which a client key is stored
+func HashAPIKey(key string) string {
+	apiKeyPepper.RLock()
+	mac := hmac.New(sha256.New, apiKeyPepper.value)
+	apiKeyPepper.RUnlock()
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// APIKeyPrefix returns the part of a client key that may be shown again
+func APIKeyPrefix(key string) string {
+	if len(key) <= apiKeyPrefixLen {
+		return key
+	}
+	return key[:apiKeyPrefixLen]
+}
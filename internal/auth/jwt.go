@@ -1,28 +1,78 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-var SecretKey = []byte("your-secret-key-change-in-production") // TODO: Load from env
+// TokenLifetime is how long an issued JWT stays valid
+const TokenLifetime = 24 * time.Hour
+
+func init() {
+	// Sub-second iat: a token issued right after a revocation must not fall in its second
+	jwt.TimePrecision = time.Microsecond
+}
 
 type Claims struct {
 	UserID   uint   `json:"user_id"`
 	Username string `json:"username"`
 	Role     string `json:"role"`
+	// MustChangePassword restricts the token to the password change endpoint
+	MustChangePassword bool `json:"must_change_password,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(userID uint, username, role string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// keyring holds the HMAC secrets by kid. Tokens are signed with the current key and
+// verified with whichever key their kid names, so secrets can be rotated without
+// logging everyone out.
+var keyring struct {
+	mu      sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+// KeyID derives the kid of a secret, so the same secret always gets the same kid
+func KeyID(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:4])
+}
+
+// SetSigningKeys replaces the keyring. current is the kid used for new tokens.
+func SetSigningKeys(keys map[string][]byte, current string) error {
+	if _, ok := keys[current]; !ok {
+		return fmt.Errorf("current signing key %q is not in the keyring", current)
+	}
+	keyring.mu.Lock()
+	defer keyring.mu.Unlock()
+	keyring.keys = keys
+	keyring.current = current
+	return nil
+}
+
+func GenerateToken(userID uint, username, role string, mustChangePassword bool) (string, error) {
+	keyring.mu.RLock()
+	kid := keyring.current
+	secret := keyring.keys[kid]
+	keyring.mu.RUnlock()
+	if secret == nil {
+		return "", errors.New("no signing key configured")
+	}
+
+	expirationTime := time.Now().Add(TokenLifetime)
 	claims := &Claims{
-		UserID:   userID,
-		Username: username,
-		Role:     role,
+		UserID:             userID,
+		Username:           username,
+		Role:               role,
+		MustChangePassword: mustChangePassword,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(), // Lets a single token be revoked
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "qiservice",
@@ -30,13 +80,21 @@ func GenerateToken(userID uint, username, role string) (string, error) {
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(SecretKey)
+	token.Header["kid"] = kid
+	return token.SignedString(secret)
 }
 
 func ParseToken(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return SecretKey, nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		keyring.mu.RLock()
+		secret, ok := keyring.keys[kid]
+		keyring.mu.RUnlock()
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
 		return nil, err
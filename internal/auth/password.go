@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword returns a salted bcrypt hash of the password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsHashed reports whether a stored value is a bcrypt hash (as opposed to a legacy plaintext row)
+func IsHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// CheckPassword verifies a password against the stored value in constant time.
+// Legacy rows still hold the plaintext; callers should rehash them when ok is true.
+func CheckPassword(stored, password string) (ok bool, legacy bool) {
+	if IsHashed(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+	if stored == "" {
+		return false, false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+}
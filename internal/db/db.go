@@ -34,15 +34,59 @@ func Init(dbPath string) {
 
 	log.Println("✅ Database connection established.")
 
+	// Service names are no longer unique: several upstreams may answer the same public model name
+	dropUniqueIndex(&Service{}, "idx_services_name")
+
+	// Request logs without a cost column come from a version that counted quotas in tokens
+	tokenBilling := DB.Migrator().HasTable(&RequestLog{}) && !hasColumn("request_logs", "cost")
+
 	// Auto Migrate Schema
 	err = DB.AutoMigrate(
 		&User{},
 		&APIKey{},
 		&Service{},
 		&RequestLog{},
+		&UpstreamKeyState{},
+		&JWTKey{},
+		&RevokedToken{},
+		&Setting{},
+		&WalletTransaction{},
+		&QuotaPlan{},
+		&UserGroup{},
+		&Organization{},
+		&OrgMember{},
+		&Role{},
+		&AuditLog{},
+		&RedactionRule{},
+		&RequestPayload{},
 	)
 	if err != nil {
 		log.Fatalf("❌ Database migration failed: %v", err)
 	}
 	log.Println("✅ Database schema migrated.")
+
+	if tokenBilling {
+		if err := DB.Save(&Setting{Key: billingCurrencySetting, Value: "pending"}).Error; err != nil {
+			log.Fatalf("❌ Failed to schedule the quota migration: %v", err)
+		}
+	}
+}
+
+// dropUniqueIndex removes a legacy unique index so AutoMigrate can recreate it as a plain index
+func dropUniqueIndex(model interface{}, name string) {
+	if !DB.Migrator().HasTable(model) {
+		return
+	}
+	indexes, err := DB.Migrator().GetIndexes(model)
+	if err != nil {
+		return
+	}
+	for _, idx := range indexes {
+		if unique, ok := idx.Unique(); ok && unique && idx.Name() == name {
+			if err := DB.Migrator().DropIndex(model, name); err != nil {
+				log.Printf("⚠️ Failed to drop index %s: %v", name, err)
+			}
+			return
+		}
+	}
 }
@@ -4,8 +4,28 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"strings"
+
+	"qiservice/internal/auth"
+
+	"gorm.io/gorm"
+)
+
+// Default admin credentials; the account must change its password on first login
+const (
+	DefaultAdminUsername = "admin"
+	DefaultAdminPassword = "admin"
 )
 
+// DefaultUserQuota is the spending limit of new non-admin users, in the price currency
+const DefaultUserQuota = 10.0
+
+// serviceGrantsSetting is set once users without grants have been given AllServices
+const serviceGrantsSetting = "service_grants"
+
+// billingCurrencySetting is "pending" while the quotas of a token-billed database await MigrateBillingCurrency
+const billingCurrencySetting = "billing_currency"
+
 // MigrateConfig loads legacy config.json and seeds the database
 func MigrateConfig() {
 	var userCount, serviceCount int64
@@ -64,14 +84,16 @@ func MigrateConfig() {
 	// 1. Create Admin User
 	var existAdmin User
 	if err := DB.Where("username = ?", "admin").First(&existAdmin).Error; err != nil {
-		adminUser := User{
-			Username:     "admin",
-			Role:         RoleSuperAdmin,
-			Quota:        9999999,
-			PasswordHash: hashPassword(jsonCfg.AdminPassword),
+		adminPassword := jsonCfg.AdminPassword
+		if adminPassword == "" {
+			adminPassword = DefaultAdminPassword
 		}
-		if adminUser.PasswordHash == "" {
-			adminUser.PasswordHash = "admin"
+		adminUser := User{
+			Username:           DefaultAdminUsername,
+			Role:               RoleSuperAdmin,
+			Quota:              -1,
+			PasswordHash:       hashPassword(adminPassword),
+			MustChangePassword: adminPassword == DefaultAdminPassword,
 		}
 		DB.Create(&adminUser)
 		log.Printf("✅ Migrated Admin User")
@@ -88,7 +110,7 @@ func MigrateConfig() {
 		legacyUser = User{
 			Username: "legacy_user",
 			Role:     "user",
-			Quota:    1000,
+			Quota:    DefaultUserQuota,
 		}
 		DB.Create(&legacyUser)
 	}
@@ -98,9 +120,10 @@ func MigrateConfig() {
 			continue
 		}
 		DB.Create(&APIKey{
-			Key:    key,
-			Name:   "Imported Key",
-			UserID: legacyUser.ID,
+			KeyHash:   auth.HashAPIKey(key),
+			KeyPrefix: auth.APIKeyPrefix(key),
+			Name:      "Imported Key",
+			UserID:    legacyUser.ID,
 		})
 	}
 	log.Printf("✅ Migrated %d Client Keys", len(jsonCfg.ClientKeys))
@@ -166,13 +189,134 @@ func MigrateConfig() {
 func createDefaultAdmin() {
 	// ... logic to create default admin if no config ...
 	DB.Create(&User{
-		Username:     "admin",
-		Role:         RoleSuperAdmin,
-		PasswordHash: "admin", // Need handling
+		Username:           DefaultAdminUsername,
+		Role:               RoleSuperAdmin,
+		PasswordHash:       hashPassword(DefaultAdminPassword),
+		MustChangePassword: true,
 	})
 }
 
-// Simple hash (placeholder) - in production use bcrypt
+// hashPassword hashes a seeded password. On failure the legacy plaintext is kept,
+// it is upgraded on the next successful login.
 func hashPassword(p string) string {
-	return p // TODO: Implement bcrypt
+	hash, err := auth.HashPassword(p)
+	if err != nil {
+		log.Printf("⚠️ Failed to hash password: %v", err)
+		return p
+	}
+	return hash
+}
+
+// MigrateAPIKeys hashes client keys stored in plaintext by earlier versions and drops
+// the plaintext column. The keys keep working: they are now matched by hash.
+func MigrateAPIKeys() {
+	if !hasColumn("api_keys", "key") {
+		return
+	}
+
+	var rows []struct {
+		ID  uint
+		Key string
+	}
+	DB.Table("api_keys").Select("id, key").Where("key_hash IS NULL OR key_hash = ''").Scan(&rows)
+	for _, r := range rows {
+		DB.Table("api_keys").Where("id = ?", r.ID).Updates(map[string]interface{}{
+			"key_hash":   auth.HashAPIKey(r.Key),
+			"key_prefix": auth.APIKeyPrefix(r.Key),
+		})
+	}
+
+	if DB.Migrator().HasIndex(&APIKey{}, "idx_api_keys_key") {
+		if err := DB.Migrator().DropIndex(&APIKey{}, "idx_api_keys_key"); err != nil {
+			log.Printf("❌ Failed to drop plaintext key index: %v", err)
+			return
+		}
+	}
+	if err := DB.Migrator().DropColumn(&APIKey{}, "key"); err != nil {
+		log.Printf("❌ Failed to drop plaintext key column: %v", err)
+		return
+	}
+	// Dropping a column rebuilds the table in SQLite, restore its indexes
+	if err := DB.AutoMigrate(&APIKey{}); err != nil {
+		log.Printf("❌ Failed to restore api_keys indexes: %v", err)
+	}
+	log.Printf("✅ Hashed %d plaintext client keys", len(rows))
+}
+
+// MigrateBillingCurrency resets the quotas and usage that earlier versions counted in tokens,
+// which mean nothing in the price currency. Usage starts over and limited quotas are lifted
+// (-1) rather than guessed, with QuotaReview set until an admin enters a limit in the price
+// currency. The server does not start until this has run.
+func MigrateBillingCurrency() {
+	var pending int64
+	DB.Model(&Setting{}).Where("key = ? AND value = ?", billingCurrencySetting, "pending").Count(&pending)
+	if pending == 0 {
+		return
+	}
+
+	var limited int64
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("used_amount <> 0").Update("used_amount", 0).Error; err != nil {
+			return err
+		}
+		res := tx.Model(&User{}).Where("quota >= 0").Updates(map[string]interface{}{"quota": -1, "quota_review": true})
+		if res.Error != nil {
+			return res.Error
+		}
+		limited = res.RowsAffected
+		return tx.Model(&Setting{}).Where("key = ?", billingCurrencySetting).Update("value", "done").Error
+	})
+	if err != nil {
+		log.Fatalf("❌ Failed to reset token quotas for currency billing: %v", err)
+	}
+	log.Printf("⚠️ Quotas are now in the price currency: usage reset, %d limited users are unlimited and marked for review until an admin sets a new limit", limited)
+}
+
+// MigrateServiceGrants gives AllServices to the users that have neither groups nor direct
+// grants, once: earlier versions left such users unrestricted, now they see no service.
+func MigrateServiceGrants() {
+	var done int64
+	DB.Model(&Setting{}).Where("key = ?", serviceGrantsSetting).Count(&done)
+	if done > 0 {
+		return
+	}
+
+	var users []User
+	if err := DB.Preload("Groups").Select("id", "services").Find(&users).Error; err != nil {
+		log.Fatalf("❌ Failed to load users for the service grant migration: %v", err)
+	}
+	granted := 0
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		for _, u := range users {
+			if len(u.Services) > 0 || len(u.Groups) > 0 {
+				continue
+			}
+			if err := tx.Model(&User{}).Where("id = ?", u.ID).Update("services", `["`+AllServices+`"]`).Error; err != nil {
+				return err
+			}
+			granted++
+		}
+		return tx.Create(&Setting{Key: serviceGrantsSetting, Value: "done"}).Error
+	})
+	if err != nil {
+		log.Fatalf("❌ Failed to migrate service grants: %v", err)
+	}
+	if granted > 0 {
+		log.Printf("✅ Granted all services to %d users without groups or grants", granted)
+	}
+}
+
+// hasColumn checks the real columns of a table. Migrator().HasColumn pattern-matches the
+// CREATE statement in SQLite, so a column named "key" is "found" in "PRIMARY KEY".
+func hasColumn(table, column string) bool {
+	columns, err := DB.Migrator().ColumnTypes(table)
+	if err != nil {
+		return false
+	}
+	for _, c := range columns {
+		if strings.EqualFold(c.Name(), column) {
+			return true
+		}
+	}
+	return false
 }
@@ -13,54 +13,277 @@ const (
 	RoleUser       = "user"
 )
 
+// Role is a custom role defined by the super admin. The roles above are built in.
+type Role struct {
+	Name        string    `gorm:"primaryKey" json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `gorm:"serializer:json" json:"permissions"` // Names from the permission catalogue
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Billing Modes
+const (
+	BillingQuota  = "quota"  // Cost accumulates in UsedAmount up to Quota
+	BillingWallet = "wallet" // Cost is held on Balance before forwarding and settled afterwards
+)
+
 // User represents a system user (admin or client)
 type User struct {
-	ID           uint           `gorm:"primaryKey" json:"id"`
-	Username     string         `gorm:"uniqueIndex;not null" json:"username"`
-	PasswordHash string         `json:"-"`                          // Hashed password, not exposed in JSON
-	Role         string         `gorm:"default:'user'" json:"role"` // 'super_admin', 'admin', 'user'
-	Balance      float64        `gorm:"default:0" json:"balance"`   // Credit balance
-	Quota        float64        `gorm:"default:0" json:"quota"`     // Max quota allowed
-	UsedAmount   float64        `gorm:"default:0" json:"used_amount"`
-	APIKeys      []APIKey       `gorm:"foreignKey:UserID" json:"api_keys,omitempty"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                 uint           `gorm:"primaryKey" json:"id"`
+	Username           string         `gorm:"uniqueIndex;not null" json:"username"`
+	PasswordHash       string         `json:"-"`                                         // Hashed password, not exposed in JSON
+	MustChangePassword bool           `gorm:"default:false" json:"must_change_password"` // Set for the default admin until changed
+	Role               string         `gorm:"default:'user'" json:"role"`                // 'super_admin', 'admin', 'user'
+	Balance            float64        `gorm:"default:0" json:"balance"`                  // Credit balance (price currency)
+	Quota              float64        `gorm:"default:0" json:"quota"`                    // Spending limit (price currency), < 0 = unlimited
+	UsedAmount         float64        `gorm:"default:0" json:"used_amount"`              // Cost of requests so far (price currency)
+	QuotaReview        bool           `gorm:"default:false" json:"quota_review"`         // Token quota lifted by the currency migration, to be set again
+	BillingMode        string         `gorm:"default:'quota'" json:"billing_mode"`       // 'quota', 'wallet'
+	HeldAmount         float64        `gorm:"default:0" json:"held_amount"`              // Balance reserved by requests in flight
+	PlanID             *uint          `gorm:"index" json:"plan_id"`                      // Quota plan, replaces the lifetime Quota when set
+	PeriodStart        time.Time      `json:"period_start"`                              // Start of the current plan window
+	PeriodUsed         float64        `gorm:"default:0" json:"period_used"`              // Cost within the current plan window
+	PeriodCarry        float64        `gorm:"default:0" json:"period_carry"`             // Allowance rolled over from the previous window
+	Services           []string       `gorm:"serializer:json" json:"services"`           // Service names granted directly, on top of Groups
+	Groups             []UserGroup    `gorm:"many2many:user_group_members" json:"groups,omitempty"`
+	RPMLimit           int            `gorm:"default:0" json:"rpm_limit"`      // Requests per minute, 0 = unlimited
+	TPMLimit           int            `gorm:"default:0" json:"tpm_limit"`      // Tokens per minute, 0 = unlimited
+	MaxConcurrent      int            `gorm:"default:0" json:"max_concurrent"` // Requests in flight, 0 = unlimited
+	LogPayloads        bool           `json:"log_payloads"`                    // Capture request/response bodies of this user
+	APIKeys            []APIKey       `gorm:"foreignKey:UserID" json:"api_keys,omitempty"`
+	CreatedAt          time.Time      `json:"created_at"`
+	UpdatedAt          time.Time      `json:"updated_at"`
+	DeletedAt          gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 // APIKey represents a client verification token
 type APIKey struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
-	Key       string    `gorm:"uniqueIndex;not null" json:"key"` // "sk-..."
-	Name      string    `json:"name"`                            // "My Laptop", "Testing"
+	KeyHash   string    `gorm:"uniqueIndex" json:"-"`   // Salted hash of the "sk-..." secret
+	KeyPrefix string    `json:"key_prefix"`             // Visible start of the key, e.g. "sk-1a2b3c4d"
+	Key       string    `gorm:"-" json:"key,omitempty"` // Plaintext, only set in the creation response
+	Name      string    `json:"name"`                   // "My Laptop", "Testing"
 	UserID    uint      `gorm:"index;not null" json:"user_id"`
 	User      User      `json:"-"` // Belongs To Relation
 	LastUsed  time.Time `json:"last_used"`
 	CreatedAt time.Time `json:"created_at"`
 	IsActive  bool      `gorm:"default:true" json:"is_active"`
+
+	// Organization key: billed to the organization and kept when its creator (UserID) leaves
+	OrgID *uint `gorm:"index" json:"org_id"`
+
+	// Limits of this key on top of its user's, 0 = unlimited
+	RPMLimit      int `gorm:"default:0" json:"rpm_limit"`
+	TPMLimit      int `gorm:"default:0" json:"tpm_limit"`
+	MaxConcurrent int `gorm:"default:0" json:"max_concurrent"`
+
+	// Scope of this key, empty = unrestricted
+	ExpiresAt     *time.Time `json:"expires_at"`
+	SpendLimit    float64    `gorm:"default:0" json:"spend_limit"` // Price currency, 0 = only the user's quota applies
+	UsedAmount    float64    `gorm:"default:0" json:"used_amount"` // Cost of requests made with this key
+	AllowedModels []string   `gorm:"serializer:json" json:"allowed_models"`
+	AllowedCIDRs  []string   `gorm:"column:allowed_cidrs;serializer:json" json:"allowed_cidrs"` // Source networks, e.g. "10.0.0.0/8"
 }
 
 // Service represents an Upstream LLM Provider (replaces ServiceConfig)
 type Service struct {
 	ID           uint   `gorm:"primaryKey" json:"id"`
-	Name         string `gorm:"uniqueIndex;not null" json:"name"` // "claude-3-5-sonnet"
-	Type         string `json:"type"`                             // "openai", "anthropic", "gemini"
+	Name         string `gorm:"index;not null" json:"name"` // "claude-3-5-sonnet" (shared by load-balanced services)
+	Type         string `json:"type"`                       // "openai", "anthropic", "gemini"
 	BaseURL      string `json:"base_url"`
-	APIKey       string `json:"api_key"`       // Upstream Key (Legacy/Primary)
-	APIKeys      string `json:"api_keys_json"` // JSON Array of keys: ["sk-...", "sk-..."]
-	ModelMapping string `json:"model_mapping"` // JSON string: {"anyrouter-haiku": "claude-haiku"}
+	APIKey       string `json:"api_key"`                 // Upstream Key (Legacy/Primary)
+	APIKeys      string `json:"api_keys_json"`           // JSON Array of keys: ["sk-...", "sk-..."]
+	ModelMapping string `json:"model_mapping"`           // JSON string: {"anyrouter-haiku": "claude-haiku"}
+	Fallbacks    string `json:"fallbacks_json"`          // JSON Array of service names tried in order on failure
+	Weight       int    `gorm:"default:1" json:"weight"` // Relative share when several services share a Name
+	Strategy     string `json:"strategy"`                // "weighted" (default), "least_inflight", "latency"
 	IsActive     bool   `gorm:"default:true" json:"is_active"`
+
+	// Prices per 1M tokens, in the currency of User.Quota/UsedAmount/Balance
+	InputPrice       float64 `json:"input_price"`
+	OutputPrice      float64 `json:"output_price"`
+	CachedInputPrice float64 `json:"cached_input_price"` // 0 = same as InputPrice
+
+	LogPayloads bool   `gorm:"default:false" json:"log_payloads"` // Capture request/response bodies
+	ParamPolicy string `json:"param_policy"`                      // Unsupported sampling parameters: "drop" (default) or "reject"
 }
 
 // RequestLog stores usage statistics (replaces file-based stats)
 type RequestLog struct {
 	ID               uint      `gorm:"primaryKey" json:"id"`
 	UserID           uint      `gorm:"index" json:"user_id"`
+	OrgID            uint      `gorm:"index" json:"org_id"`
 	ServiceModel     string    `gorm:"index" json:"model"` // The model name requested
 	UpstreamModel    string    `json:"upstream_model"`
 	PromptTokens     int       `json:"prompt_tokens"`
 	CompletionTokens int       `json:"completion_tokens"`
+	CachedTokens     int       `json:"cached_tokens"` // Part of PromptTokens read from the upstream cache
+	Cost             float64   `json:"cost"`          // Charged amount, computed from the service prices
 	DurationMs       int64     `json:"duration_ms"`
 	Status           int       `json:"status"` // HTTP Status Code (200, 500, etc)
 	CreatedAt        time.Time `gorm:"index" json:"created_at"`
 }
+
+// UpstreamKeyState persists the health of a pooled upstream key (identified by fingerprint, never the key itself)
+type UpstreamKeyState struct {
+	Fingerprint   string    `gorm:"primaryKey" json:"fingerprint"`
+	ServiceName   string    `json:"service_name"`
+	Status        string    `gorm:"default:'active'" json:"status"` // 'active', 'cooldown', 'circuit_open', 'disabled'
+	CooldownUntil time.Time `json:"cooldown_until"`
+	Failures      int       `json:"consecutive_failures"`
+	LastStatus    int       `json:"last_status"` // Last upstream HTTP status (0 = connection error)
+	LastError     string    `json:"last_error"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// JWTKey is a generated JWT signing secret, used when none is configured through the environment
+type JWTKey struct {
+	KID       string     `gorm:"primaryKey" json:"kid"`
+	Secret    string     `gorm:"not null" json:"-"` // base64
+	IsCurrent bool       `json:"is_current"`        // Signs new tokens; the others only verify
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at"` // When it stopped signing, dropped once its tokens expired
+}
+
+// RevokedToken invalidates a JWT before it expires. With a JTI it revokes that token,
+// without one it revokes every token of the user issued before RevokedAt.
+type RevokedToken struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	JTI       string    `gorm:"index" json:"jti"`
+	UserID    uint      `gorm:"index" json:"user_id"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"` // Row can be dropped afterwards
+}
+
+// WalletTransaction is a ledger entry of a wallet user. Amount moves the balance,
+// HeldDelta the reserved part of it.
+type WalletTransaction struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	UserID       uint      `gorm:"index" json:"user_id"`
+	OrgID        uint      `gorm:"index" json:"org_id"` // Set for organization wallets, UserID is then 0
+	Type         string    `gorm:"index" json:"type"`   // 'topup', 'adjust', 'hold', 'settle', 'release'
+	Amount       float64   `json:"amount"`
+	HeldDelta    float64   `json:"held_delta"`
+	BalanceAfter float64   `json:"balance_after"`
+	Reference    string    `json:"reference"`   // Model of the request, for hold/settle/release
+	OperatorID   uint      `json:"operator_id"` // Admin who made a top-up or adjustment
+	Note         string    `json:"note"`
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+}
+
+// AllServices in a list of granted service names grants every service
+const AllServices = "*"
+
+// UserGroup grants its members access to a set of services. Users without groups or
+// direct grants can call no service.
+type UserGroup struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Name        string    `gorm:"uniqueIndex;not null" json:"name"`
+	Description string    `json:"description"`
+	Services    []string  `gorm:"serializer:json" json:"services"` // Service names, or AllServices
+	Users       []User    `gorm:"many2many:user_group_members" json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Organization Member Roles
+const (
+	OrgRoleOwner  = "owner"  // Manages members including admins and owners
+	OrgRoleAdmin  = "admin"  // Manages members and organization keys
+	OrgRoleMember = "member" // Sees the organization's keys and statistics
+)
+
+// Organization is a team with a shared budget and API keys of its own.
+// The budget works like a user's: a Quota in quota mode, a Balance in wallet mode.
+type Organization struct {
+	ID          uint        `gorm:"primaryKey" json:"id"`
+	Name        string      `gorm:"uniqueIndex;not null" json:"name"`
+	Description string      `json:"description"`
+	BillingMode string      `gorm:"default:'quota'" json:"billing_mode"` // 'quota', 'wallet'
+	Quota       float64     `gorm:"default:0" json:"quota"`              // Spending limit (price currency), < 0 = unlimited
+	UsedAmount  float64     `gorm:"default:0" json:"used_amount"`        // Cost of requests made with organization keys
+	Balance     float64     `gorm:"default:0" json:"balance"`
+	HeldAmount  float64     `gorm:"default:0" json:"held_amount"`
+	Services    []string    `gorm:"serializer:json" json:"services"` // Service names its keys may call, or AllServices
+	Members     []OrgMember `gorm:"foreignKey:OrgID" json:"-"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// OrgMember is a user's membership in an organization
+type OrgMember struct {
+	OrgID     uint      `gorm:"primaryKey" json:"org_id"`
+	UserID    uint      `gorm:"primaryKey;index" json:"user_id"`
+	User      User      `json:"-"`
+	Role      string    `gorm:"default:'member'" json:"role"` // 'owner', 'admin', 'member'
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Quota Plan Periods
+const (
+	PeriodDaily   = "daily"
+	PeriodWeekly  = "weekly"
+	PeriodMonthly = "monthly"
+)
+
+// QuotaPlan is a spending allowance that renews every period
+type QuotaPlan struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"uniqueIndex;not null" json:"name"`
+	Period    string    `gorm:"not null" json:"period"`           // 'daily', 'weekly', 'monthly'
+	Limit     float64   `gorm:"column:period_limit" json:"limit"` // Per period (price currency), < 0 = unlimited
+	Rollover  bool      `json:"rollover"`                         // Carry unused allowance (up to one Limit) into the next period
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Setting is a generated server-side value that must survive restarts
+type Setting struct {
+	Key       string    `gorm:"primaryKey" json:"key"`
+	Value     string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuditLog is one administrative action. Entries form a hash chain: Hash covers the entry
+// and PrevHash, so editing or deleting a row breaks the chain from there on.
+type AuditLog struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+	ActorID    uint      `gorm:"index" json:"actor_id"`
+	Actor      string    `json:"actor"`               // Username at the time of the action
+	Action     string    `gorm:"index" json:"action"` // e.g. "user.create", "service.update"
+	TargetType string    `gorm:"index" json:"target_type"`
+	TargetID   string    `gorm:"index" json:"target_id"`
+	Target     string    `json:"target"`                // Readable name of the target, e.g. the username
+	Diff       string    `gorm:"type:text" json:"diff"` // JSON object: field -> {"before", "after"}
+	IP         string    `json:"ip"`
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `gorm:"uniqueIndex" json:"hash"`
+}
+
+// Redaction rule kinds
+const (
+	RedactRegex    = "regex"
+	RedactJSONPath = "json_path"
+)
+
+// RedactionRule masks part of captured payloads before they are stored
+type RedactionRule struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Kind        string    `gorm:"not null" json:"kind"`    // 'regex', 'json_path'
+	Pattern     string    `gorm:"not null" json:"pattern"` // Regular expression, or dotted path with * wildcards, e.g. "messages.*.content"
+	Replacement string    `json:"replacement"`             // Empty = "[REDACTED]"
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// RequestPayload holds the bodies of a request whose user or service has payload logging on
+type RequestPayload struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	RequestLogID uint      `gorm:"uniqueIndex" json:"request_log_id"`
+	UserID       uint      `gorm:"index" json:"user_id"`
+	ServiceModel string    `gorm:"index" json:"model"`
+	Request      string    `gorm:"type:text" json:"request,omitempty"`
+	Response     string    `gorm:"type:text" json:"response,omitempty"` // As sent to the client, SSE events for streams
+	Output       string    `gorm:"type:text" json:"output,omitempty"`   // Text reassembled from a streamed response
+	Streamed     bool      `json:"streamed"`
+	Truncated    bool      `json:"truncated"` // A body was cut after redaction
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+}
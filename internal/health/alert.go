@@ -0,0 +1,31 @@
+package health
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Alert notifies admins: always logged, and POSTed as {"text": msg} to
+// QISERVICE_ALERT_WEBHOOK when set (Slack/Feishu/DingTalk style incoming webhooks).
+func Alert(msg string) {
+	log.Printf("🚨 [Alert] %s", msg)
+
+	webhook := os.Getenv("QISERVICE_ALERT_WEBHOOK")
+	if webhook == "" {
+		return
+	}
+	go func() {
+		body, _ := json.Marshal(map[string]string{"text": msg})
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("[Alert] Webhook failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,177 @@
+package health
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"qiservice/internal/db"
+)
+
+// Key states
+const (
+	KeyActive      = "active"
+	KeyCooldown    = "cooldown"     // 429: rested until Retry-After
+	KeyCircuitOpen = "circuit_open" // repeated 5xx / connection errors
+	KeyDisabled    = "disabled"     // 401/403: needs an admin
+)
+
+const (
+	// circuitThreshold consecutive failures open the circuit of a key
+	circuitThreshold = 3
+	// circuitOpenFor is how long an open circuit rejects traffic before a trial request
+	circuitOpenFor = 60 * time.Second
+	// defaultCooldown applies to a 429 without Retry-After
+	defaultCooldown = 30 * time.Second
+)
+
+// KeyTracker keeps the health of every pooled upstream key, keyed by fingerprint
+type KeyTracker struct {
+	mu     sync.RWMutex
+	states map[string]*db.UpstreamKeyState
+}
+
+var Keys *KeyTracker
+
+// Init loads persisted key states
+func Init() {
+	Keys = &KeyTracker{states: make(map[string]*db.UpstreamKeyState)}
+
+	var rows []db.UpstreamKeyState
+	if err := db.DB.Find(&rows).Error; err != nil {
+		log.Printf("[Health] Failed to load key states: %v", err)
+		return
+	}
+	for i := range rows {
+		Keys.states[rows[i].Fingerprint] = &rows[i]
+	}
+}
+
+// Fingerprint identifies an upstream key without storing it
+func Fingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Available reports whether a key may receive traffic. Cooldowns and open circuits
+// expire on their own (the next request acts as the trial); disabled keys never do.
+func (t *KeyTracker) Available(fp string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	st, ok := t.states[fp]
+	if !ok {
+		return true
+	}
+	switch st.Status {
+	case KeyDisabled:
+		return false
+	case KeyCooldown, KeyCircuitOpen:
+		return time.Now().After(st.CooldownUntil)
+	default:
+		return true
+	}
+}
+
+// State returns a copy of the tracked state (Status "active" if unknown)
+func (t *KeyTracker) State(fp string) db.UpstreamKeyState {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if st, ok := t.states[fp]; ok {
+		return *st
+	}
+	return db.UpstreamKeyState{Fingerprint: fp, Status: KeyActive}
+}
+
+// ReportSuccess closes the circuit of a key
+func (t *KeyTracker) ReportSuccess(fp string) {
+	t.mu.Lock()
+	st, ok := t.states[fp]
+	if !ok || (st.Status == KeyActive && st.Failures == 0) {
+		t.mu.Unlock()
+		return
+	}
+	st.Status = KeyActive
+	st.Failures = 0
+	st.CooldownUntil = time.Time{}
+	snapshot := *st
+	t.mu.Unlock()
+
+	persist(snapshot)
+}
+
+// ReportFailure records a failed upstream call. status is 0 for connection errors.
+func (t *KeyTracker) ReportFailure(fp, serviceName string, status int, retryAfter time.Duration, errMsg string) {
+	t.mu.Lock()
+	st, ok := t.states[fp]
+	if !ok {
+		st = &db.UpstreamKeyState{Fingerprint: fp, Status: KeyActive}
+		t.states[fp] = st
+	}
+	st.ServiceName = serviceName
+	st.LastStatus = status
+	st.LastError = errMsg
+	if len(st.LastError) > 500 {
+		st.LastError = st.LastError[:500]
+	}
+
+	alert := false
+	switch {
+	case status == 401 || status == 403:
+		alert = st.Status != KeyDisabled
+		st.Status = KeyDisabled
+	case status == 429:
+		if retryAfter <= 0 {
+			retryAfter = defaultCooldown
+		}
+		st.Status = KeyCooldown
+		st.CooldownUntil = time.Now().Add(retryAfter)
+	case status == 0 || status >= 500:
+		st.Failures++
+		if st.Failures >= circuitThreshold {
+			st.Status = KeyCircuitOpen
+			st.CooldownUntil = time.Now().Add(circuitOpenFor)
+		}
+	default:
+		// Other 4xx are the caller's fault, not the key's
+		t.mu.Unlock()
+		return
+	}
+	snapshot := *st
+	t.mu.Unlock()
+
+	if alert {
+		Alert(fmt.Sprintf("Upstream key %s of service %s was rejected with %d and has been disabled: %s", fp, serviceName, status, snapshot.LastError))
+	}
+	persist(snapshot)
+}
+
+// Reset puts a key back into rotation (admin action)
+func (t *KeyTracker) Reset(fp string) {
+	t.mu.Lock()
+	st, ok := t.states[fp]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	st.Status = KeyActive
+	st.Failures = 0
+	st.CooldownUntil = time.Time{}
+	st.LastError = ""
+	snapshot := *st
+	t.mu.Unlock()
+
+	persist(snapshot)
+}
+
+func persist(st db.UpstreamKeyState) {
+	go func() {
+		if err := db.DB.Save(&st).Error; err != nil {
+			log.Printf("[Health] Failed to save key state %s: %v", st.Fingerprint, err)
+		}
+	}()
+}
@@ -0,0 +1,144 @@
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// Service states
+const (
+	ServiceUnknown = "unknown" // not probed yet
+	ServiceUp      = "up"
+	ServiceDown    = "down" // circuit open, skipped by routing
+)
+
+const (
+	// serviceThreshold consecutive failures open the circuit of a service
+	serviceThreshold = 3
+	// serviceOpenFor is how long an open service is skipped before a trial request
+	serviceOpenFor = 60 * time.Second
+	// serviceTrialTimeout frees the trial slot of a request that never reported back
+	serviceTrialTimeout = 2 * time.Minute
+)
+
+// ServiceState is the health of one upstream service as seen by the prober and by live traffic
+type ServiceState struct {
+	Status    string    `json:"status"`
+	LatencyMs int64     `json:"latency_ms"` // Of the last successful probe
+	LastError string    `json:"last_error"`
+	LastCheck time.Time `json:"last_check"`
+	OpenUntil time.Time `json:"open_until"`
+	Failures  int       `json:"consecutive_failures"`
+
+	trialAt time.Time // When the half-open trial request was let through, zero = none
+}
+
+// ServiceTracker keeps the circuit breaker of every upstream service, keyed by service ID.
+// It lives in memory only: the prober rebuilds it within one interval after a restart.
+type ServiceTracker struct {
+	mu     sync.RWMutex
+	states map[string]*ServiceState
+}
+
+var Services = &ServiceTracker{states: make(map[string]*ServiceState)}
+
+// Available reports whether a service may receive traffic. Once serviceOpenFor has elapsed an
+// open circuit is half-open: a single trial request is let through and the others are refused
+// until its outcome is reported.
+func (t *ServiceTracker) Available(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, ok := t.states[id]
+	if !ok || st.Status != ServiceDown {
+		return true
+	}
+	now := time.Now()
+	if now.Before(st.OpenUntil) || (!st.trialAt.IsZero() && now.Before(st.trialAt.Add(serviceTrialTimeout))) {
+		return false
+	}
+	st.trialAt = now
+	return true
+}
+
+// Degraded reports whether the circuit of a service is open
+func (t *ServiceTracker) Degraded(id string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	st, ok := t.states[id]
+	return ok && st.Status == ServiceDown
+}
+
+// State returns a copy of the tracked state (Status "unknown" if never checked)
+func (t *ServiceTracker) State(id string) ServiceState {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if st, ok := t.states[id]; ok {
+		return *st
+	}
+	return ServiceState{Status: ServiceUnknown}
+}
+
+// ReportSuccess closes the circuit of a service. latency is 0 when not measured.
+func (t *ServiceTracker) ReportSuccess(id string, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := t.get(id)
+	st.Status = ServiceUp
+	st.Failures = 0
+	st.OpenUntil = time.Time{}
+	st.trialAt = time.Time{}
+	st.LastCheck = time.Now()
+	if latency > 0 {
+		st.LatencyMs = latency.Milliseconds()
+	}
+}
+
+// ReportFailure records a connection error or 5xx of a service
+func (t *ServiceTracker) ReportFailure(id, serviceName, errMsg string) {
+	t.mu.Lock()
+	st := t.get(id)
+	st.Failures++
+	st.LastCheck = time.Now()
+	st.trialAt = time.Time{}
+	st.LastError = errMsg
+	if len(st.LastError) > 500 {
+		st.LastError = st.LastError[:500]
+	}
+
+	opened := false
+	if st.Failures >= serviceThreshold {
+		opened = st.Status != ServiceDown
+		st.Status = ServiceDown
+		st.OpenUntil = time.Now().Add(serviceOpenFor)
+	}
+	t.mu.Unlock()
+
+	if opened {
+		Alert("Upstream service " + serviceName + " is down, circuit opened: " + errMsg)
+	}
+}
+
+// Forget drops services that are no longer configured
+func (t *ServiceTracker) Forget(keep map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id := range t.states {
+		if !keep[id] {
+			delete(t.states, id)
+		}
+	}
+}
+
+func (t *ServiceTracker) get(id string) *ServiceState {
+	st, ok := t.states[id]
+	if !ok {
+		st = &ServiceState{Status: ServiceUnknown}
+		t.states[id] = st
+	}
+	return st
+}
@@ -0,0 +1,73 @@
+// Package metrics holds the Prometheus metrics of the gateway, served on /metrics.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Route values: how a request reached its upstream
+const (
+	RouteProxy   = "proxy"   // Fast path, relayed as is
+	RouteAdapter = "adapter" // Converted between protocols
+	RouteNone    = "none"    // Never reached an upstream (rejected, unknown model...)
+)
+
+// Registry holds every gateway metric plus the Go runtime and process collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qiservice_requests_total",
+		Help: "Model requests by service, route, HTTP status and user.",
+	}, []string{"service", "route", "status", "user"})
+
+	Tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qiservice_tokens_total",
+		Help: "Tokens billed by service, user and type (input, output, cached).",
+	}, []string{"service", "user", "type"})
+
+	Duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "qiservice_request_duration_seconds",
+		Help:    "Time until the response was complete.",
+		Buckets: []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80, 160},
+	}, []string{"service", "route"})
+
+	TimeToFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "qiservice_time_to_first_token_seconds",
+		Help:    "Time until the first chunk of a streamed response was sent to the client.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 32},
+	}, []string{"service", "route"})
+
+	InFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "qiservice_requests_in_flight",
+		Help: "Model requests currently being served.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Requests, Tokens, Duration, TimeToFirstToken, InFlight,
+	)
+}
+
+// Handler serves the registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Observation is what a model handler reports about the request it served
+type Observation struct {
+	Model         string // Requested by the client
+	Service       string // Name of the service that answered, "" if none
+	UpstreamModel string // Sent to that service
+	Route         string // RouteProxy or RouteAdapter
+	TokensIn      int
+	TokensOut     int
+	TokensCached  int
+}
@@ -0,0 +1,301 @@
+// Package payload stores the request and response bodies of users and services that opted in
+// to payload logging. Redaction rules run before anything is written, and stored payloads
+// expire after the retention period.
+package payload
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"qiservice/internal/db"
+)
+
+const (
+	// MaxBodyBytes is the most kept of one body after redaction, the rest is cut and the
+	// payload marked truncated
+	MaxBodyBytes = 256 << 10
+	// MaxCaptureBytes is the largest body captured for redaction, larger ones are not stored
+	MaxCaptureBytes = 8 << 20
+
+	// NotStored replaces a body that is not stored because it could not be redacted
+	NotStored = "[not stored: redaction could not be applied]"
+
+	defaultReplacement = "[REDACTED]"
+	defaultRetention   = 7 // Days
+	cleanupInterval    = time.Hour
+)
+
+// rule is a compiled RedactionRule
+type rule struct {
+	re          *regexp.Regexp // Kind regex
+	path        []string       // Kind json_path
+	replacement string
+}
+
+var rules struct {
+	sync.RWMutex
+	list []rule
+}
+
+// Start loads the redaction rules and deletes expired payloads in the background.
+// QISERVICE_PAYLOAD_RETENTION_DAYS overrides the retention (7 days), "0" keeps payloads forever.
+func Start() {
+	LoadRules()
+
+	days := defaultRetention
+	if v := os.Getenv("QISERVICE_PAYLOAD_RETENTION_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("[Payload] Invalid QISERVICE_PAYLOAD_RETENTION_DAYS %q, using %d", v, days)
+		} else {
+			days = n
+		}
+	}
+	if days == 0 {
+		return
+	}
+	retention := time.Duration(days) * 24 * time.Hour
+	go func() {
+		for {
+			purge(time.Now().Add(-retention))
+			time.Sleep(cleanupInterval)
+		}
+	}()
+}
+
+func purge(before time.Time) {
+	res := db.DB.Where("created_at < ?", before).Delete(&db.RequestPayload{})
+	if res.Error != nil {
+		log.Printf("[Payload] Failed to delete expired payloads: %v", res.Error)
+	} else if res.RowsAffected > 0 {
+		log.Printf("[Payload] Deleted %d expired payloads", res.RowsAffected)
+	}
+}
+
+// compile checks a rule and prepares it for use
+func compile(r db.RedactionRule) (rule, error) {
+	out := rule{replacement: r.Replacement}
+	if out.replacement == "" {
+		out.replacement = defaultReplacement
+	}
+	switch r.Kind {
+	case db.RedactRegex:
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return out, fmt.Errorf("invalid regular expression: %w", err)
+		}
+		out.re = re
+	case db.RedactJSONPath:
+		path := strings.TrimPrefix(strings.TrimPrefix(r.Pattern, "$"), ".")
+		if path == "" {
+			return out, fmt.Errorf("empty JSON path")
+		}
+		out.path = strings.Split(path, ".")
+	default:
+		return out, fmt.Errorf("unknown rule kind %q", r.Kind)
+	}
+	return out, nil
+}
+
+// Validate reports why a rule cannot be used, nil when it can
+func Validate(r db.RedactionRule) error {
+	_, err := compile(r)
+	return err
+}
+
+// LoadRules refreshes the redaction rules, call it after they change
+func LoadRules() {
+	var rows []db.RedactionRule
+	if err := db.DB.Order("id").Find(&rows).Error; err != nil {
+		log.Printf("[Payload] Failed to load redaction rules: %v", err)
+		return
+	}
+	list := make([]rule, 0, len(rows))
+	for _, r := range rows {
+		c, err := compile(r)
+		if err != nil {
+			log.Printf("[Payload] Skipping redaction rule %d: %v", r.ID, err)
+			continue
+		}
+		list = append(list, c)
+	}
+	rules.Lock()
+	rules.list = list
+	rules.Unlock()
+}
+
+// Redact applies the rules to a body: JSON paths to JSON bodies (or to each "data:" line of
+// an SSE stream), then regular expressions to the text. ok is false when path rules could not
+// be applied: the body, or a "data:" line, looks like JSON but does not parse.
+func Redact(body string) (redacted string, ok bool) {
+	rules.RLock()
+	list := rules.list
+	rules.RUnlock()
+	if len(list) == 0 || body == "" {
+		return body, true
+	}
+
+	var paths []rule
+	for _, r := range list {
+		if r.path != nil {
+			paths = append(paths, r)
+		}
+	}
+	if len(paths) > 0 {
+		if doc, ok := redactJSON(body, paths); ok {
+			body = doc
+		} else if strings.Contains(body, "data:") {
+			lines := strings.Split(body, "\n")
+			for i, line := range lines {
+				if data, ok := cutData(line); ok && data != "[DONE]" {
+					if doc, ok := redactJSON(data, paths); ok {
+						lines[i] = "data: " + doc
+					} else if looksLikeJSON(data) {
+						return "", false
+					}
+				}
+			}
+			body = strings.Join(lines, "\n")
+		} else if looksLikeJSON(body) {
+			return "", false
+		}
+	}
+
+	for _, r := range list {
+		if r.re != nil {
+			body = r.re.ReplaceAllString(body, r.replacement)
+		}
+	}
+	return body, true
+}
+
+// looksLikeJSON reports whether s starts like a JSON object or array
+func looksLikeJSON(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[")
+}
+
+// redactJSON applies path rules to a JSON document, ok is false when s is not one
+func redactJSON(s string, paths []rule) (string, bool) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(s), &doc); err != nil {
+		return s, false
+	}
+	for _, r := range paths {
+		doc = redactPath(doc, r.path, r.replacement)
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return s, false
+	}
+	return string(out), true
+}
+
+// redactPath replaces the values at path; "*" matches every key or element, numbers index arrays
+func redactPath(v interface{}, path []string, replacement string) interface{} {
+	if len(path) == 0 {
+		return replacement
+	}
+	seg, rest := path[0], path[1:]
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			if seg == "*" || seg == k {
+				node[k] = redactPath(child, rest, replacement)
+			}
+		}
+	case []interface{}:
+		idx, err := strconv.Atoi(seg)
+		for i, child := range node {
+			if seg == "*" || (err == nil && i == idx) {
+				node[i] = redactPath(child, rest, replacement)
+			}
+		}
+	}
+	return v
+}
+
+// cutData returns the payload of an SSE "data:" line
+func cutData(line string) (string, bool) {
+	data, ok := strings.CutPrefix(strings.TrimRight(line, "\r"), "data:")
+	return strings.TrimSpace(data), ok
+}
+
+// Reassemble extracts the generated text of a streamed response: OpenAI chunks (content and
+// tool call arguments) and Anthropic events (text and tool input deltas)
+func Reassemble(stream string) string {
+	var out strings.Builder
+	for _, line := range strings.Split(stream, "\n") {
+		data, ok := cutData(line)
+		if !ok || data == "" || data == "[DONE]" {
+			continue
+		}
+		var ev struct {
+			Choices []struct {
+				Delta struct {
+					Content   string `json:"content"`
+					ToolCalls []struct {
+						Function struct {
+							Name      string `json:"name"`
+							Arguments string `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Delta struct {
+				Text        string `json:"text"`
+				PartialJSON string `json:"partial_json"`
+			} `json:"delta"`
+			ContentBlock struct {
+				Type string `json:"type"`
+				Name string `json:"name"`
+			} `json:"content_block"`
+		}
+		if json.Unmarshal([]byte(data), &ev) != nil {
+			continue
+		}
+		for _, ch := range ev.Choices {
+			out.WriteString(ch.Delta.Content)
+			for _, tc := range ch.Delta.ToolCalls {
+				if tc.Function.Name != "" {
+					out.WriteString("\n[tool_call " + tc.Function.Name + "] ")
+				}
+				out.WriteString(tc.Function.Arguments)
+			}
+		}
+		if ev.ContentBlock.Type == "tool_use" {
+			out.WriteString("\n[tool_use " + ev.ContentBlock.Name + "] ")
+		}
+		out.WriteString(ev.Delta.Text)
+		out.WriteString(ev.Delta.PartialJSON)
+	}
+	return out.String()
+}
+
+// Store redacts the full bodies of p, cuts them to MaxBodyBytes and saves p; RequestLogID
+// must be set. A body the rules cannot be applied to is replaced by NotStored.
+func Store(p *db.RequestPayload) {
+	if p.Streamed {
+		p.Output = Reassemble(p.Response)
+	}
+	for _, body := range []*string{&p.Request, &p.Response, &p.Output} {
+		redacted, ok := Redact(*body)
+		if !ok {
+			redacted = NotStored
+		}
+		if len(redacted) > MaxBodyBytes {
+			redacted, p.Truncated = strings.ToValidUTF8(redacted[:MaxBodyBytes], ""), true
+		}
+		*body = redacted
+	}
+	if err := db.DB.Create(p).Error; err != nil {
+		log.Printf("[Payload] Failed to store payload of request %d: %v", p.RequestLogID, err)
+	}
+}
@@ -0,0 +1,81 @@
+package payload
+
+import (
+	"testing"
+
+	"qiservice/internal/db"
+)
+
+func setRules(t *testing.T, rs ...db.RedactionRule) {
+	t.Helper()
+	list := make([]rule, 0, len(rs))
+	for _, r := range rs {
+		c, err := compile(r)
+		if err != nil {
+			t.Fatalf("rule %v: %v", r, err)
+		}
+		list = append(list, c)
+	}
+	rules.Lock()
+	rules.list = list
+	rules.Unlock()
+}
+
+func TestRedact(t *testing.T) {
+	email := db.RedactionRule{Kind: db.RedactRegex, Pattern: `[\w.]+@[\w.]+`, Replacement: "<email>"}
+	content := db.RedactionRule{Kind: db.RedactJSONPath, Pattern: "$.messages.*.content"}
+	firstKey := db.RedactionRule{Kind: db.RedactJSONPath, Pattern: "keys.0"}
+
+	tests := []struct {
+		name  string
+		rules []db.RedactionRule
+		body  string
+		want  string
+		ok    bool
+	}{
+		{"no rules", nil, `{"a":"x@y.z"}`, `{"a":"x@y.z"}`, true},
+		{"regex", []db.RedactionRule{email}, "mail x@y.z now", "mail <email> now", true},
+		{"json path with wildcard", []db.RedactionRule{content},
+			`{"model":"m","messages":[{"role":"user","content":"secret"},{"role":"assistant","content":"also"}]}`,
+			`{"messages":[{"content":"[REDACTED]","role":"user"},{"content":"[REDACTED]","role":"assistant"}],"model":"m"}`, true},
+		{"json path array index", []db.RedactionRule{firstKey}, `{"keys":["a","b"]}`, `{"keys":["[REDACTED]","b"]}`, true},
+		{"missing path leaves the body", []db.RedactionRule{content}, `{"prompt":"hi"}`, `{"prompt":"hi"}`, true},
+		{"path then regex", []db.RedactionRule{content, email},
+			`{"messages":[{"content":"x@y.z"}],"user":"a@b.c"}`,
+			`{"messages":[{"content":"[REDACTED]"}],"user":"<email>"}`, true},
+		{"sse data lines", []db.RedactionRule{content},
+			"data: {\"messages\":[{\"content\":\"s\"}]}\n\ndata: [DONE]\n",
+			"data: {\"messages\":[{\"content\":\"[REDACTED]\"}]}\n\ndata: [DONE]\n", true},
+		{"plain text with path rules", []db.RedactionRule{content}, "not json", "not json", true},
+		{"broken json is not stored", []db.RedactionRule{content}, `{"messages":[{"content":"s"}`, "", false},
+		{"broken sse line is not stored", []db.RedactionRule{content}, "data: {\"messages\":[\ndata: [DONE]\n", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRules(t, tt.rules...)
+			got, ok := Redact(tt.body)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("Redact(%q) = %q, %v, want %q, %v", tt.body, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+	setRules(t)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		rule  db.RedactionRule
+		valid bool
+	}{
+		{db.RedactionRule{Kind: db.RedactRegex, Pattern: `sk-\w+`}, true},
+		{db.RedactionRule{Kind: db.RedactRegex, Pattern: `(`}, false},
+		{db.RedactionRule{Kind: db.RedactJSONPath, Pattern: "$.a.b"}, true},
+		{db.RedactionRule{Kind: db.RedactJSONPath, Pattern: "$"}, false},
+		{db.RedactionRule{Kind: "glob", Pattern: "*"}, false},
+	}
+	for _, tt := range tests {
+		if err := Validate(tt.rule); (err == nil) != tt.valid {
+			t.Errorf("Validate(%v) = %v, want valid %v", tt.rule, err, tt.valid)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"qiservice/internal/provider"
+	"qiservice/internal/tracing"
 	"strings"
 	"time"
 )
@@ -35,6 +36,59 @@ type AnthropicRequest struct {
 	MaxTokens int                `json:"max_tokens"`
 	Stream    bool               `json:"stream,omitempty"`
 	Tools     []AnthropicTool    `json:"tools,omitempty"`
+
+	ToolChoice *AnthropicToolChoice `json:"tool_choice,omitempty"`
+
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	TopK          *int               `json:"top_k,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Metadata      *AnthropicMetadata `json:"metadata,omitempty"`
+
+	Thinking *provider.ThinkingConfig `json:"thinking,omitempty"`
+}
+
+type AnthropicMetadata struct {
+	UserID string `json:"user_id,omitempty"`
+}
+
+// AnthropicToolChoice is {"type": "auto" | "any" | "none" | "tool", "name": ...}
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+// ToOpenAI returns the OpenAI tool_choice equivalent
+func (t *AnthropicToolChoice) ToOpenAI() interface{} {
+	if t == nil {
+		return nil
+	}
+	switch t.Type {
+	case "any":
+		return "required"
+	case "tool":
+		return map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": t.Name}}
+	}
+	return t.Type // auto, none
+}
+
+// anthropicToolChoice converts an OpenAI tool_choice
+func anthropicToolChoice(choice interface{}) *AnthropicToolChoice {
+	switch v := choice.(type) {
+	case string:
+		if v == "required" {
+			return &AnthropicToolChoice{Type: "any"}
+		}
+		if v == "auto" || v == "none" {
+			return &AnthropicToolChoice{Type: v}
+		}
+	case map[string]interface{}:
+		if fn, ok := v["function"].(map[string]interface{}); ok {
+			name, _ := fn["name"].(string)
+			return &AnthropicToolChoice{Type: "tool", Name: name}
+		}
+	}
+	return nil
 }
 
 type AnthropicTool struct {
@@ -52,15 +106,35 @@ type AnthropicMessage struct {
 	Usage   *Usage      `json:"usage,omitempty"`
 }
 
+// Usage of a response. InputTokens excludes the prompt cache reads and writes.
 type Usage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+}
+
+// ToOpenAI returns the OpenAI usage, where prompt tokens include the cached ones
+func (u Usage) ToOpenAI() provider.Usage {
+	prompt := u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+	usage := provider.Usage{PromptTokens: prompt, CompletionTokens: u.OutputTokens, TotalTokens: prompt + u.OutputTokens}
+	if u.CacheReadInputTokens > 0 {
+		usage.PromptTokensDetails = &provider.PromptTokensDetails{CachedTokens: u.CacheReadInputTokens}
+	}
+	return usage
+}
+
+// NewUsage converts an OpenAI usage
+func NewUsage(u provider.Usage) *Usage {
+	cached := u.CachedTokens()
+	return &Usage{InputTokens: u.PromptTokens - cached, OutputTokens: u.CompletionTokens, CacheReadInputTokens: cached}
 }
 
 type AnthropicResponse struct {
 	ID           string             `json:"id"`
 	Type         string             `json:"type"`
 	Role         string             `json:"role"`
+	Model        string             `json:"model"`
 	Content      []AnthropicContent `json:"content"`
 	StopReason   *string            `json:"stop_reason"`
 	StopSequence *string            `json:"stop_sequence"`
@@ -68,8 +142,31 @@ type AnthropicResponse struct {
 }
 
 type AnthropicContent struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
+	Type      string          `json:"type"`
+	Text      string          `json:"text"`
+	Thinking  string          `json:"thinking"`
+	Signature string          `json:"signature"`
+	Data      string          `json:"data"` // redacted_thinking
+	ID        string          `json:"id"`   // tool_use
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+}
+
+// MarshalJSON writes only the fields of the block type
+func (c AnthropicContent) MarshalJSON() ([]byte, error) {
+	switch c.Type {
+	case provider.ThinkingTypeThinking:
+		return json.Marshal(map[string]string{"type": c.Type, "thinking": c.Thinking, "signature": c.Signature})
+	case provider.ThinkingTypeRedacted:
+		return json.Marshal(map[string]string{"type": c.Type, "data": c.Data})
+	case "tool_use":
+		input := c.Input
+		if !json.Valid(input) {
+			input = json.RawMessage("{}")
+		}
+		return json.Marshal(map[string]interface{}{"type": c.Type, "id": c.ID, "name": c.Name, "input": input})
+	}
+	return json.Marshal(map[string]string{"type": c.Type, "text": c.Text})
 }
 
 // ExtractText retrieves text from string or []map[string]interface{} (json unmarshal result)
@@ -99,11 +196,41 @@ func ExtractText(content interface{}) string {
 	return ""
 }
 
-func (p *AnthropicProvider) ChatCompletion(ctx context.Context, req provider.ChatCompletionRequest, apiKey string) (*provider.ChatCompletionResponse, error) {
+// toAnthropicRequest converts an OpenAI style request to the Messages API format
+func toAnthropicRequest(req provider.ChatCompletionRequest) (AnthropicRequest, error) {
 	anthropicReq := AnthropicRequest{
 		Model:     req.Model,
 		MaxTokens: 4096, // Default max tokens as Anthropic requires it
 		Messages:  []AnthropicMessage{},
+		Stream:    req.Stream,
+
+		TopP:          req.TopP,
+		TopK:          req.TopK,
+		StopSequences: req.Stop,
+	}
+	if limit := req.MaxOutputTokens(); limit != nil {
+		anthropicReq.MaxTokens = *limit
+	}
+	if t := req.Temperature; t != nil {
+		temperature := min(*t, 1) // Anthropic range is 0-1, OpenAI 0-2
+		anthropicReq.Temperature = &temperature
+	}
+	if req.User != "" {
+		anthropicReq.Metadata = &AnthropicMetadata{UserID: req.User}
+	}
+	if budget, set := req.ThinkingBudget(); set && budget == 0 {
+		anthropicReq.Thinking = &provider.ThinkingConfig{Type: "disabled"}
+	} else if set {
+		budget = max(budget, 1024) // Anthropic minimum
+		anthropicReq.Thinking = &provider.ThinkingConfig{Type: "enabled", BudgetTokens: budget}
+		if anthropicReq.MaxTokens <= budget {
+			anthropicReq.MaxTokens = budget + 4096 // The budget is part of max_tokens
+		}
+		// Thinking is incompatible with temperature and top_k, and only allows top_p >= 0.95
+		anthropicReq.Temperature, anthropicReq.TopK = nil, nil
+		if anthropicReq.TopP != nil && *anthropicReq.TopP < 0.95 {
+			anthropicReq.TopP = nil
+		}
 	}
 
 	for _, msg := range req.Messages {
@@ -113,9 +240,10 @@ func (p *AnthropicProvider) ChatCompletion(ctx context.Context, req provider.Cha
 		}
 
 		if msg.Role == "user" || msg.Role == "assistant" {
-			// Check for Tool Calls in Assistant message
-			if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
-				var contentBlocks []map[string]interface{}
+			// Check for Tool Calls (or thinking to send back) in Assistant message
+			thinking := thinkingBlocks(msg.ThinkingBlocks)
+			if msg.Role == "assistant" && (len(msg.ToolCalls) > 0 || len(thinking) > 0) {
+				contentBlocks := thinking
 
 				// Add text content if present
 				if msg.Content != "" {
@@ -145,6 +273,16 @@ func (p *AnthropicProvider) ChatCompletion(ctx context.Context, req provider.Cha
 					Role:    "assistant",
 					Content: contentBlocks,
 				})
+			} else if len(msg.Parts) > 0 {
+				// Multimodal Message
+				contentBlocks, err := contentBlocks(msg.Parts)
+				if err != nil {
+					return anthropicReq, err
+				}
+				anthropicReq.Messages = append(anthropicReq.Messages, AnthropicMessage{
+					Role:    msg.Role,
+					Content: contentBlocks,
+				})
 			} else {
 				// Standard Text Message
 				anthropicReq.Messages = append(anthropicReq.Messages, AnthropicMessage{
@@ -202,6 +340,60 @@ func (p *AnthropicProvider) ChatCompletion(ctx context.Context, req provider.Cha
 				InputSchema: t.Function.Parameters,
 			})
 		}
+		anthropicReq.ToolChoice = anthropicToolChoice(req.ToolChoice)
+	}
+
+	return anthropicReq, nil
+}
+
+// thinkingBlocks converts the thinking of an assistant message. Only blocks signed by
+// Anthropic can be sent back; reasoning from other vendors is left out.
+func thinkingBlocks(blocks []provider.ThinkingBlock) []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, b := range blocks {
+		switch {
+		case b.Type == provider.ThinkingTypeRedacted && b.Data != "":
+			out = append(out, map[string]interface{}{"type": b.Type, "data": b.Data})
+		case b.Type == provider.ThinkingTypeThinking && b.Signature != "" && !b.IsGemini():
+			out = append(out, map[string]interface{}{"type": b.Type, "thinking": b.Thinking, "signature": b.Signature})
+		}
+	}
+	return out
+}
+
+// contentBlocks converts multimodal parts to text, image and document blocks. Media is sent
+// as a base64 or url source; uploaded file IDs and audio have no equivalent.
+func contentBlocks(parts []provider.ContentPart) ([]map[string]interface{}, error) {
+	var blocks []map[string]interface{}
+	for _, part := range parts {
+		if part.Type == provider.PartText {
+			blocks = append(blocks, map[string]interface{}{"type": "text", "text": part.Text})
+			continue
+		}
+		if (part.Type != provider.PartImage && part.Type != provider.PartDocument) || part.FileID != "" {
+			return nil, provider.Unsupported(provider.ProviderAnthropic, part)
+		}
+		source := map[string]interface{}{"type": "url", "url": part.URL}
+		if part.Data != "" {
+			source = map[string]interface{}{"type": "base64", "media_type": part.GuessMIMEType(), "data": part.Data}
+		}
+		block := map[string]interface{}{"type": part.Type, "source": source}
+		if part.Type == provider.PartDocument && part.Filename != "" {
+			block["title"] = part.Filename
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func (p *AnthropicProvider) ChatCompletion(ctx context.Context, req provider.ChatCompletionRequest, apiKey string) (*provider.ChatCompletionResponse, error) {
+	_, span := tracing.Start(ctx, "anthropic.translate_request")
+	req.Stream = false
+	anthropicReq, err := toAnthropicRequest(req)
+	tracing.Fail(span, err)
+	span.End()
+	if err != nil {
+		return nil, err
 	}
 
 	reqBody, err := json.Marshal(anthropicReq)
@@ -218,8 +410,7 @@ func (p *AnthropicProvider) ChatCompletion(ctx context.Context, req provider.Cha
 	httpReq.Header.Set("x-api-key", apiKey)
 	httpReq.Header.Set("anthropic-version", "2023-06-01")
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	resp, err := provider.Client.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
@@ -227,7 +418,7 @@ func (p *AnthropicProvider) ChatCompletion(ctx context.Context, req provider.Cha
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("anthropic API error: %d - %s", resp.StatusCode, string(bodyBytes))
+		return nil, &provider.APIError{Provider: provider.ProviderAnthropic, StatusCode: resp.StatusCode, Body: string(bodyBytes), RetryAfter: provider.ParseRetryAfter(resp.Header.Get("Retry-After"))}
 	}
 
 	var anthroResp AnthropicResponse
@@ -241,14 +432,38 @@ func (p *AnthropicProvider) ChatCompletion(ctx context.Context, req provider.Cha
 	}
 
 	// Map back
-	content := ""
-	if len(anthroResp.Content) > 0 {
-		content = anthroResp.Content[0].Text
+	content, reasoning := "", ""
+	var thinking []provider.ThinkingBlock
+	var toolCalls []provider.ToolCall
+	for _, block := range anthroResp.Content {
+		switch block.Type {
+		case "text":
+			content += block.Text
+		case "tool_use":
+			args := string(block.Input)
+			if args == "" || args == "null" {
+				args = "{}"
+			}
+			toolCalls = append(toolCalls, provider.ToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: provider.FunctionCall{Name: block.Name, Arguments: args},
+			})
+		case provider.ThinkingTypeThinking:
+			reasoning += block.Thinking
+			thinking = append(thinking, provider.ThinkingBlock{Type: block.Type, Thinking: block.Thinking, Signature: block.Signature})
+		case provider.ThinkingTypeRedacted:
+			thinking = append(thinking, provider.ThinkingBlock{Type: block.Type, Data: block.Data})
+		}
 	}
 
 	finishReason := "stop"
 	if anthroResp.StopReason != nil {
-		finishReason = *anthroResp.StopReason
+		finishReason = openAIFinishReason(*anthroResp.StopReason)
+	}
+	var usage provider.Usage
+	if anthroResp.Usage != nil {
+		usage = anthroResp.Usage.ToOpenAI()
 	}
 
 	return &provider.ChatCompletionResponse{
@@ -260,21 +475,40 @@ func (p *AnthropicProvider) ChatCompletion(ctx context.Context, req provider.Cha
 			{
 				Index: 0,
 				Message: provider.Message{
-					Role:    "assistant",
-					Content: content,
+					Role:             "assistant",
+					Content:          content,
+					ReasoningContent: reasoning,
+					ThinkingBlocks:   thinking,
+					ToolCalls:        toolCalls,
 				},
 				FinishReason: finishReason,
 			},
 		},
+		Usage: usage,
 	}, nil
 }
 
+// openAIFinishReason maps an Anthropic stop_reason to the OpenAI finish_reason
+func openAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case "tool_use":
+		return "tool_calls"
+	case "max_tokens", "model_context_window_exceeded":
+		return "length"
+	case "refusal":
+		return "content_filter"
+	}
+	return "stop" // end_turn, stop_sequence, pause_turn
+}
+
 // Anthropic Streaming Events
 type AnthropicEvent struct {
-	Type         string          `json:"type"`
-	Delta        *AnthropicDelta `json:"delta,omitempty"`
-	ContentBlock *AnthropicBlock `json:"content_block,omitempty"`
-	Index        int             `json:"index,omitempty"`
+	Type         string            `json:"type"`
+	Message      *AnthropicMessage `json:"message,omitempty"` // message_start
+	Delta        *AnthropicDelta   `json:"delta,omitempty"`
+	ContentBlock *AnthropicBlock   `json:"content_block,omitempty"`
+	Index        int               `json:"index,omitempty"`
+	Usage        *Usage            `json:"usage,omitempty"` // message_delta, running totals
 }
 
 type AnthropicBlock struct {
@@ -282,96 +516,26 @@ type AnthropicBlock struct {
 	ID   string `json:"id,omitempty"`
 	Name string `json:"name,omitempty"`
 	Text string `json:"text,omitempty"`
+	Data string `json:"data,omitempty"` // redacted_thinking
 }
 
 type AnthropicDelta struct {
 	Type        string `json:"type"`
 	Text        string `json:"text,omitempty"`
 	PartialJSON string `json:"partial_json,omitempty"`
+	Thinking    string `json:"thinking,omitempty"`
+	Signature   string `json:"signature,omitempty"`
+	StopReason  string `json:"stop_reason,omitempty"` // message_delta
 }
 
 func (p *AnthropicProvider) StreamChatCompletion(ctx context.Context, req provider.ChatCompletionRequest, apiKey string, outputChan chan<- provider.StreamResponse) error {
-	anthropicReq := AnthropicRequest{
-		Model:     req.Model,
-		MaxTokens: 4096,
-		Messages:  []AnthropicMessage{},
-		Stream:    true,
-	}
-
-	for _, msg := range req.Messages {
-		if msg.Role == "system" {
-			anthropicReq.System = msg.Content
-			continue
-		}
-
-		if msg.Role == "user" || msg.Role == "assistant" {
-			// Check for Tool Calls in Assistant message
-			if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
-				var contentBlocks []map[string]interface{}
-
-				if msg.Content != "" {
-					contentBlocks = append(contentBlocks, map[string]interface{}{"type": "text", "text": msg.Content})
-				}
-
-				for _, tc := range msg.ToolCalls {
-					var inputMap map[string]interface{}
-					if err := json.Unmarshal([]byte(tc.Function.Arguments), &inputMap); err != nil {
-						inputMap = map[string]interface{}{}
-					}
-					contentBlocks = append(contentBlocks, map[string]interface{}{
-						"type":  "tool_use",
-						"id":    tc.ID,
-						"name":  tc.Function.Name,
-						"input": inputMap,
-					})
-				}
-
-				anthropicReq.Messages = append(anthropicReq.Messages, AnthropicMessage{Role: "assistant", Content: contentBlocks})
-			} else {
-				anthropicReq.Messages = append(anthropicReq.Messages, AnthropicMessage{Role: msg.Role, Content: msg.Content})
-			}
-		} else if msg.Role == "tool" {
-			toolResultBlock := map[string]interface{}{
-				"type":        "tool_result",
-				"tool_use_id": msg.ToolCallID,
-				"content":     msg.Content,
-			}
-
-			lastIdx := len(anthropicReq.Messages) - 1
-			if lastIdx >= 0 && anthropicReq.Messages[lastIdx].Role == "user" {
-				prevContent := anthropicReq.Messages[lastIdx].Content
-				var newContent []interface{}
-				if s, ok := prevContent.(string); ok {
-					newContent = append(newContent, map[string]interface{}{"type": "text", "text": s})
-				} else if list, ok := prevContent.([]interface{}); ok {
-					newContent = list
-				} else if list, ok := prevContent.([]map[string]interface{}); ok {
-					for _, item := range list {
-						newContent = append(newContent, item)
-					}
-				}
-				newContent = append(newContent, toolResultBlock)
-				anthropicReq.Messages[lastIdx].Content = newContent
-			} else {
-				anthropicReq.Messages = append(anthropicReq.Messages, AnthropicMessage{Role: "user", Content: []interface{}{toolResultBlock}})
-			}
-		}
-	}
-
-	// Map Tools
-	if len(req.Tools) > 0 {
-		anthropicReq.Tools = []AnthropicTool{}
-		for _, t := range req.Tools {
-			var schema interface{}
-			// Ensure schema is properly set (handle any/map)
-			schema = t.Function.Parameters
-
-			anthropicReq.Tools = append(anthropicReq.Tools, AnthropicTool{
-				Name:        t.Function.Name,
-				Description: t.Function.Description,
-				InputSchema: schema,
-			})
-		}
+	_, span := tracing.Start(ctx, "anthropic.translate_request")
+	req.Stream = true
+	anthropicReq, err := toAnthropicRequest(req)
+	tracing.Fail(span, err)
+	span.End()
+	if err != nil {
+		return err
 	}
 
 	reqBody, _ := json.Marshal(anthropicReq)
@@ -384,8 +548,7 @@ func (p *AnthropicProvider) StreamChatCompletion(ctx context.Context, req provid
 	httpReq.Header.Set("x-api-key", apiKey)
 	httpReq.Header.Set("anthropic-version", "2023-06-01")
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	resp, err := provider.Client.Do(httpReq)
 	if err != nil {
 		return err
 	}
@@ -393,9 +556,11 @@ func (p *AnthropicProvider) StreamChatCompletion(ctx context.Context, req provid
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("anthropic stream error: %d - %s", resp.StatusCode, string(bodyBytes))
+		return &provider.APIError{Provider: provider.ProviderAnthropic, Stream: true, StatusCode: resp.StatusCode, Body: string(bodyBytes), RetryAfter: provider.ParseRetryAfter(resp.Header.Get("Retry-After"))}
 	}
 
+	// Input tokens come with message_start, output tokens with message_delta
+	var usage Usage
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -411,6 +576,9 @@ func (p *AnthropicProvider) StreamChatCompletion(ctx context.Context, req provid
 
 		// Handle different Anthropic Events
 		if event.Type == "message_start" {
+			if event.Message != nil && event.Message.Usage != nil {
+				usage = *event.Message.Usage
+			}
 			// First chunk: Send Role
 			outputChan <- provider.StreamResponse{
 				ID:      "chatcmpl-stream",
@@ -420,6 +588,18 @@ func (p *AnthropicProvider) StreamChatCompletion(ctx context.Context, req provid
 				Choices: []provider.StreamChoice{{Index: 0, Delta: provider.Message{Role: "assistant"}}},
 			}
 		} else if event.Type == "content_block_start" {
+			// Redacted thinking comes whole
+			if event.ContentBlock != nil && event.ContentBlock.Type == provider.ThinkingTypeRedacted {
+				outputChan <- provider.StreamResponse{
+					ID:      "chatcmpl-stream",
+					Object:  "chat.completion.chunk",
+					Created: time.Now().Unix(),
+					Model:   req.Model,
+					Choices: []provider.StreamChoice{{Index: 0, Delta: provider.Message{
+						ThinkingBlocks: []provider.ThinkingBlock{{Type: provider.ThinkingTypeRedacted, Data: event.ContentBlock.Data}},
+					}}},
+				}
+			}
 			// Tool Use Start
 			if event.ContentBlock != nil && event.ContentBlock.Type == "tool_use" {
 				outputChan <- provider.StreamResponse{
@@ -452,6 +632,26 @@ func (p *AnthropicProvider) StreamChatCompletion(ctx context.Context, req provid
 						Model:   req.Model,
 						Choices: []provider.StreamChoice{{Index: 0, Delta: provider.Message{Content: event.Delta.Text}}},
 					}
+				} else if event.Delta.Type == "thinking_delta" {
+					// Reasoning
+					outputChan <- provider.StreamResponse{
+						ID:      "chatcmpl-stream",
+						Object:  "chat.completion.chunk",
+						Created: time.Now().Unix(),
+						Model:   req.Model,
+						Choices: []provider.StreamChoice{{Index: 0, Delta: provider.Message{ReasoningContent: event.Delta.Thinking}}},
+					}
+				} else if event.Delta.Type == "signature_delta" {
+					// End of the thinking block: its signature, needed to send it back
+					outputChan <- provider.StreamResponse{
+						ID:      "chatcmpl-stream",
+						Object:  "chat.completion.chunk",
+						Created: time.Now().Unix(),
+						Model:   req.Model,
+						Choices: []provider.StreamChoice{{Index: 0, Delta: provider.Message{
+							ThinkingBlocks: []provider.ThinkingBlock{{Type: provider.ThinkingTypeThinking, Signature: event.Delta.Signature}},
+						}}},
+					}
 				} else if event.Delta.Type == "input_json_delta" {
 					// Tool Arguments
 					outputChan <- provider.StreamResponse{
@@ -472,8 +672,46 @@ func (p *AnthropicProvider) StreamChatCompletion(ctx context.Context, req provid
 					}
 				}
 			}
+		} else if event.Type == "message_delta" {
+			if u := event.Usage; u != nil {
+				usage.OutputTokens = u.OutputTokens
+				if u.InputTokens > 0 || u.CacheReadInputTokens > 0 || u.CacheCreationInputTokens > 0 {
+					usage.InputTokens, usage.CacheReadInputTokens, usage.CacheCreationInputTokens = u.InputTokens, u.CacheReadInputTokens, u.CacheCreationInputTokens
+				}
+			}
+			if event.Delta != nil && event.Delta.StopReason != "" {
+				reason := openAIFinishReason(event.Delta.StopReason)
+				outputChan <- provider.StreamResponse{
+					ID:      "chatcmpl-stream",
+					Object:  "chat.completion.chunk",
+					Created: time.Now().Unix(),
+					Model:   req.Model,
+					Choices: []provider.StreamChoice{{Index: 0, Delta: provider.Message{}, FinishReason: &reason}},
+				}
+			}
+		} else if event.Type == "message_stop" {
+			// Final usage chunk without choices, as OpenAI sends it with include_usage
+			total := usage.ToOpenAI()
+			outputChan <- provider.StreamResponse{
+				ID:      "chatcmpl-stream",
+				Object:  "chat.completion.chunk",
+				Created: time.Now().Unix(),
+				Model:   req.Model,
+				Choices: []provider.StreamChoice{},
+				Usage:   &total,
+			}
 		}
 	}
 
 	return nil
 }
+
+func (p *AnthropicProvider) HealthCheck(ctx context.Context, apiKey string) error {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", p.BaseURL+"/models", nil)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("x-api-key", apiKey)
+	httpReq.Header.Set("anthropic-version", "2023-06-01")
+	return provider.DoHealthCheck(provider.ProviderAnthropic, httpReq)
+}
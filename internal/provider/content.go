@@ -0,0 +1,255 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+// Content part types
+const (
+	PartText     = "text"
+	PartImage    = "image"
+	PartDocument = "document" // PDF
+	PartAudio    = "audio"
+)
+
+// ContentPart is one piece of a multimodal message. Media is either remote (URL), inline
+// (base64 Data with its MIMEType) or, for OpenAI upstreams only, an uploaded FileID.
+// It (un)marshals in the OpenAI chat format: text, image_url, input_audio and file parts.
+type ContentPart struct {
+	Type     string
+	Text     string // PartText
+	URL      string
+	Data     string // Base64, without the data: prefix
+	MIMEType string // e.g. "image/png", "application/pdf", "audio/wav"
+	FileID   string
+	Filename string // PartDocument
+	Detail   string // OpenAI image detail ("low", "high", "auto")
+}
+
+// UnsupportedContentError is returned when a part has no equivalent in the upstream protocol
+type UnsupportedContentError struct {
+	Provider string
+	Part     string
+}
+
+func (e *UnsupportedContentError) Error() string {
+	return fmt.Sprintf("%s does not accept %s content", e.Provider, e.Part)
+}
+
+// Unsupported builds the error of a part the provider cannot send
+func Unsupported(providerName string, p ContentPart) error {
+	kind := p.Type
+	switch {
+	case p.FileID != "":
+		kind += " file ID"
+	case p.URL != "":
+		kind += " URL"
+	}
+	return &UnsupportedContentError{Provider: providerName, Part: kind}
+}
+
+// DataURL returns the data: URL of inline media
+func (p ContentPart) DataURL() string {
+	return "data:" + p.MIMEType + ";base64," + p.Data
+}
+
+// GuessMIMEType returns the MIME type of a part, from its URL extension when it has none
+// (defaults: image/jpeg for images, application/pdf for documents)
+func (p ContentPart) GuessMIMEType() string {
+	if p.MIMEType != "" {
+		return p.MIMEType
+	}
+	if p.URL != "" {
+		if t := mime.TypeByExtension(path.Ext(strings.SplitN(p.URL, "?", 2)[0])); t != "" {
+			return strings.SplitN(t, ";", 2)[0]
+		}
+	}
+	switch p.Type {
+	case PartImage:
+		return "image/jpeg"
+	case PartDocument:
+		return "application/pdf"
+	}
+	return "application/octet-stream"
+}
+
+// parseDataURL splits "data:<mime>;base64,<data>"
+func parseDataURL(s string) (mimeType, data string, ok bool) {
+	rest, ok := strings.CutPrefix(s, "data:")
+	if !ok {
+		return "", "", false
+	}
+	meta, data, ok := strings.Cut(rest, ",")
+	if !ok || !strings.HasSuffix(meta, ";base64") {
+		return "", "", false
+	}
+	return strings.TrimSuffix(meta, ";base64"), data, true
+}
+
+// Audio formats of OpenAI input_audio parts
+var audioFormats = map[string]string{"wav": "audio/wav", "mp3": "audio/mpeg"}
+
+type openAIPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Refusal  string `json:"refusal,omitempty"`
+	ImageURL *struct {
+		URL    string `json:"url"`
+		Detail string `json:"detail,omitempty"`
+	} `json:"image_url,omitempty"`
+	InputAudio *struct {
+		Data   string `json:"data"`
+		Format string `json:"format"`
+	} `json:"input_audio,omitempty"`
+	File *struct {
+		FileData string `json:"file_data,omitempty"`
+		FileID   string `json:"file_id,omitempty"`
+		Filename string `json:"filename,omitempty"`
+	} `json:"file,omitempty"`
+}
+
+func (p *ContentPart) UnmarshalJSON(b []byte) error {
+	var raw openAIPart
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	switch {
+	case raw.Type == "text":
+		*p = ContentPart{Type: PartText, Text: raw.Text}
+	case raw.Type == "refusal": // Assistant history
+		*p = ContentPart{Type: PartText, Text: raw.Refusal}
+	case raw.Type == "image_url" && raw.ImageURL != nil:
+		*p = ContentPart{Type: PartImage, Detail: raw.ImageURL.Detail}
+		if mimeType, data, ok := parseDataURL(raw.ImageURL.URL); ok {
+			p.MIMEType, p.Data = mimeType, data
+		} else {
+			p.URL = raw.ImageURL.URL
+		}
+	case raw.Type == "input_audio" && raw.InputAudio != nil:
+		mimeType, ok := audioFormats[raw.InputAudio.Format]
+		if !ok {
+			return fmt.Errorf("unsupported audio format %q", raw.InputAudio.Format)
+		}
+		*p = ContentPart{Type: PartAudio, Data: raw.InputAudio.Data, MIMEType: mimeType}
+	case raw.Type == "file" && raw.File != nil:
+		*p = ContentPart{Type: PartDocument, FileID: raw.File.FileID, Filename: raw.File.Filename}
+		if raw.File.FileData != "" {
+			mimeType, data, ok := parseDataURL(raw.File.FileData)
+			if !ok {
+				return fmt.Errorf("file_data must be a base64 data URL")
+			}
+			p.MIMEType, p.Data = mimeType, data
+		}
+	default:
+		return fmt.Errorf("unsupported content part type %q", raw.Type)
+	}
+	return nil
+}
+
+func (p ContentPart) MarshalJSON() ([]byte, error) {
+	raw := openAIPart{}
+	switch {
+	case p.Type == PartText:
+		raw.Type, raw.Text = "text", p.Text
+	case p.Type == PartImage && (p.URL != "" || p.Data != ""):
+		raw.Type = "image_url"
+		raw.ImageURL = &struct {
+			URL    string `json:"url"`
+			Detail string `json:"detail,omitempty"`
+		}{p.URL, p.Detail}
+		if p.Data != "" {
+			raw.ImageURL.URL = p.DataURL()
+		}
+	case p.Type == PartAudio && p.Data != "":
+		format := ""
+		for f, m := range audioFormats {
+			if m == p.MIMEType {
+				format = f
+			}
+		}
+		if format == "" {
+			return nil, &UnsupportedContentError{Provider: ProviderOpenAI, Part: p.MIMEType + " audio"}
+		}
+		raw.Type = "input_audio"
+		raw.InputAudio = &struct {
+			Data   string `json:"data"`
+			Format string `json:"format"`
+		}{p.Data, format}
+	case p.Type == PartDocument && (p.Data != "" || p.FileID != ""):
+		raw.Type = "file"
+		raw.File = &struct {
+			FileData string `json:"file_data,omitempty"`
+			FileID   string `json:"file_id,omitempty"`
+			Filename string `json:"filename,omitempty"`
+		}{FileID: p.FileID, Filename: p.Filename}
+		if p.Data != "" {
+			raw.File.FileData = p.DataURL()
+			if raw.File.Filename == "" {
+				raw.File.Filename = "document.pdf" // Required by OpenAI with file_data
+			}
+		}
+	default:
+		return nil, Unsupported(ProviderOpenAI, p)
+	}
+	return json.Marshal(raw)
+}
+
+// NewMessage builds a message from its parts: Content gets the text, Parts is kept
+// only when there is media
+func NewMessage(role string, parts []ContentPart) Message {
+	m := Message{Role: role}
+	var texts []string
+	for _, p := range parts {
+		if p.Type == PartText {
+			texts = append(texts, p.Text)
+		} else {
+			m.Parts = parts
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return m
+}
+
+// message is Message without its JSON methods
+type message Message
+
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		message
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*m = Message(raw.message)
+	switch {
+	case len(raw.Content) == 0 || string(raw.Content) == "null":
+	case raw.Content[0] == '"':
+		return json.Unmarshal(raw.Content, &m.Content)
+	default:
+		var parts []ContentPart
+		if err := json.Unmarshal(raw.Content, &parts); err != nil {
+			return err
+		}
+		withContent := NewMessage(m.Role, parts)
+		m.Content, m.Parts = withContent.Content, withContent.Parts
+	}
+	return nil
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	var content interface{}
+	if len(m.Parts) > 0 {
+		content = m.Parts
+	} else if m.Content != "" {
+		content = m.Content
+	}
+	return json.Marshal(struct {
+		message
+		Content interface{} `json:"content,omitempty"`
+	}{message(m), content})
+}
@@ -9,6 +9,8 @@ import (
 	"io"
 	"net/http"
 	"qiservice/internal/provider"
+	"qiservice/internal/tracing"
+	"reflect"
 	"strings"
 	"time"
 )
@@ -29,8 +31,33 @@ func NewGeminiProvider(baseURL string) *GeminiProvider {
 
 // Gemini structures
 type GeminiRequest struct {
-	Contents          []GeminiContent `json:"contents"`
-	SystemInstruction *GeminiContent  `json:"system_instruction,omitempty"`
+	Contents          []GeminiContent   `json:"contents"`
+	SystemInstruction *GeminiContent    `json:"system_instruction,omitempty"`
+	Tools             []GeminiTool      `json:"tools,omitempty"`
+	ToolConfig        *GeminiToolConfig `json:"toolConfig,omitempty"`
+
+	GenerationConfig *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type GeminiGenerationConfig struct {
+	MaxOutputTokens  *int        `json:"maxOutputTokens,omitempty"`
+	Temperature      *float64    `json:"temperature,omitempty"`
+	TopP             *float64    `json:"topP,omitempty"`
+	TopK             *int        `json:"topK,omitempty"`
+	StopSequences    []string    `json:"stopSequences,omitempty"`
+	CandidateCount   *int        `json:"candidateCount,omitempty"`
+	Seed             *int64      `json:"seed,omitempty"`
+	PresencePenalty  *float64    `json:"presencePenalty,omitempty"`
+	FrequencyPenalty *float64    `json:"frequencyPenalty,omitempty"`
+	ResponseMIMEType string      `json:"responseMimeType,omitempty"`
+	ResponseSchema   interface{} `json:"responseSchema,omitempty"`
+
+	ThinkingConfig *GeminiThinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+type GeminiThinkingConfig struct {
+	ThinkingBudget  *int `json:"thinkingBudget,omitempty"` // 0 disables thinking
+	IncludeThoughts bool `json:"includeThoughts,omitempty"`
 }
 
 type GeminiContent struct {
@@ -39,11 +66,54 @@ type GeminiContent struct {
 }
 
 type GeminiPart struct {
-	Text string `json:"text"`
+	Text       string            `json:"text,omitempty"`
+	InlineData *GeminiInlineData `json:"inline_data,omitempty"`
+	FileData   *GeminiFileData   `json:"file_data,omitempty"`
+
+	FunctionCall     *GeminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+
+	Thought          bool   `json:"thought,omitempty"`          // Text is a thought summary
+	ThoughtSignature string `json:"thoughtSignature,omitempty"` // To send back with the part
+}
+
+// GeminiInlineData is base64 media sent within the request
+type GeminiInlineData struct {
+	MIMEType string `json:"mime_type"`
+	Data     string `json:"data"`
+}
+
+// GeminiFileData is media referenced by URI
+type GeminiFileData struct {
+	MIMEType string `json:"mime_type"`
+	FileURI  string `json:"file_uri"`
 }
 
 type GeminiResponse struct {
-	Candidates []GeminiCandidate `json:"candidates"`
+	Candidates    []GeminiCandidate    `json:"candidates"`
+	UsageMetadata *GeminiUsageMetadata `json:"usageMetadata,omitempty"`
+}
+
+// GeminiUsageMetadata is the token usage of a response. Stream chunks repeat it with the
+// running totals, the last one is final.
+type GeminiUsageMetadata struct {
+	PromptTokenCount        int `json:"promptTokenCount"` // Includes the cached tokens
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+}
+
+// toOpenAI returns the OpenAI usage; thoughts are billed as output
+func (u *GeminiUsageMetadata) toOpenAI() provider.Usage {
+	if u == nil {
+		return provider.Usage{}
+	}
+	completion := u.CandidatesTokenCount + u.ThoughtsTokenCount
+	usage := provider.Usage{PromptTokens: u.PromptTokenCount, CompletionTokens: completion, TotalTokens: u.PromptTokenCount + completion}
+	if u.CachedContentTokenCount > 0 {
+		usage.PromptTokensDetails = &provider.PromptTokensDetails{CachedTokens: u.CachedContentTokenCount}
+	}
+	return usage
 }
 
 type GeminiCandidate struct {
@@ -52,30 +122,156 @@ type GeminiCandidate struct {
 	Index        int           `json:"index"`
 }
 
-func (p *GeminiProvider) ChatCompletion(ctx context.Context, req provider.ChatCompletionRequest, apiKey string) (*provider.ChatCompletionResponse, error) {
+// toGeminiRequest converts an OpenAI style request to the generateContent format
+func toGeminiRequest(req provider.ChatCompletionRequest) (GeminiRequest, error) {
 	geminiReq := GeminiRequest{
-		Contents: []GeminiContent{},
+		Contents:         []GeminiContent{},
+		Tools:            geminiTools(req.Tools),
+		GenerationConfig: generationConfig(req),
+	}
+	// Gemini rejects a toolConfig without tools
+	if geminiReq.Tools != nil {
+		geminiReq.ToolConfig = geminiToolConfig(req.ToolChoice)
 	}
 
+	// Function responses are matched by name, OpenAI results only carry the call ID
+	callNames := map[string]string{}
+
 	for _, msg := range req.Messages {
 		if msg.Role == "system" {
+			if msg.Content == "" {
+				continue
+			}
 			geminiReq.SystemInstruction = &GeminiContent{
 				Parts: []GeminiPart{{Text: msg.Content}},
 			}
 			continue
 		}
 
+		if msg.Role == "tool" {
+			name := msg.Name
+			if name == "" {
+				name = callNames[msg.ToolCallID]
+			}
+			part := functionResponsePart(msg, name)
+			// Results of parallel calls go back in a single turn
+			last := len(geminiReq.Contents) - 1
+			if last >= 0 && geminiReq.Contents[last].Parts[0].FunctionResponse != nil {
+				geminiReq.Contents[last].Parts = append(geminiReq.Contents[last].Parts, part)
+			} else {
+				geminiReq.Contents = append(geminiReq.Contents, GeminiContent{Role: "user", Parts: []GeminiPart{part}})
+			}
+			continue
+		}
+
 		role := "user"
 		if msg.Role == "assistant" {
 			role = "model"
 		}
 
+		parts, err := geminiParts(msg)
+		if err != nil {
+			return geminiReq, err
+		}
+		for _, tc := range msg.ToolCalls {
+			callNames[tc.ID] = tc.Function.Name
+		}
+		calls := functionCallParts(msg.ToolCalls)
+		parts = append(parts, calls...)
+		// The thought signature goes back on the first function call, or the first part
+		for _, b := range msg.ThinkingBlocks {
+			if sig := b.GeminiSignature(); sig != "" && len(parts) > 0 {
+				signed := &parts[0]
+				if len(calls) > 0 {
+					signed = &parts[len(parts)-len(calls)]
+				}
+				signed.ThoughtSignature = sig
+				break
+			}
+		}
+		if len(parts) == 0 {
+			continue // Gemini rejects empty parts and contents
+		}
 		geminiReq.Contents = append(geminiReq.Contents, GeminiContent{
 			Role:  role,
-			Parts: []GeminiPart{{Text: msg.Content}},
+			Parts: parts,
 		})
 	}
 
+	return geminiReq, nil
+}
+
+// generationConfig maps the sampling parameters, nil when none is set. JSON response
+// formats become a JSON MIME type, with the schema reduced to what Gemini accepts;
+// thinking asks for thought summaries, returned as reasoning.
+func generationConfig(req provider.ChatCompletionRequest) *GeminiGenerationConfig {
+	config := GeminiGenerationConfig{
+		MaxOutputTokens:  req.MaxOutputTokens(),
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		TopK:             req.TopK,
+		StopSequences:    req.Stop,
+		CandidateCount:   req.N,
+		Seed:             req.Seed,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+	}
+	if budget, set := req.ThinkingBudget(); set {
+		config.ThinkingConfig = &GeminiThinkingConfig{ThinkingBudget: &budget, IncludeThoughts: budget > 0}
+	}
+	if f := req.ResponseFormat; f != nil && f.Type != "text" {
+		config.ResponseMIMEType = "application/json"
+		if f.JSONSchema != nil && f.JSONSchema.Schema != nil {
+			config.ResponseSchema = sanitizeSchema(normalizeJSON(f.JSONSchema.Schema))
+		}
+	}
+	if reflect.ValueOf(config).IsZero() {
+		return nil
+	}
+	return &config
+}
+
+// signatureBlock keeps a thought signature, to be sent back in the next turns
+func signatureBlock(sig string) provider.ThinkingBlock {
+	return provider.ThinkingBlock{Type: provider.ThinkingTypeThinking, Signature: provider.GeminiSignature(sig)}
+}
+
+// geminiParts converts the content of a message: inline media becomes inline_data and
+// URLs file_data. Uploaded file IDs have no equivalent. Empty text gets no part.
+func geminiParts(msg provider.Message) ([]GeminiPart, error) {
+	if len(msg.Parts) == 0 {
+		if msg.Content == "" {
+			return nil, nil
+		}
+		return []GeminiPart{{Text: msg.Content}}, nil
+	}
+	var parts []GeminiPart
+	for _, part := range msg.Parts {
+		switch {
+		case part.Type == provider.PartText:
+			if part.Text != "" {
+				parts = append(parts, GeminiPart{Text: part.Text})
+			}
+		case part.Data != "":
+			parts = append(parts, GeminiPart{InlineData: &GeminiInlineData{MIMEType: part.GuessMIMEType(), Data: part.Data}})
+		case part.URL != "":
+			parts = append(parts, GeminiPart{FileData: &GeminiFileData{MIMEType: part.GuessMIMEType(), FileURI: part.URL}})
+		default:
+			return nil, provider.Unsupported(provider.ProviderGemini, part)
+		}
+	}
+	return parts, nil
+}
+
+func (p *GeminiProvider) ChatCompletion(ctx context.Context, req provider.ChatCompletionRequest, apiKey string) (*provider.ChatCompletionResponse, error) {
+	_, span := tracing.Start(ctx, "gemini.translate_request")
+	geminiReq, err := toGeminiRequest(req)
+	tracing.Fail(span, err)
+	span.End()
+	if err != nil {
+		return nil, err
+	}
+
 	reqBody, err := json.Marshal(geminiReq)
 	if err != nil {
 		return nil, err
@@ -89,8 +285,7 @@ func (p *GeminiProvider) ChatCompletion(ctx context.Context, req provider.ChatCo
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	resp, err := provider.Client.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
@@ -98,7 +293,7 @@ func (p *GeminiProvider) ChatCompletion(ctx context.Context, req provider.ChatCo
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("gemini API error: %d - %s", resp.StatusCode, string(bodyBytes))
+		return nil, &provider.APIError{Provider: provider.ProviderGemini, StatusCode: resp.StatusCode, Body: string(bodyBytes), RetryAfter: provider.ParseRetryAfter(resp.Header.Get("Retry-After"))}
 	}
 
 	var geminiResp GeminiResponse
@@ -114,18 +309,33 @@ func (p *GeminiProvider) ChatCompletion(ctx context.Context, req provider.ChatCo
 	// Map back to OpenAI format
 	choices := []provider.Choice{}
 	for _, candidate := range geminiResp.Candidates {
-		content := ""
-		if len(candidate.Content.Parts) > 0 {
-			content = candidate.Content.Parts[0].Text
+		content, reasoning := "", ""
+		var toolCalls []provider.ToolCall
+		var thinking []provider.ThinkingBlock
+		for _, part := range candidate.Content.Parts {
+			if part.ThoughtSignature != "" {
+				thinking = append(thinking, signatureBlock(part.ThoughtSignature))
+			}
+			switch {
+			case part.FunctionCall != nil:
+				toolCalls = append(toolCalls, toolCall(part.FunctionCall))
+			case part.Thought:
+				reasoning += part.Text
+			default:
+				content += part.Text
+			}
 		}
 
 		choices = append(choices, provider.Choice{
 			Index: candidate.Index,
 			Message: provider.Message{
-				Role:    "assistant",
-				Content: content,
+				Role:             "assistant",
+				Content:          content,
+				ToolCalls:        toolCalls,
+				ReasoningContent: reasoning,
+				ThinkingBlocks:   thinking,
 			},
-			FinishReason: candidate.FinishReason, // Note: Might need mapping standard values (STOP -> stop)
+			FinishReason: finishReason(candidate.FinishReason, len(toolCalls) > 0),
 		})
 	}
 
@@ -135,24 +345,18 @@ func (p *GeminiProvider) ChatCompletion(ctx context.Context, req provider.ChatCo
 		Created: time.Now().Unix(),
 		Model:   req.Model,
 		Choices: choices,
+		Usage:   geminiResp.UsageMetadata.toOpenAI(),
 	}, nil
 }
 
 func (p *GeminiProvider) StreamChatCompletion(ctx context.Context, req provider.ChatCompletionRequest, apiKey string, outputChan chan<- provider.StreamResponse) error {
 	// Prepare Gemini Request
-	geminiReq := GeminiRequest{
-		Contents: []GeminiContent{},
-	}
-	for _, msg := range req.Messages {
-		if msg.Role == "system" {
-			geminiReq.SystemInstruction = &GeminiContent{Parts: []GeminiPart{{Text: msg.Content}}}
-			continue
-		}
-		role := "user"
-		if msg.Role == "assistant" {
-			role = "model"
-		}
-		geminiReq.Contents = append(geminiReq.Contents, GeminiContent{Role: role, Parts: []GeminiPart{{Text: msg.Content}}})
+	_, span := tracing.Start(ctx, "gemini.translate_request")
+	geminiReq, err := toGeminiRequest(req)
+	tracing.Fail(span, err)
+	span.End()
+	if err != nil {
+		return err
 	}
 
 	reqBody, _ := json.Marshal(geminiReq)
@@ -164,8 +368,7 @@ func (p *GeminiProvider) StreamChatCompletion(ctx context.Context, req provider.
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	resp, err := provider.Client.Do(httpReq)
 	if err != nil {
 		return err
 	}
@@ -173,10 +376,12 @@ func (p *GeminiProvider) StreamChatCompletion(ctx context.Context, req provider.
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("gemini stream error: %d - %s", resp.StatusCode, string(bodyBytes))
+		return &provider.APIError{Provider: provider.ProviderGemini, Stream: true, StatusCode: resp.StatusCode, Body: string(bodyBytes), RetryAfter: provider.ParseRetryAfter(resp.Header.Get("Retry-After"))}
 	}
 
 	// Parse SSE from Gemini (alt=sse returns standard SSE)
+	toolCalls := map[int]int{} // By candidate
+	var usage *GeminiUsageMetadata
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -189,30 +394,67 @@ func (p *GeminiProvider) StreamChatCompletion(ctx context.Context, req provider.
 		if err := json.Unmarshal([]byte(dataStr), &geminiResp); err != nil {
 			continue
 		}
+		if geminiResp.UsageMetadata != nil {
+			usage = geminiResp.UsageMetadata
+		}
 
-		if len(geminiResp.Candidates) > 0 {
-			content := ""
-			if len(geminiResp.Candidates[0].Content.Parts) > 0 {
-				content = geminiResp.Candidates[0].Content.Parts[0].Text
+		for _, candidate := range geminiResp.Candidates {
+			chunk := func(delta provider.Message, finish *string) provider.StreamResponse {
+				delta.Role = "assistant"
+				return provider.StreamResponse{
+					ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+					Object:  "chat.completion.chunk",
+					Created: time.Now().Unix(),
+					Model:   req.Model,
+					Choices: []provider.StreamChoice{{Index: candidate.Index, Delta: delta, FinishReason: finish}},
+				}
 			}
 
-			// Send Chunk
-			outputChan <- provider.StreamResponse{
-				ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   req.Model,
-				Choices: []provider.StreamChoice{
-					{
-						Index: geminiResp.Candidates[0].Index,
-						Delta: provider.Message{
-							Role:    "assistant",
-							Content: content,
-						},
-					},
-				},
+			for _, part := range candidate.Content.Parts {
+				if part.ThoughtSignature != "" {
+					outputChan <- chunk(provider.Message{ThinkingBlocks: []provider.ThinkingBlock{signatureBlock(part.ThoughtSignature)}}, nil)
+				}
+				if part.FunctionCall == nil {
+					if part.Thought && part.Text != "" {
+						outputChan <- chunk(provider.Message{ReasoningContent: part.Text}, nil)
+					} else if part.Text != "" {
+						outputChan <- chunk(provider.Message{Content: part.Text}, nil)
+					}
+					continue
+				}
+				// Gemini sends each call whole: one delta per call, with its complete arguments
+				index := toolCalls[candidate.Index]
+				tc := toolCall(part.FunctionCall)
+				tc.Index = &index
+				toolCalls[candidate.Index]++
+				outputChan <- chunk(provider.Message{ToolCalls: []provider.ToolCall{tc}}, nil)
+			}
+			if candidate.FinishReason != "" {
+				reason := finishReason(candidate.FinishReason, toolCalls[candidate.Index] > 0)
+				outputChan <- chunk(provider.Message{}, &reason)
 			}
 		}
 	}
+	if usage != nil {
+		// Final usage chunk without choices, as OpenAI sends it with include_usage
+		total := usage.toOpenAI()
+		outputChan <- provider.StreamResponse{
+			ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   req.Model,
+			Choices: []provider.StreamChoice{},
+			Usage:   &total,
+		}
+	}
 	return nil
 }
+
+// HealthCheck lists models; BaseURL already ends with /models
+func (p *GeminiProvider) HealthCheck(ctx context.Context, apiKey string) error {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s?key=%s", p.BaseURL, apiKey), nil)
+	if err != nil {
+		return err
+	}
+	return provider.DoHealthCheck(provider.ProviderGemini, httpReq)
+}
@@ -0,0 +1,68 @@
+package gemini
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"qiservice/internal/provider"
+)
+
+func TestToGeminiRequest(t *testing.T) {
+	weather := provider.Tool{Type: "function", Function: provider.ToolFunction{Name: "weather", Parameters: map[string]interface{}{
+		"type": "object", "properties": map[string]interface{}{"city": map[string]interface{}{"type": "string"}},
+	}}}
+	tests := []struct {
+		name    string
+		req     provider.ChatCompletionRequest
+		want    []string // Substrings of the encoded request
+		notWant []string
+	}{
+		{
+			name: "tool_choice without tools sends no toolConfig",
+			req: provider.ChatCompletionRequest{ToolChoice: "auto", Messages: []provider.Message{
+				{Role: "user", Content: "hi"},
+			}},
+			notWant: []string{"toolConfig"},
+		},
+		{
+			name: "tool_choice with tools",
+			req: provider.ChatCompletionRequest{Tools: []provider.Tool{weather}, ToolChoice: "required", Messages: []provider.Message{
+				{Role: "user", Content: "hi"},
+			}},
+			want: []string{`"toolConfig":{"functionCallingConfig":{"mode":"ANY"}}`, `"type":"OBJECT"`},
+		},
+		{
+			name: "empty text gets no part",
+			req: provider.ChatCompletionRequest{Messages: []provider.Message{
+				{Role: "system", Content: ""},
+				{Role: "user", Content: "hi"},
+				{Role: "assistant", Content: "", ToolCalls: []provider.ToolCall{{ID: "c1", Type: "function", Function: provider.FunctionCall{Name: "weather", Arguments: `{"city":"Paris"}`}}}},
+				{Role: "tool", ToolCallID: "c1", Content: "sunny"},
+				{Role: "assistant", Content: ""},
+			}},
+			want:    []string{`"functionCall":{"name":"weather"`, `"functionResponse":{"name":"weather"`},
+			notWant: []string{`{}`, `"parts":[]`, "systemInstruction"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gr, err := toGeminiRequest(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := json.Marshal(gr)
+			body := string(b)
+			for _, s := range tt.want {
+				if !strings.Contains(body, s) {
+					t.Errorf("missing %s in %s", s, body)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(body, s) {
+					t.Errorf("unexpected %s in %s", s, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package gemini
+
+import (
+	"encoding/json"
+	"qiservice/internal/provider"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Gemini function calling structures
+type GeminiTool struct {
+	FunctionDeclarations []GeminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type GeminiFunctionDeclaration struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"` // OpenAPI subset, see sanitizeSchema
+}
+
+type GeminiFunctionCall struct {
+	ID   string                 `json:"id,omitempty"`
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args"`
+}
+
+type GeminiFunctionResponse struct {
+	ID       string                 `json:"id,omitempty"`
+	Name     string                 `json:"name"`
+	Response map[string]interface{} `json:"response"`
+}
+
+type GeminiToolConfig struct {
+	FunctionCallingConfig GeminiFunctionCallingConfig `json:"functionCallingConfig"`
+}
+
+type GeminiFunctionCallingConfig struct {
+	Mode                 string   `json:"mode"` // AUTO, ANY or NONE
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+// geminiTools converts the OpenAI tool definitions to function declarations
+func geminiTools(tools []provider.Tool) []GeminiTool {
+	if len(tools) == 0 {
+		return nil
+	}
+	tool := GeminiTool{}
+	for _, t := range tools {
+		decl := GeminiFunctionDeclaration{Name: t.Function.Name, Description: t.Function.Description}
+		// Gemini rejects OBJECT schemas without properties: leave parameters out for tools without arguments
+		if schema, ok := sanitizeSchema(normalizeJSON(t.Function.Parameters)).(map[string]interface{}); ok && schema["properties"] != nil {
+			decl.Parameters = schema
+		}
+		tool.FunctionDeclarations = append(tool.FunctionDeclarations, decl)
+	}
+	return []GeminiTool{tool}
+}
+
+// geminiToolConfig converts tool_choice ("auto", "none", "required" or
+// {"type":"function","function":{"name":...}})
+func geminiToolConfig(choice interface{}) *GeminiToolConfig {
+	mode, name := "", ""
+	switch v := normalizeJSON(choice).(type) {
+	case string:
+		mode = v
+	case map[string]interface{}:
+		mode, _ = v["type"].(string)
+		if fn, ok := v["function"].(map[string]interface{}); ok {
+			name, _ = fn["name"].(string)
+		}
+	}
+	config := &GeminiToolConfig{}
+	switch mode {
+	case "auto":
+		config.FunctionCallingConfig.Mode = "AUTO"
+	case "none":
+		config.FunctionCallingConfig.Mode = "NONE"
+	case "required":
+		config.FunctionCallingConfig.Mode = "ANY"
+	case "function":
+		config.FunctionCallingConfig.Mode = "ANY"
+		config.FunctionCallingConfig.AllowedFunctionNames = []string{name}
+	default:
+		return nil
+	}
+	return config
+}
+
+// functionCallParts converts the tool calls of an assistant message
+func functionCallParts(calls []provider.ToolCall) []GeminiPart {
+	var parts []GeminiPart
+	for _, tc := range calls {
+		args := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil || args == nil {
+			args = map[string]interface{}{}
+		}
+		parts = append(parts, GeminiPart{FunctionCall: &GeminiFunctionCall{Name: tc.Function.Name, Args: args}})
+	}
+	return parts
+}
+
+// functionResponsePart converts a tool result. Gemini wants an object: JSON objects are sent
+// as they are, anything else under "output".
+func functionResponsePart(msg provider.Message, name string) GeminiPart {
+	response := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(msg.Content), &response); err != nil || response == nil {
+		response = map[string]interface{}{"output": msg.Content}
+	}
+	return GeminiPart{FunctionResponse: &GeminiFunctionResponse{Name: name, Response: response}}
+}
+
+// toolCall converts a function call of the response. Gemini only sometimes assigns IDs,
+// OpenAI and Anthropic clients need one to match the result.
+func toolCall(fc *GeminiFunctionCall) provider.ToolCall {
+	id := fc.ID
+	if id == "" {
+		id = "call_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	}
+	args, _ := json.Marshal(fc.Args)
+	if fc.Args == nil {
+		args = []byte("{}")
+	}
+	return provider.ToolCall{
+		ID:       id,
+		Type:     "function",
+		Function: provider.FunctionCall{Name: fc.Name, Arguments: string(args)},
+	}
+}
+
+// finishReason maps a Gemini finish reason to the OpenAI one
+func finishReason(reason string, toolCalls bool) string {
+	switch {
+	case toolCalls:
+		return "tool_calls"
+	case reason == "MAX_TOKENS":
+		return "length"
+	case reason == "SAFETY", reason == "RECITATION", reason == "BLOCKLIST", reason == "PROHIBITED_CONTENT", reason == "SPII":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// normalizeJSON turns typed values (structs, json.RawMessage) into plain JSON values
+func normalizeJSON(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, string, map[string]interface{}:
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out interface{}
+	json.Unmarshal(b, &out)
+	return out
+}
+
+// Schema keywords Gemini accepts; everything else ($schema, additionalProperties, $ref,
+// exclusiveMinimum...) is dropped
+var schemaKeywords = map[string]bool{
+	"type": true, "format": true, "title": true, "description": true, "nullable": true, "enum": true,
+	"items": true, "minItems": true, "maxItems": true, "properties": true, "required": true,
+	"minProperties": true, "maxProperties": true, "minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true, "anyOf": true, "propertyOrdering": true, "default": true, "example": true,
+}
+
+// Formats Gemini accepts, by type
+var schemaFormats = map[string]map[string]bool{
+	"STRING":  {"enum": true, "date-time": true},
+	"NUMBER":  {"float": true, "double": true},
+	"INTEGER": {"int32": true, "int64": true},
+}
+
+// sanitizeSchema rewrites a JSON schema into the OpenAPI subset of Gemini: type lists become
+// a single upper-case type plus nullable, const and oneOf become enum and anyOf, enums must be
+// strings and required may only name declared properties
+func sanitizeSchema(v interface{}) interface{} {
+	in, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	out := map[string]interface{}{}
+	for k, val := range in {
+		switch k {
+		case "const":
+			out["enum"] = []interface{}{val}
+		case "oneOf":
+			out["anyOf"] = val
+		default:
+			if schemaKeywords[k] {
+				out[k] = val
+			}
+		}
+	}
+
+	switch t := out["type"].(type) {
+	case string:
+		out["type"] = strings.ToUpper(t)
+	case []interface{}:
+		delete(out, "type")
+		for _, item := range t {
+			if s, _ := item.(string); s == "null" {
+				out["nullable"] = true
+			} else if s != "" && out["type"] == nil {
+				out["type"] = strings.ToUpper(s)
+			}
+		}
+	}
+	typ, _ := out["type"].(string)
+
+	if enum, ok := out["enum"].([]interface{}); ok {
+		for _, e := range enum {
+			if _, ok := e.(string); !ok {
+				delete(out, "enum") // Gemini only has string enums
+				break
+			}
+		}
+		if out["enum"] != nil {
+			out["type"] = "STRING"
+		}
+	}
+	if f, ok := out["format"].(string); ok && !schemaFormats[typ][f] {
+		delete(out, "format")
+	}
+
+	if props, ok := out["properties"].(map[string]interface{}); ok {
+		sanitized := map[string]interface{}{}
+		for name, p := range props {
+			sanitized[name] = sanitizeSchema(p)
+		}
+		if len(sanitized) == 0 {
+			delete(out, "properties")
+		} else {
+			out["properties"] = sanitized
+		}
+		if req, ok := out["required"].([]interface{}); ok {
+			var kept []interface{}
+			for _, r := range req {
+				if name, _ := r.(string); sanitized[name] != nil {
+					kept = append(kept, r)
+				}
+			}
+			out["required"] = kept
+		}
+	}
+	if req, ok := out["required"].([]interface{}); ok && (len(req) == 0 || out["properties"] == nil) {
+		delete(out, "required")
+	}
+	if items, ok := out["items"]; ok {
+		out["items"] = sanitizeSchema(items)
+	}
+	// The request is shared with the other services of the chain: build new slices, never
+	// write into the caller's schema
+	if anyOf, ok := out["anyOf"].([]interface{}); ok {
+		sanitized := make([]interface{}, len(anyOf))
+		for i, s := range anyOf {
+			sanitized[i] = sanitizeSchema(s)
+		}
+		out["anyOf"] = sanitized
+	}
+	return out
+}
@@ -0,0 +1,91 @@
+package gemini
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decodeSchema(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("bad fixture %s: %v", s, err)
+	}
+	return v
+}
+
+func TestSanitizeSchema(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "upper-case type and dropped keywords",
+			in:   `{"type":"object","$schema":"x","additionalProperties":false,"properties":{"a":{"type":"string"}},"required":["a"]}`,
+			want: `{"type":"OBJECT","properties":{"a":{"type":"STRING"}},"required":["a"]}`,
+		},
+		{
+			name: "type list becomes nullable",
+			in:   `{"type":["integer","null"]}`,
+			want: `{"type":"INTEGER","nullable":true}`,
+		},
+		{
+			name: "const becomes a string enum",
+			in:   `{"const":"on"}`,
+			want: `{"enum":["on"],"type":"STRING"}`,
+		},
+		{
+			name: "numeric enums are dropped",
+			in:   `{"type":"integer","enum":[1,2]}`,
+			want: `{"type":"INTEGER"}`,
+		},
+		{
+			name: "unsupported format is dropped",
+			in:   `{"type":"string","format":"uri"}`,
+			want: `{"type":"STRING"}`,
+		},
+		{
+			name: "required keeps declared properties only",
+			in:   `{"type":"object","properties":{"a":{"type":"string"}},"required":["a","b"]}`,
+			want: `{"type":"OBJECT","properties":{"a":{"type":"STRING"}},"required":["a"]}`,
+		},
+		{
+			name: "oneOf becomes anyOf",
+			in:   `{"oneOf":[{"type":"string"},{"type":"number"}]}`,
+			want: `{"anyOf":[{"type":"STRING"},{"type":"NUMBER"}]}`,
+		},
+		{
+			name: "items are sanitized",
+			in:   `{"type":"array","items":{"type":"boolean","examples":[true]}}`,
+			want: `{"type":"ARRAY","items":{"type":"BOOLEAN"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeSchema(decodeSchema(t, tt.in))
+			if want := decodeSchema(t, tt.want); !reflect.DeepEqual(got, want) {
+				gotJSON, _ := json.Marshal(got)
+				t.Errorf("sanitizeSchema(%s) = %s, want %s", tt.in, gotJSON, tt.want)
+			}
+		})
+	}
+}
+
+// The request is shared across the services of a failover chain: sanitizing for Gemini
+// must leave the schema other upstreams receive untouched
+func TestSanitizeSchemaKeepsInput(t *testing.T) {
+	const schema = `{"type":"object","properties":{"v":{"oneOf":[{"type":"string"},{"type":"object","properties":{"n":{"type":["integer","null"]}}}]},"w":{"anyOf":[{"type":"string"}]},"l":{"type":"array","items":{"type":"string"}}},"required":["v","x"]}`
+	in := decodeSchema(t, schema)
+
+	first := sanitizeSchema(in)
+	second := sanitizeSchema(in)
+	if !reflect.DeepEqual(in, decodeSchema(t, schema)) {
+		b, _ := json.Marshal(in)
+		t.Fatalf("input changed: %s", b)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("second run differs: %v vs %v", first, second)
+	}
+}
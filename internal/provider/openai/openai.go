@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -27,8 +28,31 @@ func NewOpenAIProvider(baseURL string) *OpenAIProvider {
 	}
 }
 
+// marshalRequest encodes the request body. A thinking parameter becomes reasoning_effort and
+// thinking blocks (signed by other vendors) are left out; reasoning_content stays for the
+// vendors that want it back. Unsupported content is reported without the encoding/json wrapping.
+func marshalRequest(req provider.ChatCompletionRequest) ([]byte, error) {
+	if budget, set := req.ThinkingBudget(); set && budget > 0 && req.ReasoningEffort == "" {
+		req.ReasoningEffort = provider.ReasoningEffort(budget)
+	}
+	req.Thinking = nil
+	messages := make([]provider.Message, len(req.Messages))
+	for i, m := range req.Messages {
+		m.ThinkingBlocks = nil
+		messages[i] = m
+	}
+	req.Messages = messages
+
+	b, err := json.Marshal(req)
+	var contentErr *provider.UnsupportedContentError
+	if errors.As(err, &contentErr) {
+		return nil, contentErr
+	}
+	return b, err
+}
+
 func (p *OpenAIProvider) ChatCompletion(ctx context.Context, req provider.ChatCompletionRequest, apiKey string) (*provider.ChatCompletionResponse, error) {
-	reqBody, err := json.Marshal(req)
+	reqBody, err := marshalRequest(req)
 	if err != nil {
 		return nil, err
 	}
@@ -41,8 +65,7 @@ func (p *OpenAIProvider) ChatCompletion(ctx context.Context, req provider.ChatCo
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("Authorization", "Bearer "+apiKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	resp, err := provider.Client.Do(httpReq)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +73,7 @@ func (p *OpenAIProvider) ChatCompletion(ctx context.Context, req provider.ChatCo
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("openai API error: %d - %s", resp.StatusCode, string(bodyBytes))
+		return nil, &provider.APIError{Provider: provider.ProviderOpenAI, StatusCode: resp.StatusCode, Body: string(bodyBytes), RetryAfter: provider.ParseRetryAfter(resp.Header.Get("Retry-After"))}
 	}
 
 	var chatResp provider.ChatCompletionResponse
@@ -75,7 +98,8 @@ func (p *OpenAIProvider) ChatCompletion(ctx context.Context, req provider.ChatCo
 
 func (p *OpenAIProvider) StreamChatCompletion(ctx context.Context, req provider.ChatCompletionRequest, apiKey string, outputChan chan<- provider.StreamResponse) error {
 	req.Stream = true
-	reqBody, err := json.Marshal(req)
+	req.StreamOptions = &provider.StreamOptions{IncludeUsage: true} // Usage is billed
+	reqBody, err := marshalRequest(req)
 	if err != nil {
 		return err
 	}
@@ -88,8 +112,7 @@ func (p *OpenAIProvider) StreamChatCompletion(ctx context.Context, req provider.
 	httpReq.Header.Set("Content-Type", "application/json")
 	httpReq.Header.Set("Authorization", "Bearer "+apiKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	resp, err := provider.Client.Do(httpReq)
 	if err != nil {
 		return err
 	}
@@ -97,7 +120,7 @@ func (p *OpenAIProvider) StreamChatCompletion(ctx context.Context, req provider.
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("openai stream error: %d - %s", resp.StatusCode, string(bodyBytes))
+		return &provider.APIError{Provider: provider.ProviderOpenAI, Stream: true, StatusCode: resp.StatusCode, Body: string(bodyBytes), RetryAfter: provider.ParseRetryAfter(resp.Header.Get("Retry-After"))}
 	}
 
 	scanner := bufio.NewScanner(resp.Body)
@@ -127,9 +150,10 @@ func (p *OpenAIProvider) StreamChatCompletion(ctx context.Context, req provider.
 
 func (p *OpenAIProvider) parseStreamResponse(body []byte, model string) (*provider.ChatCompletionResponse, error) {
 	scanner := bufio.NewScanner(bytes.NewReader(body))
-	fullContent := ""
+	fullContent, fullReasoning := "", ""
 	var lastID string
 	var finishReason string = "stop"
+	var usage provider.Usage
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -148,8 +172,12 @@ func (p *OpenAIProvider) parseStreamResponse(body []byte, model string) (*provid
 			continue // Skip bad chunks
 		}
 
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
 		if len(chunk.Choices) > 0 {
 			fullContent += chunk.Choices[0].Delta.Content
+			fullReasoning += chunk.Choices[0].Delta.ReasoningContent
 			if chunk.Choices[0].FinishReason != nil {
 				finishReason = *chunk.Choices[0].FinishReason
 			}
@@ -169,11 +197,22 @@ func (p *OpenAIProvider) parseStreamResponse(body []byte, model string) (*provid
 			{
 				Index: 0,
 				Message: provider.Message{
-					Role:    "assistant",
-					Content: fullContent,
+					Role:             "assistant",
+					Content:          fullContent,
+					ReasoningContent: fullReasoning,
 				},
 				FinishReason: finishReason,
 			},
 		},
+		Usage: usage,
 	}, nil
 }
+
+func (p *OpenAIProvider) HealthCheck(ctx context.Context, apiKey string) error {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", p.BaseURL+"/models", nil)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+	return provider.DoHealthCheck(provider.ProviderOpenAI, httpReq)
+}
@@ -0,0 +1,97 @@
+package provider
+
+import "encoding/json"
+
+// ResponseFormat is the OpenAI response_format: "text", "json_object" or "json_schema"
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Schema      any    `json:"schema,omitempty"`
+	Strict      *bool  `json:"strict,omitempty"`
+}
+
+// StopSequences is the OpenAI stop parameter, a string or an array of strings
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(b []byte) error {
+	var one string
+	if json.Unmarshal(b, &one) == nil {
+		*s = StopSequences{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(s))
+}
+
+// MaxOutputTokens returns max_completion_tokens, or max_tokens for older clients
+func (r ChatCompletionRequest) MaxOutputTokens() *int {
+	if r.MaxCompletionTokens != nil {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
+}
+
+// Sampling parameters some upstream protocols have no equivalent for
+const (
+	ParamTopK             = "top_k"
+	ParamN                = "n"
+	ParamSeed             = "seed"
+	ParamPresencePenalty  = "presence_penalty"
+	ParamFrequencyPenalty = "frequency_penalty"
+	ParamResponseFormat   = "response_format"
+	ParamUser             = "user"
+)
+
+// unsupportedParams lists, by provider, the parameters its adapter cannot translate
+var unsupportedParams = map[string][]string{
+	ProviderOpenAI:    {ParamTopK},
+	ProviderAnthropic: {ParamN, ParamSeed, ParamPresencePenalty, ParamFrequencyPenalty, ParamResponseFormat},
+	ProviderGemini:    {ParamUser},
+}
+
+// UnsupportedParams returns the parameters set in req that providerName cannot honour.
+// n = 1 and a "text" response format are the defaults everywhere and never reported.
+func (r ChatCompletionRequest) UnsupportedParams(providerName string) []string {
+	set := map[string]bool{
+		ParamTopK:             r.TopK != nil,
+		ParamN:                r.N != nil && *r.N > 1,
+		ParamSeed:             r.Seed != nil,
+		ParamPresencePenalty:  r.PresencePenalty != nil,
+		ParamFrequencyPenalty: r.FrequencyPenalty != nil,
+		ParamResponseFormat:   r.ResponseFormat != nil && r.ResponseFormat.Type != "text",
+		ParamUser:             r.User != "",
+	}
+	var out []string
+	for _, name := range unsupportedParams[providerName] {
+		if set[name] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// DropParams unsets the given parameters
+func (r *ChatCompletionRequest) DropParams(names []string) {
+	for _, name := range names {
+		switch name {
+		case ParamTopK:
+			r.TopK = nil
+		case ParamN:
+			r.N = nil
+		case ParamSeed:
+			r.Seed = nil
+		case ParamPresencePenalty:
+			r.PresencePenalty = nil
+		case ParamFrequencyPenalty:
+			r.FrequencyPenalty = nil
+		case ParamResponseFormat:
+			r.ResponseFormat = nil
+		case ParamUser:
+			r.User = ""
+		}
+	}
+}
@@ -1,15 +1,51 @@
 package provider
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"qiservice/internal/tracing"
+)
 
 // ChatCompletionRequest represents the standard OpenAI chat completion request
 type ChatCompletionRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Tools       []Tool    `json:"tools,omitempty"`
-	ToolChoice  any       `json:"tool_choice,omitempty"`
-	Temperature float64   `json:"temperature,omitempty"`
-	Stream      bool      `json:"stream,omitempty"`
+	Model      string    `json:"model"`
+	Messages   []Message `json:"messages"`
+	Tools      []Tool    `json:"tools,omitempty"`
+	ToolChoice any       `json:"tool_choice,omitempty"`
+	Stream     bool      `json:"stream,omitempty"`
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	// Sampling parameters, nil when left to the upstream default (see params.go)
+	MaxTokens           *int            `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64        `json:"temperature,omitempty"`
+	TopP                *float64        `json:"top_p,omitempty"`
+	TopK                *int            `json:"top_k,omitempty"` // Not an OpenAI parameter
+	Stop                StopSequences   `json:"stop,omitempty"`
+	N                   *int            `json:"n,omitempty"`
+	Seed                *int64          `json:"seed,omitempty"`
+	PresencePenalty     *float64        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64        `json:"frequency_penalty,omitempty"`
+	ResponseFormat      *ResponseFormat `json:"response_format,omitempty"`
+	User                string          `json:"user,omitempty"`
+
+	// Reasoning: the Anthropic thinking parameter, or the OpenAI effort (see ThinkingBudget)
+	Thinking        *ThinkingConfig `json:"thinking,omitempty"`
+	ReasoningEffort string          `json:"reasoning_effort,omitempty"`
+}
+
+// StreamOptions asks OpenAI upstreams for a final usage chunk, which billing relies on
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type Tool struct {
@@ -23,15 +59,24 @@ type ToolFunction struct {
 	Parameters  any    `json:"parameters"` // JSON schema
 }
 
+// Message is a chat message. Content holds its text; Parts is only set when the message
+// carries media (see NewMessage), content is then sent as an array of parts.
 type Message struct {
-	Role       string     `json:"role,omitempty"`
-	Content    string     `json:"content,omitempty"`
-	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
-	ToolCallID string     `json:"tool_call_id,omitempty"` // For tool_result messages
-	Name       string     `json:"name,omitempty"`         // For tool_result messages
+	Role       string        `json:"role,omitempty"`
+	Content    string        `json:"content,omitempty"`
+	Parts      []ContentPart `json:"-"`
+	ToolCalls  []ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID string        `json:"tool_call_id,omitempty"` // For tool_result messages
+	Name       string        `json:"name,omitempty"`         // For tool_result messages
+
+	// Reasoning of the assistant: its text (DeepSeek style), and the signed blocks that must
+	// be sent back unchanged in later turns (see ThinkingBlock)
+	ReasoningContent string          `json:"reasoning_content,omitempty"`
+	ThinkingBlocks   []ThinkingBlock `json:"thinking_blocks,omitempty"`
 }
 
 type ToolCall struct {
+	Index    *int         `json:"index,omitempty"` // Stream deltas only
 	ID       string       `json:"id"`
 	Type     string       `json:"type"`
 	Function FunctionCall `json:"function"`
@@ -43,9 +88,23 @@ type FunctionCall struct {
 }
 
 type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens        int                  `json:"prompt_tokens"`
+	CompletionTokens    int                  `json:"completion_tokens"`
+	TotalTokens         int                  `json:"total_tokens"`
+	PromptTokensDetails *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+// PromptTokensDetails breaks down the prompt tokens (cached tokens are included in PromptTokens)
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+// CachedTokens returns how many prompt tokens were served from the upstream prompt cache
+func (u Usage) CachedTokens() int {
+	if u.PromptTokensDetails == nil {
+		return 0
+	}
+	return u.PromptTokensDetails.CachedTokens
 }
 
 // ChatCompletionResponse represents the standard OpenAI chat completion response
@@ -85,6 +144,80 @@ type StreamChoice struct {
 type Provider interface {
 	ChatCompletion(ctx context.Context, req ChatCompletionRequest, apiKey string) (*ChatCompletionResponse, error)
 	StreamChatCompletion(ctx context.Context, req ChatCompletionRequest, apiKey string, outputChan chan<- StreamResponse) error
+	// HealthCheck sends a cheap request (the model list) to see whether the upstream answers
+	HealthCheck(ctx context.Context, apiKey string) error
+}
+
+// Client sends the adapter requests: during a traced request each call gets a span and
+// carries the trace context to the upstream
+var Client = &http.Client{Transport: tracing.Transport(nil)}
+
+// DoHealthCheck runs a prepared health check request, returning an *APIError on a non-200 answer
+func DoHealthCheck(providerName string, req *http.Request) error {
+	resp, err := Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return &APIError{Provider: providerName, StatusCode: resp.StatusCode, Body: string(bodyBytes), RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return nil
+}
+
+// APIError is returned when the upstream answers with a non-200 status
+type APIError struct {
+	Provider   string // "openai", "anthropic", "gemini"
+	Stream     bool
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // From the Retry-After header, 0 if absent
+}
+
+func (e *APIError) Error() string {
+	kind := "API"
+	if e.Stream {
+		kind = "stream"
+	}
+	return fmt.Sprintf("%s %s error: %d - %s", e.Provider, kind, e.StatusCode, e.Body)
+}
+
+// ParseRetryAfter reads a Retry-After header (seconds or HTTP date)
+func ParseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// IsRetryableStatus reports whether an upstream status is worth retrying on another service
+func IsRetryableStatus(status int) bool {
+	return status == 429 || status >= 500
+}
+
+// IsRetryable reports whether err is a connection error, a 5xx or a 429,
+// i.e. the request may succeed on a different upstream service.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return IsRetryableStatus(apiErr.StatusCode)
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
 }
 
 // Constants for provider names
@@ -0,0 +1,85 @@
+package provider
+
+import "strings"
+
+// ThinkingConfig is the Anthropic thinking parameter: {"type": "enabled", "budget_tokens": N}
+// or {"type": "disabled"}
+type ThinkingConfig struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// Thinking block types
+const (
+	ThinkingTypeThinking = "thinking"
+	ThinkingTypeRedacted = "redacted_thinking" // Encrypted by the upstream, only Data is set
+)
+
+// ThinkingBlock is a reasoning block with the signature the upstream checks when it is sent
+// back in a later turn (Anthropic requires it before tool_use blocks). In stream deltas a block
+// may carry only its Signature, which closes the thinking block in progress.
+type ThinkingBlock struct {
+	Type      string `json:"type"`
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Data      string `json:"data,omitempty"` // ThinkingTypeRedacted
+}
+
+// Gemini thought signatures are marked so they are never sent to another vendor
+const geminiSignaturePrefix = "gemini:"
+
+// GeminiSignature wraps a Gemini thoughtSignature for a ThinkingBlock
+func GeminiSignature(sig string) string {
+	return geminiSignaturePrefix + sig
+}
+
+// IsGemini reports whether the block holds a Gemini thought signature
+func (b ThinkingBlock) IsGemini() bool {
+	return strings.HasPrefix(b.Signature, geminiSignaturePrefix)
+}
+
+// GeminiSignature returns the Gemini thought signature of the block, "" if it is not one
+func (b ThinkingBlock) GeminiSignature() string {
+	sig, _ := strings.CutPrefix(b.Signature, geminiSignaturePrefix)
+	if sig == b.Signature {
+		return ""
+	}
+	return sig
+}
+
+// Thinking budgets used for reasoning_effort
+var effortBudgets = map[string]int{"minimal": 1024, "low": 1024, "medium": 4096, "high": 16384}
+
+// ThinkingBudget returns the reasoning budget in tokens asked for by the thinking parameter or,
+// failing that, reasoning_effort. set is false when the client asked for neither; a budget of 0
+// means reasoning is disabled. An enabled thinking without budget gets the "medium" one.
+func (r ChatCompletionRequest) ThinkingBudget() (budget int, set bool) {
+	if t := r.Thinking; t != nil {
+		if t.Type != "enabled" {
+			return 0, true
+		}
+		if t.BudgetTokens > 0 {
+			return t.BudgetTokens, true
+		}
+		return effortBudgets["medium"], true
+	}
+	if r.ReasoningEffort == "" {
+		return 0, false
+	}
+	if budget, ok := effortBudgets[r.ReasoningEffort]; ok {
+		return budget, true
+	}
+	return 0, true // "none"
+}
+
+// ReasoningEffort returns the reasoning_effort closest to a thinking budget
+func ReasoningEffort(budget int) string {
+	switch {
+	case budget < effortBudgets["medium"]:
+		return "low"
+	case budget < effortBudgets["high"]:
+		return "medium"
+	default:
+		return "high"
+	}
+}
@@ -0,0 +1,198 @@
+// Package quota implements quota plans: spending allowances that renew every day, week or month,
+// optionally rolling unused allowance over. Windows are reset by a background job.
+package quota
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"qiservice/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// resetInterval is how often windows that ended are rolled
+const resetInterval = time.Minute
+
+var plans = struct {
+	sync.RWMutex
+	byID map[uint]db.QuotaPlan
+}{byID: make(map[uint]db.QuotaPlan)}
+
+// ValidPeriod reports whether period is a known plan period
+func ValidPeriod(period string) bool {
+	switch period {
+	case db.PeriodDaily, db.PeriodWeekly, db.PeriodMonthly:
+		return true
+	}
+	return false
+}
+
+// PeriodStart is the start of the window containing t: midnight, Monday midnight or the 1st of the month
+func PeriodStart(period string, t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch period {
+	case db.PeriodWeekly:
+		offset := (int(day.Weekday()) + 6) % 7 // Days since Monday
+		return day.AddDate(0, 0, -offset)
+	case db.PeriodMonthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return day
+	}
+}
+
+// NextReset is the end of the window containing t
+func NextReset(period string, t time.Time) time.Time {
+	start := PeriodStart(period, t)
+	switch period {
+	case db.PeriodWeekly:
+		return start.AddDate(0, 0, 7)
+	case db.PeriodMonthly:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// Usage is the state of a user's current plan window
+type Usage struct {
+	Plan      string    `json:"plan"`
+	Period    string    `json:"period"`
+	Used      float64   `json:"used"`
+	Limit     float64   `json:"limit"` // Plan limit plus rollover, < 0 = unlimited
+	Rollover  float64   `json:"rollover"`
+	NextReset time.Time `json:"next_reset"`
+}
+
+// Exceeded reports whether the window allows no more spending
+func (u *Usage) Exceeded() bool {
+	return u.Limit >= 0 && u.Used >= u.Limit
+}
+
+// Current returns the window state of a user, nil without a plan. A window that ended but has
+// not been reset yet is reported as the new one.
+func Current(user *db.User) *Usage {
+	if user.PlanID == nil {
+		return nil
+	}
+	plan, ok := Get(*user.PlanID)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	used, carry := user.PeriodUsed, user.PeriodCarry
+	if user.PeriodStart.Before(PeriodStart(plan.Period, now)) {
+		carry = rolledOver(plan, user)
+		used = 0
+	}
+	usage := &Usage{
+		Plan:      plan.Name,
+		Period:    plan.Period,
+		Used:      used,
+		Limit:     plan.Limit,
+		Rollover:  carry,
+		NextReset: NextReset(plan.Period, now),
+	}
+	if plan.Limit >= 0 {
+		usage.Limit += carry
+	}
+	return usage
+}
+
+// rolledOver is the allowance carried out of the user's current window
+func rolledOver(plan db.QuotaPlan, user *db.User) float64 {
+	if !plan.Rollover || plan.Limit < 0 {
+		return 0
+	}
+	unused := plan.Limit + user.PeriodCarry - user.PeriodUsed
+	return math.Max(0, math.Min(unused, plan.Limit))
+}
+
+// Get returns a plan from the cache
+func Get(id uint) (db.QuotaPlan, bool) {
+	plans.RLock()
+	defer plans.RUnlock()
+	p, ok := plans.byID[id]
+	return p, ok
+}
+
+// LoadPlans refreshes the plan cache, call it after plans change
+func LoadPlans() {
+	var rows []db.QuotaPlan
+	if err := db.DB.Find(&rows).Error; err != nil {
+		log.Printf("[Quota] Failed to load plans: %v", err)
+		return
+	}
+	byID := make(map[uint]db.QuotaPlan, len(rows))
+	for _, p := range rows {
+		byID[p.ID] = p
+	}
+	plans.Lock()
+	plans.byID = byID
+	plans.Unlock()
+}
+
+// Start loads the plans and resets ended windows now and every resetInterval
+func Start() {
+	LoadPlans()
+	ResetEnded()
+	go func() {
+		for range time.Tick(resetInterval) {
+			ResetEnded()
+		}
+	}()
+}
+
+// ResetEnded opens a new window for every user whose window has ended
+func ResetEnded() {
+	var users []db.User
+	if err := db.DB.Select("id", "plan_id", "period_start", "period_used", "period_carry").
+		Where("plan_id IS NOT NULL").Find(&users).Error; err != nil {
+		log.Printf("[Quota] Failed to load users: %v", err)
+		return
+	}
+	now := time.Now()
+	reset := 0
+	for i := range users {
+		u := &users[i]
+		plan, ok := Get(*u.PlanID)
+		if !ok {
+			continue
+		}
+		start := PeriodStart(plan.Period, now)
+		if !u.PeriodStart.Before(start) {
+			continue
+		}
+		// Subtract what was read instead of zeroing, so costs charged meanwhile are kept;
+		// the period_start condition makes a concurrent reset a no-op
+		res := db.DB.Model(&db.User{}).Where("id = ? AND period_start = ?", u.ID, u.PeriodStart).UpdateColumns(map[string]interface{}{
+			"period_start": start,
+			"period_used":  gorm.Expr("period_used - ?", u.PeriodUsed),
+			"period_carry": rolledOver(plan, u),
+		})
+		if res.Error != nil {
+			log.Printf("[Quota] Failed to reset user %d: %v", u.ID, res.Error)
+			continue
+		}
+		reset += int(res.RowsAffected)
+	}
+	if reset > 0 {
+		log.Printf("[Quota] Started a new period for %d users", reset)
+	}
+}
+
+// Assign puts a user on a plan (nil removes it) with a fresh window
+func Assign(tx *gorm.DB, userID uint, planID *uint) error {
+	updates := map[string]interface{}{"plan_id": planID, "period_used": 0, "period_carry": 0}
+	if planID != nil {
+		plan, ok := Get(*planID)
+		if !ok {
+			return gorm.ErrRecordNotFound
+		}
+		updates["period_start"] = PeriodStart(plan.Period, time.Now())
+	}
+	return tx.Model(&db.User{}).Where("id = ?", userID).UpdateColumns(updates).Error
+}
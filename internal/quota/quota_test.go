@@ -0,0 +1,126 @@
+package quota
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"qiservice/internal/db"
+)
+
+func date(y int, m time.Month, d, h int) time.Time {
+	return time.Date(y, m, d, h, 0, 0, 0, time.UTC)
+}
+
+func TestPeriodWindows(t *testing.T) {
+	tests := []struct {
+		period     string
+		t          time.Time
+		start, end time.Time
+	}{
+		{db.PeriodDaily, date(2026, 3, 15, 13), date(2026, 3, 15, 0), date(2026, 3, 16, 0)},
+		{db.PeriodDaily, date(2026, 12, 31, 23), date(2026, 12, 31, 0), date(2027, 1, 1, 0)},
+		{db.PeriodWeekly, date(2026, 3, 15, 13), date(2026, 3, 9, 0), date(2026, 3, 16, 0)}, // Sunday
+		{db.PeriodWeekly, date(2026, 3, 16, 0), date(2026, 3, 16, 0), date(2026, 3, 23, 0)}, // Monday
+		{db.PeriodMonthly, date(2026, 1, 31, 8), date(2026, 1, 1, 0), date(2026, 2, 1, 0)},
+		{db.PeriodMonthly, date(2026, 12, 2, 8), date(2026, 12, 1, 0), date(2027, 1, 1, 0)},
+	}
+	for _, tt := range tests {
+		if got := PeriodStart(tt.period, tt.t); !got.Equal(tt.start) {
+			t.Errorf("PeriodStart(%s, %v) = %v, want %v", tt.period, tt.t, got, tt.start)
+		}
+		if got := NextReset(tt.period, tt.t); !got.Equal(tt.end) {
+			t.Errorf("NextReset(%s, %v) = %v, want %v", tt.period, tt.t, got, tt.end)
+		}
+	}
+}
+
+func TestRolledOver(t *testing.T) {
+	tests := []struct {
+		name        string
+		plan        db.QuotaPlan
+		used, carry float64
+		want        float64
+	}{
+		{"no rollover", db.QuotaPlan{Limit: 10}, 4, 0, 0},
+		{"unused allowance", db.QuotaPlan{Limit: 10, Rollover: true}, 4, 0, 6},
+		{"carry is spent first", db.QuotaPlan{Limit: 10, Rollover: true}, 12, 5, 3},
+		{"capped at one limit", db.QuotaPlan{Limit: 10, Rollover: true}, 0, 10, 10},
+		{"overspent window", db.QuotaPlan{Limit: 10, Rollover: true}, 15, 0, 0},
+		{"unlimited plan", db.QuotaPlan{Limit: -1, Rollover: true}, 3, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := rolledOver(tt.plan, &db.User{PeriodUsed: tt.used, PeriodCarry: tt.carry}); got != tt.want {
+			t.Errorf("%s: rolledOver = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func setPlans(ps ...db.QuotaPlan) {
+	byID := make(map[uint]db.QuotaPlan)
+	for _, p := range ps {
+		byID[p.ID] = p
+	}
+	plans.Lock()
+	plans.byID = byID
+	plans.Unlock()
+}
+
+func TestCurrent(t *testing.T) {
+	setPlans(db.QuotaPlan{ID: 1, Name: "daily", Period: db.PeriodDaily, Limit: 10, Rollover: true})
+	planID := uint(1)
+	today := PeriodStart(db.PeriodDaily, time.Now())
+
+	tests := []struct {
+		name                string
+		start               time.Time
+		used, carry         float64
+		wantUsed, wantLimit float64
+		wantCarry           float64
+		wantExceeded        bool
+	}{
+		{"current window", today, 4, 2, 4, 12, 2, false},
+		{"current window used up", today, 12, 2, 12, 12, 2, true},
+		{"ended window not reset yet", today.AddDate(0, 0, -1), 7, 0, 0, 13, 3, false},
+		{"ended overspent window", today.AddDate(0, 0, -2), 30, 0, 0, 10, 0, false},
+	}
+	for _, tt := range tests {
+		u := Current(&db.User{PlanID: &planID, PeriodStart: tt.start, PeriodUsed: tt.used, PeriodCarry: tt.carry})
+		if u == nil {
+			t.Fatalf("%s: no usage", tt.name)
+		}
+		if u.Used != tt.wantUsed || u.Limit != tt.wantLimit || u.Rollover != tt.wantCarry || u.Exceeded() != tt.wantExceeded {
+			t.Errorf("%s: used %v limit %v rollover %v exceeded %v, want %v/%v/%v/%v", tt.name,
+				u.Used, u.Limit, u.Rollover, u.Exceeded(), tt.wantUsed, tt.wantLimit, tt.wantCarry, tt.wantExceeded)
+		}
+	}
+	if Current(&db.User{}) != nil {
+		t.Error("usage reported for a user without a plan")
+	}
+}
+
+func TestResetEnded(t *testing.T) {
+	db.Init(filepath.Join(t.TempDir(), "quota.db"))
+	plan := db.QuotaPlan{Name: "daily", Period: db.PeriodDaily, Limit: 10, Rollover: true}
+	db.DB.Create(&plan)
+	LoadPlans()
+
+	today := PeriodStart(db.PeriodDaily, time.Now())
+	ended := db.User{Username: "ended", PlanID: &plan.ID, PeriodStart: today.AddDate(0, 0, -1), PeriodUsed: 4, PeriodCarry: 1}
+	current := db.User{Username: "current", PlanID: &plan.ID, PeriodStart: today, PeriodUsed: 4}
+	db.DB.Create(&ended)
+	db.DB.Create(&current)
+
+	ResetEnded()
+	ResetEnded() // A second run finds nothing to reset
+
+	var gotEnded, gotCurrent db.User
+	db.DB.First(&gotEnded, ended.ID)
+	if !gotEnded.PeriodStart.Equal(today) || gotEnded.PeriodUsed != 0 || gotEnded.PeriodCarry != 7 {
+		t.Errorf("ended window: start %v used %v carry %v, want %v/0/7", gotEnded.PeriodStart, gotEnded.PeriodUsed, gotEnded.PeriodCarry, today)
+	}
+	db.DB.First(&gotCurrent, current.ID)
+	if gotCurrent.PeriodUsed != 4 || gotCurrent.PeriodCarry != 0 {
+		t.Errorf("current window changed: used %v carry %v", gotCurrent.PeriodUsed, gotCurrent.PeriodCarry)
+	}
+}
@@ -0,0 +1,176 @@
+// Package ratelimit enforces per-user and per-key request, token and concurrency limits
+// in process, with token buckets that refill continuously over one minute.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// idleAfter is how long an untouched bucket is kept before it is swept
+const idleAfter = 10 * time.Minute
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	inFlight int
+}
+
+// refill tops the bucket up for the time elapsed, capped at capacity
+func (b *bucket) refill(capacity float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Minutes()*capacity)
+	}
+	b.last = now
+}
+
+// wait is the time until the bucket holds at least need tokens
+func (b *bucket) wait(capacity, need float64) time.Duration {
+	if capacity <= 0 {
+		return time.Minute
+	}
+	missing := need - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / capacity * float64(time.Minute))
+}
+
+// Limiter holds the buckets of every limited subject ("user:1", "key:7", ...)
+type Limiter struct {
+	mu       sync.Mutex
+	requests map[string]*bucket
+	tokens   map[string]*bucket
+	streams  map[string]*bucket
+}
+
+var Global = New()
+
+func New() *Limiter {
+	l := &Limiter{
+		requests: make(map[string]*bucket),
+		tokens:   make(map[string]*bucket),
+		streams:  make(map[string]*bucket),
+	}
+	go l.sweep()
+	return l
+}
+
+func get(m map[string]*bucket, key string) *bucket {
+	b, ok := m[key]
+	if !ok {
+		b = &bucket{}
+		m[key] = b
+	}
+	return b
+}
+
+// Limits configured for one subject; 0 means unlimited
+type Limits struct {
+	RPM           int
+	TPM           int
+	MaxConcurrent int
+}
+
+// Rejection says which limit was hit and when to retry
+type Rejection struct {
+	Limit      string // "rpm", "tpm" or "concurrency"
+	RetryAfter time.Duration
+}
+
+// Acquire admits one request for every subject, or none of them. A request needs one
+// request token, a non-negative token balance (usage is only known afterwards, see
+// ChargeTokens) and a free concurrency slot. On success the caller must Release.
+func (l *Limiter) Acquire(subjects map[string]Limits) *Rejection {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+
+	for key, lim := range subjects {
+		if lim.RPM > 0 {
+			b := get(l.requests, key)
+			b.refill(float64(lim.RPM), now)
+			if b.tokens < 1 {
+				return &Rejection{Limit: "rpm", RetryAfter: b.wait(float64(lim.RPM), 1)}
+			}
+		}
+		if lim.TPM > 0 {
+			b := get(l.tokens, key)
+			b.refill(float64(lim.TPM), now)
+			if b.tokens <= 0 {
+				return &Rejection{Limit: "tpm", RetryAfter: b.wait(float64(lim.TPM), 1)}
+			}
+		}
+		if lim.MaxConcurrent > 0 {
+			b := get(l.streams, key)
+			b.last = now
+			if b.inFlight >= lim.MaxConcurrent {
+				// Nothing to compute: a slot frees when a running request ends
+				return &Rejection{Limit: "concurrency", RetryAfter: time.Second}
+			}
+		}
+	}
+
+	// All checks passed: commit
+	for key, lim := range subjects {
+		if lim.RPM > 0 {
+			l.requests[key].tokens--
+		}
+		if lim.MaxConcurrent > 0 {
+			l.streams[key].inFlight++
+		}
+	}
+	return nil
+}
+
+// Release frees the concurrency slots taken by Acquire
+func (l *Limiter) Release(subjects map[string]Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, lim := range subjects {
+		if lim.MaxConcurrent <= 0 {
+			continue
+		}
+		if b, ok := l.streams[key]; ok && b.inFlight > 0 {
+			b.inFlight--
+		}
+	}
+}
+
+// ChargeTokens debits the tokens a finished request used. The balance may go negative,
+// which holds back further requests until it has refilled.
+func (l *Limiter) ChargeTokens(subjects map[string]Limits, used int) {
+	if used <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, lim := range subjects {
+		if lim.TPM <= 0 {
+			continue
+		}
+		b := get(l.tokens, key)
+		b.refill(float64(lim.TPM), now)
+		b.tokens -= float64(used)
+	}
+}
+
+// sweep drops idle buckets so the maps do not grow with every key ever seen
+func (l *Limiter) sweep() {
+	for range time.Tick(idleAfter) {
+		cutoff := time.Now().Add(-idleAfter)
+		l.mu.Lock()
+		for _, m := range []map[string]*bucket{l.requests, l.tokens, l.streams} {
+			for key, b := range m {
+				if b.inFlight == 0 && b.last.Before(cutoff) {
+					delete(m, key)
+				}
+			}
+		}
+		l.mu.Unlock()
+	}
+}
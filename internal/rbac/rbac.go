@@ -0,0 +1,177 @@
+// Package rbac maps roles to permissions. The built-in roles are fixed; custom roles are
+// stored in the database and defined by the super admin.
+package rbac
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"qiservice/internal/db"
+)
+
+// Permissions
+const (
+	UsersRead          = "users.read"         // List users
+	UsersWrite         = "users.write"        // Create, update and delete users, top up their wallets
+	UsersManageStaff   = "users.manage_staff" // Act on users whose role carries permissions, not only on ordinary users
+	RolesAssign        = "roles.assign"       // Give users a role other than 'user'
+	RolesManage        = "roles.manage"       // Define custom roles
+	KeysManageOthers   = "keys.manage_others" // Issue API keys for other users
+	ServicesWrite      = "services.write"     // Change services, see masked upstream keys, upstream errors and key health
+	ServicesAll        = "services.all"       // See and call every service, whatever the groups
+	StatsGlobal        = "stats.global"       // Statistics of every user
+	WalletRead         = "wallet.read"        // Read the wallet ledger of every user and organization
+	PlansWrite         = "plans.write"        // Manage quota plans
+	GroupsWrite        = "groups.write"       // Manage user groups
+	OrgsManage         = "orgs.manage"        // Create and delete organizations, act as owner of every organization
+	QuotaExempt        = "quota.exempt"       // API keys are not checked against the user's quota
+	AuthRotateKey      = "auth.rotate_key"    // Rotate the JWT signing key
+	AuditRead          = "audit.read"         // Search and verify the audit log
+	PayloadsRead       = "payloads.read"      // Read captured request and response bodies
+	permissionWildcard = "*"
+)
+
+// Permission describes an entry of the catalogue
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Catalogue lists every permission that can be granted
+var Catalogue = []Permission{
+	{UsersRead, "查看用户列表"},
+	{UsersWrite, "创建、修改、删除用户及为其充值"},
+	{UsersManageStaff, "管理拥有权限的用户（否则只能管理普通用户）"},
+	{RolesAssign, "为用户分配角色"},
+	{RolesManage, "定义自定义角色"},
+	{KeysManageOthers, "为其他用户签发 API Key"},
+	{ServicesWrite, "配置服务、查看上游 Key 状态与错误"},
+	{ServicesAll, "可见并调用全部服务，不受用户组限制"},
+	{StatsGlobal, "查看全站统计"},
+	{WalletRead, "查看全部钱包流水"},
+	{PlansWrite, "管理配额套餐"},
+	{GroupsWrite, "管理用户组"},
+	{OrgsManage, "创建、删除团队，并以所有者身份管理全部团队"},
+	{QuotaExempt, "API Key 调用不受用户配额限制"},
+	{AuthRotateKey, "轮换 JWT 签名密钥"},
+	{AuditRead, "查看并校验审计日志"},
+	{PayloadsRead, "查看记录的请求与响应载荷"},
+}
+
+// builtin are the permissions of the fixed roles
+var builtin = map[string][]string{
+	db.RoleSuperAdmin: {permissionWildcard},
+	db.RoleAdmin: {
+		UsersRead, UsersWrite, KeysManageOthers, ServicesWrite, ServicesAll, StatsGlobal,
+		WalletRead, PlansWrite, GroupsWrite, OrgsManage, QuotaExempt,
+	},
+	db.RoleUser: {},
+}
+
+var roles = struct {
+	sync.RWMutex
+	custom map[string]map[string]bool
+}{custom: make(map[string]map[string]bool)}
+
+// Valid reports whether name is a permission of the catalogue
+func Valid(name string) bool {
+	for _, p := range Catalogue {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBuiltin reports whether role is one of the fixed roles
+func IsBuiltin(role string) bool {
+	_, ok := builtin[role]
+	return ok
+}
+
+// Exists reports whether role is a built-in or custom role
+func Exists(role string) bool {
+	if IsBuiltin(role) {
+		return true
+	}
+	roles.RLock()
+	defer roles.RUnlock()
+	_, ok := roles.custom[role]
+	return ok
+}
+
+// Has reports whether role grants the permission
+func Has(role, permission string) bool {
+	if perms, ok := builtin[role]; ok {
+		for _, p := range perms {
+			if p == permission || p == permissionWildcard {
+				return true
+			}
+		}
+		return false
+	}
+	roles.RLock()
+	defer roles.RUnlock()
+	return roles.custom[role][permission]
+}
+
+// Permissions lists what role grants, sorted
+func Permissions(role string) []string {
+	out := []string{}
+	for _, p := range Catalogue {
+		if Has(role, p.Name) {
+			out = append(out, p.Name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Privileged reports whether role grants any permission, which makes its users staff
+func Privileged(role string) bool {
+	return len(Permissions(role)) > 0
+}
+
+// Unprivileged lists the roles that grant no permission: their users are ordinary users
+func Unprivileged() []string {
+	out := []string{db.RoleUser}
+	roles.RLock()
+	defer roles.RUnlock()
+	for name, perms := range roles.custom {
+		if len(perms) == 0 {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// Covers reports whether role a grants every permission of role b
+func Covers(a, b string) bool {
+	for _, p := range Permissions(b) {
+		if !Has(a, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Load refreshes the custom roles, call it after they change
+func Load() {
+	var rows []db.Role
+	if err := db.DB.Find(&rows).Error; err != nil {
+		log.Printf("[RBAC] Failed to load roles: %v", err)
+		return
+	}
+	custom := make(map[string]map[string]bool, len(rows))
+	for _, r := range rows {
+		perms := make(map[string]bool, len(r.Permissions))
+		for _, p := range r.Permissions {
+			perms[p] = true
+		}
+		custom[r.Name] = perms
+	}
+	roles.Lock()
+	roles.custom = custom
+	roles.Unlock()
+}
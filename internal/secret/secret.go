@@ -0,0 +1,197 @@
+// Package secret seals upstream credentials with envelope encryption: every value gets
+// its own data key (AES-256-GCM), and the data key is wrapped with the master key.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// prefix marks a sealed value: enc:v1:<fingerprint>:<hint>:<wrapped data key>:<ciphertext>
+const prefix = "enc:v1:"
+
+// defaultKeyFile holds the generated master key when none is configured
+const defaultKeyFile = "master.key"
+
+var aad = []byte("qiservice-upstream-credential")
+
+var master cipher.AEAD
+
+// Init loads the master key. Sources, in order:
+//   - QISERVICE_MASTER_KEY: 32 bytes, base64 or hex encoded
+//   - QISERVICE_MASTER_KEY_FILE: a file with the same content
+//   - master.key in the working directory, generated on first boot
+func Init() error {
+	raw := os.Getenv("QISERVICE_MASTER_KEY")
+	if raw == "" {
+		path := os.Getenv("QISERVICE_MASTER_KEY_FILE")
+		if path == "" {
+			path = defaultKeyFile
+			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				if err := generateKeyFile(path); err != nil {
+					return err
+				}
+			}
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read master key: %w", err)
+		}
+		raw = string(data)
+	}
+
+	key, err := decodeKey(strings.TrimSpace(raw))
+	if err != nil {
+		return err
+	}
+	master, err = newAEAD(key)
+	return err
+}
+
+func generateKeyFile(path string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return fmt.Errorf("write master key: %w", err)
+	}
+	log.Printf("🔑 Generated master key in %s, back it up: upstream credentials cannot be decrypted without it", path)
+	return nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("master key must be 32 bytes, base64 or hex encoded")
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts with a random nonce prepended to the output
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// IsSealed reports whether a stored value is encrypted
+func IsSealed(v string) bool {
+	return strings.HasPrefix(v, prefix)
+}
+
+// Seal encrypts plaintext. fingerprint and hint stay readable so the value can be
+// identified and shown masked without decrypting it.
+func Seal(plaintext, fingerprint, hint string) (string, error) {
+	if master == nil {
+		return "", errors.New("master key not loaded")
+	}
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	ct, err := seal(aead, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(master, dek)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return prefix + strings.Join([]string{
+		fingerprint,
+		enc.EncodeToString([]byte(hint)),
+		enc.EncodeToString(wrapped),
+		enc.EncodeToString(ct),
+	}, ":"), nil
+}
+
+// Open decrypts a sealed value
+func Open(sealed string) (string, error) {
+	parts, err := split(sealed)
+	if err != nil {
+		return "", err
+	}
+	if master == nil {
+		return "", errors.New("master key not loaded")
+	}
+	enc := base64.RawURLEncoding
+	wrapped, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	ct, err := enc.DecodeString(parts[3])
+	if err != nil {
+		return "", err
+	}
+	dek, err := open(master, wrapped)
+	if err != nil {
+		return "", fmt.Errorf("unwrap data key: %w", err)
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, ct)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Meta returns the readable fingerprint and hint of a sealed value
+func Meta(sealed string) (fingerprint, hint string, ok bool) {
+	parts, err := split(sealed)
+	if err != nil {
+		return "", "", false
+	}
+	h, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+	return parts[0], string(h), true
+}
+
+func split(sealed string) ([]string, error) {
+	if !IsSealed(sealed) {
+		return nil, errors.New("value is not sealed")
+	}
+	parts := strings.Split(strings.TrimPrefix(sealed, prefix), ":")
+	if len(parts) != 4 {
+		return nil, errors.New("malformed sealed value")
+	}
+	return parts, nil
+}
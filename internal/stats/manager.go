@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"qiservice/internal/db"
+	"qiservice/internal/payload"
 )
 
 // Legacy compatibility structs
@@ -37,14 +38,17 @@ type ModelStats struct {
 	// app.js uses "request_count", "input_tokens", "output_tokens".
 	// That explains why charts were empty/undefined!
 
-	TokensIn  int `json:"input_tokens"`
-	TokensOut int `json:"output_tokens"`
+	TokensIn  int     `json:"input_tokens"`
+	TokensOut int     `json:"output_tokens"`
+	Cached    int     `json:"cached_tokens"`
+	Cost      float64 `json:"cost"`
 }
 
 type DailyStats struct {
-	Date     string                `json:"date"`
-	Summary  map[string]ModelStats `json:"summary"` // Model -> Stats
-	TotalReq int64                 `json:"total_requests"`
+	Date      string                `json:"date"`
+	Summary   map[string]ModelStats `json:"summary"` // Model -> Stats
+	TotalReq  int64                 `json:"total_requests"`
+	TotalCost float64               `json:"total_cost"`
 }
 
 type Manager struct{}
@@ -56,7 +60,8 @@ func Init(dataDir string) {
 	GlobalManager = &Manager{}
 }
 
-func (m *Manager) Record(model string, duration time.Duration, success bool, tokensIn, tokensOut int, userID uint) {
+// Record logs a request; the captured payload, when set, is stored linked to the new row
+func (m *Manager) Record(model string, duration time.Duration, success bool, tokensIn, tokensOut, tokensCached int, cost float64, userID, orgID uint, captured *db.RequestPayload) {
 	// Async insert to not block
 	go func() {
 		status := 200
@@ -69,17 +74,28 @@ func (m *Manager) Record(model string, duration time.Duration, success bool, tok
 			Status:           status,
 			PromptTokens:     tokensIn,
 			CompletionTokens: tokensOut,
+			CachedTokens:     tokensCached,
+			Cost:             cost,
 			UserID:           userID,
+			OrgID:            orgID,
 			CreatedAt:        time.Now(),
 		}
 
 		if err := db.DB.Create(&logEntry).Error; err != nil {
 			log.Printf("[Stats] Failed to record: %v", err)
+			return
+		}
+		if captured != nil {
+			captured.RequestLogID = logEntry.ID
+			captured.UserID = userID
+			captured.ServiceModel = model
+			payload.Store(captured)
 		}
 	}()
 }
 
-func (m *Manager) GetDaily(date string, userID uint) *DailyStats {
+// GetDaily aggregates a day by model, scoped to a user and/or an organization when their IDs are set
+func (m *Manager) GetDaily(date string, userID, orgID uint) *DailyStats {
 	// Parse Date Range (Use Local Time to match Record)
 	start, _ := time.ParseInLocation("2006-01-02", date, time.Local)
 	end := start.Add(24 * time.Hour)
@@ -92,17 +108,22 @@ func (m *Manager) GetDaily(date string, userID uint) *DailyStats {
 		Count         int
 		SumPrompt     int
 		SumCompletion int
+		SumCached     int
+		SumCost       float64
 	}
 
 	var results []Result
 	query := db.DB.Model(&db.RequestLog{}).
-		Select("service_model, count(*) as count, sum(prompt_tokens) as sum_prompt, sum(completion_tokens) as sum_completion").
+		Select("service_model, count(*) as count, sum(prompt_tokens) as sum_prompt, sum(completion_tokens) as sum_completion, sum(cached_tokens) as sum_cached, sum(cost) as sum_cost").
 		Where("created_at >= ? AND created_at < ?", start, end)
 
 	// User Scoping: Aggregator View (Admin) vs Personal View (User)
 	if userID > 0 {
 		query = query.Where("user_id = ?", userID)
 	}
+	if orgID > 0 {
+		query = query.Where("org_id = ?", orgID)
+	}
 
 	query.Group("service_model").Scan(&results)
 
@@ -117,8 +138,11 @@ func (m *Manager) GetDaily(date string, userID uint) *DailyStats {
 			Requests:  r.Count,
 			TokensIn:  r.SumPrompt,
 			TokensOut: r.SumCompletion,
+			Cached:    r.SumCached,
+			Cost:      r.SumCost,
 		}
 		total += int64(r.Count)
+		stats.TotalCost += r.SumCost
 	}
 	stats.TotalReq = total
 
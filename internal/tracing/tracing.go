@@ -0,0 +1,146 @@
+// Package tracing exports OpenTelemetry traces of model requests over OTLP/HTTP.
+// Tracing is off (every span is a no-op) unless QISERVICE_OTLP_ENDPOINT is set.
+package tracing
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HeaderTraceID is the response header carrying the trace ID of the request
+const HeaderTraceID = "X-Trace-Id"
+
+var (
+	tracer     = otel.Tracer("qiservice")
+	propagator = propagation.TraceContext{}
+)
+
+// Init sets up the OTLP exporter. QISERVICE_OTLP_ENDPOINT is the collector URL, e.g.
+// "http://localhost:4318" ("/v1/traces" is added when there is no path); OTEL_SERVICE_NAME
+// overrides the service name. Spans are sent in batches in the background.
+func Init() {
+	endpoint := os.Getenv("QISERVICE_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		log.Printf("[Tracing] Invalid QISERVICE_OTLP_ENDPOINT %q, tracing disabled", endpoint)
+		return
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		log.Printf("[Tracing] Failed to create the OTLP exporter, tracing disabled: %v", err)
+		return
+	}
+
+	name := os.Getenv("OTEL_SERVICE_NAME")
+	if name == "" {
+		name = "qiservice"
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", name))),
+	))
+	log.Printf("[Tracing] Exporting traces to %s", u)
+}
+
+// StartRequest starts the root span of an inbound request, continuing the caller's trace
+// when it sent a traceparent header
+func StartRequest(ctx context.Context, name string, header http.Header) (context.Context, trace.Span) {
+	ctx = propagator.Extract(ctx, propagation.HeaderCarrier(header))
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// Start starts a child span. Outside a traced request (no recording span in ctx) it returns
+// a no-op span, so background work such as health probes does not create traces of its own.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Fail marks a span as failed
+func Fail(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// TraceID returns the trace ID of ctx, "" when it is not traced
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// Transport wraps base (http.DefaultTransport if nil): each upstream call gets a client
+// span, ended when the response body is closed, and carries the trace in a traceparent header
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return transport{base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !trace.SpanFromContext(r.Context()).IsRecording() {
+		return t.base.RoundTrip(r)
+	}
+	ctx, span := tracer.Start(r.Context(), "HTTP "+r.Method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", r.URL.Host),
+			attribute.String("url.path", r.URL.Path), // Not the full URL: Gemini keys are query parameters
+		))
+	r = r.Clone(ctx)
+	propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		Fail(span, err)
+		span.End()
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+// spanBody ends the span of a call once its body has been consumed (streams included)
+type spanBody struct {
+	io.ReadCloser
+	span trace.Span
+}
+
+func (b *spanBody) Close() error {
+	b.span.End()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,173 @@
+// Package wallet implements prepaid balances of users and organizations: an estimated cost is
+// held before a request is forwarded and settled to the actual cost afterwards. Every movement
+// is written to the ledger.
+package wallet
+
+import (
+	"errors"
+	"log"
+
+	"qiservice/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// Ledger entry types
+const (
+	TypeTopUp   = "topup"
+	TypeAdjust  = "adjust"
+	TypeHold    = "hold"
+	TypeSettle  = "settle"
+	TypeRelease = "release"
+)
+
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// Hold is an amount reserved on a wallet for one request. OrgID is set for organization wallets.
+type Hold struct {
+	UserID    uint
+	OrgID     uint
+	Amount    float64
+	Reference string
+}
+
+// Init releases holds left behind by requests that were in flight when the server stopped
+func Init() {
+	for _, model := range []interface{}{&db.User{}, &db.Organization{}} {
+		res := db.DB.Model(model).Where("held_amount <> 0").UpdateColumn("held_amount", 0)
+		if res.Error != nil {
+			log.Printf("[Wallet] Failed to release stale holds: %v", res.Error)
+		} else if res.RowsAffected > 0 {
+			log.Printf("[Wallet] Released stale holds of %d wallets", res.RowsAffected)
+		}
+	}
+}
+
+// account selects the row holding the wallet of a user or, when orgID is set, an organization
+func account(tx *gorm.DB, userID, orgID uint) *gorm.DB {
+	if orgID != 0 {
+		return tx.Model(&db.Organization{}).Where("id = ?", orgID)
+	}
+	return tx.Model(&db.User{}).Where("id = ?", userID)
+}
+
+// Reserve holds amount on the user's available balance (balance minus holds).
+// Returns a nil Hold and no error when the user is not billed by wallet.
+func Reserve(userID uint, amount float64, reference string) (*Hold, error) {
+	var user db.User
+	if err := db.DB.Select("id", "billing_mode").First(&user, userID).Error; err != nil {
+		return nil, nil
+	}
+	if user.BillingMode != db.BillingWallet {
+		return nil, nil
+	}
+	return reserve(&Hold{UserID: userID, Amount: amount, Reference: reference})
+}
+
+// ReserveOrg is Reserve for an organization wallet
+func ReserveOrg(orgID uint, amount float64, reference string) (*Hold, error) {
+	var org db.Organization
+	if err := db.DB.Select("id", "billing_mode").First(&org, orgID).Error; err != nil {
+		return nil, nil
+	}
+	if org.BillingMode != db.BillingWallet {
+		return nil, nil
+	}
+	return reserve(&Hold{OrgID: orgID, Amount: amount, Reference: reference})
+}
+
+func reserve(h *Hold) (*Hold, error) {
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		// The condition makes check and reservation one atomic statement
+		res := account(tx, h.UserID, h.OrgID).
+			Where("balance - held_amount >= ?", h.Amount).
+			UpdateColumn("held_amount", gorm.Expr("held_amount + ?", h.Amount))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInsufficientBalance
+		}
+		return record(tx, &db.WalletTransaction{UserID: h.UserID, OrgID: h.OrgID, Type: TypeHold, HeldDelta: h.Amount, Reference: h.Reference})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Settle releases the hold and debits the actual cost. A cost above the estimate is capped
+// at what the wallet has left besides other holds, so the balance never goes negative.
+// Safe on a nil Hold.
+func (h *Hold) Settle(cost float64) error {
+	if h == nil {
+		return nil
+	}
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		// Releasing first takes the write lock, so the balance read below cannot change under us
+		if err := account(tx, h.UserID, h.OrgID).UpdateColumn("held_amount", gorm.Expr("held_amount - ?", h.Amount)).Error; err != nil {
+			return err
+		}
+		var w struct {
+			Balance    float64
+			HeldAmount float64
+		}
+		if err := account(tx, h.UserID, h.OrgID).Select("balance", "held_amount").Scan(&w).Error; err != nil {
+			return err
+		}
+		if available := max(w.Balance-w.HeldAmount, 0); cost > available {
+			log.Printf("[Wallet] %s cost %.6f, more than the %.6f left: debiting %.6f", h.Reference, cost, available, available)
+			cost = available
+		}
+		entry := &db.WalletTransaction{UserID: h.UserID, OrgID: h.OrgID, Type: TypeSettle, Amount: -cost, HeldDelta: -h.Amount, Reference: h.Reference}
+		if cost == 0 {
+			entry.Type = TypeRelease
+		}
+		if err := account(tx, h.UserID, h.OrgID).UpdateColumn("balance", gorm.Expr("balance - ?", cost)).Error; err != nil {
+			return err
+		}
+		return record(tx, entry)
+	})
+}
+
+// Credit adds amount (negative to correct) to a user's wallet on behalf of an admin
+func Credit(userID uint, amount float64, operatorID uint, note string) (*db.WalletTransaction, error) {
+	return credit(&db.WalletTransaction{UserID: userID, Amount: amount, OperatorID: operatorID, Note: note})
+}
+
+// CreditOrg is Credit for an organization wallet
+func CreditOrg(orgID uint, amount float64, operatorID uint, note string) (*db.WalletTransaction, error) {
+	return credit(&db.WalletTransaction{OrgID: orgID, Amount: amount, OperatorID: operatorID, Note: note})
+}
+
+func credit(entry *db.WalletTransaction) (*db.WalletTransaction, error) {
+	amount := entry.Amount
+	entry.Type = TypeTopUp
+	if amount < 0 {
+		entry.Type = TypeAdjust
+	}
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		res := account(tx, entry.UserID, entry.OrgID).UpdateColumn("balance", gorm.Expr("balance + ?", amount))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return record(tx, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// record stores a ledger entry with the balance after the change
+func record(tx *gorm.DB, entry *db.WalletTransaction) error {
+	var balance float64
+	if err := account(tx, entry.UserID, entry.OrgID).Select("balance").Scan(&balance).Error; err != nil {
+		return err
+	}
+	entry.BalanceAfter = balance
+	return tx.Create(entry).Error
+}
@@ -0,0 +1,100 @@
+package wallet
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"qiservice/internal/db"
+)
+
+func setup(t *testing.T, balance float64) *db.User {
+	t.Helper()
+	db.Init(filepath.Join(t.TempDir(), "wallet.db"))
+	user := &db.User{Username: "w", BillingMode: db.BillingWallet, Balance: balance}
+	if err := db.DB.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func reload(t *testing.T, id uint) db.User {
+	t.Helper()
+	var user db.User
+	if err := db.DB.First(&user, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func near(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+func TestHoldSettle(t *testing.T) {
+	tests := []struct {
+		name          string
+		balance       float64
+		holds         []float64 // Reserved in order, the first one is settled
+		cost          float64
+		wantErr       error // Of the last Reserve
+		balanceAfter  float64
+		heldAfter     float64
+		settledAmount float64 // Ledger amount of the settle entry
+		settleType    string
+	}{
+		{"cost below the hold", 10, []float64{4}, 1.5, nil, 8.5, 0, -1.5, TypeSettle},
+		{"zero cost releases", 10, []float64{4}, 0, nil, 10, 0, 0, TypeRelease},
+		{"cost above the hold uses the free balance", 10, []float64{4}, 6, nil, 4, 0, -6, TypeSettle},
+		{"cost above the balance is capped", 10, []float64{4}, 25, nil, 0, 0, -10, TypeSettle},
+		{"other holds stay reserved", 10, []float64{4, 5}, 25, nil, 5, 5, -5, TypeSettle},
+		{"hold above the available balance", 10, []float64{6, 5}, 0, ErrInsufficientBalance, 10, 0, 0, TypeRelease},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := setup(t, tt.balance)
+			var first *Hold
+			var err error
+			for i, amount := range tt.holds {
+				var h *Hold
+				h, err = Reserve(user.ID, amount, "m")
+				if i == 0 {
+					if err != nil {
+						t.Fatalf("first hold: %v", err)
+					}
+					first = h
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("last hold: %v, want %v", err, tt.wantErr)
+			}
+			if err := first.Settle(tt.cost); err != nil {
+				t.Fatal(err)
+			}
+
+			got := reload(t, user.ID)
+			if !near(got.Balance, tt.balanceAfter) || !near(got.HeldAmount, tt.heldAfter) {
+				t.Errorf("balance %.2f held %.2f, want %.2f/%.2f", got.Balance, got.HeldAmount, tt.balanceAfter, tt.heldAfter)
+			}
+			var entry db.WalletTransaction
+			db.DB.Where("type IN ?", []string{TypeSettle, TypeRelease}).Last(&entry)
+			if entry.Type != tt.settleType || !near(entry.Amount, tt.settledAmount) || !near(entry.BalanceAfter, tt.balanceAfter) {
+				t.Errorf("ledger %s %.2f after %.2f, want %s %.2f after %.2f", entry.Type, entry.Amount, entry.BalanceAfter, tt.settleType, tt.settledAmount, tt.balanceAfter)
+			}
+		})
+	}
+}
+
+func TestReserveSkipsQuotaUsers(t *testing.T) {
+	user := setup(t, 0)
+	db.DB.Model(user).Update("billing_mode", db.BillingQuota)
+	h, err := Reserve(user.ID, 5, "m")
+	if h != nil || err != nil {
+		t.Fatalf("Reserve = %v, %v, want no hold", h, err)
+	}
+	if err := h.Settle(3); err != nil {
+		t.Fatal(err)
+	}
+	if got := reload(t, user.ID); got.Balance != 0 || got.HeldAmount != 0 {
+		t.Errorf("balance %.2f held %.2f, want untouched", got.Balance, got.HeldAmount)
+	}
+}
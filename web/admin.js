@@ -15,6 +15,8 @@ function checkAuth() {
 }
 
 function logout() {
+    // Best effort server-side revocation, the page leaves right away
+    fetch(API_BASE + '/logout', { method: 'POST', headers: { 'Authorization': 'Bearer ' + token }, keepalive: true }).catch(() => {});
     localStorage.removeItem('token');
     localStorage.removeItem('user');
     window.location.href = 'login.html';
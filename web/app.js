@@ -16,24 +16,39 @@ window.onload = async function() {
     document.getElementById('disp-role').textContent = formatRole(currentUser.role);
     document.getElementById('user-avatar').textContent = currentUser.username.charAt(0).toUpperCase();
 
+    // Permissions come from the role and may have changed since login
+    await refreshPermissions();
+
     // Permission Check: Show/Hide Admin Nav
-    if (currentUser.role === 'admin' || currentUser.role === 'super_admin') {
+    const manageUsers = can('users.read') || can('roles.manage');
+    if (manageUsers || can('services.write') || can('audit.read') || can('payloads.read')) {
         document.getElementById('admin-nav').style.display = 'block';
+        document.getElementById('nav-users').style.display = manageUsers ? '' : 'none';
+        document.getElementById('nav-services').style.display = can('services.write') ? '' : 'none';
+        document.getElementById('nav-audit').style.display = can('audit.read') ? '' : 'none';
+        document.getElementById('nav-payloads').style.display = can('payloads.read') ? '' : 'none';
     }
+    if (can('orgs.manage')) document.getElementById('team-create-btn').style.display = '';
+    if (can('roles.manage')) document.getElementById('role-section').style.display = 'block';
 
-    // Role Hint based on Role
+    // Role Hint based on Permissions
     if (document.getElementById('cu-role')) {
         const hint = document.getElementById('cu-role-hint');
-        if (currentUser.role === 'super_admin') {
-            hint.textContent = "超管特权：可创建管理员或普通用户。";
+        if (can('roles.assign')) {
+            hint.textContent = "可分配的角色以自身权限为上限。";
         } else {
-            // Disable Admin option for regular admins
-            const adminOpt = document.querySelector("#cu-role option[value='admin']");
-            if(adminOpt) adminOpt.disabled = true;
+            document.getElementById('cu-role').disabled = true;
             hint.textContent = "当前权限：仅可创建普通用户。";
         }
     }
 
+    // The default admin password must be changed before anything else works
+    if (currentUser.must_change_password) {
+        document.getElementById('login_check').style.display = 'none';
+        openPasswordModal(true);
+        return;
+    }
+
     // Load Data
     await loadServices();
     await loadMyKeys();
@@ -45,15 +60,64 @@ window.onload = async function() {
 function formatRole(role) {
     if (role === 'super_admin') return '超级管理员';
     if (role === 'admin') return '管理员';
-    return '普通用户';
+    if (role === 'user') return '普通用户';
+    return role; // Custom role
+}
+
+function can(permission) {
+    return (currentUser.permissions || []).includes(permission);
+}
+
+async function refreshPermissions() {
+    try {
+        const res = await fetch(API + '/user/me', { headers: { 'Authorization': 'Bearer ' + token } });
+        if (res.ok) {
+            currentUser.permissions = (await res.json()).permissions || [];
+            localStorage.setItem('user', JSON.stringify(currentUser));
+        }
+    } catch(e) { console.error(e); }
 }
 
-function logout() {
+async function logout() {
+    // Revoke the token server-side, then forget it locally either way
+    try {
+        await fetch(API + '/logout', { method: 'POST', headers: { 'Authorization': 'Bearer ' + token } });
+    } catch(e) { console.error(e); }
     localStorage.removeItem('token');
     localStorage.removeItem('user');
     window.location.href = 'login.html';
 }
 
+// --- Password ---
+function openPasswordModal(forced) {
+    document.getElementById('pwd-old').value = '';
+    document.getElementById('pwd-new').value = '';
+    document.getElementById('pwd-forced-hint').style.display = forced ? 'block' : 'none';
+    document.getElementById('pwd-cancel').style.display = forced ? 'none' : '';
+    modal.open('modal-password');
+}
+
+async function submitChangePassword() {
+    const d = {
+        old_password: document.getElementById('pwd-old').value,
+        new_password: document.getElementById('pwd-new').value
+    };
+    const res = await fetch(API + '/user/password', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+        body: JSON.stringify(d)
+    });
+    const data = await res.json();
+    if (!res.ok) {
+        alert('修改失败: ' + (data.error || res.status));
+        return;
+    }
+    localStorage.setItem('token', data.token);
+    localStorage.setItem('user', JSON.stringify(data.user));
+    alert('密码已修改');
+    window.location.reload();
+}
+
 // Navigation
 function nav(page) {
     // Hide all pages
@@ -70,8 +134,11 @@ function nav(page) {
         
         // Load data on demand
         if (page === 'my-keys') loadMyKeys();
-        if (page === 'users') loadUsers();
-        if (page === 'services') renderAdminServices();
+        if (page === 'teams') loadTeams();
+        if (page === 'users') { loadRoles(); loadUsers(); loadPlans(); loadGroups(); }
+        if (page === 'services') { renderAdminServices(); loadRedactionRules(); }
+        if (page === 'payloads') loadPayloads();
+        if (page === 'audit') loadAudit();
         if (page === 'playground') updatePlaygroundSelects();
         
         // Refresh Dashboard on view
@@ -84,20 +151,28 @@ function nav(page) {
 
 // Global scope for onclick
 window.generateMyKey = function() {
+    keyTeamId = null;
     modal.open('modal-key');
 }
 
+// Team the key modal creates a key for, null for a personal key
+let keyTeamId = null;
+
 async function submitNewMyKey() {
     const name = document.getElementById('key-name-input').value || 'Default Key';
+    const url = keyTeamId ? `${API}/orgs/${keyTeamId}/keys` : API + '/my_keys';
     try {
-        const res = await fetch(API + '/my_keys', {
+        const res = await fetch(url, {
             method: 'POST',
             headers: { 'Authorization': 'Bearer ' + token, 'Content-Type': 'application/json' },
-            body: JSON.stringify({ name })
+            body: JSON.stringify({ name, ...readLimitInputs('key'), ...readKeyScopeInputs() })
         });
         if (res.ok) {
+            const data = await res.json();
             modal.close('modal-key');
-            loadMyKeys();
+            // Only a hash is stored, this is the one chance to copy the key
+            prompt("密钥已创建，请立即复制保存（关闭后将无法再次查看）:", data.key);
+            if (keyTeamId) openTeam(keyTeamId); else loadMyKeys();
         } else {
             alert("新建失败");
         }
@@ -133,7 +208,7 @@ function renderDashboardServices() {
             <div style="height:200px;"><canvas id="chart-req"></canvas></div>
         </div>
         <div class="card">
-            <h3>Token 消耗</h3>
+            <h3>Token 消耗 <span id="stats-cost" style="font-size:0.8rem; color:var(--text-muted);"></span></h3>
             <div style="height:200px;"><canvas id="chart-tok"></canvas></div>
         </div>
     `;
@@ -154,14 +229,45 @@ function renderDashboardServices() {
         div.className = 'card';
         div.style.marginBottom = '0'; // Grid handles gap
         div.innerHTML = `
-            <div style="font-weight:bold; font-size:1.1rem; margin-bottom:0.5rem;">${s.name}</div>
-            <div style="font-size:0.8rem; color:var(--text-muted); margin-bottom:1rem;">类型: ${s.type}</div>
+            <div style="display:flex; justify-content:space-between; align-items:center; margin-bottom:0.5rem;">
+                <div style="font-weight:bold; font-size:1.1rem;">${s.name}</div>
+                <span data-health-id="${s.id}" style="font-size:0.8rem;"></span>
+            </div>
+            <div style="font-size:0.8rem; color:var(--text-muted); margin-bottom:1rem;">类型: ${s.type} · 价格 / 1M: ${formatPrices(s)}</div>
             <div style="font-size:0.8rem; background:var(--bg-body); padding:0.5rem; border-radius:4px;">
                 如果是通过 OpenAI SDK 调用，模型 Model 请填 <span style="color:var(--primary); font-family:monospace;">${s.name}</span>
             </div>
         `;
         grid.appendChild(div);
     });
+    loadServiceHealth();
+}
+
+// Fills every [data-health-id] badge with the prober's view of that service
+async function loadServiceHealth() {
+    try {
+        const res = await fetch(API + '/services/health', { headers: { 'Authorization': 'Bearer ' + token } });
+        if (!res.ok) return;
+        const list = await res.json();
+        list.forEach(item => {
+            const h = item.health;
+            let label = '⚪ 未检测';
+            if (h.status === 'up') label = `🟢 正常 ${h.latency_ms}ms`;
+            if (h.status === 'down') label = '🔴 降级 (熔断中)';
+            document.querySelectorAll(`[data-health-id="${item.service_id}"]`).forEach(el => {
+                el.textContent = label;
+                el.title = h.last_error || '';
+            });
+        });
+    } catch(e) { console.error(e); }
+}
+
+// Per-1M-token prices of a service, e.g. "输入 2.5 / 输出 10 / 缓存 1.25"
+function formatPrices(s) {
+    if (!s.input_price && !s.output_price) return '免费';
+    let text = `输入 ${s.input_price || 0} / 输出 ${s.output_price || 0}`;
+    if (s.cached_input_price) text += ` / 缓存 ${s.cached_input_price}`;
+    return text;
 }
 
 function loadDashboardStats() {
@@ -182,6 +288,8 @@ function renderCharts(data) {
     const models = Object.keys(data.summary || {});
     const reqs = models.map(m => data.summary[m].request_count);
     const tokens = models.map(m => (data.summary[m].input_tokens + data.summary[m].output_tokens));
+    const costEl = document.getElementById('stats-cost');
+    if (costEl) costEl.textContent = `今日费用 ${(data.total_cost || 0).toFixed(4)}`;
 
     new Chart(document.getElementById('chart-req'), {
         type: 'doughnut',
@@ -232,6 +340,42 @@ function renderQuotaWidget(user) {
     div.style.border = '1px solid rgba(99,102,241,0.2)';
     div.style.marginBottom = '1.5rem';
     
+    if (user.billing_mode === 'wallet') {
+        div.innerHTML = `
+            <div style="display:flex; justify-content:space-between; align-items:center;">
+                 <h3 style="margin:0; color:var(--primary);">💰 钱包余额 (Wallet)</h3>
+                 <div style="font-weight:bold; font-size:1.2rem;">${(user.balance - user.held_amount).toFixed(4)} 可用</div>
+            </div>
+            <div style="margin-top:0.5rem; display:flex; justify-content:space-between; font-size:0.8rem; color:var(--text-muted);">
+                <span>余额: ${user.balance.toFixed(4)} · 冻结中: ${user.held_amount.toFixed(4)} · 累计消费: ${user.used_amount.toFixed(4)}</span>
+                <a href="#" onclick="openLedger(); return false;">查看流水</a>
+            </div>
+        `;
+        container.insertBefore(div, container.firstChild);
+        return;
+    }
+
+    if (user.period) {
+        const p = user.period;
+        const unlimited = p.limit < 0;
+        const pct = unlimited ? 0 : (p.limit > 0 ? Math.min(100, (p.used / p.limit) * 100) : 100);
+        div.innerHTML = `
+            <div style="display:flex; justify-content:space-between; align-items:center;">
+                 <h3 style="margin:0; color:var(--primary);">🎟️ ${p.plan} (${periodNames[p.period] || p.period})</h3>
+                 <div style="font-weight:bold; font-size:1.2rem;">${unlimited ? '无限制 (Unlimited)' : (p.limit - p.used).toFixed(4) + ' 剩余 / ' + p.limit.toFixed(4) + ' 本期'}</div>
+            </div>
+            <div style="margin-top:1rem; background:rgba(255,255,255,0.1); border-radius:10px; height:10px; overflow:hidden;">
+                <div style="width:${pct}%; background:var(--primary); height:100%; transition:width 0.5s;"></div>
+            </div>
+            <div style="margin-top:0.5rem; display:flex; justify-content:space-between; font-size:0.8rem; color:var(--text-muted);">
+                <span>本期已用: ${p.used.toFixed(4)}${p.rollover ? ' · 含结转 ' + p.rollover.toFixed(4) : ''}</span>
+                <span>下次重置: ${new Date(p.next_reset).toLocaleString()}</span>
+            </div>
+        `;
+        container.insertBefore(div, container.firstChild);
+        return;
+    }
+
     // Quota < 0 is unlimited. 0 is strictly 0.
     const isUnlimited = user.quota < 0;
     const used = user.used_amount;
@@ -247,7 +391,7 @@ function renderQuotaWidget(user) {
             <div style="width:${percent}%; background:var(--primary); height:100%; transition:width 0.5s;"></div>
         </div>
         <div style="margin-top:0.5rem; text-align:right; font-size:0.8rem; color:var(--text-muted);">
-            已用: ${used.toFixed(4)} Tokens
+            已用: ${used.toFixed(4)}
         </div>
     `;
     
@@ -301,7 +445,7 @@ async function loadMyKeys() {
             renderMyKeys(keys);
         } else {
             // Fallback for now
-             document.getElementById('my-keys-list').innerHTML = `<tr><td colspan="4" style="text-align:center;">暂不支持获取密钥列表 (API缺)</td></tr>`;
+             document.getElementById('my-keys-list').innerHTML = `<tr><td colspan="5" style="text-align:center;">暂不支持获取密钥列表 (API缺)</td></tr>`;
         }
     } catch(e) { console.error(e); }
 }
@@ -314,11 +458,9 @@ function renderMyKeys(keys) {
         tr.innerHTML = `
             <td>${k.name || '默认密钥'}</td>
             <td>
-                <div style="display:flex; align-items:center; gap:0.5rem;">
-                    <code style="color:var(--success);">${k.key.substring(0,8)}...${k.key.substring(k.key.length-4)}</code>
-                    <button class="btn btn-sm btn-secondary" onclick="copyText('${k.key}')" title="复制完整密钥">📋</button>
-                </div>
+                <code style="color:var(--success);" title="完整密钥仅在创建时显示">${k.key_prefix}...</code>
             </td>
+            <td style="font-size:0.8rem;">${formatLimits(k)}${formatKeyScope(k)}</td>
             <td>${k.is_active ? '✅ 正常' : '❌ 停用'}</td>
             <td>
                 <button class="btn btn-sm btn-danger" onclick="deleteMyKey(${k.id})">删除</button>
@@ -328,47 +470,6 @@ function renderMyKeys(keys) {
     });
 }
 
-function copyText(text) {
-    if (navigator.clipboard && navigator.clipboard.writeText) {
-        navigator.clipboard.writeText(text).then(() => {
-            alert("已复制到剪贴板");
-        }).catch(err => {
-            console.error('Failed to copy: ', err);
-            fallbackCopyText(text);
-        });
-    } else {
-        fallbackCopyText(text);
-    }
-}
-
-function fallbackCopyText(text) {
-    var textArea = document.createElement("textarea");
-    textArea.value = text;
-    
-    // Avoid scrolling to bottom
-    textArea.style.top = "0";
-    textArea.style.left = "0";
-    textArea.style.position = "fixed";
-
-    document.body.appendChild(textArea);
-    textArea.focus();
-    textArea.select();
-
-    try {
-        var successful = document.execCommand('copy');
-        if (successful) {
-            alert("已复制到剪贴板");
-        } else {
-            prompt("复制失败，请手动复制:", text);
-        }
-    } catch (err) {
-        console.error('Fallback: Oops, unable to copy', err);
-        prompt("复制失败，请手动复制:", text);
-    }
-
-    document.body.removeChild(textArea);
-}
-
 async function deleteMyKey(id) {
     if(!confirm("确定要删除此密钥吗？")) return;
     try {
@@ -409,14 +510,25 @@ function renderUsers() {
             <td>${u.id}</td>
             <td>
                 <div>${u.username}</div>
+                ${u.groups && u.groups.length ? `<div style="color:var(--text-muted); font-size:0.8rem;">${u.groups.map(g => g.name).join(', ')}</div>` : ''}
             </td>
-            <td><span style="background:${u.role==='admin'?'var(--primary)':'var(--border-color)'}; color:${u.role==='admin'?'white':'var(--text-muted)'}; padding:2px 6px; border-radius:4px; font-size:0.8rem;">${formatRole(u.role)}</span></td>
+            <td><span style="background:${isStaffRole(u.role)?'var(--primary)':'var(--border-color)'}; color:${isStaffRole(u.role)?'white':'var(--text-muted)'}; padding:2px 6px; border-radius:4px; font-size:0.8rem;">${formatRole(u.role)}</span></td>
             <td>
-                <div>${u.quota} <span style="font-size:0.8rem;">总量</span></div>
+                ${u.billing_mode === 'wallet' ? `
+                <div>${u.balance.toFixed(4)} <span style="font-size:0.8rem;">余额 (钱包)</span></div>
+                <div style="color:var(--text-muted); font-size:0.8rem;">${u.held_amount.toFixed(4)} 冻结 · ${u.used_amount.toFixed(4)} 已用</div>
+                ` : u.plan_id ? `
+                <div>${planName(u.plan_id)} <span style="font-size:0.8rem;">套餐</span></div>
+                <div style="color:var(--text-muted); font-size:0.8rem;">本期 ${u.period_used.toFixed(4)} 已用 · 累计 ${u.used_amount.toFixed(4)}</div>
+                ` : `
+                <div>${u.quota < 0 ? '无限制' : u.quota} <span style="font-size:0.8rem;">总量</span>${u.quota_review ? ' <span style="color:var(--warning); font-size:0.8rem;" title="升级时由 Token 配额改为无限制，请按货币重新设置">待复核</span>' : ''}</div>
                 <div style="color:var(--text-muted); font-size:0.8rem;">${u.used_amount.toFixed(4)} 已用</div>
+                `}
             </td>
             <td>
                 <button class="btn btn-sm btn-secondary" onclick="openEditUser(${u.id})" ${canEdit?'':'disabled'}>管理</button>
+                <button class="btn btn-sm btn-secondary" onclick="topUpUser(${u.id})" ${canEdit?'':'disabled'}>充值</button>
+                <button class="btn btn-sm btn-secondary" onclick="openLedger(${u.id})" ${canEdit?'':'disabled'}>流水</button>
                 <button class="btn btn-sm btn-danger" onclick="deleteUser(${u.id})" ${checkDeletePermission(u)?'':'disabled'}>删除</button>
             </td>
         `;
@@ -424,10 +536,434 @@ function renderUsers() {
     });
 }
 
+// --- Admin: Quota Plans ---
+let globalPlans = [];
+const periodNames = { daily: '每日', weekly: '每周', monthly: '每月' };
+
+async function loadPlans() {
+    try {
+        const res = await fetch(API + '/plans', { headers: { 'Authorization': 'Bearer ' + token } });
+        if (res.ok) {
+            globalPlans = await res.json();
+            renderPlans();
+            renderUsers();
+        }
+    } catch(e) { console.error(e); }
+}
+
+function planName(id) {
+    const p = globalPlans.find(x => x.id === id);
+    return p ? p.name : `#${id}`;
+}
+
+function renderPlans() {
+    const tbody = document.getElementById('plan-list-body');
+    tbody.innerHTML = globalPlans.length ? '' : '<tr><td colspan="5" style="text-align:center; color:var(--text-muted);">暂无套餐</td></tr>';
+    globalPlans.forEach(p => {
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td>${p.name}</td>
+            <td>${periodNames[p.period] || p.period}</td>
+            <td>${p.limit < 0 ? '无限制' : p.limit}</td>
+            <td>${p.rollover ? '是' : '否'}</td>
+            <td>
+                <button class="btn btn-sm btn-secondary" onclick="openPlanModal(${p.id})">编辑</button>
+                <button class="btn btn-sm btn-danger" onclick="deletePlan(${p.id})">删除</button>
+            </td>
+        `;
+        tbody.appendChild(tr);
+    });
+}
+
+function fillPlanSelect(id, selected) {
+    const sel = document.getElementById(id);
+    sel.innerHTML = '<option value="0">不使用套餐 (总配额)</option>' +
+        globalPlans.map(p => `<option value="${p.id}">${p.name} (${periodNames[p.period] || p.period} ${p.limit < 0 ? '无限制' : p.limit})</option>`).join('');
+    sel.value = selected || 0;
+}
+
+function openPlanModal(id) {
+    const p = globalPlans.find(x => x.id === id) || { id: 0, name: '', period: 'monthly', limit: 10, rollover: false };
+    document.getElementById('mp-title').textContent = id ? '编辑套餐' : '新增套餐';
+    document.getElementById('mp-id').value = p.id;
+    document.getElementById('mp-name').value = p.name;
+    document.getElementById('mp-period').value = p.period;
+    document.getElementById('mp-limit').value = p.limit;
+    document.getElementById('mp-rollover').checked = p.rollover;
+    modal.open('modal-plan');
+}
+
+async function submitPlan() {
+    const d = {
+        id: parseInt(document.getElementById('mp-id').value) || 0,
+        name: document.getElementById('mp-name').value.trim(),
+        period: document.getElementById('mp-period').value,
+        limit: parseFloat(document.getElementById('mp-limit').value),
+        rollover: document.getElementById('mp-rollover').checked
+    };
+    const res = await fetch(API + '/plans', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+        body: JSON.stringify(d)
+    });
+    if (res.ok) {
+        modal.close('modal-plan');
+        loadPlans();
+    } else {
+        const err = await res.json();
+        alert('错误: ' + err.error);
+    }
+}
+
+async function deletePlan(id) {
+    if (!confirm('删除套餐后，使用该套餐的用户将恢复为总配额计费，确定删除吗？')) return;
+    const res = await fetch(API + '/plans/' + id, { method: 'DELETE', headers: { 'Authorization': 'Bearer ' + token } });
+    if (res.ok) loadPlans();
+    else alert('删除失败');
+}
+
+// --- Teams ---
+let globalTeams = [];
+let currentTeam = null;
+const teamRoleNames = { owner: '所有者', admin: '管理员', member: '成员' };
+
+function isAdminUser() {
+    return can('orgs.manage');
+}
+
+async function loadTeams() {
+    try {
+        const res = await fetch(API + '/orgs', { headers: { 'Authorization': 'Bearer ' + token } });
+        if (res.ok) {
+            globalTeams = await res.json();
+            renderTeams();
+            if (currentTeam && globalTeams.some(t => t.id === currentTeam.id)) openTeam(currentTeam.id);
+            else document.getElementById('team-detail').style.display = 'none';
+        }
+    } catch(e) { console.error(e); }
+}
+
+function formatTeamBudget(t) {
+    if (t.billing_mode === 'wallet') {
+        return `<div>${t.balance.toFixed(4)} <span style="font-size:0.8rem;">余额 (钱包)</span></div>
+            <div style="color:var(--text-muted); font-size:0.8rem;">${t.held_amount.toFixed(4)} 冻结 · ${t.used_amount.toFixed(4)} 已用</div>`;
+    }
+    return `<div>${t.quota < 0 ? '无限制' : t.quota} <span style="font-size:0.8rem;">总量</span></div>
+        <div style="color:var(--text-muted); font-size:0.8rem;">${t.used_amount.toFixed(4)} 已用</div>`;
+}
+
+function renderTeams() {
+    const tbody = document.getElementById('team-list-body');
+    tbody.innerHTML = globalTeams.length ? '' : '<tr><td colspan="5" style="text-align:center; color:var(--text-muted);">尚未加入任何团队</td></tr>';
+    globalTeams.forEach(t => {
+        const admin = isAdminUser();
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td><div>${escapeHtml(t.name)}</div><div style="color:var(--text-muted); font-size:0.8rem;">${escapeHtml(t.description)}</div></td>
+            <td>${teamRoleNames[t.my_role] || t.my_role}</td>
+            <td>${formatTeamBudget(t)}</td>
+            <td>${t.member_count}</td>
+            <td>
+                <button class="btn btn-sm btn-secondary" onclick="openTeam(${t.id})">详情</button>
+                ${t.my_role !== 'member' ? `<button class="btn btn-sm btn-secondary" onclick="openLedger(null, ${t.id})">流水</button>` : ''}
+                ${admin ? `
+                <button class="btn btn-sm btn-secondary" onclick="openTeamModal(${t.id})">编辑</button>
+                <button class="btn btn-sm btn-secondary" onclick="topUpTeam(${t.id})">充值</button>
+                <button class="btn btn-sm btn-danger" onclick="deleteTeam(${t.id})">删除</button>
+                ` : ''}
+            </td>
+        `;
+        tbody.appendChild(tr);
+    });
+}
+
+async function openTeam(id) {
+    currentTeam = globalTeams.find(t => t.id === id);
+    if (!currentTeam) return;
+    const manage = currentTeam.my_role !== 'member';
+    document.getElementById('team-detail').style.display = 'block';
+    document.getElementById('team-detail-title').textContent = currentTeam.name;
+    document.getElementById('team-member-form').style.display = manage ? 'flex' : 'none';
+    document.getElementById('team-key-btn').style.display = manage ? '' : 'none';
+    const headers = { 'Authorization': 'Bearer ' + token };
+
+    const [members, keys, stats] = await Promise.all([
+        fetch(`${API}/orgs/${id}/members`, { headers }).then(r => r.ok ? r.json() : []),
+        fetch(`${API}/orgs/${id}/keys`, { headers }).then(r => r.ok ? r.json() : []),
+        fetch(`${API}/stats?org_id=${id}`, { headers }).then(r => r.ok ? r.json() : null)
+    ]);
+    document.getElementById('team-today').textContent = stats ? `今日 ${stats.total_requests} 次请求 · 费用 ${stats.total_cost.toFixed(4)}` : '';
+
+    const mbody = document.getElementById('team-member-body');
+    mbody.innerHTML = '';
+    members.forEach(m => {
+        const self = m.username === currentUser.username;
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td>${escapeHtml(m.username)}</td>
+            <td>${teamRoleNames[m.role] || m.role}</td>
+            <td style="font-size:0.8rem;">${new Date(m.created_at).toLocaleString()}</td>
+            <td>${manage || self ? `<button class="btn btn-sm btn-danger" onclick="removeTeamMember(${m.user_id}, ${self})">${self ? '退出' : '移除'}</button>` : ''}</td>
+        `;
+        mbody.appendChild(tr);
+    });
+
+    const kbody = document.getElementById('team-key-body');
+    kbody.innerHTML = keys.length ? '' : '<tr><td colspan="5" style="text-align:center; color:var(--text-muted);">暂无团队密钥</td></tr>';
+    keys.forEach(k => {
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td>${escapeHtml(k.name)}</td>
+            <td><code style="color:var(--success);">${k.key_prefix}...</code></td>
+            <td style="font-size:0.8rem;">${formatLimits(k)}${formatKeyScope(k)}</td>
+            <td>${k.used_amount.toFixed(4)}</td>
+            <td>${manage ? `<button class="btn btn-sm btn-danger" onclick="deleteTeamKey(${k.id})">删除</button>` : ''}</td>
+        `;
+        kbody.appendChild(tr);
+    });
+}
+
+async function saveTeamMember() {
+    const d = {
+        username: document.getElementById('tm-username').value.trim(),
+        role: document.getElementById('tm-role').value
+    };
+    if (!d.username) return;
+    const res = await fetch(`${API}/orgs/${currentTeam.id}/members`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+        body: JSON.stringify(d)
+    });
+    if (res.ok) {
+        document.getElementById('tm-username').value = '';
+        loadTeams();
+    } else {
+        const err = await res.json();
+        alert('错误: ' + err.error);
+    }
+}
+
+async function removeTeamMember(userId, self) {
+    if (!confirm(self ? '确定退出该团队吗？' : '确定移除该成员吗？其创建的团队密钥会保留。')) return;
+    const res = await fetch(`${API}/orgs/${currentTeam.id}/members/${userId}`, { method: 'DELETE', headers: { 'Authorization': 'Bearer ' + token } });
+    if (res.ok) loadTeams();
+    else alert('操作失败: ' + (await res.json()).error);
+}
+
+function generateTeamKey() {
+    keyTeamId = currentTeam.id;
+    modal.open('modal-key');
+}
+
+async function deleteTeamKey(id) {
+    if (!confirm('确定要删除此团队密钥吗？')) return;
+    const res = await fetch(`${API}/orgs/${currentTeam.id}/keys/${id}`, { method: 'DELETE', headers: { 'Authorization': 'Bearer ' + token } });
+    if (res.ok) openTeam(currentTeam.id);
+    else alert('删除失败');
+}
+
+function openTeamModal(id) {
+    const t = globalTeams.find(x => x.id === id) || { id: 0, name: '', description: '', billing_mode: 'quota', quota: -1, services: [] };
+    document.getElementById('mt-title').textContent = id ? '编辑团队' : '新建团队';
+    document.getElementById('mt-id').value = t.id;
+    document.getElementById('mt-name').value = t.name;
+    document.getElementById('mt-desc').value = t.description;
+    document.getElementById('mt-billing').value = t.billing_mode;
+    document.getElementById('mt-quota').value = t.quota;
+    fillCheckboxes('mt-services', serviceGrantItems(), t.services || []);
+    document.getElementById('mt-owner').value = '';
+    document.getElementById('mt-owner-group').style.display = id ? 'none' : 'block';
+    modal.open('modal-team');
+}
+
+async function submitTeam() {
+    const d = {
+        id: parseInt(document.getElementById('mt-id').value) || 0,
+        name: document.getElementById('mt-name').value.trim(),
+        description: document.getElementById('mt-desc').value.trim(),
+        billing_mode: document.getElementById('mt-billing').value,
+        quota: parseFloat(document.getElementById('mt-quota').value),
+        services: readCheckboxes('mt-services')
+    };
+    if (isNaN(d.quota)) d.quota = -1;
+    const headers = { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token };
+    const res = await fetch(API + '/orgs', { method: 'POST', headers, body: JSON.stringify(d) });
+    if (!res.ok) {
+        const err = await res.json();
+        return alert('错误: ' + err.error);
+    }
+    const team = await res.json();
+    const owner = document.getElementById('mt-owner').value.trim();
+    if (!d.id && owner) {
+        const r = await fetch(`${API}/orgs/${team.id}/members`, { method: 'POST', headers, body: JSON.stringify({ username: owner, role: 'owner' }) });
+        if (!r.ok) alert('团队已创建，但设置所有者失败: ' + (await r.json()).error);
+    }
+    modal.close('modal-team');
+    loadTeams();
+}
+
+async function topUpTeam(id) {
+    const t = globalTeams.find(x => x.id === id);
+    const amount = parseFloat(prompt(`为团队 ${t.name} 充值的金额 (负数为扣减):`));
+    if (!amount) return;
+    const note = prompt('备注 (可选):') || '';
+    const res = await fetch(API + '/wallet/topup', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+        body: JSON.stringify({ org_id: id, amount: amount, note: note })
+    });
+    if (res.ok) loadTeams();
+    else alert('充值失败: ' + (await res.json()).error);
+}
+
+async function deleteTeam(id) {
+    if (!confirm('确定删除该团队吗？团队密钥将一并删除。')) return;
+    const res = await fetch(API + '/orgs/' + id, { method: 'DELETE', headers: { 'Authorization': 'Bearer ' + token } });
+    if (res.ok) {
+        if (currentTeam && currentTeam.id === id) currentTeam = null;
+        loadTeams();
+    } else alert('删除失败');
+}
+
+// --- Admin: User Groups ---
+let globalGroups = [];
+
+async function loadGroups() {
+    try {
+        const res = await fetch(API + '/groups', { headers: { 'Authorization': 'Bearer ' + token } });
+        if (res.ok) {
+            globalGroups = await res.json();
+            renderGroups();
+        }
+    } catch(e) { console.error(e); }
+}
+
+function renderGroups() {
+    const tbody = document.getElementById('group-list-body');
+    tbody.innerHTML = globalGroups.length ? '' : '<tr><td colspan="4" style="text-align:center; color:var(--text-muted);">暂无用户组</td></tr>';
+    globalGroups.forEach(g => {
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td><div>${g.name}</div><div style="color:var(--text-muted); font-size:0.8rem;">${g.description || ''}</div></td>
+            <td style="font-size:0.8rem;">${g.services.length ? g.services.map(n => n === '*' ? '全部服务' : n).join(', ') : '无'}</td>
+            <td>${g.members.length}</td>
+            <td>
+                <button class="btn btn-sm btn-secondary" onclick="openGroupModal(${g.id})">编辑</button>
+                <button class="btn btn-sm btn-danger" onclick="deleteGroup(${g.id})">删除</button>
+            </td>
+        `;
+        tbody.appendChild(tr);
+    });
+}
+
+// Distinct public service names (load-balanced services share one)
+function serviceNames() {
+    return [...new Set(globalServices.map(s => s.name))];
+}
+
+// Grant choices: every service ('*'), then each service name
+function serviceGrantItems() {
+    return [['*', '全部服务'], ...serviceNames().map(n => [n, n])];
+}
+
+// Renders [value, label] pairs as checkboxes, checking the selected values
+function fillCheckboxes(containerId, items, selected) {
+    const el = document.getElementById(containerId);
+    el.innerHTML = items.length ? '' : '<span style="color:var(--text-muted); font-size:0.8rem;">暂无可选项</span>';
+    items.forEach(([value, label]) => {
+        const lbl = document.createElement('label');
+        lbl.style.cssText = 'display:flex; align-items:center; gap:0.25rem; font-size:0.9rem;';
+        lbl.innerHTML = `<input type="checkbox" value="${value}" ${selected.includes(value) ? 'checked' : ''}> ${label}`;
+        el.appendChild(lbl);
+    });
+}
+
+function readCheckboxes(containerId) {
+    return [...document.querySelectorAll(`#${containerId} input:checked`)].map(i => i.value);
+}
+
+function openGroupModal(id) {
+    const g = globalGroups.find(x => x.id === id) || { id: 0, name: '', description: '', services: [] };
+    document.getElementById('mg-title').textContent = id ? '编辑用户组' : '新增用户组';
+    document.getElementById('mg-id').value = g.id;
+    document.getElementById('mg-name').value = g.name;
+    document.getElementById('mg-desc').value = g.description;
+    fillCheckboxes('mg-services', serviceGrantItems(), g.services);
+    modal.open('modal-group');
+}
+
+async function submitGroup() {
+    const d = {
+        id: parseInt(document.getElementById('mg-id').value) || 0,
+        name: document.getElementById('mg-name').value.trim(),
+        description: document.getElementById('mg-desc').value.trim(),
+        services: readCheckboxes('mg-services')
+    };
+    const res = await fetch(API + '/groups', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+        body: JSON.stringify(d)
+    });
+    if (res.ok) {
+        modal.close('modal-group');
+        loadGroups();
+    } else {
+        const err = await res.json();
+        alert('错误: ' + err.error);
+    }
+}
+
+async function deleteGroup(id) {
+    if (!confirm('确定删除该用户组吗？组内成员将失去该组授予的服务。')) return;
+    const res = await fetch(API + '/groups/' + id, { method: 'DELETE', headers: { 'Authorization': 'Bearer ' + token } });
+    if (res.ok) { loadGroups(); loadUsers(); }
+    else alert('删除失败');
+}
+
+async function topUpUser(id) {
+    const u = globalUsers.find(x => x.id === id);
+    const amount = parseFloat(prompt(`为 ${u.username} 充值的金额 (负数为扣减):`));
+    if (!amount) return;
+    const note = prompt('备注 (可选):') || '';
+    const res = await fetch(API + '/wallet/topup', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+        body: JSON.stringify({ user_id: id, amount: amount, note: note })
+    });
+    if (res.ok) {
+        loadUsers();
+    } else {
+        const err = await res.json();
+        alert('充值失败: ' + err.error);
+    }
+}
+
+// Wallet ledger of a user (admin), a team, or of the current user when no id is given
+async function openLedger(userId, teamId) {
+    const url = teamId ? `${API}/orgs/${teamId}/ledger` : userId ? `${API}/wallet/ledger?user_id=${userId}` : `${API}/user/ledger`;
+    const res = await fetch(url, { headers: { 'Authorization': 'Bearer ' + token } });
+    if (!res.ok) return alert('加载流水失败');
+    const entries = await res.json();
+    const types = { topup: '充值', adjust: '调整', hold: '冻结', settle: '结算', release: '解冻' };
+    const tbody = document.getElementById('ledger-body');
+    tbody.innerHTML = entries.length ? '' : '<tr><td colspan="6" style="text-align:center; color:var(--text-muted);">暂无记录</td></tr>';
+    entries.forEach(e => {
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td style="font-size:0.8rem;">${new Date(e.created_at).toLocaleString()}</td>
+            <td>${types[e.type] || e.type}</td>
+            <td style="color:${e.amount < 0 ? '#ef4444' : '#10b981'};">${e.amount ? e.amount.toFixed(6) : '-'}</td>
+            <td>${e.held_delta ? e.held_delta.toFixed(6) : '-'}</td>
+            <td>${e.balance_after.toFixed(6)}</td>
+            <td style="font-size:0.8rem;">${e.reference || e.note || ''}</td>
+        `;
+        tbody.appendChild(tr);
+    });
+    modal.open('modal-ledger');
+}
+
 function checkDeletePermission(targetUser) {
-    if (currentUser.role === 'super_admin') return true; 
-    if (currentUser.role === 'admin' && targetUser.role === 'user') return true;
-    return false;
+    return canManageUser(targetUser);
 }
 
 async function deleteUser(id) {
@@ -437,22 +973,358 @@ async function deleteUser(id) {
         headers: { 'Authorization': 'Bearer ' + token }
     });
     if(res.ok) loadUsers();
-    else alert("删除失败 (权限不足)");
+    else alert('删除失败: ' + (await res.json()).error);
 }
 
 function checkEditPermission(targetUser) {
-    if (currentUser.role === 'super_admin') return true; // SuperAdmin can edit anyone
-    if (currentUser.role === 'admin') {
-        if (targetUser.role === 'user') return true; // Admin can edit User
-        return false; // Admin cannot edit Admin/SuperAdmin
+    return canManageUser(targetUser);
+}
+
+// Mirrors the server: staff need users.manage_staff, and never a role granting more than ours
+function canManageUser(targetUser) {
+    const theirs = rolePerms[targetUser.role] || [];
+    if (theirs.length && !can('users.manage_staff')) return false;
+    return theirs.every(p => can(p));
+}
+
+// --- Admin: Redaction Rules ---
+let globalRedactionRules = [];
+
+async function loadRedactionRules() {
+    const res = await fetch(API + '/redaction_rules', { headers: { 'Authorization': 'Bearer ' + token } });
+    if (!res.ok) return;
+    globalRedactionRules = await res.json();
+    const tbody = document.getElementById('redaction-list-body');
+    tbody.innerHTML = globalRedactionRules.length ? '' : '<tr><td colspan="5" style="text-align:center; color:var(--text-muted);">暂无规则</td></tr>';
+    globalRedactionRules.forEach(r => {
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td>${r.kind === 'regex' ? '正则' : 'JSON 路径'}</td>
+            <td><code>${escapeHtml(r.pattern)}</code></td>
+            <td>${escapeHtml(r.replacement || '[REDACTED]')}</td>
+            <td>${escapeHtml(r.description)}</td>
+            <td>
+                <button class="btn btn-sm btn-secondary" onclick="openRedactionModal(${r.id})">编辑</button>
+                <button class="btn btn-sm btn-danger" onclick="deleteRedactionRule(${r.id})">删除</button>
+            </td>
+        `;
+        tbody.appendChild(tr);
+    });
+}
+
+function openRedactionModal(id) {
+    const r = globalRedactionRules.find(x => x.id === id) || { id: '', kind: 'regex', pattern: '', replacement: '', description: '' };
+    document.getElementById('mrr-title').textContent = id ? '编辑脱敏规则' : '新增脱敏规则';
+    document.getElementById('mrr-id').value = r.id;
+    document.getElementById('mrr-kind').value = r.kind;
+    document.getElementById('mrr-pattern').value = r.pattern;
+    document.getElementById('mrr-replacement').value = r.replacement;
+    document.getElementById('mrr-desc').value = r.description;
+    modal.open('modal-redaction');
+}
+
+async function submitRedaction() {
+    const d = {
+        id: parseInt(document.getElementById('mrr-id').value) || 0,
+        kind: document.getElementById('mrr-kind').value,
+        pattern: document.getElementById('mrr-pattern').value.trim(),
+        replacement: document.getElementById('mrr-replacement').value,
+        description: document.getElementById('mrr-desc').value.trim()
+    };
+    const res = await fetch(API + '/redaction_rules', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+        body: JSON.stringify(d)
+    });
+    if (res.ok) {
+        modal.close('modal-redaction');
+        loadRedactionRules();
+    } else {
+        alert('错误: ' + (await res.json()).error);
+    }
+}
+
+async function deleteRedactionRule(id) {
+    if (!confirm('确定删除该脱敏规则？')) return;
+    const res = await fetch(API + '/redaction_rules/' + id, { method: 'DELETE', headers: { 'Authorization': 'Bearer ' + token } });
+    if (res.ok) loadRedactionRules();
+    else alert('删除失败: ' + (await res.json()).error);
+}
+
+// --- Admin: Payload Viewer ---
+const PAYLOAD_PAGE = 50;
+let payloadEntries = [];
+
+async function loadPayloads(more) {
+    const params = new URLSearchParams({ limit: PAYLOAD_PAGE });
+    const filters = { user_id: 'payload-user', model: 'payload-model', request_log_id: 'payload-log' };
+    for (const [param, id] of Object.entries(filters)) {
+        const v = document.getElementById(id).value.trim();
+        if (v) params.set(param, v);
+    }
+    if (more && payloadEntries.length) params.set('before_id', payloadEntries[payloadEntries.length - 1].id);
+
+    const res = await fetch(API + '/payloads?' + params, { headers: { 'Authorization': 'Bearer ' + token } });
+    if (!res.ok) {
+        alert('加载失败: ' + (await res.json()).error);
+        return;
+    }
+    const page = await res.json();
+    payloadEntries = more ? payloadEntries.concat(page) : page;
+    document.getElementById('payload-more').style.display = page.length === PAYLOAD_PAGE ? '' : 'none';
+
+    const tbody = document.getElementById('payload-list-body');
+    tbody.innerHTML = payloadEntries.length ? '' : '<tr><td colspan="8" style="text-align:center; color:var(--text-muted);">暂无记录</td></tr>';
+    payloadEntries.forEach(p => {
+        const l = p.log || {};
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td>#${p.request_log_id}</td>
+            <td style="white-space:nowrap;">${new Date(p.created_at).toLocaleString()}</td>
+            <td>${p.user_id || '团队'}</td>
+            <td>${escapeHtml(p.model)}${p.streamed ? ' <span style="font-size:0.75rem; color:var(--text-muted);">流式</span>' : ''}</td>
+            <td>${l.status || '-'}</td>
+            <td>${l.prompt_tokens ?? '-'} / ${l.completion_tokens ?? '-'}</td>
+            <td>${l.duration_ms ?? '-'} ms</td>
+            <td><button class="btn btn-sm btn-secondary" onclick="viewPayload(${p.id})">查看</button></td>
+        `;
+        tbody.appendChild(tr);
+    });
+}
+
+async function viewPayload(id) {
+    const res = await fetch(API + '/payloads/' + id, { headers: { 'Authorization': 'Bearer ' + token } });
+    if (!res.ok) {
+        alert('加载失败: ' + (await res.json()).error);
+        return;
+    }
+    const p = await res.json();
+    const l = p.log || {};
+    const pretty = s => { try { return JSON.stringify(JSON.parse(s), null, 2); } catch(e) { return s || ''; } };
+    document.getElementById('mp-title').textContent = `请求载荷 · 请求记录 #${p.request_log_id}`;
+    document.getElementById('mp-meta').textContent = `${new Date(p.created_at).toLocaleString()} · 用户 ${p.user_id || '团队'} · ${p.model} · 状态 ${l.status || '-'} · Tokens ${l.prompt_tokens ?? '-'}/${l.completion_tokens ?? '-'} · 费用 ${l.cost ?? '-'}${p.truncated ? ' · 内容超出上限已截断' : ''}`;
+    document.getElementById('mp-output-group').style.display = p.streamed ? '' : 'none';
+    document.getElementById('mp-output').textContent = p.output || '';
+    document.getElementById('mp-request').textContent = pretty(p.request);
+    document.getElementById('mp-response').textContent = p.streamed ? (p.response || '') : pretty(p.response);
+    modal.open('modal-payload');
+}
+
+// --- Admin: Audit Log ---
+const AUDIT_PAGE = 50;
+let auditEntries = [];
+
+async function loadAudit(more) {
+    const params = new URLSearchParams({ limit: AUDIT_PAGE });
+    const filters = { actor: 'audit-actor', action: 'audit-action', target_id: 'audit-target', from: 'audit-from', to: 'audit-to' };
+    for (const [param, id] of Object.entries(filters)) {
+        const v = document.getElementById(id).value.trim();
+        if (v) params.set(param, v);
+    }
+    if (more && auditEntries.length) params.set('before_id', auditEntries[auditEntries.length - 1].id);
+
+    const res = await fetch(API + '/audit?' + params, { headers: { 'Authorization': 'Bearer ' + token } });
+    if (!res.ok) {
+        alert('加载失败: ' + (await res.json()).error);
+        return;
+    }
+    const page = await res.json();
+    auditEntries = more ? auditEntries.concat(page) : page;
+    document.getElementById('audit-more').style.display = page.length === AUDIT_PAGE ? '' : 'none';
+    renderAudit();
+}
+
+function renderAudit() {
+    const tbody = document.getElementById('audit-list-body');
+    tbody.innerHTML = auditEntries.length ? '' : '<tr><td colspan="7" style="text-align:center; color:var(--text-muted);">暂无记录</td></tr>';
+    auditEntries.forEach(e => {
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td>${e.id}</td>
+            <td style="white-space:nowrap;">${new Date(e.created_at).toLocaleString()}</td>
+            <td>${escapeHtml(e.actor)}</td>
+            <td><code>${e.action}</code></td>
+            <td>${e.target_type}${e.target_id ? ' #' + e.target_id : ''}<div style="color:var(--text-muted); font-size:0.8rem;">${escapeHtml(e.target)}</div></td>
+            <td style="font-size:0.8rem;">${formatAuditDiff(e.diff)}</td>
+            <td>${e.ip}</td>
+        `;
+        tbody.appendChild(tr);
+    });
+}
+
+// Audit entries carry user input (names, descriptions)
+function escapeHtml(s) {
+    return String(s ?? '').replace(/[&<>"']/g, ch => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' }[ch]));
+}
+
+// One line per changed field: before → after
+function formatAuditDiff(diff) {
+    let changes;
+    try { changes = JSON.parse(diff || '{}'); } catch(e) { return escapeHtml(diff); }
+    const show = v => v === null || v === undefined ? '∅' : escapeHtml(typeof v === 'object' ? JSON.stringify(v) : String(v));
+    const lines = Object.keys(changes).sort().map(k => `<div><b>${escapeHtml(k)}</b>: ${show(changes[k].before)} → ${show(changes[k].after)}</div>`);
+    return lines.join('') || '<span style="color:var(--text-muted);">无变更</span>';
+}
+
+async function verifyAudit() {
+    const out = document.getElementById('audit-verify-result');
+    out.textContent = '校验中...';
+    const res = await fetch(API + '/audit/verify', { headers: { 'Authorization': 'Bearer ' + token } });
+    const r = await res.json();
+    if (!res.ok) {
+        out.textContent = '校验失败: ' + r.error;
+    } else if (r.valid) {
+        out.style.color = 'var(--success)';
+        out.textContent = `✔ 哈希链完整，共 ${r.checked} 条`;
+    } else {
+        out.style.color = 'var(--danger)';
+        out.textContent = `✘ 第 ${r.broken_id} 条记录被篡改：${r.reason}`;
+    }
+}
+
+// --- Admin: Roles ---
+let globalRoles = [];
+let permissionCatalogue = [];
+let rolePerms = {}; // role name -> permissions
+
+function isStaffRole(role) {
+    return (rolePerms[role] || []).length > 0;
+}
+
+async function loadRoles() {
+    try {
+        const res = await fetch(API + '/roles', { headers: { 'Authorization': 'Bearer ' + token } });
+        if (res.ok) {
+            const data = await res.json();
+            globalRoles = data.roles;
+            permissionCatalogue = data.permissions;
+            rolePerms = {};
+            globalRoles.forEach(r => rolePerms[r.name] = r.permissions);
+            fillRoleSelect('cu-role', 'user');
+            renderRoles();
+            renderUsers();
+        }
+    } catch(e) { console.error(e); }
+}
+
+// Options are the roles the current user may assign
+function fillRoleSelect(id, selected) {
+    const sel = document.getElementById(id);
+    sel.innerHTML = '';
+    globalRoles.forEach(r => {
+        const assignable = r.name === 'user' || (can('roles.assign') && r.name !== 'super_admin' && canManageUser({ role: r.name }));
+        if (!assignable && r.name !== selected) return;
+        const opt = document.createElement('option');
+        opt.value = r.name;
+        opt.textContent = `${formatRole(r.name)}${r.builtin ? '' : ' - ' + r.description}`;
+        opt.disabled = !assignable;
+        sel.appendChild(opt);
+    });
+    sel.value = selected;
+}
+
+function renderRoles() {
+    const tbody = document.getElementById('role-list-body');
+    tbody.innerHTML = '';
+    globalRoles.forEach(r => {
+        const tr = document.createElement('tr');
+        tr.innerHTML = `
+            <td><div>${formatRole(r.name)}</div><div style="color:var(--text-muted); font-size:0.8rem;">${r.builtin ? '内置' : r.description || ''}</div></td>
+            <td style="font-size:0.8rem;">${r.permissions.length ? r.permissions.join(', ') : '无'}</td>
+            <td>${r.builtin ? '' : `
+                <button class="btn btn-sm btn-secondary" onclick="openRoleModal('${r.name}')">编辑</button>
+                <button class="btn btn-sm btn-danger" onclick="deleteRole('${r.name}')">删除</button>
+            `}</td>
+        `;
+        tbody.appendChild(tr);
+    });
+}
+
+function openRoleModal(name) {
+    const r = globalRoles.find(x => x.name === name) || { name: '', description: '', permissions: [] };
+    document.getElementById('mr-title').textContent = name ? '编辑角色' : '新增角色';
+    document.getElementById('mr-name').value = r.name;
+    document.getElementById('mr-name').disabled = !!name;
+    document.getElementById('mr-desc').value = r.description;
+    fillCheckboxes('mr-perms', permissionCatalogue.map(p => [p.name, `${p.name} (${p.description})`]), r.permissions);
+    modal.open('modal-role');
+}
+
+async function submitRole() {
+    const d = {
+        name: document.getElementById('mr-name').value.trim(),
+        description: document.getElementById('mr-desc').value.trim(),
+        permissions: readCheckboxes('mr-perms')
+    };
+    const res = await fetch(API + '/roles', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+        body: JSON.stringify(d)
+    });
+    if (res.ok) {
+        modal.close('modal-role');
+        loadRoles();
+    } else {
+        const err = await res.json();
+        alert('错误: ' + err.error);
     }
-    return false;
+}
+
+async function deleteRole(name) {
+    if (!confirm(`确定删除角色 ${name} 吗？`)) return;
+    const res = await fetch(API + '/roles/' + encodeURIComponent(name), { method: 'DELETE', headers: { 'Authorization': 'Bearer ' + token } });
+    if (res.ok) loadRoles();
+    else alert('删除失败: ' + (await res.json()).error);
 }
 
 // --- Admin: Services ---
-function renderAdminServices() {
+let keyHealth = {}; // service_id -> [{fingerprint, masked, status, ...}]
+
+async function loadKeyHealth() {
+    try {
+        const res = await fetch(API + '/services/key_health', { headers: { 'Authorization': 'Bearer ' + token } });
+        if (!res.ok) return;
+        const list = await res.json();
+        keyHealth = {};
+        list.forEach(s => { keyHealth[s.service_id] = s.keys; });
+        renderAdminServices(false);
+    } catch(e) { console.error(e); }
+}
+
+function formatKeyStatus(k) {
+    if (k.status === 'disabled') return '⛔ 已停用';
+    if ((k.status === 'cooldown' || k.status === 'circuit_open') && new Date(k.cooldown_until) > new Date()) {
+        const label = k.status === 'cooldown' ? '⏳ 冷却中' : '⚠️ 熔断中';
+        return `${label} (至 ${new Date(k.cooldown_until).toLocaleTimeString()})`;
+    }
+    return '✅ 正常';
+}
+
+function renderKeyHealth(serviceId) {
+    const keys = keyHealth[serviceId] || [];
+    return keys.map(k => `
+        <div style="display:flex; justify-content:space-between; align-items:center; gap:0.5rem; margin-top:4px;" title="${k.last_error ? k.last_error.replace(/"/g, '&quot;') : ''}">
+            <span style="font-family:monospace;">${k.masked}</span>
+            <span>${formatKeyStatus(k)}</span>
+            ${k.status !== 'active' ? `<span style="cursor:pointer; color:var(--primary);" onclick="resetKeyHealth('${k.fingerprint}')">恢复</span>` : ''}
+        </div>
+    `).join('');
+}
+
+async function resetKeyHealth(fingerprint) {
+    const res = await fetch(API + '/services/key_health/reset', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+        body: JSON.stringify({ fingerprint })
+    });
+    if (res.ok) loadKeyHealth();
+    else alert('操作失败');
+}
+
+function renderAdminServices(refreshHealth = true) {
     const grid = document.getElementById('admin-service-list');
     grid.innerHTML = '';
+    if (refreshHealth) loadKeyHealth();
     
     globalServices.forEach(s => {
         const div = document.createElement('div');
@@ -461,12 +1333,16 @@ function renderAdminServices() {
         div.innerHTML = `
             <div style="display:flex; justify-content:space-between; margin-bottom:1rem;">
                 <div style="font-weight:bold;">${s.name}</div>
-                <div style="font-size:0.8rem;">${s.type}</div>
+                <div style="font-size:0.8rem;">${s.type} · <span data-health-id="${s.id}"></span></div>
             </div>
             <div style="font-size:0.8rem; color:var(--text-muted); margin-bottom:1rem;">
                 <div>Target: ${s.model_name || '(Passthrough)'}</div>
                 <div>URL: ${s.base_url || 'Default'}</div>
                 <div>Keys: ${s.api_keys ? s.api_keys.length : 0}</div>
+                <div>Weight: ${s.weight || 1} (${s.strategy || 'weighted'})</div>
+                <div>价格 / 1M: ${formatPrices(s)}</div>
+                ${s.fallbacks && s.fallbacks.length ? `<div>Fallbacks: ${s.fallbacks.join(' → ')}</div>` : ''}
+                ${renderKeyHealth(s.id)}
             </div>
             <div style="display:flex; gap:0.5rem;">
                 <button class="btn btn-sm btn-secondary" onclick="openServiceModal('${s.id}')">编辑</button>
@@ -475,6 +1351,7 @@ function renderAdminServices() {
         `;
         grid.appendChild(div);
     });
+    loadServiceHealth();
 }
 
 // --- Modals & Actions ---
@@ -484,15 +1361,21 @@ const modal = {
 };
 window.closeModal = modal.close; // Export
 
-function openCreateUserModal() { modal.open('modal-user'); }
+function openCreateUserModal() {
+    fillPlanSelect('cu-plan', null);
+    modal.open('modal-user');
+}
 
 async function submitCreateUser() {
     const d = { 
         username: document.getElementById('cu-username').value, 
         password: document.getElementById('cu-password').value, 
         role: document.getElementById('cu-role').value, 
-        quota: parseFloat(document.getElementById('cu-quota').value) 
+        quota: parseFloat(document.getElementById('cu-quota').value),
+        billing_mode: document.getElementById('cu-billing').value
     };
+    const planId = parseInt(document.getElementById('cu-plan').value);
+    if (planId) d.plan_id = planId;
 
     const res = await fetch(API+'/users', {
         method:'POST',
@@ -516,18 +1399,20 @@ function openEditUser(id) {
     document.getElementById('eu-username').value = u.username;
     document.getElementById('eu-password').value = '';
     document.getElementById('eu-quota').value = u.quota;
-    document.getElementById('eu-quota').value = u.quota;
+    document.getElementById('eu-billing').value = u.billing_mode || 'quota';
+    fillPlanSelect('eu-plan', u.plan_id);
+    fillCheckboxes('eu-groups', globalGroups.map(g => [g.id, g.name]), (u.groups || []).map(g => g.id));
+    fillCheckboxes('eu-services', serviceGrantItems(), u.services || []);
+    document.getElementById('eu-rpm').value = u.rpm_limit || 0;
+    document.getElementById('eu-tpm').value = u.tpm_limit || 0;
+    document.getElementById('eu-conc').value = u.max_concurrent || 0;
+    document.getElementById('eu-log-payloads').checked = !!u.log_payloads;
     
-    // Role Edit for SuperAdmin
+    // Role Edit needs roles.assign
     const roleSelect = document.getElementById('eu-role');
     if (roleSelect) {
-        if (currentUser.role === 'super_admin') {
-            roleSelect.disabled = false;
-            roleSelect.value = u.role;
-        } else {
-            roleSelect.disabled = true;
-            roleSelect.value = u.role;
-        }
+        fillRoleSelect('eu-role', u.role);
+        roleSelect.disabled = !can('roles.assign') || u.role === 'super_admin';
     }
     
     modal.open('modal-edit-user');
@@ -539,7 +1424,10 @@ async function submitEditUser() {
     const quota = parseFloat(document.getElementById('eu-quota').value);
     const roleElem = document.getElementById('eu-role');
     
-    const d = { user_id: id, quota: quota };
+    const d = { user_id: id, quota: quota, billing_mode: document.getElementById('eu-billing').value, plan_id: parseInt(document.getElementById('eu-plan').value) || 0, ...readLimitInputs('eu') };
+    d.group_ids = readCheckboxes('eu-groups').map(v => parseInt(v));
+    d.services = readCheckboxes('eu-services');
+    d.log_payloads = document.getElementById('eu-log-payloads').checked;
     if (pwd) d.password = pwd;
     if (roleElem && !roleElem.disabled) d.role = roleElem.value;
 
@@ -557,6 +1445,52 @@ async function submitEditUser() {
     }
 }
 
+// Rate limits: inputs are <prefix>-rpm / -tpm / -conc, empty means "leave as is"
+function readLimitInputs(prefix) {
+    const d = {};
+    const fields = { rpm: 'rpm_limit', tpm: 'tpm_limit', conc: 'max_concurrent' };
+    Object.entries(fields).forEach(([suffix, key]) => {
+        const v = document.getElementById(prefix + '-' + suffix).value;
+        if (v !== '') d[key] = parseInt(v);
+    });
+    return d;
+}
+
+// Scope of a new key from the key-* inputs, empty inputs are left out
+function readKeyScopeInputs() {
+    const d = {};
+    const list = id => document.getElementById(id).value.split(',').map(v => v.trim()).filter(v => v !== '');
+    const days = parseInt(document.getElementById('key-expires-days').value);
+    if (days > 0) d.expires_at = new Date(Date.now() + days * 86400000).toISOString();
+    const spend = parseFloat(document.getElementById('key-spend').value);
+    if (spend > 0) d.spend_limit = spend;
+    const models = list('key-models');
+    if (models.length) d.allowed_models = models;
+    const cidrs = list('key-cidrs');
+    if (cidrs.length) d.allowed_cidrs = cidrs;
+    return d;
+}
+
+function formatKeyScope(k) {
+    const parts = [];
+    if (k.expires_at) {
+        const exp = new Date(k.expires_at);
+        parts.push(exp < new Date() ? '已过期' : `${exp.toLocaleDateString()} 到期`);
+    }
+    if (k.spend_limit) parts.push(`已用 ${k.used_amount.toFixed(4)} / ${k.spend_limit}`);
+    if (k.allowed_models && k.allowed_models.length) parts.push(`模型: ${k.allowed_models.join(', ')}`);
+    if (k.allowed_cidrs && k.allowed_cidrs.length) parts.push(`来源: ${k.allowed_cidrs.join(', ')}`);
+    return parts.map(p => `<div style="color:var(--text-muted);">${p}</div>`).join('');
+}
+
+function formatLimits(o) {
+    const parts = [];
+    if (o.rpm_limit) parts.push(`${o.rpm_limit} RPM`);
+    if (o.tpm_limit) parts.push(`${o.tpm_limit} TPM`);
+    if (o.max_concurrent) parts.push(`并发 ${o.max_concurrent}`);
+    return parts.length ? parts.join(' / ') : '不限制';
+}
+
 // Service Logic
 // Service Logic
 let tempKeys = [];
@@ -574,6 +1508,14 @@ function openServiceModal(id) {
         document.getElementById('ms-type').value = s.type;
         document.getElementById('ms-url').value = s.base_url;
         document.getElementById('ms-map').value = s.model_name;
+        document.getElementById('ms-fallbacks').value = (s.fallbacks || []).join(', ');
+        document.getElementById('ms-weight').value = s.weight || 1;
+        document.getElementById('ms-strategy').value = s.strategy || 'weighted';
+        document.getElementById('ms-price-in').value = s.input_price || '';
+        document.getElementById('ms-price-out').value = s.output_price || '';
+        document.getElementById('ms-price-cached').value = s.cached_input_price || '';
+        document.getElementById('ms-log-payloads').checked = !!s.log_payloads;
+        document.getElementById('ms-param-policy').value = s.param_policy || 'drop';
         // keys
         if(s.api_keys && s.api_keys.length > 0) {
             tempKeys = [...s.api_keys];
@@ -586,6 +1528,14 @@ function openServiceModal(id) {
         document.getElementById('ms-name').value = '';
         document.getElementById('ms-url').value = '';
         document.getElementById('ms-map').value = '';
+        document.getElementById('ms-fallbacks').value = '';
+        document.getElementById('ms-weight').value = 1;
+        document.getElementById('ms-strategy').value = 'weighted';
+        document.getElementById('ms-price-in').value = '';
+        document.getElementById('ms-price-out').value = '';
+        document.getElementById('ms-price-cached').value = '';
+        document.getElementById('ms-log-payloads').checked = false;
+        document.getElementById('ms-param-policy').value = 'drop';
     }
     renderServiceKeys();
 }
@@ -604,8 +1554,11 @@ function renderServiceKeys() {
         div.style.borderRadius = '4px';
         div.style.fontSize = '0.9rem';
         
+        // Saved keys come back masked and are never shown again; new ones are masked here
+        const saved = k.includes('...');
+        const label = saved ? k : `${k.substring(0, 4)}...${k.substring(k.length-4)} (新)`;
         div.innerHTML = `
-            <span style="font-family:monospace; overflow:hidden; text-overflow:ellipsis;">${k.substring(0, 12)}...${k.substring(k.length-4)}</span>
+            <span style="font-family:monospace; overflow:hidden; text-overflow:ellipsis;">${label}</span>
             <span style="cursor:pointer; color:#ef4444;" onclick="removeServiceKey(${idx})">🗑️</span>
         `;
         list.appendChild(div);
@@ -637,8 +1590,16 @@ async function submitService() {
         type: document.getElementById('ms-type').value,
         base_url: document.getElementById('ms-url').value,
         model_name: document.getElementById('ms-map').value,
+        fallbacks: document.getElementById('ms-fallbacks').value.split(',').map(n => n.trim()).filter(n => n !== ''),
+        weight: parseInt(document.getElementById('ms-weight').value) || 1,
+        strategy: document.getElementById('ms-strategy').value,
+        input_price: parseFloat(document.getElementById('ms-price-in').value) || 0,
+        output_price: parseFloat(document.getElementById('ms-price-out').value) || 0,
+        cached_input_price: parseFloat(document.getElementById('ms-price-cached').value) || 0,
         api_keys: tempKeys,
-        api_key: tempKeys[0] || ''
+        api_key: tempKeys[0] || '',
+        log_payloads: document.getElementById('ms-log-payloads').checked,
+        param_policy: document.getElementById('ms-param-policy').value
     };
 
     // Update List & Save
@@ -689,29 +1650,23 @@ function updatePlaygroundSelects() {
     // Populate dropdowns from globalServices
     const sEl = document.getElementById('pg-model');
     sEl.innerHTML = '';
+    const seen = new Set();
     globalServices.forEach(s => {
+        if (seen.has(s.name)) return; // load-balanced services share a name
+        seen.add(s.name);
         const opt = document.createElement('option');
         opt.value = s.name;
         opt.textContent = s.name;
         sEl.appendChild(opt);
     });
     
-    // Populate Keys
+    // API keys are only stored hashed, so the playground calls with the login session
     const kEl = document.getElementById('pg-key');
     kEl.innerHTML = '';
-    
-    if (myKeys.length === 0) {
-        kEl.innerHTML = '<option value="">(无可用密钥)</option>';
-    } else {
-        myKeys.forEach(k => {
-            if (k.is_active) {
-                const opt = document.createElement('option');
-                opt.value = k.key;
-                opt.textContent = k.name || k.key.substring(0, 8) + '...';
-                kEl.appendChild(opt);
-            }
-        });
-    }
+    const opt = document.createElement('option');
+    opt.value = token;
+    opt.textContent = '当前登录会话';
+    kEl.appendChild(opt);
 }
 
 async function sendMsg() {